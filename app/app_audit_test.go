@@ -0,0 +1,81 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hackfix.me/sesame/db/models"
+)
+
+func TestAppAuditIntegration(t *testing.T) {
+	t.Parallel()
+
+	tctx, cancel, h := newTestContext(t, 5*time.Second)
+	defer cancel()
+
+	app, err := newTestApp(tctx)
+	h(assert.NoError(t, err))
+
+	err = app.Run("init", "--firewall-type=mock")
+	h(assert.NoError(t, err))
+
+	// An event older than the retention period, which is deleted once a new
+	// event is recorded.
+	_, err = app.ctx.DB.ExecContext(app.ctx.DB.NewContext(),
+		`INSERT INTO audit_events (created_at, type, payload) VALUES (?, ?, ?)`,
+		timeNow.Add(-48*time.Hour), models.AuditEventUserAdd, "{}")
+	h(assert.NoError(t, err))
+	app.ctx.Config.Audit.Retention = sql.Null[time.Duration]{V: 24 * time.Hour, Valid: true}
+
+	for _, args := range [][]string{
+		{"service", "add", "web", "80", "--max-access-duration=1h"},
+		{"user", "add", "alice"},
+		{"user", "grant", "alice", "web"},
+		{"open", "web", "10.0.0.1", "--duration=30m"},
+		{"close", "web", "10.0.0.1"},
+	} {
+		err = app.Run(args...)
+		h(assert.NoError(t, err))
+	}
+
+	err = app.Run("audit")
+	h(assert.NoError(t, err))
+	// Long details are wrapped, so only the first line of each event is checked.
+	stdout := app.stdout.String()
+	for _, expRe := range []string{
+		`(?im)^\s*time\s+type\s+user\s+site id\s+source\s+service\s+details\s*$`,
+		`(?m)service\.add\s+-\s+-\s+-\s+web\s+service\.kill_connections=false\s*$`,
+		`(?m)user\.add\s+-\s+-\s+-\s+-\s+user\.name=alice\s*$`,
+		`(?m)user\.grant\s+-\s+-\s+-\s+web\s+user\.name=alice\s*$`,
+		`(?m)open\s+-\s+-\s+-\s+web\s+clients=10\.0\.0\.1 duration=30m0s\s*$`,
+		`(?m)close\s+-\s+-\s+-\s+web\s+clients=10\.0\.0\.1 kill_connections=false\s*$`,
+	} {
+		h(assert.Regexp(t, expRe, stdout))
+	}
+	// The expired event was deleted.
+	h(assert.Equal(t, 5, strings.Count(stdout, timeNow.Local().Format(time.DateTime))))
+
+	err = app.Run("audit", "--type=open,close", "--service=web", "--since=1h", "--output=json")
+	h(assert.NoError(t, err))
+	var events []*models.AuditEvent
+	err = json.Unmarshal(app.stdout.Bytes(), &events)
+	h(assert.NoError(t, err))
+	h(assert.Len(t, events, 2))
+	h(assert.Equal(t, models.AuditEventOpen, events[0].Type))
+	h(assert.Equal(t, "web", events[0].ServiceName))
+	h(assert.Equal(t, []any{"10.0.0.1"}, events[0].Payload["clients"]))
+	h(assert.Equal(t, models.AuditEventClose, events[1].Type))
+
+	err = app.Run("audit", "--until=1h")
+	h(assert.NoError(t, err))
+	h(assert.Empty(t, app.stdout.String()))
+
+	err = app.Run("audit", "--user=alice")
+	h(assert.NoError(t, err))
+	h(assert.Empty(t, app.stdout.String()))
+}
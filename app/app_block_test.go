@@ -0,0 +1,135 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mandelsoft/vfs/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+
+	"go.hackfix.me/sesame/app/config"
+	"go.hackfix.me/sesame/db/models"
+	ftypes "go.hackfix.me/sesame/firewall/types"
+)
+
+func TestAppBlockIntegration(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		args      []string
+		file      string
+		expStderr []string
+		expErr    string
+	}{
+		{
+			name: "ok/service_duration",
+			args: []string{"--service", "web", "--duration", "1h", "192.168.1.1", "10.0.0.0/8"},
+			expStderr: []string{
+				"blocked access", "service.name=web", "duration=1h0m0s",
+				`ip_ranges="[10.0.0.0-10.255.255.255 192.168.1.1-192.168.1.1]"`,
+			},
+		},
+		{
+			name: "ok/all_services",
+			args: []string{"192.168.1.1"},
+			expStderr: []string{
+				"blocked access", "service.name=all", "duration=0s",
+				"ip_ranges=[192.168.1.1-192.168.1.1]",
+			},
+		},
+		{
+			name: "ok/from_file",
+			args: []string{"--from-file", "/blocklist.txt"},
+			file: "# Threat list\n\n192.168.1.1 ; scanner\n172.16.1.0/24\n",
+			expStderr: []string{
+				"blocked access",
+				`ip_ranges="[172.16.1.0-172.16.1.255 192.168.1.1-192.168.1.1]"`,
+			},
+		},
+		{
+			name:   "err/no_clients",
+			args:   []string{},
+			expErr: "one or more clients, or --from-file, must be specified",
+		},
+		{
+			name:   "err/missing_file",
+			args:   []string{"--from-file", "/missing.txt"},
+			expErr: "failed reading clients file",
+		},
+		{
+			name:   "err/invalid_client",
+			args:   []string{"not.an.ip"},
+			expErr: "failed parsing IP address 'not.an.ip'",
+		},
+		{
+			name:   "err/unknown_service",
+			args:   []string{"--service", "blah", "192.168.1.1"},
+			expErr: "unknown service",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			services := []*models.Service{
+				{
+					Name:              "web",
+					Ports:             ftypes.PortRanges{{From: 80, To: 80}},
+					MaxAccessDuration: time.Hour,
+				},
+				{
+					Name:              "db",
+					Ports:             ftypes.PortRanges{{From: 5432, To: 5432}},
+					MaxAccessDuration: 30 * time.Minute,
+				},
+			}
+
+			cfg := config.Config{
+				Firewall: config.Firewall{
+					Type: sql.Null[ftypes.FirewallType]{V: ftypes.FirewallMock, Valid: true},
+				},
+			}
+
+			tctx, cancel, h := newTestContext(t, 5*time.Second)
+			defer cancel()
+
+			app, err := newTestApp(tctx)
+			h(assert.NoError(t, err))
+
+			cfgJSON, err := json.Marshal(cfg)
+			h(assert.NoError(t, err))
+			err = vfs.WriteFile(app.ctx.FS, "/config.json", cfgJSON, 0o644)
+			h(assert.NoError(t, err))
+
+			if tt.file != "" {
+				err = vfs.WriteFile(app.ctx.FS, "/blocklist.txt", []byte(tt.file), 0o644)
+				h(assert.NoError(t, err))
+			}
+
+			err = initTestDB(app.ctx, services)
+			h(assert.NoError(t, err))
+
+			err = app.Run(append([]string{"block"}, tt.args...)...)
+			stdout := app.stdout.String()
+			stderr := app.stderr.String()
+
+			if tt.expErr != "" {
+				h(assert.ErrorContains(t, err, tt.expErr))
+				h(assert.Empty(t, stdout))
+				h(assert.Empty(t, stderr))
+				return
+			}
+
+			h(assert.NoError(t, err))
+			h(assert.Empty(t, stdout))
+			h(assert.NotEmpty(t, stderr))
+			for _, expStderr := range tt.expStderr {
+				h(assert.Contains(t, stderr, expStderr))
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package app
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	aerrors "go.hackfix.me/sesame/app/errors"
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/db/types"
+)
+
+//nolint:tparallel // Cannot be parallelized since the tests are expected to run in the defined sequence.
+func TestAppCertRevokeIntegration(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		target     string
+		expErr     string
+		expRevoked []string
+	}{
+		{
+			name:       "ok/serial",
+			target:     "a1",
+			expRevoked: []string{"a1"},
+		},
+		{
+			name:       "err/serial_already_revoked",
+			target:     "A1",
+			expErr:     "client certificate is already revoked",
+			expRevoked: []string{"a1"},
+		},
+		{
+			name:       "ok/user_site",
+			target:     "bob/home",
+			expRevoked: []string{"a1", "b1"},
+		},
+		{
+			name:       "err/user_site_already_revoked",
+			target:     "bob/home",
+			expErr:     "no unrevoked client certificates found for 'bob/home'",
+			expRevoked: []string{"a1", "b1"},
+		},
+		{
+			name:       "err/unknown",
+			target:     "carol",
+			expErr:     "no client certificate or user found for 'carol'",
+			expRevoked: []string{"a1", "b1"},
+		},
+		{
+			name:       "err/unknown_user_site",
+			target:     "carol/home",
+			expErr:     "user with name 'carol' doesn't exist",
+			expRevoked: []string{"a1", "b1"},
+		},
+		{
+			name:       "ok/user",
+			target:     "alice",
+			expRevoked: []string{"a1", "a2", "b1"},
+		},
+	}
+
+	tctx, cancel, h := newTestContext(t, 5*time.Second)
+	defer cancel()
+
+	app, err := newTestApp(tctx)
+	h(assert.NoError(t, err))
+
+	err = initTestDB(app.ctx, nil)
+	h(assert.NoError(t, err))
+
+	dbCtx := app.ctx.DB.NewContext()
+	users := map[string]*models.User{}
+	for _, name := range []string{"alice", "bob"} {
+		user := &models.User{Name: name}
+		err = user.Save(dbCtx, app.ctx.DB, false)
+		h(assert.NoError(t, err))
+		users[name] = user
+	}
+
+	for _, c := range []struct {
+		user, siteID string
+		serial       int64
+	}{{"alice", "home", 0xa1}, {"alice", "work", 0xa2}, {"bob", "home", 0xb1}} {
+		cert := &x509.Certificate{SerialNumber: big.NewInt(c.serial), NotAfter: timeNow.Add(time.Hour)}
+		var cc *models.ClientCertificate
+		cc, err = models.NewClientCertificate(users[c.user], c.siteID, time.Hour, cert)
+		h(assert.NoError(t, err))
+		err = cc.Save(dbCtx, app.ctx.DB, false)
+		h(assert.NoError(t, err))
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err = app.Run("cert", "revoke", tt.target)
+
+			var serr *aerrors.StructuredError
+			if errors.As(err, &serr) {
+				err = serr.Cause()
+			}
+
+			if tt.expErr != "" {
+				h(assert.ErrorContains(t, err, tt.expErr))
+			} else {
+				h(assert.NoError(t, err))
+			}
+
+			var ccs []*models.ClientCertificate
+			ccs, err = models.ClientCertificates(dbCtx, app.ctx.DB,
+				types.NewFilter("cc.revoked_at IS NOT NULL", nil))
+			h(assert.NoError(t, err))
+			revoked := make([]string, len(ccs))
+			for i, cc := range ccs {
+				revoked[i] = cc.SerialNumber
+				h(assert.Equal(t, timeNow, cc.RevokedAt.V))
+			}
+			h(assert.ElementsMatch(t, tt.expRevoked, revoked))
+		})
+	}
+}
+
+//nolint:tparallel // Cannot be parallelized since the tests are expected to run in the defined sequence.
+func TestAppCertListIntegration(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		args    []string
+		expErr  string
+		expRows []string
+	}{
+		{
+			name: "ok/all",
+			args: []string{},
+			expRows: []string{
+				"(server)/Valid", "bob/b1/Expired", "alice/a2/Expiring", "bob/b2/Revoked", "alice/a1/Valid",
+			},
+		},
+		{
+			name:    "ok/user",
+			args:    []string{"--user=alice"},
+			expRows: []string{"alice/a2/Expiring", "alice/a1/Valid"},
+		},
+		{
+			name:    "ok/site",
+			args:    []string{"--site=work"},
+			expRows: []string{"alice/a2/Expiring", "bob/b2/Revoked"},
+		},
+		{
+			name:    "ok/status",
+			args:    []string{"--status=expiring,revoked"},
+			expRows: []string{"alice/a2/Expiring", "bob/b2/Revoked"},
+		},
+		{
+			name:    "ok/user_status",
+			args:    []string{"--user=bob", "--status=valid"},
+			expRows: []string{},
+		},
+		{
+			name:    "err/invalid_status",
+			args:    []string{"--status=unknown"},
+			expErr:  `must be one of "valid","expiring","expired","revoked" but got "unknown"`,
+			expRows: []string{},
+		},
+	}
+
+	tctx, cancel, h := newTestContext(t, 5*time.Second)
+	defer cancel()
+
+	app, err := newTestApp(tctx)
+	h(assert.NoError(t, err))
+
+	err = app.Run("init")
+	h(assert.NoError(t, err))
+
+	dbCtx := app.ctx.DB.NewContext()
+	users := map[string]*models.User{}
+	for _, name := range []string{"alice", "bob"} {
+		user := &models.User{Name: name}
+		err = user.Save(dbCtx, app.ctx.DB, false)
+		h(assert.NoError(t, err))
+		users[name] = user
+	}
+
+	for _, c := range []struct {
+		user, siteID string
+		serial       int64
+		expiresAt    time.Time
+	}{
+		{"alice", "home", 0xa1, timeNow.Add(4 * time.Hour)},
+		{"alice", "work", 0xa2, timeNow.Add(time.Hour)},
+		{"bob", "home", 0xb1, timeNow.Add(-time.Hour)},
+		{"bob", "work", 0xb2, timeNow.Add(2 * time.Hour)},
+	} {
+		cert := &x509.Certificate{SerialNumber: big.NewInt(c.serial), NotAfter: c.expiresAt}
+		var cc *models.ClientCertificate
+		cc, err = models.NewClientCertificate(users[c.user], c.siteID, time.Hour, cert)
+		h(assert.NoError(t, err))
+		err = cc.Save(dbCtx, app.ctx.DB, false)
+		h(assert.NoError(t, err))
+	}
+
+	// Certificate a2 was issued 3h ago, so it's past the default renewal
+	// threshold of 75% of its lifetime.
+	_, err = app.ctx.DB.ExecContext(dbCtx, "UPDATE client_certs SET created_at = ? WHERE serial_number = ?",
+		timeNow.Add(-3*time.Hour), "a2")
+	h(assert.NoError(t, err))
+
+	err = app.Run("cert", "revoke", "b2")
+	h(assert.NoError(t, err))
+	err = app.flushOutputs()
+	h(assert.NoError(t, err))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err = app.Run(append([]string{"cert", "list"}, tt.args...)...)
+			if tt.expErr != "" {
+				h(assert.ErrorContains(t, err, tt.expErr))
+			} else {
+				h(assert.NoError(t, err))
+			}
+
+			// Only check the identifying columns and status, since the time
+			// columns depend on the local timezone.
+			rows := []string{}
+			for i, line := range strings.Split(strings.TrimSpace(app.stdout.String()), "\n") {
+				fields := strings.Fields(line)
+				if i == 0 || len(fields) == 0 {
+					continue
+				}
+				status := fields[len(fields)-2]
+				if fields[0] == "(server)" {
+					rows = append(rows, fmt.Sprintf("%s/%s", fields[0], status))
+					continue
+				}
+				rows = append(rows, fmt.Sprintf("%s/%s/%s", fields[0], fields[2], status))
+			}
+			h(assert.Equal(t, tt.expRows, rows))
+		})
+	}
+}
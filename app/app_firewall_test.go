@@ -0,0 +1,166 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mandelsoft/vfs/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+	"go4.org/netipx"
+
+	"go.hackfix.me/sesame/app/config"
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/db/types"
+	"go.hackfix.me/sesame/firewall"
+	"go.hackfix.me/sesame/firewall/mock"
+	ftypes "go.hackfix.me/sesame/firewall/types"
+)
+
+func TestAppFirewallSyncIntegration(t *testing.T) {
+	t.Parallel()
+
+	tctx, cancel, h := newTestContext(t, 5*time.Second)
+	defer cancel()
+
+	app, err := newTestApp(tctx)
+	h(assert.NoError(t, err))
+
+	cfg := config.Config{
+		Firewall: config.Firewall{
+			Type: sql.Null[ftypes.FirewallType]{V: ftypes.FirewallMock, Valid: true},
+		},
+	}
+	cfgJSON, err := json.Marshal(cfg)
+	h(assert.NoError(t, err))
+	err = vfs.WriteFile(app.ctx.FS, "/config.json", cfgJSON, 0o644)
+	h(assert.NoError(t, err))
+
+	svc := &models.Service{
+		Name:              "web",
+		Ports:             ftypes.PortRanges{{From: 80, To: 80}},
+		MaxAccessDuration: time.Hour,
+	}
+	err = initTestDB(app.ctx, []*models.Service{svc})
+	h(assert.NoError(t, err))
+
+	dbCtx := app.ctx.DB.NewContext()
+	grants := []*models.AccessGrant{
+		{
+			ExpiresAt: timeNow.Add(30 * time.Minute),
+			Service:   svc,
+			IPRange:   netipx.MustParseIPRange("10.0.0.1-10.0.0.10"),
+		},
+		{
+			ExpiresAt: timeNow.Add(time.Hour),
+			Service:   svc,
+			IPRange:   netipx.MustParseIPRange("2001:db8::-2001:db8::ff"),
+		},
+		{
+			ExpiresAt: timeNow.Add(-time.Minute),
+			Service:   svc,
+			IPRange:   netipx.MustParseIPRange("192.168.1.1-192.168.1.1"),
+		},
+	}
+	for _, ag := range grants {
+		err = ag.Save(dbCtx, app.ctx.DB)
+		h(assert.NoError(t, err))
+	}
+
+	err = app.Run("firewall", "sync")
+	h(assert.NoError(t, err))
+	h(assert.Empty(t, app.stdout.String()))
+	assertLogContains(t, h, app.stderr.String(), []string{
+		"INF synced firewall state",
+		"restored=2",
+		"removed=0",
+	})
+
+	// The expired grant should be removed.
+	stored, err := models.AccessGrants(dbCtx, app.ctx.DB, nil)
+	h(assert.NoError(t, err))
+	h(assert.Len(t, stored, 2))
+	h(assert.Equal(t, "10.0.0.1-10.0.0.10", stored[0].IPRange.String()))
+	h(assert.Equal(t, "2001:db8::-2001:db8::ff", stored[1].IPRange.String()))
+
+	err = app.Run("open", "web", "172.16.0.1")
+	h(assert.NoError(t, err))
+
+	stored, err = models.AccessGrants(dbCtx, app.ctx.DB, nil)
+	h(assert.NoError(t, err))
+	h(assert.Len(t, stored, 3))
+
+	err = app.Run("close", "web", "10.0.0.0/8")
+	h(assert.NoError(t, err))
+
+	stored, err = models.AccessGrants(dbCtx, app.ctx.DB, nil)
+	h(assert.NoError(t, err))
+	h(assert.Len(t, stored, 2))
+	for _, ag := range stored {
+		h(assert.NotEqual(t, "10.0.0.1-10.0.0.10", ag.IPRange.String()))
+	}
+
+	// Closing a single address splits the grant, keeping its expiration.
+	err = app.Run("close", "web", "2001:db8::10")
+	h(assert.NoError(t, err))
+
+	stored, err = models.AccessGrants(dbCtx, app.ctx.DB, types.NewFilter("ag.ip_range LIKE ?", []any{"2001:%"}))
+	h(assert.NoError(t, err))
+	h(assert.Len(t, stored, 2))
+	ranges := []string{stored[0].IPRange.String(), stored[1].IPRange.String()}
+	h(assert.ElementsMatch(t, []string{"2001:db8::-2001:db8::f", "2001:db8::11-2001:db8::ff"}, ranges))
+	for _, ag := range stored {
+		h(assert.Equal(t, timeNow.Add(time.Hour), ag.ExpiresAt))
+	}
+}
+
+func TestAppStatusIntegration(t *testing.T) {
+	t.Parallel()
+
+	tctx, cancel, h := newTestContext(t, 5*time.Second)
+	defer cancel()
+
+	// The same mock firewall is used by all commands, so that its state can be
+	// set up by the test.
+	mockFw := mock.New(timeNowFn)
+	app, err := newTestApp(tctx, WithMockFirewall(mockFw))
+	h(assert.NoError(t, err))
+
+	// Both services share port 443.
+	services := []*models.Service{
+		{Name: "web", Ports: ftypes.PortRanges{{From: 80, To: 80}, {From: 443, To: 443}}},
+		{Name: "alt", Ports: ftypes.PortRanges{{From: 443, To: 443}}},
+	}
+	err = initTestDB(app.ctx, services)
+	h(assert.NoError(t, err))
+
+	err = app.Run("status")
+	h(assert.ErrorContains(t, err, "no firewall was configured on this system"))
+
+	err = app.Run("init", "--firewall-type=mock")
+	h(assert.NoError(t, err))
+
+	err = app.Run("status")
+	h(assert.NoError(t, err))
+	h(assert.Empty(t, app.stdout.String()))
+
+	allow := func(ipAddr string, ports ftypes.PortRanges, duration time.Duration) {
+		ipSet, perr := firewall.ParseToIPSet(ipAddr)
+		h(assert.NoError(t, perr))
+		h(assert.NoError(t, mockFw.Allow(ipSet, ftypes.ProtocolTCP, ports, duration)))
+	}
+	allow("10.0.0.1", ftypes.PortRanges{{From: 80, To: 80}}, 30*time.Minute)
+	allow("192.168.1.0/24", ftypes.PortRanges{{From: 443, To: 443}}, time.Hour)
+	// A range that doesn't match any service.
+	allow("10.0.0.5-10.0.0.10", ftypes.PortRanges{{From: 8000, To: 8010}}, 90*time.Second)
+
+	err = app.Run("status")
+	h(assert.NoError(t, err))
+	h(assert.Equal(t, ""+
+		" SERVICE  PORT           CLIENT              EXPIRES IN \n"+
+		" -        8000-8010/tcp  10.0.0.5-10.0.0.10  1m30s      \n"+
+		" alt,web  443/tcp        192.168.1.0/24      1h         \n"+
+		" web      80/tcp         10.0.0.1            30m        \n",
+		app.stdout.String()))
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppKeyIntegration(t *testing.T) {
+	t.Parallel()
+
+	tctx, cancel, h := newTestContext(t, 10*time.Second)
+	defer cancel()
+
+	app, err := newTestApp(tctx)
+	h(assert.NoError(t, err))
+
+	err = app.Run("init", "--firewall-type=mock")
+	h(assert.NoError(t, err))
+
+	rawServerTLSCert := func() []byte {
+		var cert []byte
+		err := app.ctx.DB.QueryRowContext(app.ctx.DB.NewContext(),
+			`SELECT server_tls_cert FROM _meta`).Scan(&cert)
+		h(assert.NoError(t, err))
+		return cert
+	}
+	encPrefix := []byte("sesame:enc:v1:")
+	h(assert.False(t, bytes.HasPrefix(rawServerTLSCert(), encPrefix)))
+
+	err = app.Run("key", "change")
+	h(assert.ErrorContains(t, err, "encryption is not enabled"))
+
+	err = app.env.Set("SESAME_PASSPHRASE", "secret")
+	h(assert.NoError(t, err))
+	err = app.Run("key", "enable")
+	h(assert.NoError(t, err))
+	assertLogContains(t, h, app.stderr.String(), []string{"INF enabled encryption"})
+	h(assert.True(t, bytes.HasPrefix(rawServerTLSCert(), encPrefix)))
+
+	err = app.Run("key", "enable")
+	h(assert.ErrorContains(t, err, "encryption is already enabled"))
+
+	// Encrypted data is transparently decrypted.
+	_, err = app.ctx.ServerTLSCert()
+	h(assert.NoError(t, err))
+	_, err = app.ctx.CATLSCert()
+	h(assert.NoError(t, err))
+
+	err = app.env.Set("SESAME_PASSPHRASE", "wrong")
+	h(assert.NoError(t, err))
+	err = app.env.Set("SESAME_NEW_PASSPHRASE", "newsecret")
+	h(assert.NoError(t, err))
+	err = app.Run("key", "change")
+	h(assert.ErrorContains(t, err, "invalid encryption key"))
+
+	err = app.env.Set("SESAME_PASSPHRASE", "secret")
+	h(assert.NoError(t, err))
+	err = app.Run("key", "change")
+	h(assert.NoError(t, err))
+	assertLogContains(t, h, app.stderr.String(), []string{"INF changed encryption passphrase"})
+
+	err = app.Run("key", "disable")
+	h(assert.ErrorContains(t, err, "invalid encryption key"))
+
+	err = app.env.Set("SESAME_PASSPHRASE", "newsecret")
+	h(assert.NoError(t, err))
+	err = app.Run("key", "disable")
+	h(assert.NoError(t, err))
+	assertLogContains(t, h, app.stderr.String(), []string{"INF disabled encryption"})
+	h(assert.False(t, bytes.HasPrefix(rawServerTLSCert(), encPrefix)))
+
+	_, err = app.ctx.ServerTLSCert()
+	h(assert.NoError(t, err))
+}
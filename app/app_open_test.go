@@ -31,7 +31,7 @@ func TestAppOpenIntegration(t *testing.T) {
 			clients:        []string{"192.168.1.1", "10.0.0.0/8", "172.16.1.1-172.16.1.100", "2001:db8::/32"},
 			accessDuration: 30 * time.Minute,
 			expStderr: []string{
-				"granted access", "service.name=web", "service.port=80", "duration=30m0s",
+				"granted access", "service.name=web", "service.ports=80", "service.protocol=tcp", "duration=30m0s",
 				`ip_ranges="[10.0.0.0-10.255.255.255 172.16.1.1-172.16.1.100 192.168.1.1-192.168.1.1 2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff]`,
 			},
 		},
@@ -39,7 +39,7 @@ func TestAppOpenIntegration(t *testing.T) {
 			name:    "err/no_clients",
 			svcName: "web",
 			clients: []string{},
-			expErr:  `failed parsing CLI arguments: expected "<clients> ..."`,
+			expErr:  "failed parsing CLI arguments: open: one or more clients, or --self, must be specified",
 		},
 		{
 			name:    "err/invalid_client",
@@ -63,12 +63,12 @@ func TestAppOpenIntegration(t *testing.T) {
 			services := []*models.Service{
 				{
 					Name:              "web",
-					Port:              uint16(80),
+					Ports:             ftypes.PortRanges{{From: 80, To: 80}},
 					MaxAccessDuration: time.Hour,
 				},
 				{
 					Name:              "db",
-					Port:              uint16(5432),
+					Ports:             ftypes.PortRanges{{From: 5432, To: 5432}},
 					MaxAccessDuration: 30 * time.Minute,
 				},
 			}
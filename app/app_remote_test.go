@@ -3,6 +3,7 @@ package app
 import (
 	"fmt"
 	"net/http"
+	"net/netip"
 	"regexp"
 	"strings"
 	"sync"
@@ -12,6 +13,9 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	aerrors "go.hackfix.me/sesame/app/errors"
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/db/types"
+	"go.hackfix.me/sesame/web/client"
 )
 
 // Test the scenario of 2 Sesame nodes, where one creates a user and invitation
@@ -46,11 +50,17 @@ func TestAppRemoteIntegration(t *testing.T) {
 
 	err = app1.Run("service", "ls")
 	h(assert.NoError(t, err))
-	h(assert.Contains(t, app1.stdout.String(), "python  8080  1h"))
+	h(assert.Contains(t, app1.stdout.String(), "python  8080   tcp       1h"))
+
+	err = app1.Run("service", "add", "db", "5432")
+	h(assert.NoError(t, err))
 
 	err = app1.Run("user", "add", "newuser")
 	h(assert.NoError(t, err))
 
+	err = app1.Run("user", "grant", "newuser", "python")
+	h(assert.NoError(t, err))
+
 	err = app1.Run("invite", "user", "newuser", "--expiration=1m")
 	h(assert.NoError(t, err))
 
@@ -95,6 +105,14 @@ func TestAppRemoteIntegration(t *testing.T) {
 	err = app2.flushOutputs()
 	h(assert.NoError(t, err))
 
+	// The client certificate was issued for the CSR sent by app2, for the
+	// invited user.
+	joined := &models.Remote{Name: "testremote"}
+	err = joined.Load(app2.ctx.DB.NewContext(), app2.ctx.DB)
+	h(assert.NoError(t, err))
+	h(assert.Equal(t, "newuser", joined.TLSClientCert.Leaf.Subject.CommonName))
+	h(assert.Equal(t, joined.TLSCACert.DNSNames, joined.TLSClientCert.Leaf.DNSNames))
+
 	// Confirm that the invite token has been redeemed and cannot be reused.
 	err = app2.Run("remote", "add", "testremote2", srvAddress, token)
 	h(assert.Error(t, err))
@@ -129,7 +147,7 @@ func TestAppRemoteIntegration(t *testing.T) {
 		"INF granted access",
 		"user.name=newuser",
 		"service.name=python",
-		"service.port=8080",
+		"service.ports=8080",
 		"ip_ranges=[10.0.0.10-10.0.0.10]",
 		"duration=1h",
 	})
@@ -146,10 +164,143 @@ func TestAppRemoteIntegration(t *testing.T) {
 		"INF denied access",
 		"user.name=newuser",
 		"service.name=python",
-		"service.port=8080",
+		"service.ports=8080",
 		"ip_ranges=[10.0.0.10-10.0.0.10]",
 	})
 
+	// Access can be granted to the address the remote node observes requests
+	// from, which is loopback in this case.
+	err = app2.flushOutputs()
+	h(assert.NoError(t, err))
+	err = app2.Run("open", "python", "--self")
+	h(assert.EqualError(t, err, "failed parsing CLI arguments: open: --self requires --remote"))
+	err = app2.Run("open", "--remote=testremoteupd", "python", "--self", "10.0.0.10")
+	h(assert.EqualError(t, err, "failed parsing CLI arguments: open: clients can't be specified together with --self"))
+	err = app2.Run("open", "--remote=testremoteupd", "python", "--self")
+	h(assert.NoError(t, err))
+	selfAddrMatch := regexp.MustCompile(`observed by the remote.* address=(\S+)`).FindStringSubmatch(app2.stderr.String())
+	h(assert.Len(t, selfAddrMatch, 2))
+	selfAddr := netip.MustParseAddr(selfAddrMatch[1])
+	h(assert.True(t, selfAddr.IsLoopback()))
+
+	err = app1.flushOutputs()
+	h(assert.NoError(t, err))
+	assertLogContains(t, h, app1.stderr.String(), []string{
+		"INF granted access",
+		"user.name=newuser",
+		"service.name=python",
+		fmt.Sprintf("ip_ranges=[%s-%s]", selfAddr, selfAddr),
+	})
+	err = app2.Run("close", "--remote=testremoteupd", "python", selfAddr.String())
+	h(assert.NoError(t, err))
+	err = app2.flushOutputs()
+	h(assert.NoError(t, err))
+
+	// The user doesn't have permission to manage access to the db service.
+	err = app2.Run("open", "--remote=testremoteupd", "db", "10.0.0.10")
+	h(assert.ErrorAs(t, err, &serr))
+	h(assert.Equal(t, http.StatusForbidden, serr.Metadata()["status_code"]))
+	err = app2.Run("close", "--remote=testremoteupd", "db", "10.0.0.10")
+	h(assert.ErrorAs(t, err, &serr))
+	h(assert.Equal(t, http.StatusForbidden, serr.Metadata()["status_code"]))
+	err = app2.flushOutputs()
+	h(assert.NoError(t, err))
+
+	// Renew the client certificate while it's still valid, authenticating with it.
+	err = app2.Run("remote", "renew", "testremoteupd")
+	h(assert.NoError(t, err))
+	assertLogContains(t, h, app2.stderr.String(), []string{
+		"INF renewed TLS client certificate",
+		"remote.name=testremoteupd",
+	})
+	err = app2.flushOutputs()
+	h(assert.NoError(t, err))
+
+	// The renewed certificate is revoked, and the new one can be used.
+	ccs, err := models.ClientCertificates(app1.ctx.DB.NewContext(), app1.ctx.DB, nil)
+	h(assert.NoError(t, err))
+	h(assert.Len(t, ccs, 2))
+	h(assert.True(t, ccs[0].IsRevoked() != ccs[1].IsRevoked()))
+	err = app2.Run("open", "--remote=testremoteupd", "python", "10.0.0.10")
+	h(assert.NoError(t, err))
+
+	// Renew the client certificate with the renewal token, as if it had
+	// expired, without presenting it during the TLS handshake.
+	remote := &models.Remote{Name: "testremoteupd"}
+	err = remote.Load(app2.ctx.DB.NewContext(), app2.ctx.DB)
+	h(assert.NoError(t, err))
+	h(assert.NotEmpty(t, remote.RenewalToken))
+	tlsConfig, err := remote.ClientTLSConfig()
+	h(assert.NoError(t, err))
+	tlsConfig.Certificates = nil
+	c := client.New(srvAddress, tlsConfig, app2.ctx.Logger)
+	renewResp, err := c.Renew(tctx, *remote.TLSClientCert, remote.RenewalToken)
+	h(assert.NoError(t, err))
+	h(assert.NotEqual(t, remote.RenewalToken, renewResp.RenewalToken))
+
+	// The renewal token of a renewed certificate can't be reused.
+	_, err = c.Renew(tctx, *remote.TLSClientCert, remote.RenewalToken)
+	h(assert.ErrorAs(t, err, &serr))
+	h(assert.Equal(t, http.StatusUnauthorized, serr.Metadata()["status_code"]))
+
+	remote.TLSClientCert = renewResp.TLSClientCert
+	remote.RenewalToken = renewResp.RenewalToken
+	remote.RenewalTokenExpiresAt = renewResp.RenewalTokenExpiresAt
+	err = remote.Save(app2.ctx.DB.NewContext(), app2.ctx.DB, true)
+	h(assert.NoError(t, err))
+	err = app2.Run("open", "--remote=testremoteupd", "python", "10.0.0.10")
+	h(assert.NoError(t, err))
+	err = app2.flushOutputs()
+	h(assert.NoError(t, err))
+
+	// Certificates past the renewal threshold are renewed automatically before
+	// remote operations. TLS verification relies on the actual system time, so
+	// only the time app2 uses to decide whether to renew is changed.
+	timeNowFn := app2.ctx.TimeNow
+	certExpiresAt := renewResp.TLSClientCert.Leaf.NotAfter
+	app2.ctx.TimeNow = func() time.Time { return certExpiresAt.Add(-time.Hour) }
+	err = app2.Run("close", "--remote=testremoteupd", "python", "10.0.0.10")
+	h(assert.NoError(t, err))
+	assertLogContains(t, h, app2.stderr.String(), []string{
+		"INF renewed TLS client certificate",
+		"remote.name=testremoteupd",
+	})
+	err = app2.flushOutputs()
+	h(assert.NoError(t, err))
+
+	// Expired certificates are renewed with the renewal token, with a warning if
+	// the token is close to expiry.
+	err = remote.Load(app2.ctx.DB.NewContext(), app2.ctx.DB)
+	h(assert.NoError(t, err))
+	tokenExpiresAt := remote.RenewalTokenExpiresAt
+	app2.ctx.TimeNow = func() time.Time { return tokenExpiresAt.Add(-time.Hour) }
+	err = app2.Run("open", "--remote=testremoteupd", "python", "10.0.0.10")
+	h(assert.NoError(t, err))
+	assertLogContains(t, h, app2.stderr.String(), []string{
+		"WRN the renewal token is close to expiry",
+		"remote.name=testremoteupd",
+	})
+	assertLogContains(t, h, app2.stderr.String(), []string{
+		"INF renewed TLS client certificate",
+		"remote.name=testremoteupd",
+	})
+	app2.ctx.TimeNow = timeNowFn
+	err = app2.flushOutputs()
+	h(assert.NoError(t, err))
+
+	// Revoked certificates are rejected, even if they haven't expired.
+	ccs, err = models.ClientCertificates(app1.ctx.DB.NewContext(), app1.ctx.DB,
+		types.NewFilter("cc.revoked_at IS NULL", nil))
+	h(assert.NoError(t, err))
+	h(assert.Len(t, ccs, 1))
+	err = ccs[0].Revoke(app1.ctx.DB.NewContext(), app1.ctx.DB, timeNow)
+	h(assert.NoError(t, err))
+	err = app2.Run("open", "--remote=testremoteupd", "python", "10.0.0.10")
+	h(assert.ErrorAs(t, err, &serr))
+	h(assert.Equal(t, http.StatusUnauthorized, serr.Metadata()["status_code"]))
+	err = app2.flushOutputs()
+	h(assert.NoError(t, err))
+
 	err = app2.Run("remote", "rm", "testremoteupd")
 	h(assert.NoError(t, err))
 
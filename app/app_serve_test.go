@@ -0,0 +1,493 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"go.hackfix.me/sesame/crypto"
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/web/common"
+	stypes "go.hackfix.me/sesame/web/server/types"
+)
+
+func TestAppServeTLSCertRotationIntegration(t *testing.T) {
+	t.Parallel()
+
+	// See the comment in TestAppRemoteIntegration.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	timeout := 5 * time.Second
+	tctx, cancel, h := newTestContext(t, timeout)
+	defer cancel()
+
+	// TLS verification in the stdlib relies on the actual system time.
+	app, err := newTestApp(tctx, WithTimeNow(time.Now))
+	h(assert.NoError(t, err))
+
+	err = app.Run("init", "--firewall-type=mock")
+	h(assert.NoError(t, err))
+
+	oldTLSCert, err := app.ctx.ServerTLSCert()
+	h(assert.NoError(t, err))
+	oldCert, err := crypto.ExtractLeafCert(oldTLSCert)
+	h(assert.NoError(t, err))
+	caTLSCert, err := app.ctx.CATLSCert()
+	h(assert.NoError(t, err))
+	caCert, err := crypto.ExtractCACert(caTLSCert)
+	h(assert.NoError(t, err))
+
+	// A tiny threshold makes the certificate due for renewal right away.
+	app.ctx.Config.Server.TLSCertRenewalThreshold = sql.Null[float64]{V: 1e-9, Valid: true}
+
+	addrCh := make(chan string)
+	app.stderr.waitFor(`started listener.*address=(.*)\n`, 1, addrCh)
+	renewedCh := make(chan string)
+	app.stderr.waitFor(`renewed server TLS certificate.* serial_number=(\w+)`, 1, renewedCh)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err = app.Run("serve", ":0")
+		h(assert.NoError(t, err))
+	}()
+
+	var srvAddress, serial string
+	for srvAddress == "" || serial == "" {
+		select {
+		case srvAddress = <-addrCh:
+		case serial = <-renewedCh:
+		case <-tctx.Done():
+			t.Fatalf("timed out after %s", timeout)
+		}
+	}
+
+	// The renewed certificate is stored, and keeps the same key.
+	newTLSCert, err := app.ctx.ServerTLSCert()
+	h(assert.NoError(t, err))
+	newCert, err := crypto.ExtractLeafCert(newTLSCert)
+	h(assert.NoError(t, err))
+	h(assert.Equal(t, serial, newCert.SerialNumber.Text(16)))
+	h(assert.NotEqual(t, oldCert.SerialNumber, newCert.SerialNumber))
+	h(assert.Equal(t, oldCert.RawSubjectPublicKeyInfo, newCert.RawSubjectPublicKeyInfo))
+	h(assert.Equal(t, oldCert.DNSNames, newCert.DNSNames))
+
+	// New connections use the renewed certificate, which is issued by the same
+	// CA. The client certificate isn't required for the TLS handshake.
+	remote := &models.Remote{TLSCACert: caCert, TLSClientCert: &oldTLSCert}
+	tlsCfg, err := remote.ClientTLSConfig()
+	h(assert.NoError(t, err))
+	tlsCfg.Certificates = nil
+	conn, err := tls.Dial("tcp", srvAddress, tlsCfg)
+	h(assert.NoError(t, err))
+	peerCerts := conn.ConnectionState().PeerCertificates
+	h(assert.Len(t, peerCerts, 1))
+	h(assert.Equal(t, newCert.SerialNumber, peerCerts[0].SerialNumber))
+	err = conn.Close()
+	h(assert.NoError(t, err))
+}
+
+func TestAppServeCARotationIntegration(t *testing.T) {
+	t.Parallel()
+
+	// See the comment in TestAppRemoteIntegration.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	timeout := 5 * time.Second
+	tctx, cancel, h := newTestContext(t, timeout)
+	defer cancel()
+
+	// TLS verification in the stdlib relies on the actual system time.
+	app, err := newTestApp(tctx, WithTimeNow(time.Now))
+	h(assert.NoError(t, err))
+
+	err = app.Run("init", "--firewall-type=mock")
+	h(assert.NoError(t, err))
+
+	oldCATLSCert, err := app.ctx.CATLSCert()
+	h(assert.NoError(t, err))
+	oldCACert, err := crypto.ExtractCACert(oldCATLSCert)
+	h(assert.NoError(t, err))
+
+	// A client certificate issued by the previous CA.
+	timeNow := time.Now()
+	clientTLSCert, err := crypto.NewTLSCert(
+		"newuser", oldCACert.DNSNames, timeNow, timeNow.Add(time.Hour), &oldCATLSCert)
+	h(assert.NoError(t, err))
+
+	err = app.Run("ca", "rotate", "--rollover=1h")
+	h(assert.NoError(t, err))
+	assertLogContains(t, h, app.stderr.String(), []string{"INF rotated CA"})
+
+	newCATLSCert, err := app.ctx.CATLSCert()
+	h(assert.NoError(t, err))
+	newCACert, err := crypto.ExtractCACert(newCATLSCert)
+	h(assert.NoError(t, err))
+	h(assert.NotEqual(t, oldCACert.SerialNumber, newCACert.SerialNumber))
+	h(assert.NotEqual(t, oldCACert.RawSubjectPublicKeyInfo, newCACert.RawSubjectPublicKeyInfo))
+	h(assert.Equal(t, oldCACert.DNSNames, newCACert.DNSNames))
+
+	// Both CAs are trusted during the rollover, and the server certificate
+	// chain includes the cross-signed new CA certificate.
+	caCerts, err := app.ctx.TrustedCACerts()
+	h(assert.NoError(t, err))
+	h(assert.Len(t, caCerts, 2))
+	tlsCert, err := app.ctx.ServerTLSCert()
+	h(assert.NoError(t, err))
+	h(assert.Len(t, tlsCert.Certificate, 2))
+
+	// Once the rollover ends, only the new CA is trusted.
+	app.ctx.TimeNow = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	caCerts, err = app.ctx.TrustedCACerts()
+	h(assert.NoError(t, err))
+	h(assert.Len(t, caCerts, 1))
+	h(assert.Equal(t, newCACert.SerialNumber, caCerts[0].SerialNumber))
+	tlsCert, err = app.ctx.ServerTLSCert()
+	h(assert.NoError(t, err))
+	h(assert.Len(t, tlsCert.Certificate, 1))
+	app.ctx.TimeNow = time.Now
+
+	addrCh := make(chan string)
+	app.stderr.waitFor(`started listener.*address=(.*)\n`, 1, addrCh)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err = app.Run("serve", ":0")
+		h(assert.NoError(t, err))
+	}()
+
+	var srvAddress string
+	select {
+	case srvAddress = <-addrCh:
+	case <-tctx.Done():
+		t.Fatalf("timed out after %s", timeout)
+	}
+
+	// Remote clients that only trust the previous CA can verify the server
+	// certificate, and their client certificates issued by the previous CA are
+	// still verified, though in this case they're unknown to the server.
+	// Clients that already trust the new CA can also verify it. In both cases,
+	// the new CA certificate is advertised in the response.
+	for _, caCert := range []*x509.Certificate{oldCACert, newCACert} {
+		remote := &models.Remote{TLSCACert: caCert, TLSClientCert: &clientTLSCert}
+		tlsCfg, err := remote.ClientTLSConfig()
+		h(assert.NoError(t, err))
+
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+		req, err := http.NewRequestWithContext(tctx, http.MethodPost,
+			fmt.Sprintf("https://%s/api/v1/open", srvAddress), strings.NewReader("{}"))
+		h(assert.NoError(t, err))
+		resp, err := httpClient.Do(req)
+		h(assert.NoError(t, err))
+		body, err := io.ReadAll(resp.Body)
+		h(assert.NoError(t, err))
+		err = resp.Body.Close()
+		h(assert.NoError(t, err))
+
+		h(assert.Equal(t, http.StatusUnauthorized, resp.StatusCode))
+		h(assert.Contains(t, string(body), "unknown client TLS certificate"))
+		h(assert.Len(t, resp.TLS.PeerCertificates, 2))
+		h(assert.Equal(t, base64.StdEncoding.EncodeToString(newCACert.Raw),
+			resp.Header.Get(common.HeaderCACert)))
+	}
+}
+
+func TestAppServeMetricsIntegration(t *testing.T) {
+	t.Parallel()
+
+	// See the comment in TestAppRemoteIntegration.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	timeout := 5 * time.Second
+	tctx, cancel, h := newTestContext(t, timeout)
+	defer cancel()
+
+	// TLS verification in the stdlib relies on the actual system time.
+	app, err := newTestApp(tctx, WithTimeNow(time.Now))
+	h(assert.NoError(t, err))
+
+	err = app.Run("init", "--firewall-type=mock")
+	h(assert.NoError(t, err))
+
+	// The access grant is restored in the firewall when the server starts.
+	for _, args := range [][]string{
+		{"service", "add", "web", "80", "--max-access-duration=1h"},
+		{"open", "web", "10.0.0.1", "--duration=30m"},
+	} {
+		err = app.Run(args...)
+		h(assert.NoError(t, err))
+	}
+
+	caTLSCert, err := app.ctx.CATLSCert()
+	h(assert.NoError(t, err))
+	caCert, err := crypto.ExtractCACert(caTLSCert)
+	h(assert.NoError(t, err))
+	// A client certificate issued by the CA, but unknown to the server.
+	timeNow := time.Now()
+	clientTLSCert, err := crypto.NewTLSCert(
+		"nobody", caCert.DNSNames, timeNow, timeNow.Add(time.Hour), &caTLSCert)
+	h(assert.NoError(t, err))
+
+	addrCh := make(chan string)
+	app.stderr.waitFor(`started listener.*address=(.*)\n`, 1, addrCh)
+	metricsAddrCh := make(chan string)
+	app.stderr.waitFor(`started metrics listener.*address=(.*)\n`, 1, metricsAddrCh)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err = app.Run("serve", ":0", "--metrics-address=127.0.0.1:0")
+		h(assert.NoError(t, err))
+	}()
+
+	var srvAddress, metricsAddress string
+	for srvAddress == "" || metricsAddress == "" {
+		select {
+		case srvAddress = <-addrCh:
+		case metricsAddress = <-metricsAddrCh:
+		case <-tctx.Done():
+			t.Fatalf("timed out after %s", timeout)
+		}
+	}
+
+	remote := &models.Remote{TLSCACert: caCert, TLSClientCert: &clientTLSCert}
+	tlsCfg, err := remote.ClientTLSConfig()
+	h(assert.NoError(t, err))
+	httpsClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+
+	doRequest := func(client *http.Client, method, url string) (int, string) {
+		req, err := http.NewRequestWithContext(tctx, method, url, strings.NewReader("{}"))
+		h(assert.NoError(t, err))
+		resp, err := client.Do(req)
+		h(assert.NoError(t, err))
+		body, err := io.ReadAll(resp.Body)
+		h(assert.NoError(t, err))
+		err = resp.Body.Close()
+		h(assert.NoError(t, err))
+		return resp.StatusCode, string(body)
+	}
+
+	// Metrics are only served on the main address to known clients.
+	status, body := doRequest(httpsClient, http.MethodGet, fmt.Sprintf("https://%s/metrics", srvAddress))
+	h(assert.Equal(t, http.StatusUnauthorized, status))
+	h(assert.Contains(t, body, "unknown client TLS certificate"))
+
+	// A join request without an invite token.
+	status, _ = doRequest(httpsClient, http.MethodPost, fmt.Sprintf("https://%s/api/v1/join", srvAddress))
+	h(assert.Equal(t, http.StatusUnauthorized, status))
+
+	status, _ = doRequest(httpsClient, http.MethodGet, fmt.Sprintf("https://%s/unknown", srvAddress))
+	h(assert.Equal(t, http.StatusNotFound, status))
+
+	status, body = doRequest(http.DefaultClient, http.MethodGet, fmt.Sprintf("http://%s/metrics", metricsAddress))
+	h(assert.Equal(t, http.StatusOK, status))
+	for _, expRe := range []string{
+		`(?m)^sesame_http_requests_total\{method="GET",route="/metrics",status="401"\} 1$`,
+		`(?m)^sesame_http_requests_total\{method="POST",route="/api/v1/join",status="401"\} 1$`,
+		`(?m)^sesame_http_requests_total\{method="other",route="other",status="404"\} 1$`,
+		`(?m)^sesame_http_request_duration_seconds_count\{method="POST",route="/api/v1/join"\} 1$`,
+		`(?m)^sesame_joins_total\{reason="unauthorized",result="failure"\} 1$`,
+		`(?m)^sesame_access_grants_active\{service="web"\} 1$`,
+		`(?m)^sesame_tls_cert_expiry_seconds\{cert="server"\} \d`,
+		`(?m)^sesame_tls_cert_expiry_seconds\{cert="ca"\} \d`,
+	} {
+		h(assert.Regexp(t, expRe, body))
+	}
+	h(assert.NotContains(t, body, "sesame_firewall_errors_total"))
+}
+
+func TestAppServeHealthIntegration(t *testing.T) {
+	t.Parallel()
+
+	// See the comment in TestAppRemoteIntegration.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	timeout := 5 * time.Second
+	tctx, cancel, h := newTestContext(t, timeout)
+	defer cancel()
+
+	// TLS verification in the stdlib relies on the actual system time.
+	app, err := newTestApp(tctx, WithTimeNow(time.Now))
+	h(assert.NoError(t, err))
+
+	err = app.Run("init", "--firewall-type=mock")
+	h(assert.NoError(t, err))
+
+	caTLSCert, err := app.ctx.CATLSCert()
+	h(assert.NoError(t, err))
+	caCert, err := crypto.ExtractCACert(caTLSCert)
+	h(assert.NoError(t, err))
+
+	addrCh := make(chan string)
+	app.stderr.waitFor(`started listener.*address=(.*)\n`, 1, addrCh)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err = app.Run("serve", ":0", "--error-level=full")
+		h(assert.NoError(t, err))
+	}()
+
+	var srvAddress string
+	select {
+	case srvAddress = <-addrCh:
+	case <-tctx.Done():
+		t.Fatalf("timed out after %s", timeout)
+	}
+
+	// The endpoints don't require a client certificate.
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: newServerTLSConfig(caCert)}}
+
+	getHealth := func(path string) (int, *stypes.HealthResponse) {
+		req, err := http.NewRequestWithContext(tctx, http.MethodGet,
+			fmt.Sprintf("https://%s%s", srvAddress, path), nil)
+		h(assert.NoError(t, err))
+		resp, err := httpClient.Do(req)
+		h(assert.NoError(t, err))
+		body, err := io.ReadAll(resp.Body)
+		h(assert.NoError(t, err))
+		err = resp.Body.Close()
+		h(assert.NoError(t, err))
+		h(assert.Equal(t, "application/json", resp.Header.Get("Content-Type")))
+
+		var healthResp stypes.HealthResponse
+		err = json.Unmarshal(body, &healthResp)
+		h(assert.NoError(t, err))
+		return resp.StatusCode, &healthResp
+	}
+
+	status, resp := getHealth("/healthz")
+	h(assert.Equal(t, http.StatusOK, status))
+	h(assert.Equal(t, &stypes.HealthResponse{Status: stypes.HealthStatusOK}, resp))
+
+	okCheck := &stypes.HealthCheck{Status: stypes.HealthStatusOK}
+	status, resp = getHealth("/readyz")
+	h(assert.Equal(t, http.StatusOK, status))
+	h(assert.Equal(t, &stypes.HealthResponse{
+		Status: stypes.HealthStatusOK,
+		Checks: map[string]*stypes.HealthCheck{
+			"database": okCheck, "schema": okCheck, "firewall": okCheck, "server_cert": okCheck,
+		},
+	}, resp))
+
+	// Simulate a database that wasn't migrated to the latest schema.
+	_, err = app.ctx.DB.ExecContext(app.ctx.DB.NewContext(),
+		`DELETE FROM _migration_history WHERE name = '0017-table-audit-events'`)
+	h(assert.NoError(t, err))
+
+	status, resp = getHealth("/readyz")
+	h(assert.Equal(t, http.StatusServiceUnavailable, status))
+	h(assert.Equal(t, stypes.HealthStatusError, resp.Status))
+	h(assert.Equal(t, okCheck, resp.Checks["database"]))
+	h(assert.Equal(t, &stypes.HealthCheck{
+		Status: stypes.HealthStatusError,
+		Error:  "database schema is outdated; pending migrations: 0017-table-audit-events",
+	}, resp.Checks["schema"]))
+}
+
+func TestAppServeBanIntegration(t *testing.T) {
+	t.Parallel()
+
+	// See the comment in TestAppRemoteIntegration.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	timeout := 5 * time.Second
+	tctx, cancel, h := newTestContext(t, timeout)
+	defer cancel()
+
+	// TLS verification in the stdlib relies on the actual system time.
+	app, err := newTestApp(tctx, WithTimeNow(time.Now))
+	h(assert.NoError(t, err))
+
+	err = app.Run("init", "--firewall-type=mock")
+	h(assert.NoError(t, err))
+
+	app.ctx.Config.Server.BanThreshold = sql.Null[int]{V: 3, Valid: true}
+
+	caTLSCert, err := app.ctx.CATLSCert()
+	h(assert.NoError(t, err))
+	caCert, err := crypto.ExtractCACert(caTLSCert)
+	h(assert.NoError(t, err))
+
+	addrCh := make(chan string)
+	app.stderr.waitFor(`started listener.*address=(.*)\n`, 1, addrCh)
+
+	// Listen on IPv4 only, so that the client address is predictable.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err = app.Run("serve", "127.0.0.1:0", "--error-level=full")
+		h(assert.NoError(t, err))
+	}()
+
+	var srvAddress string
+	select {
+	case srvAddress = <-addrCh:
+	case <-tctx.Done():
+		t.Fatalf("timed out after %s", timeout)
+	}
+
+	// Joining doesn't require a client certificate.
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: newServerTLSConfig(caCert)}}
+
+	join := func() int {
+		req, err := http.NewRequestWithContext(tctx, http.MethodPost,
+			fmt.Sprintf("https://%s/api/v1/join", srvAddress), strings.NewReader("{}"))
+		h(assert.NoError(t, err))
+		req.Header.Set("Authorization", "Bearer invalid")
+		resp, err := httpClient.Do(req)
+		h(assert.NoError(t, err))
+		_, err = io.Copy(io.Discard, resp.Body)
+		h(assert.NoError(t, err))
+		err = resp.Body.Close()
+		h(assert.NoError(t, err))
+		return resp.StatusCode
+	}
+
+	for range 3 {
+		h(assert.Equal(t, http.StatusUnauthorized, join()))
+	}
+
+	// The client is banned after reaching the threshold, so it's rejected
+	// before authentication.
+	h(assert.Equal(t, http.StatusTooManyRequests, join()))
+
+	aes, err := models.AuditEvents(app.ctx.DB.NewContext(), app.ctx.DB, nil)
+	h(assert.NoError(t, err))
+	var banEvents []*models.AuditEvent
+	for _, ae := range aes {
+		if ae.Type == models.AuditEventBanAdd {
+			banEvents = append(banEvents, ae)
+		}
+	}
+	h(assert.Len(t, banEvents, 1))
+	h(assert.Equal(t, "127.0.0.1", banEvents[0].SourceIP.String()))
+	h(assert.Equal(t, "/join", banEvents[0].Payload["path"]))
+}
+
+// newServerTLSConfig returns a TLS configuration that verifies the server
+// certificate issued by caCert, without presenting a client certificate.
+func newServerTLSConfig(caCert *x509.Certificate) *tls.Config {
+	tlsCfg := crypto.DefaultTLSConfig()
+	tlsCfg.RootCAs = x509.NewCertPool()
+	tlsCfg.RootCAs.AddCert(caCert)
+	tlsCfg.ServerName = caCert.DNSNames[0]
+	return tlsCfg
+}
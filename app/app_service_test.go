@@ -1,14 +1,20 @@
 package app
 
 import (
+	"database/sql"
+	"encoding/json"
 	"errors"
 	"testing"
 	"time"
 
+	"github.com/mandelsoft/vfs/pkg/vfs"
 	"github.com/stretchr/testify/assert"
+	"go4.org/netipx"
 
+	"go.hackfix.me/sesame/app/config"
 	aerrors "go.hackfix.me/sesame/app/errors"
 	"go.hackfix.me/sesame/db/models"
+	ftypes "go.hackfix.me/sesame/firewall/types"
 )
 
 //nolint:tparallel // Cannot be parallelized since the tests are expected to run in the defined sequence.
@@ -32,7 +38,8 @@ func TestAppServiceIntegration(t *testing.T) {
 					CreatedAt:         timeNow,
 					UpdatedAt:         timeNow,
 					Name:              "web",
-					Port:              uint16(80),
+					Ports:             ftypes.PortRanges{{From: 80, To: 80}},
+					Protocol:          ftypes.ProtocolTCP,
 					MaxAccessDuration: time.Hour,
 				},
 			},
@@ -46,7 +53,8 @@ func TestAppServiceIntegration(t *testing.T) {
 					CreatedAt:         timeNow,
 					UpdatedAt:         timeNow,
 					Name:              "db",
-					Port:              uint16(5432),
+					Ports:             ftypes.PortRanges{{From: 5432, To: 5432}},
+					Protocol:          ftypes.ProtocolTCP,
 					MaxAccessDuration: 30 * time.Minute,
 				},
 				{
@@ -54,21 +62,26 @@ func TestAppServiceIntegration(t *testing.T) {
 					CreatedAt:         timeNow,
 					UpdatedAt:         timeNow,
 					Name:              "web",
-					Port:              uint16(80),
+					Ports:             ftypes.PortRanges{{From: 80, To: 80}},
+					Protocol:          ftypes.ProtocolTCP,
 					MaxAccessDuration: time.Hour,
 				},
 			},
 		},
 		{
 			name: "ok/update",
-			args: []string{"update", "web", "8080", "--max-access-duration", "5m"},
+			args: []string{
+				"update", "web", "8080,60000-61000", "--max-access-duration", "5m", "--protocol", "both",
+				"--kill-connections",
+			},
 			expServices: []*models.Service{
 				{
 					ID:                2,
 					CreatedAt:         timeNow,
 					UpdatedAt:         timeNow,
 					Name:              "db",
-					Port:              uint16(5432),
+					Ports:             ftypes.PortRanges{{From: 5432, To: 5432}},
+					Protocol:          ftypes.ProtocolTCP,
 					MaxAccessDuration: 30 * time.Minute,
 				},
 				{
@@ -76,8 +89,10 @@ func TestAppServiceIntegration(t *testing.T) {
 					CreatedAt:         timeNow,
 					UpdatedAt:         timeNow,
 					Name:              "web",
-					Port:              uint16(8080),
+					Ports:             ftypes.PortRanges{{From: 8080, To: 8080}, {From: 60000, To: 61000}},
+					Protocol:          ftypes.ProtocolBoth,
 					MaxAccessDuration: 5 * time.Minute,
+					KillConnections:   true,
 				},
 			},
 		},
@@ -90,7 +105,8 @@ func TestAppServiceIntegration(t *testing.T) {
 					CreatedAt:         timeNow,
 					UpdatedAt:         timeNow,
 					Name:              "db",
-					Port:              uint16(5432),
+					Ports:             ftypes.PortRanges{{From: 5432, To: 5432}},
+					Protocol:          ftypes.ProtocolTCP,
 					MaxAccessDuration: 30 * time.Minute,
 				},
 				{
@@ -98,14 +114,41 @@ func TestAppServiceIntegration(t *testing.T) {
 					CreatedAt:         timeNow,
 					UpdatedAt:         timeNow,
 					Name:              "web",
-					Port:              uint16(8080),
+					Ports:             ftypes.PortRanges{{From: 8080, To: 8080}, {From: 60000, To: 61000}},
+					Protocol:          ftypes.ProtocolBoth,
 					MaxAccessDuration: 5 * time.Minute,
+					KillConnections:   true,
 				},
 			},
 			expStdout: "" +
-				" NAME  PORT  MAX ACCESS DURATION \n" +
-				" db    5432  30m                 \n" +
-				" web   8080  5m                  \n",
+				" NAME  PORTS             PROTOCOL  MAX ACCESS DURATION  KILL CONNECTIONS \n" +
+				" db    5432              tcp       30m                  false            \n" +
+				" web   8080,60000-61000  both      5m                   true             \n",
+		},
+		{
+			name: "ok/update_keep_protocol",
+			args: []string{"update", "web", "60000-61000,8080", "--max-access-duration", "5m"},
+			expServices: []*models.Service{
+				{
+					ID:                2,
+					CreatedAt:         timeNow,
+					UpdatedAt:         timeNow,
+					Name:              "db",
+					Ports:             ftypes.PortRanges{{From: 5432, To: 5432}},
+					Protocol:          ftypes.ProtocolTCP,
+					MaxAccessDuration: 30 * time.Minute,
+				},
+				{
+					ID:                1,
+					CreatedAt:         timeNow,
+					UpdatedAt:         timeNow,
+					Name:              "web",
+					Ports:             ftypes.PortRanges{{From: 8080, To: 8080}, {From: 60000, To: 61000}},
+					Protocol:          ftypes.ProtocolBoth,
+					MaxAccessDuration: 5 * time.Minute,
+					KillConnections:   true,
+				},
+			},
 		},
 		{
 			name: "ok/remove_1",
@@ -116,7 +159,8 @@ func TestAppServiceIntegration(t *testing.T) {
 					CreatedAt:         timeNow,
 					UpdatedAt:         timeNow,
 					Name:              "db",
-					Port:              uint16(5432),
+					Ports:             ftypes.PortRanges{{From: 5432, To: 5432}},
+					Protocol:          ftypes.ProtocolTCP,
 					MaxAccessDuration: 30 * time.Minute,
 				},
 			},
@@ -130,11 +174,28 @@ func TestAppServiceIntegration(t *testing.T) {
 					CreatedAt:         timeNow,
 					UpdatedAt:         timeNow,
 					Name:              "db",
-					Port:              uint16(5432),
+					Ports:             ftypes.PortRanges{{From: 5432, To: 5432}},
+					Protocol:          ftypes.ProtocolTCP,
 					MaxAccessDuration: 30 * time.Minute,
 				},
 			},
-			expErr: "failed parsing CLI arguments: <port>: must be greater than 0",
+			expErr: "failed parsing CLI arguments: <ports>: invalid port '0': must be greater than 0",
+		},
+		{
+			name: "err/invalid_protocol",
+			args: []string{"add", "dns", "53", "--protocol", "sctp"},
+			expServices: []*models.Service{
+				{
+					ID:                2,
+					CreatedAt:         timeNow,
+					UpdatedAt:         timeNow,
+					Name:              "db",
+					Ports:             ftypes.PortRanges{{From: 5432, To: 5432}},
+					Protocol:          ftypes.ProtocolTCP,
+					MaxAccessDuration: 30 * time.Minute,
+				},
+			},
+			expErr: `must be one of "tcp","udp","both" but got "sctp"`,
 		},
 		{
 			name: "err/service_exists",
@@ -145,7 +206,8 @@ func TestAppServiceIntegration(t *testing.T) {
 					CreatedAt:         timeNow,
 					UpdatedAt:         timeNow,
 					Name:              "db",
-					Port:              uint16(5432),
+					Ports:             ftypes.PortRanges{{From: 5432, To: 5432}},
+					Protocol:          ftypes.ProtocolTCP,
 					MaxAccessDuration: 30 * time.Minute,
 				},
 			},
@@ -160,7 +222,8 @@ func TestAppServiceIntegration(t *testing.T) {
 					CreatedAt:         timeNow,
 					UpdatedAt:         timeNow,
 					Name:              "db",
-					Port:              uint16(5432),
+					Ports:             ftypes.PortRanges{{From: 5432, To: 5432}},
+					Protocol:          ftypes.ProtocolTCP,
 					MaxAccessDuration: 30 * time.Minute,
 				},
 			},
@@ -175,7 +238,8 @@ func TestAppServiceIntegration(t *testing.T) {
 					CreatedAt:         timeNow,
 					UpdatedAt:         timeNow,
 					Name:              "db",
-					Port:              uint16(5432),
+					Ports:             ftypes.PortRanges{{From: 5432, To: 5432}},
+					Protocol:          ftypes.ProtocolTCP,
 					MaxAccessDuration: 30 * time.Minute,
 				},
 			},
@@ -231,3 +295,76 @@ func TestAppServiceIntegration(t *testing.T) {
 		})
 	}
 }
+
+func TestAppServiceFirewallIntegration(t *testing.T) {
+	t.Parallel()
+
+	tctx, cancel, h := newTestContext(t, 5*time.Second)
+	defer cancel()
+
+	app, err := newTestApp(tctx)
+	h(assert.NoError(t, err))
+
+	cfg := config.Config{
+		Firewall: config.Firewall{
+			Type: sql.Null[ftypes.FirewallType]{V: ftypes.FirewallMock, Valid: true},
+		},
+	}
+	cfgJSON, err := json.Marshal(cfg)
+	h(assert.NoError(t, err))
+	err = vfs.WriteFile(app.ctx.FS, "/config.json", cfgJSON, 0o644)
+	h(assert.NoError(t, err))
+
+	svc := &models.Service{
+		Name:              "web",
+		Ports:             ftypes.PortRanges{{From: 80, To: 80}},
+		MaxAccessDuration: time.Hour,
+	}
+	err = initTestDB(app.ctx, []*models.Service{svc})
+	h(assert.NoError(t, err))
+
+	dbCtx := app.ctx.DB.NewContext()
+	grants := []*models.AccessGrant{
+		{
+			ExpiresAt: timeNow.Add(5 * time.Minute),
+			Service:   svc,
+			IPRange:   netipx.MustParseIPRange("10.0.0.1-10.0.0.10"),
+		},
+		{
+			ExpiresAt: timeNow.Add(time.Hour),
+			Service:   svc,
+			IPRange:   netipx.MustParseIPRange("2001:db8::-2001:db8::ff"),
+		},
+	}
+	for _, ag := range grants {
+		err = ag.Save(dbCtx, app.ctx.DB)
+		h(assert.NoError(t, err))
+	}
+
+	err = app.Run("service", "update", "web", "8080", "--max-access-duration", "10m", "--clamp-grants")
+	h(assert.NoError(t, err))
+	assertLogContains(t, h, app.stderr.String(), []string{
+		"INF updated service",
+		"service.ports=8080",
+		"grants_migrated=2",
+		"grants_clamped=1",
+	})
+
+	stored, err := models.AccessGrants(dbCtx, app.ctx.DB, nil)
+	h(assert.NoError(t, err))
+	h(assert.Len(t, stored, 2))
+	h(assert.Equal(t, timeNow.Add(5*time.Minute), stored[0].ExpiresAt))
+	h(assert.Equal(t, timeNow.Add(10*time.Minute), stored[1].ExpiresAt))
+
+	err = app.Run("service", "remove", "web")
+	h(assert.NoError(t, err))
+	assertLogContains(t, h, app.stderr.String(), []string{
+		"INF removed service",
+		"service.name=web",
+		"grants_removed=2",
+	})
+
+	stored, err = models.AccessGrants(dbCtx, app.ctx.DB, nil)
+	h(assert.NoError(t, err))
+	h(assert.Empty(t, stored))
+}
@@ -0,0 +1,159 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	aerrors "go.hackfix.me/sesame/app/errors"
+	"go.hackfix.me/sesame/db/models"
+	ftypes "go.hackfix.me/sesame/firewall/types"
+)
+
+//nolint:tparallel // Cannot be parallelized since the tests are expected to run in the defined sequence.
+func TestAppUserIntegration(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		args      []string
+		expStdout string
+		expErr    string
+		expPerms  []string
+	}{
+		{
+			name:     "ok/add_1",
+			args:     []string{"add", "alice"},
+			expPerms: []string{},
+		},
+		{
+			name:     "ok/add_2",
+			args:     []string{"add", "bob"},
+			expPerms: []string{},
+		},
+		{
+			name:     "ok/grant_1",
+			args:     []string{"grant", "alice", "ssh"},
+			expPerms: []string{"alice/ssh"},
+		},
+		{
+			name:     "ok/grant_2",
+			args:     []string{"grant", "alice", "db"},
+			expPerms: []string{"alice/ssh", "alice/db"},
+		},
+		{
+			name:     "ok/grant_3",
+			args:     []string{"grant", "bob", "ssh"},
+			expPerms: []string{"alice/ssh", "alice/db", "bob/ssh"},
+		},
+		{
+			name:     "err/grant_exists",
+			args:     []string{"grant", "alice", "ssh"},
+			expErr:   "permission with user 'alice' and service 'ssh' already exists",
+			expPerms: []string{"alice/ssh", "alice/db", "bob/ssh"},
+		},
+		{
+			name:     "err/grant_unknown_service",
+			args:     []string{"grant", "alice", "web"},
+			expErr:   "service with name 'web' doesn't exist",
+			expPerms: []string{"alice/ssh", "alice/db", "bob/ssh"},
+		},
+		{
+			name:     "err/grant_unknown_user",
+			args:     []string{"grant", "carol", "ssh"},
+			expErr:   "user with name 'carol' doesn't exist",
+			expPerms: []string{"alice/ssh", "alice/db", "bob/ssh"},
+		},
+		{
+			name:     "ok/revoke",
+			args:     []string{"revoke", "alice", "ssh"},
+			expPerms: []string{"alice/db", "bob/ssh"},
+		},
+		{
+			name:     "err/revoke_not_granted",
+			args:     []string{"revoke", "alice", "ssh"},
+			expErr:   "permission with user 'alice' and service 'ssh' doesn't exist",
+			expPerms: []string{"alice/db", "bob/ssh"},
+		},
+		{
+			name: "ok/update",
+			args: []string{
+				"update", "alice", "--max-access-duration=30m",
+				"--allowed-cidrs=10.0.0.0/8,192.168.1.1", "--self-only",
+			},
+			expPerms: []string{"alice/db", "bob/ssh"},
+		},
+		{
+			name:     "err/update_invalid_cidr",
+			args:     []string{"update", "alice", "--allowed-cidrs=10.0.0.0/33"},
+			expErr:   "--allowed-cidrs: invalid CIDR '10.0.0.0/33'",
+			expPerms: []string{"alice/db", "bob/ssh"},
+		},
+		{
+			name:     "err/update_unknown_user",
+			args:     []string{"update", "carol", "--self-only"},
+			expErr:   "user with name 'carol' doesn't exist",
+			expPerms: []string{"alice/db", "bob/ssh"},
+		},
+		{
+			name: "ok/list",
+			args: []string{"list"},
+			expStdout: "" +
+				" NAME   SERVICES  MAX ACCESS DURATION  ALLOWED CIDRS               SELF ONLY \n" +
+				" alice  db        30m                  10.0.0.0/8, 192.168.1.1/32  true      \n" +
+				" bob    ssh       -                    -                           false     \n",
+			expPerms: []string{"alice/db", "bob/ssh"},
+		},
+		{
+			name:     "ok/remove",
+			args:     []string{"remove", "bob"},
+			expPerms: []string{"alice/db"},
+		},
+	}
+
+	tctx, cancel, h := newTestContext(t, 5*time.Second)
+	defer cancel()
+
+	app, err := newTestApp(tctx)
+	h(assert.NoError(t, err))
+
+	err = initTestDB(app.ctx, []*models.Service{
+		{Name: "ssh", Ports: ftypes.PortRanges{{From: 22, To: 22}}, MaxAccessDuration: time.Hour},
+		{Name: "db", Ports: ftypes.PortRanges{{From: 5432, To: 5432}}, MaxAccessDuration: time.Hour},
+	})
+	h(assert.NoError(t, err))
+
+	for _, tt := range tests {
+		args := []string{"user"}
+		t.Run(tt.name, func(t *testing.T) {
+			args = append(args, tt.args...)
+			err = app.Run(args...)
+			stdout := app.stdout.String()
+
+			var serr *aerrors.StructuredError
+			if errors.As(err, &serr) {
+				err = serr.Cause()
+			}
+
+			if tt.expErr != "" {
+				h(assert.ErrorContains(t, err, tt.expErr))
+			} else {
+				h(assert.NoError(t, err))
+			}
+
+			h(assert.Equal(t, tt.expStdout, stdout))
+
+			var perms []*models.UserServicePermission
+			perms, err = models.UserServicePermissions(app.ctx.DB.NewContext(), app.ctx.DB, nil)
+			h(assert.NoError(t, err))
+			permsStr := make([]string, len(perms))
+			for i, p := range perms {
+				permsStr[i] = fmt.Sprintf("%s/%s", p.User.Name, p.Service.Name)
+			}
+			h(assert.Equal(t, tt.expPerms, permsStr))
+		})
+	}
+}
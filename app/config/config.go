@@ -13,12 +13,21 @@ import (
 	"go.hackfix.me/sesame/xtime"
 )
 
+// Default values of the ban settings, which are also used if the settings are
+// missing from configuration files created by older Sesame versions.
+const (
+	DefaultBanThreshold = 10
+	DefaultBanWindow    = 10 * time.Minute
+	DefaultBanDuration  = time.Hour
+)
+
 // Config represents the application configuration, backed by a filesystem for
 // persistence.
 type Config struct {
 	Firewall Firewall
 	Server   Server
 	Client   Client
+	Audit    Audit
 
 	fs   vfs.FileSystem
 	path string
@@ -88,6 +97,21 @@ type Server struct {
 	// set to 0.75, the server's certificate will be scheduled for renewal after
 	// 67.5 days.
 	TLSCertRenewalThreshold sql.Null[float64] `json:"tls_cert_renewal_threshold"`
+	// CACertExpiration is the amount of time the CA certificate that issues the
+	// server's and clients' TLS certificates is valid for.
+	// It serializes from/to xtime.Duration string values. Minimum value: 1 hour.
+	CACertExpiration sql.Null[time.Duration] `json:"ca_cert_expiration"`
+	// BanThreshold is the number of failed authentication attempts on untrusted
+	// endpoints (e.g. /join) within BanWindow after which the client IP address
+	// is banned by the firewall for BanDuration. A value of 0 disables banning.
+	BanThreshold sql.Null[int] `json:"ban_threshold"`
+	// BanWindow is the amount of time failed authentication attempts are
+	// counted for.
+	// It serializes from/to xtime.Duration string values.
+	BanWindow sql.Null[time.Duration] `json:"ban_window"`
+	// BanDuration is the amount of time clients are banned for.
+	// It serializes from/to xtime.Duration string values.
+	BanDuration sql.Null[time.Duration] `json:"ban_duration"`
 }
 
 // Client defines configuration options specific to the HTTP client.
@@ -114,27 +138,50 @@ type Firewall struct {
 	// this system unless specified by the user.
 	// It serializes from/to xtime.Duration string values. Minimum value: 1 minute.
 	DefaultAccessDuration sql.Null[time.Duration] `json:"default_access_duration"`
+	// StrictEstablished makes the firewall accept packets that clients send on
+	// established connections only while they're allowed access, so that their
+	// connections are cut off once their access expires. Changes are applied to
+	// an existing firewall by 'sesame firewall sync'.
+	StrictEstablished sql.Null[bool] `json:"strict_established"`
+}
+
+// Audit defines configuration options for the audit log.
+type Audit struct {
+	// Retention is the amount of time audit events are kept for. Older events
+	// are deleted when new events are recorded. If unset, events are kept
+	// indefinitely.
+	// It serializes from/to xtime.Duration string values.
+	Retention sql.Null[time.Duration] `json:"retention"`
 }
 
 type cfgWrapper struct {
 	Firewall fwCfgWrapper     `json:"firewall"`
 	Server   srvCfgWrapper    `json:"server"`
 	Client   clientCfgWrapper `json:"client"`
+	Audit    auditCfgWrapper  `json:"audit"`
 }
 type fwCfgWrapper struct {
 	Type                  string `json:"type,omitempty"`
 	DefaultAccessDuration string `json:"default_access_duration,omitempty"`
+	StrictEstablished     *bool  `json:"strict_established,omitempty"`
 }
 type srvCfgWrapper struct {
 	Address                 string  `json:"address,omitempty"`
 	TLSCertExpiration       string  `json:"tls_cert_expiration,omitempty"`
 	TLSCertRenewalThreshold float64 `json:"tls_cert_renewal_threshold,omitempty"`
+	CACertExpiration        string  `json:"ca_cert_expiration,omitempty"`
+	BanThreshold            *int    `json:"ban_threshold,omitempty"`
+	BanWindow               string  `json:"ban_window,omitempty"`
+	BanDuration             string  `json:"ban_duration,omitempty"`
 }
 type clientCfgWrapper struct {
 	TLSCertExpiration             string  `json:"tls_cert_expiration,omitempty"`
 	TLSCertRenewalThreshold       float64 `json:"tls_cert_renewal_threshold,omitempty"`
 	TLSCertRenewalTokenExpiration string  `json:"tls_cert_renewal_token_expiration,omitempty"`
 }
+type auditCfgWrapper struct {
+	Retention string `json:"retention,omitempty"`
+}
 
 // MarshalJSON implements custom JSON marshaling to convert sql.Null values
 // to their underlying types, omitting invalid/null fields from the output.
@@ -147,6 +194,9 @@ func (c Config) MarshalJSON() ([]byte, error) {
 	if c.Firewall.DefaultAccessDuration.Valid {
 		w.Firewall.DefaultAccessDuration = xtime.FormatDuration(c.Firewall.DefaultAccessDuration.V, time.Minute)
 	}
+	if c.Firewall.StrictEstablished.Valid {
+		w.Firewall.StrictEstablished = &c.Firewall.StrictEstablished.V
+	}
 
 	if c.Server.Address.Valid {
 		w.Server.Address = c.Server.Address.V
@@ -157,6 +207,18 @@ func (c Config) MarshalJSON() ([]byte, error) {
 	if c.Server.TLSCertRenewalThreshold.Valid {
 		w.Server.TLSCertRenewalThreshold = c.Server.TLSCertRenewalThreshold.V
 	}
+	if c.Server.CACertExpiration.Valid {
+		w.Server.CACertExpiration = xtime.FormatDuration(c.Server.CACertExpiration.V, time.Hour)
+	}
+	if c.Server.BanThreshold.Valid {
+		w.Server.BanThreshold = &c.Server.BanThreshold.V
+	}
+	if c.Server.BanWindow.Valid {
+		w.Server.BanWindow = xtime.FormatDuration(c.Server.BanWindow.V, time.Second)
+	}
+	if c.Server.BanDuration.Valid {
+		w.Server.BanDuration = xtime.FormatDuration(c.Server.BanDuration.V, time.Second)
+	}
 
 	if c.Client.TLSCertExpiration.Valid {
 		w.Client.TLSCertExpiration = xtime.FormatDuration(c.Client.TLSCertExpiration.V, time.Hour)
@@ -168,6 +230,10 @@ func (c Config) MarshalJSON() ([]byte, error) {
 		w.Client.TLSCertRenewalTokenExpiration = xtime.FormatDuration(c.Client.TLSCertRenewalTokenExpiration.V, time.Hour)
 	}
 
+	if c.Audit.Retention.Valid {
+		w.Audit.Retention = xtime.FormatDuration(c.Audit.Retention.V, time.Hour)
+	}
+
 	//nolint:wrapcheck // This is fine.
 	return json.Marshal(w)
 }
@@ -195,6 +261,9 @@ func (c *Config) UnmarshalJSON(data []byte) error {
 		}
 		c.Firewall.DefaultAccessDuration = sql.Null[time.Duration]{V: dur, Valid: true}
 	}
+	if w.Firewall.StrictEstablished != nil {
+		c.Firewall.StrictEstablished = sql.Null[bool]{V: *w.Firewall.StrictEstablished, Valid: true}
+	}
 
 	if w.Server.Address != "" {
 		c.Server.Address = sql.Null[string]{V: w.Server.Address, Valid: true}
@@ -209,6 +278,33 @@ func (c *Config) UnmarshalJSON(data []byte) error {
 	if w.Server.TLSCertRenewalThreshold > 0 {
 		c.Server.TLSCertRenewalThreshold = sql.Null[float64]{V: w.Server.TLSCertRenewalThreshold, Valid: true}
 	}
+	if w.Server.CACertExpiration != "" {
+		dur, err := xtime.ParseDuration(w.Server.CACertExpiration)
+		if err != nil {
+			return fmt.Errorf("failed parsing server's CA cert expiration: %w", err)
+		}
+		c.Server.CACertExpiration = sql.Null[time.Duration]{V: dur, Valid: true}
+	}
+	if w.Server.BanThreshold != nil {
+		if *w.Server.BanThreshold < 0 {
+			return fmt.Errorf("invalid ban threshold %d: must not be negative", *w.Server.BanThreshold)
+		}
+		c.Server.BanThreshold = sql.Null[int]{V: *w.Server.BanThreshold, Valid: true}
+	}
+	if w.Server.BanWindow != "" {
+		dur, err := xtime.ParseDuration(w.Server.BanWindow)
+		if err != nil {
+			return fmt.Errorf("failed parsing server's ban window: %w", err)
+		}
+		c.Server.BanWindow = sql.Null[time.Duration]{V: dur, Valid: true}
+	}
+	if w.Server.BanDuration != "" {
+		dur, err := xtime.ParseDuration(w.Server.BanDuration)
+		if err != nil {
+			return fmt.Errorf("failed parsing server's ban duration: %w", err)
+		}
+		c.Server.BanDuration = sql.Null[time.Duration]{V: dur, Valid: true}
+	}
 
 	if w.Client.TLSCertExpiration != "" {
 		dur, err := xtime.ParseDuration(w.Client.TLSCertExpiration)
@@ -228,6 +324,14 @@ func (c *Config) UnmarshalJSON(data []byte) error {
 		c.Client.TLSCertRenewalTokenExpiration = sql.Null[time.Duration]{V: dur, Valid: true}
 	}
 
+	if w.Audit.Retention != "" {
+		dur, err := xtime.ParseDuration(w.Audit.Retention)
+		if err != nil {
+			return fmt.Errorf("failed parsing audit retention: %w", err)
+		}
+		c.Audit.Retention = sql.Null[time.Duration]{V: dur, Valid: true}
+	}
+
 	return nil
 }
 
@@ -240,6 +344,19 @@ func (c *Config) SetDefaults() {
 	if !c.Server.TLSCertRenewalThreshold.Valid {
 		c.Server.TLSCertRenewalThreshold = sql.Null[float64]{V: 0.75, Valid: true}
 	}
+	if !c.Server.CACertExpiration.Valid {
+		// ~10 years
+		c.Server.CACertExpiration = sql.Null[time.Duration]{V: 24 * time.Hour * 365 * 10, Valid: true}
+	}
+	if !c.Server.BanThreshold.Valid {
+		c.Server.BanThreshold = sql.Null[int]{V: DefaultBanThreshold, Valid: true}
+	}
+	if !c.Server.BanWindow.Valid {
+		c.Server.BanWindow = sql.Null[time.Duration]{V: DefaultBanWindow, Valid: true}
+	}
+	if !c.Server.BanDuration.Valid {
+		c.Server.BanDuration = sql.Null[time.Duration]{V: DefaultBanDuration, Valid: true}
+	}
 	if !c.Client.TLSCertExpiration.Valid {
 		// ~1 month
 		c.Client.TLSCertExpiration = sql.Null[time.Duration]{V: 24 * time.Hour * 30, Valid: true}
@@ -251,4 +368,8 @@ func (c *Config) SetDefaults() {
 		// ~5 months
 		c.Client.TLSCertRenewalTokenExpiration = sql.Null[time.Duration]{V: 24 * time.Hour * 30 * 5, Valid: true}
 	}
+	if !c.Audit.Retention.Valid {
+		// ~1 year
+		c.Audit.Retention = sql.Null[time.Duration]{V: 24 * time.Hour * 365, Valid: true}
+	}
 }
@@ -0,0 +1,27 @@
+package context
+
+import (
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/db/types"
+)
+
+// Audit records the audit event in the database, and deletes events older than
+// the configured retention period. Since the audited action was already
+// performed, failures are logged instead of returned.
+func (c *Context) Audit(ev *models.AuditEvent) {
+	dbCtx := c.DB.NewContext()
+	if err := ev.Save(dbCtx, c.DB); err != nil {
+		c.Logger.Error("failed recording audit event", "type", ev.Type, "error", err)
+		return
+	}
+
+	if c.Config == nil || !c.Config.Audit.Retention.Valid || c.Config.Audit.Retention.V <= 0 {
+		return
+	}
+
+	cutoff := ev.CreatedAt.Add(-c.Config.Audit.Retention.V)
+	_, err := models.DeleteAuditEvents(dbCtx, c.DB, types.NewFilter("created_at < ?", []any{cutoff}))
+	if err != nil {
+		c.Logger.Error("failed deleting expired audit events", "error", err)
+	}
+}
@@ -3,7 +3,9 @@ package context
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"fmt"
 	"io"
 	"log/slog"
 	"time"
@@ -14,6 +16,7 @@ import (
 	"go.hackfix.me/sesame/crypto"
 	"go.hackfix.me/sesame/db"
 	"go.hackfix.me/sesame/db/queries"
+	ftypes "go.hackfix.me/sesame/firewall/types"
 )
 
 // Context contains common objects used by the application. It is passed around
@@ -36,12 +39,19 @@ type Context struct {
 
 	DB *db.DB
 
+	// MockFirewall, if set, is used by all commands instead of a new mock
+	// firewall, so that its state is preserved between commands.
+	MockFirewall ftypes.Firewall
+
 	// Metadata
 	Version     *VersionInfo
 	VersionInit string // app version the DB was initialized with
 }
 
 // ServerTLSCert returns the TLS certificate used by the Sesame web server.
+// During a CA rollover, the certificate chain also includes the current CA
+// certificate cross-signed by the previous CA, so that clients that only trust
+// the previous CA can verify it.
 func (c *Context) ServerTLSCert() (tlsCert tls.Certificate, err error) {
 	var certNull sql.Null[[]byte]
 	certNull, err = queries.GetServerTLSCert(c.DB.NewContext(), c.DB)
@@ -49,5 +59,77 @@ func (c *Context) ServerTLSCert() (tlsCert tls.Certificate, err error) {
 		return
 	}
 
+	tlsCert, err = crypto.DecodeTLSCert(certNull.V)
+	if err != nil {
+		return
+	}
+
+	rollover, err := c.caRollover()
+	if err != nil {
+		return
+	}
+	if rollover != nil {
+		tlsCert.Certificate = append(tlsCert.Certificate, rollover.CrossCert)
+	}
+
+	return tlsCert, nil
+}
+
+// CATLSCert returns the CA certificate and private key used to issue TLS
+// certificates. Databases initialized before the CA certificate was separated
+// from the server certificate use the self-signed server certificate as CA.
+func (c *Context) CATLSCert() (tls.Certificate, error) {
+	certNull, err := queries.GetCATLSCert(c.DB.NewContext(), c.DB)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if !certNull.Valid {
+		return c.ServerTLSCert()
+	}
+
 	return crypto.DecodeTLSCert(certNull.V)
 }
+
+// TrustedCACerts returns the CA certificates trusted to have issued client
+// certificates. This is the current CA certificate, and the previous one
+// during a CA rollover.
+func (c *Context) TrustedCACerts() ([]*x509.Certificate, error) {
+	caTLSCert, err := c.CATLSCert()
+	if err != nil {
+		return nil, err
+	}
+
+	caCert, err := crypto.ExtractCACert(caTLSCert)
+	if err != nil {
+		return nil, err
+	}
+	caCerts := []*x509.Certificate{caCert}
+
+	rollover, err := c.caRollover()
+	if err != nil {
+		return nil, err
+	}
+	if rollover != nil {
+		prevCACert, err := x509.ParseCertificate(rollover.PrevCACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing previous CA certificate: %w", err)
+		}
+		caCerts = append(caCerts, prevCACert)
+	}
+
+	return caCerts, nil
+}
+
+// caRollover returns the state of the CA rollover, or nil if no rollover is
+// in progress.
+func (c *Context) caRollover() (*queries.CARollover, error) {
+	rollover, err := queries.GetCARollover(c.DB.NewContext(), c.DB)
+	if err != nil {
+		return nil, err
+	}
+	if rollover == nil || !c.TimeNow().Before(rollover.EndsAt) {
+		return nil, nil //nolint:nilnil // No rollover in progress is not an error.
+	}
+
+	return rollover, nil
+}
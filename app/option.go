@@ -12,6 +12,7 @@ import (
 	cfg "go.hackfix.me/sesame/app/config"
 	actx "go.hackfix.me/sesame/app/context"
 	"go.hackfix.me/sesame/db"
+	ftypes "go.hackfix.me/sesame/firewall/types"
 )
 
 // Option is a function that allows configuring the application.
@@ -79,6 +80,14 @@ func WithLogger(_, isStderrTTY bool) Option {
 	}
 }
 
+// WithMockFirewall sets the firewall used by all commands when the mock
+// firewall type is configured.
+func WithMockFirewall(fw ftypes.Firewall) Option {
+	return func(app *App) {
+		app.ctx.MockFirewall = fw
+	}
+}
+
 // WithTimeNow sets the function used to retrieve the current system time.
 func WithTimeNow(timeNowFn func() time.Time) Option {
 	return func(app *App) {
@@ -8,6 +8,7 @@ import (
 	"io"
 	"log/slog"
 	"regexp"
+	"slices"
 	"sync"
 	"testing"
 	"time"
@@ -133,7 +134,14 @@ type hookWriter struct {
 	ctx         context.Context
 	mx          sync.RWMutex
 	w           chan []byte
-	subs        []chan []byte
+	subs        []*hookSub
+}
+
+// hookSub is a subscriber of the data written to a hookWriter. done is closed
+// when the subscriber stops listening, so that writes aren't blocked by it.
+type hookSub struct {
+	ch   chan []byte
+	done chan struct{}
 }
 
 func newHookWriter(ctx context.Context) *hookWriter {
@@ -142,7 +150,7 @@ func newHookWriter(ctx context.Context) *hookWriter {
 		tmp:        newSafeBuffer(),
 		ctx:        ctx,
 		w:          make(chan []byte, 10),
-		subs:       make([]chan []byte, 0),
+		subs:       make([]*hookSub, 0),
 	}
 
 	go func() {
@@ -151,7 +159,11 @@ func newHookWriter(ctx context.Context) *hookWriter {
 			case d := <-hw.w:
 				hw.mx.RLock()
 				for _, s := range hw.subs {
-					s <- d
+					select {
+					case s.ch <- d:
+					case <-s.done:
+					case <-hw.ctx.Done():
+					}
 				}
 				hw.mx.RUnlock()
 			case <-hw.ctx.Done():
@@ -170,17 +182,21 @@ func newHookWriter(ctx context.Context) *hookWriter {
 func (hw *hookWriter) waitFor(rxPat string, matchIdx int, wCh chan string) {
 	rx := regexp.MustCompile(rxPat)
 
-	ch := make(chan []byte)
+	sub := &hookSub{ch: make(chan []byte), done: make(chan struct{})}
 	hw.mx.Lock()
-	hw.subs = append(hw.subs, ch)
+	hw.subs = append(hw.subs, sub)
 	hw.mx.Unlock()
 
 	go func() {
+		defer hw.unsubscribe(sub)
 		for {
 			select {
-			case d := <-ch:
+			case d := <-sub.ch:
 				match := rx.FindStringSubmatch(string(d))
 				if len(match)-1 >= matchIdx {
+					// Stop listening before notifying, so that subsequent
+					// writes don't wait for this subscriber.
+					hw.unsubscribe(sub)
 					wCh <- match[matchIdx]
 					return
 				}
@@ -191,13 +207,29 @@ func (hw *hookWriter) waitFor(rxPat string, matchIdx int, wCh chan string) {
 	}()
 }
 
+// unsubscribe stops sending written data to the subscriber. It's safe to call
+// more than once.
+func (hw *hookWriter) unsubscribe(sub *hookSub) {
+	select {
+	case <-sub.done:
+		return
+	default:
+		close(sub.done)
+	}
+
+	hw.mx.Lock()
+	defer hw.mx.Unlock()
+	hw.subs = slices.DeleteFunc(hw.subs, func(s *hookSub) bool { return s == sub })
+}
+
 func (hw *hookWriter) Write(p []byte) (n int, err error) {
 	n, err = hw.tmp.Write(p)
 	if err != nil {
 		return
 	}
+	// The slice may be reused by the caller once Write returns.
 	select {
-	case hw.w <- p:
+	case hw.w <- bytes.Clone(p):
 	case <-hw.ctx.Done():
 	}
 	return
@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	actx "go.hackfix.me/sesame/app/context"
+	aerrors "go.hackfix.me/sesame/app/errors"
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/db/types"
+)
+
+// The Audit command shows the audit log of actions performed on this node.
+type Audit struct {
+	//nolint:lll // Long struct tags are unavoidable.
+	Since time.Time `type:"time" help:"Show events since a time duration before now (e.g. 1h, 3d, 1w), or since a timestamp in RFC 3339 format."`
+	//nolint:lll // Long struct tags are unavoidable.
+	Until   time.Time `type:"time" help:"Show events until a time duration before now (e.g. 1h, 3d, 1w), or until a timestamp in RFC 3339 format."`
+	User    string    `short:"u" help:"Show events performed by a specific remote user."`
+	Service string    `short:"s" help:"Show events of a specific service."`
+	//nolint:lll // Long struct tags are unavoidable.
+	Type   []string `short:"t" enum:"${auditEventTypes}" help:"Show events of a specific type. Valid values: ${enum} \n Multiple values can be specified separated by comma. Default: all"`
+	Output string   `short:"o" enum:"table,json" default:"table" help:"Output format. Valid values: ${enum}"`
+}
+
+// Run the audit command.
+func (c *Audit) Run(appCtx *actx.Context) error {
+	events, err := models.AuditEvents(appCtx.DB.NewContext(), appCtx.DB, c.filter())
+	if err != nil {
+		return aerrors.NewWithCause("failed querying audit events", err)
+	}
+
+	if c.Output == "json" {
+		enc := json.NewEncoder(appCtx.Stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(events); err != nil {
+			return aerrors.NewWithCause("failed encoding audit events", err)
+		}
+		return nil
+	}
+
+	data := make([][]string, len(events))
+	for i, ev := range events {
+		source := "-"
+		if ev.SourceIP.IsValid() {
+			source = ev.SourceIP.String()
+		}
+		data[i] = []string{
+			ev.CreatedAt.Local().Format(time.DateTime),
+			string(ev.Type),
+			valueOrDash(ev.UserName),
+			valueOrDash(ev.SiteID),
+			source,
+			valueOrDash(ev.ServiceName),
+			formatPayload(ev.Payload),
+		}
+	}
+
+	if len(data) > 0 {
+		header := []string{"Time", "Type", "User", "Site ID", "Source", "Service", "Details"}
+		if err = renderTable(header, data, appCtx.Stdout); err != nil {
+			return aerrors.NewWithCause("failed rendering table", err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Audit) filter() *types.Filter {
+	filter := types.NewFilter("1=1", nil)
+	if !c.Since.IsZero() {
+		filter = filter.And(types.NewFilter("ae.created_at >= ?", []any{c.Since.UTC()}))
+	}
+	if !c.Until.IsZero() {
+		filter = filter.And(types.NewFilter("ae.created_at <= ?", []any{c.Until.UTC()}))
+	}
+	if c.User != "" {
+		filter = filter.And(types.NewFilter("ae.user_name = ?", []any{c.User}))
+	}
+	if c.Service != "" {
+		filter = filter.And(types.NewFilter("ae.service_name = ?", []any{c.Service}))
+	}
+	if len(c.Type) > 0 {
+		args := make([]any, len(c.Type))
+		for i, t := range c.Type {
+			args[i] = t
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+		filter = filter.And(types.NewFilter(fmt.Sprintf("ae.type IN (%s)", placeholders), args))
+	}
+
+	return filter
+}
+
+// auditEventTypes returns the valid audit event types separated by comma.
+func auditEventTypes() string {
+	evTypes := models.AuditEventTypes()
+	typesStr := make([]string, len(evTypes))
+	for i, t := range evTypes {
+		typesStr[i] = string(t)
+	}
+
+	return strings.Join(typesStr, ",")
+}
+
+// formatPayload returns the audit event payload as key=value pairs sorted by
+// key.
+func formatPayload(payload map[string]any) string {
+	pairs := make([]string, 0, len(payload))
+	for _, k := range slices.Sorted(maps.Keys(payload)) {
+		v := payload[k]
+		if vs, ok := v.([]any); ok {
+			strs := make([]string, len(vs))
+			for i, el := range vs {
+				strs[i] = fmt.Sprint(el)
+			}
+			v = strings.Join(strs, ",")
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%v", k, v))
+	}
+
+	if len(pairs) == 0 {
+		return "-"
+	}
+
+	return strings.Join(pairs, " ")
+}
+
+func valueOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
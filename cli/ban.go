@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/alecthomas/kong"
+
+	actx "go.hackfix.me/sesame/app/context"
+	aerrors "go.hackfix.me/sesame/app/errors"
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/firewall"
+	ftypes "go.hackfix.me/sesame/firewall/types"
+	"go.hackfix.me/sesame/xtime"
+)
+
+// The Ban command manages the clients banned by the firewall after repeated
+// failed authentication attempts.
+type Ban struct {
+	List   struct{} `cmd:"" aliases:"ls" help:"List the currently banned clients."`
+	Remove struct {
+		Addresses []netip.Addr `arg:"" help:"IP addresses to unban."`
+	} `cmd:"" aliases:"rm" help:"Remove the ban of one or more clients before it expires."`
+}
+
+// Run the ban command.
+func (c *Ban) Run(kctx *kong.Context, appCtx *actx.Context) error {
+	if !appCtx.Config.Firewall.Type.Valid {
+		return aerrors.NewWith(
+			"no firewall was configured on this system", "hint", "Did you forget to run 'sesame init'?")
+	}
+
+	fw, fwMgr, err := firewall.Setup(
+		appCtx, appCtx.Config.Firewall.Type.V, appCtx.Config.Firewall.DefaultAccessDuration.V, appCtx.Logger,
+	)
+	if err != nil {
+		return aerrors.NewWithCause(
+			"failed setting up firewall", err, "firewall.type", appCtx.Config.Firewall.Type.V)
+	}
+
+	switch kctx.Command() {
+	case "ban list":
+		var bans []ftypes.Ban
+		if bans, err = fw.Bans(); err != nil {
+			return aerrors.NewWithCause(
+				"failed listing bans", err, "firewall.type", appCtx.Config.Firewall.Type.V)
+		}
+
+		data := make([][]string, len(bans))
+		for i, b := range bans {
+			data[i] = []string{b.Addr.String(), xtime.FormatDuration(b.Expires, time.Second)}
+		}
+
+		if len(data) > 0 {
+			if err = renderTable([]string{"Client", "Expires In"}, data, appCtx.Stdout); err != nil {
+				return aerrors.NewWithCause("failed rendering table", err)
+			}
+		}
+	case "ban remove <addresses>":
+		for _, addr := range c.Remove.Addresses {
+			if err = fwMgr.Unban(addr); err != nil {
+				return aerrors.NewWithCause("failed removing ban", err, "ip", addr.String())
+			}
+			appCtx.Audit(&models.AuditEvent{
+				Type: models.AuditEventBanRemove, Payload: map[string]any{"ip": addr.Unmap().String()},
+			})
+		}
+	}
+
+	return nil
+}
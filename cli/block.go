@@ -0,0 +1,183 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mandelsoft/vfs/pkg/vfs"
+	"go4.org/netipx"
+
+	actx "go.hackfix.me/sesame/app/context"
+	aerrors "go.hackfix.me/sesame/app/errors"
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/firewall"
+)
+
+// Block blocks clients from accessing services.
+type Block struct {
+	//nolint:lll // Long struct tags are unavoidable.
+	Clients []string `arg:"" optional:"" help:"One or more client IP addresses in plain, CIDR or range notation. \n Examples: 10.0.0.10, 192.168.1.0/24, 172.16.1.10-172.16.1.100, a3:bc00::/32"`
+	//nolint:lll // Long struct tags are unavoidable.
+	Service string `short:"s" help:"The name of the service. If not specified, access to all services is blocked, including services added later once the firewall state is synced."`
+	//nolint:lll // Long struct tags are unavoidable.
+	Duration time.Duration `short:"d" help:"Duration of the block. If not specified, clients are blocked until they're unblocked."`
+	//nolint:lll // Long struct tags are unavoidable.
+	FromFile string `help:"Path to a file with client IP addresses to block, one per line. \n Empty lines, and anything after a # or ; character are ignored."`
+}
+
+// Validate checks that either clients or --from-file were specified.
+func (c *Block) Validate() error {
+	if len(c.Clients) == 0 && c.FromFile == "" {
+		return errors.New("one or more clients, or --from-file, must be specified")
+	}
+	return nil
+}
+
+// Run the block command.
+func (c *Block) Run(appCtx *actx.Context) error {
+	ipSet, svc, fwMgr, err := setupBlock(appCtx, c.Clients, c.FromFile, c.Service)
+	if err != nil {
+		return err
+	}
+
+	if err = fwMgr.BlockAccess(ipSet, svc, c.Duration); err != nil {
+		return aerrors.NewWithCause(
+			"failed blocking access", err,
+			"service.name", c.Service,
+			"firewall.type", appCtx.Config.Firewall.Type.V)
+	}
+
+	appCtx.Audit(&models.AuditEvent{
+		Type: models.AuditEventBlock, ServiceName: c.Service,
+		Payload: blockAuditPayload(c.Clients, c.FromFile, c.Duration),
+	})
+
+	return nil
+}
+
+// Unblock removes the blocks of clients from accessing services.
+type Unblock struct {
+	//nolint:lll // Long struct tags are unavoidable.
+	Clients []string `arg:"" optional:"" help:"One or more client IP addresses in plain, CIDR or range notation. \n Examples: 10.0.0.10, 192.168.1.0/24, 172.16.1.10-172.16.1.100, a3:bc00::/32"`
+	//nolint:lll // Long struct tags are unavoidable.
+	Service string `short:"s" help:"The name of the service. If not specified, all blocks of the clients are removed."`
+	//nolint:lll // Long struct tags are unavoidable.
+	FromFile string `help:"Path to a file with client IP addresses to unblock, one per line. \n Empty lines, and anything after a # or ; character are ignored."`
+}
+
+// Validate checks that either clients or --from-file were specified.
+func (c *Unblock) Validate() error {
+	if len(c.Clients) == 0 && c.FromFile == "" {
+		return errors.New("one or more clients, or --from-file, must be specified")
+	}
+	return nil
+}
+
+// Run the unblock command.
+func (c *Unblock) Run(appCtx *actx.Context) error {
+	ipSet, svc, fwMgr, err := setupBlock(appCtx, c.Clients, c.FromFile, c.Service)
+	if err != nil {
+		return err
+	}
+
+	if err = fwMgr.UnblockAccess(ipSet, svc); err != nil {
+		return aerrors.NewWithCause(
+			"failed removing block", err,
+			"service.name", c.Service,
+			"firewall.type", appCtx.Config.Firewall.Type.V)
+	}
+
+	appCtx.Audit(&models.AuditEvent{
+		Type: models.AuditEventUnblock, ServiceName: c.Service,
+		Payload: blockAuditPayload(c.Clients, c.FromFile, 0),
+	})
+
+	return nil
+}
+
+// setupBlock parses the clients and the clients listed in fromFile into an IP
+// set, loads the service if svcName is set, and sets up the firewall manager.
+func setupBlock(
+	appCtx *actx.Context, clients []string, fromFile, svcName string,
+) (*netipx.IPSet, *models.Service, *firewall.Manager, error) {
+	if !appCtx.Config.Firewall.Type.Valid {
+		return nil, nil, nil, aerrors.NewWith(
+			"no firewall was configured on this system", "hint", "Did you forget to run 'sesame init'?")
+	}
+
+	if fromFile != "" {
+		fileClients, err := readClientsFile(appCtx, fromFile)
+		if err != nil {
+			return nil, nil, nil, aerrors.NewWithCause("failed reading clients file", err, "path", fromFile)
+		}
+		clients = append(clients, fileClients...)
+	}
+
+	ipSet, err := firewall.ParseToIPSet(clients...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var svc *models.Service
+	if svcName != "" {
+		svc = &models.Service{Name: svcName}
+		if err = svc.Load(appCtx.DB.NewContext(), appCtx.DB); err != nil {
+			return nil, nil, nil, aerrors.NewWithCause("unknown service", err, "service.name", svcName)
+		}
+	}
+
+	_, fwMgr, err := firewall.Setup(
+		appCtx, appCtx.Config.Firewall.Type.V, appCtx.Config.Firewall.DefaultAccessDuration.V, appCtx.Logger,
+	)
+	if err != nil {
+		return nil, nil, nil, aerrors.NewWithCause(
+			"failed setting up firewall", err, "firewall.type", appCtx.Config.Firewall.Type.V)
+	}
+
+	return ipSet, svc, fwMgr, nil
+}
+
+// readClientsFile returns the client IP addresses listed in the file, one per
+// line. Empty lines and comments starting with # or ; are ignored, which
+// supports the format of common IP block lists.
+func readClientsFile(appCtx *actx.Context, path string) ([]string, error) {
+	data, err := vfs.ReadFile(appCtx.FS, path)
+	if err != nil {
+		return nil, err //nolint:wrapcheck // The error is wrapped by the caller.
+	}
+
+	var clients []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line, _, _ = strings.Cut(line, ";")
+		if line = strings.TrimSpace(line); line != "" {
+			clients = append(clients, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading lines: %w", err)
+	}
+
+	return clients, nil
+}
+
+// blockAuditPayload returns the payload of block and unblock audit events.
+// Clients read from a file aren't included, since the list can be long.
+func blockAuditPayload(clients []string, fromFile string, duration time.Duration) map[string]any {
+	payload := map[string]any{}
+	if len(clients) > 0 {
+		payload["clients"] = clients
+	}
+	if fromFile != "" {
+		payload["from_file"] = fromFile
+	}
+	if duration > 0 {
+		payload["duration"] = duration.String()
+	}
+	return payload
+}
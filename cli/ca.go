@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/alecthomas/kong"
+
+	actx "go.hackfix.me/sesame/app/context"
+	aerrors "go.hackfix.me/sesame/app/errors"
+	"go.hackfix.me/sesame/crypto"
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/db/queries"
+)
+
+// The CA command manages the certificate authority that issues the server TLS
+// certificate, and TLS client certificates issued to remote users.
+type CA struct {
+	Rotate struct {
+		//nolint:lll // Long struct tags are unavoidable.
+		Rollover time.Duration `help:"Duration during which the previous CA is still trusted, to allow remote nodes to renew their certificates. Default: the client certificate expiration."`
+	} `cmd:"" help:"Replace the CA with a new one, and issue a new server TLS certificate."`
+}
+
+// Run the ca command.
+func (c *CA) Run(kctx *kong.Context, appCtx *actx.Context) error {
+	switch kctx.Command() {
+	case "ca rotate":
+		rollover := c.Rotate.Rollover
+		if rollover == 0 {
+			rollover = appCtx.Config.Client.TLSCertExpiration.V
+		}
+
+		caCert, err := rotateCA(appCtx, rollover)
+		if err != nil {
+			return aerrors.NewWithCause("failed rotating the CA", err)
+		}
+
+		appCtx.Logger.Info("rotated CA",
+			"serial_number", caCert.Leaf.SerialNumber.Text(16),
+			"expires_at", caCert.Leaf.NotAfter,
+			"rollover_ends_at", appCtx.TimeNow().Add(rollover))
+		appCtx.Audit(&models.AuditEvent{
+			Type: models.AuditEventCARotate,
+			Payload: map[string]any{
+				"serial_number":    caCert.Leaf.SerialNumber.Text(16),
+				"rollover_ends_at": appCtx.TimeNow().Add(rollover).UTC(),
+			},
+		})
+	}
+
+	return nil
+}
+
+// rotateCA creates a new CA, and a new server TLS certificate issued by it.
+// The new CA is cross-signed by the previous CA, which remains trusted until
+// the rollover period ends. This allows remote nodes that only trust the
+// previous CA to verify the new server certificate, and to keep using client
+// certificates issued by the previous CA until they're renewed. A running
+// server picks up the change on its next TLS certificate check.
+func rotateCA(appCtx *actx.Context, rollover time.Duration) (tls.Certificate, error) {
+	prevCATLSCert, err := appCtx.CATLSCert()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	prevCACert, err := crypto.ExtractCACert(prevCATLSCert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed extracting CA certificate: %w", err)
+	}
+
+	var (
+		cfg       = appCtx.Config.Server
+		timeNow   = appCtx.TimeNow()
+		san       = prevCACert.DNSNames
+		rolloverT = timeNow.Add(rollover)
+	)
+	caTLSCert, err := crypto.NewTLSCert("Sesame CA", san, timeNow, timeNow.Add(cfg.CACertExpiration.V), nil)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed generating the CA TLS certificate: %w", err)
+	}
+
+	tlsCert, err := crypto.NewServerTLSCert(
+		"Sesame server", san, timeNow, timeNow.Add(cfg.TLSCertExpiration.V), caTLSCert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed generating the server TLS certificate: %w", err)
+	}
+
+	crossCert, err := crypto.CrossSignCert(caTLSCert.Leaf, rolloverT, prevCATLSCert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	caTLSCertPEM, err := crypto.EncodeTLSCert(caTLSCert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed encoding the CA TLS certificate: %w", err)
+	}
+
+	tlsCertPEM, err := crypto.EncodeTLSCert(tlsCert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed encoding the server TLS certificate: %w", err)
+	}
+
+	err = queries.SetCATLSCert(appCtx.DB.NewContext(), appCtx.DB, caTLSCertPEM, tlsCertPEM,
+		&queries.CARollover{PrevCACert: prevCACert.Raw, CrossCert: crossCert.Raw, EndsAt: rolloverT})
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return caTLSCert, nil
+}
@@ -0,0 +1,214 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kong"
+
+	actx "go.hackfix.me/sesame/app/context"
+	aerrors "go.hackfix.me/sesame/app/errors"
+	"go.hackfix.me/sesame/crypto"
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/db/types"
+	"go.hackfix.me/sesame/xtime"
+)
+
+// The Cert command manages the server TLS certificate, and TLS client
+// certificates issued to remote users.
+type Cert struct {
+	Revoke struct {
+		//nolint:lll // Long struct tags are unavoidable.
+		Target string `arg:"" help:"The serial number of the certificate to revoke, a user name to revoke all certificates of the user, or a user name and site ID separated by '/' to revoke the certificates of the user in that site."`
+	} `cmd:"" help:"Revoke client certificates, rejecting them even if they haven't expired."`
+	List struct {
+		User string `short:"u" help:"Show certificates of a specific user."`
+		Site string `short:"s" help:"Show certificates of a specific remote site ID."`
+		//nolint:lll // Long struct tags are unavoidable.
+		Status []string `enum:"valid,expiring,expired,revoked" help:"Show certificates with a specific status. Valid values: ${enum} \n Multiple values can be specified separated by comma. Default: all"`
+	} `cmd:"" aliases:"ls" help:"List the server and client certificates."`
+}
+
+// Run the cert command.
+func (c *Cert) Run(kctx *kong.Context, appCtx *actx.Context) error {
+	switch kctx.Command() {
+	case "cert revoke <target>":
+		ccs, err := c.revokeTargets(appCtx)
+		if err != nil {
+			return aerrors.NewWithCause("failed revoking client certificates", err, "target", c.Revoke.Target)
+		}
+
+		dbCtx := appCtx.DB.NewContext()
+		timeNow := appCtx.TimeNow().UTC()
+		for _, cc := range ccs {
+			if err = cc.Revoke(dbCtx, appCtx.DB, timeNow); err != nil {
+				return aerrors.NewWithCause("failed revoking client certificate", err,
+					"serial_number", cc.SerialNumber)
+			}
+			appCtx.Logger.Info("revoked client certificate",
+				"serial_number", cc.SerialNumber, "user.name", cc.User.Name, "site_id", cc.SiteID)
+			appCtx.Audit(&models.AuditEvent{
+				Type: models.AuditEventCertRevoke,
+				Payload: map[string]any{
+					"serial_number": cc.SerialNumber, "user.name": cc.User.Name, "site_id": cc.SiteID,
+				},
+			})
+		}
+	case "cert list":
+		return c.list(appCtx)
+	}
+
+	return nil
+}
+
+func (c *Cert) list(appCtx *actx.Context) error {
+	var (
+		timeNow = appCtx.TimeNow().UTC()
+		header  = []string{
+			"User", "Site ID", "Serial", "Issued", "Expires", "Renewal Token Expires", "Status", "Last Seen",
+		}
+		data [][]string
+	)
+
+	statusFilter := make(map[models.CertStatus]bool)
+	for _, s := range c.List.Status {
+		statusFilter[models.CertStatus(s)] = true
+	}
+	showStatus := func(s models.CertStatus) bool {
+		return len(statusFilter) == 0 || statusFilter[s]
+	}
+
+	// The server certificate isn't issued for a user or site.
+	if c.List.User == "" && c.List.Site == "" {
+		row, status, err := serverCertRow(appCtx, timeNow)
+		if err != nil {
+			return aerrors.NewWithCause("failed loading the server TLS certificate", err)
+		}
+		if showStatus(status) {
+			data = append(data, row)
+		}
+	}
+
+	filter := types.NewFilter("1=1", nil)
+	if c.List.User != "" {
+		filter = filter.And(types.NewFilter(
+			"cc.user_id IN (SELECT id FROM users WHERE name = ?)", []any{c.List.User}))
+	}
+	if c.List.Site != "" {
+		filter = filter.And(types.NewFilter("cc.site_id = ?", []any{c.List.Site}))
+	}
+	ccs, err := models.ClientCertificates(appCtx.DB.NewContext(), appCtx.DB, filter)
+	if err != nil {
+		return aerrors.NewWithCause("failed querying client certificates", err)
+	}
+
+	threshold := appCtx.Config.Client.TLSCertRenewalThreshold.V
+	for _, cc := range ccs {
+		status := cc.Status(timeNow, threshold)
+		if !showStatus(status) {
+			continue
+		}
+
+		lastSeen := "-"
+		if cc.LastSeenAt.Valid {
+			lastSeen = formatTimeRel(cc.LastSeenAt.V, timeNow)
+		}
+		data = append(data, []string{
+			cc.User.Name, cc.SiteID, cc.SerialNumber,
+			cc.CreatedAt.Local().Format(time.DateTime),
+			formatTimeRel(cc.ExpiresAt, timeNow),
+			formatTimeRel(cc.RenewalTokenExpiresAt, timeNow),
+			status.Title(), lastSeen,
+		})
+	}
+
+	if len(data) > 0 {
+		if err = renderTable(header, data, appCtx.Stdout); err != nil {
+			return aerrors.NewWithCause("failed rendering table", err)
+		}
+	}
+
+	return nil
+}
+
+// serverCertRow returns the table row and status of the server TLS certificate.
+func serverCertRow(appCtx *actx.Context, timeNow time.Time) ([]string, models.CertStatus, error) {
+	tlsCert, err := appCtx.ServerTLSCert()
+	if err != nil {
+		return nil, "", err
+	}
+
+	cert, err := crypto.ExtractLeafCert(tlsCert)
+	if err != nil {
+		return nil, "", err
+	}
+
+	status := models.CertStatusAt(cert.NotBefore, cert.NotAfter, false, timeNow,
+		appCtx.Config.Server.TLSCertRenewalThreshold.V)
+
+	return []string{
+		"(server)", "-", cert.SerialNumber.Text(16),
+		cert.NotBefore.Local().Format(time.DateTime),
+		formatTimeRel(cert.NotAfter, timeNow),
+		"-", status.Title(), "-",
+	}, status, nil
+}
+
+// formatTimeRel formats t along with the duration relative to timeNow.
+func formatTimeRel(t, timeNow time.Time) string {
+	if t.After(timeNow) {
+		return fmt.Sprintf("%s (in %s)", t.Local().Format(time.DateTime),
+			xtime.FormatDuration(t.Sub(timeNow), time.Second))
+	}
+	return fmt.Sprintf("%s (%s ago)", t.Local().Format(time.DateTime),
+		xtime.FormatDuration(timeNow.Sub(t), time.Second))
+}
+
+// revokeTargets returns the client certificates identified by the revoke
+// target. A target without a '/' is first looked up as a certificate serial
+// number, and then as a user name.
+func (c *Cert) revokeTargets(appCtx *actx.Context) ([]*models.ClientCertificate, error) {
+	dbCtx := appCtx.DB.NewContext()
+	target := c.Revoke.Target
+
+	userName, siteID, hasSite := strings.Cut(target, "/")
+	if !hasSite {
+		serial := strings.ToLower(strings.ReplaceAll(target, ":", ""))
+		ccs, err := models.ClientCertificates(dbCtx, appCtx.DB,
+			types.NewFilter("cc.serial_number = ?", []any{serial}))
+		if err != nil {
+			return nil, err
+		}
+		if len(ccs) > 0 {
+			if ccs[0].IsRevoked() {
+				return nil, errors.New("client certificate is already revoked")
+			}
+			return ccs, nil
+		}
+	}
+
+	user := &models.User{Name: userName}
+	if err := user.Load(dbCtx, appCtx.DB); err != nil {
+		var errNoRes types.NoResultError
+		if !hasSite && errors.As(err, &errNoRes) {
+			return nil, fmt.Errorf("no client certificate or user found for '%s'", target)
+		}
+		return nil, err
+	}
+
+	filter := types.NewFilter("cc.user_id = ? AND cc.revoked_at IS NULL", []any{user.ID})
+	if hasSite {
+		filter = filter.And(types.NewFilter("cc.site_id = ?", []any{siteID}))
+	}
+	ccs, err := models.ClientCertificates(dbCtx, appCtx.DB, filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(ccs) == 0 {
+		return nil, fmt.Errorf("no unrevoked client certificates found for '%s'", target)
+	}
+
+	return ccs, nil
+}
@@ -14,14 +14,23 @@ import (
 
 // CLI is the command line interface of Sesame.
 type CLI struct {
-	Init    Init    `kong:"cmd,help='Create initial application artifacts.'"`
-	Invite  Invite  `kong:"cmd,help='Manage invitations for remote users.'"`
-	Open    Open    `kong:"cmd,help='Grant clients access to services.'"`
-	Close   Close   `kong:"cmd,help='Deny clients access to services.'"`
-	Remote  Remote  `kong:"cmd,help='Manage remote Sesame nodes.'"`
-	Serve   Serve   `kong:"cmd,help='Start the web server.'"`
-	Service Service `kong:"cmd,help='Manage services.'"`
-	User    User    `kong:"cmd,help='Manage remote users.'"`
+	Init     Init     `kong:"cmd,help='Create initial application artifacts.'"`
+	CA       CA       `kong:"cmd,help='Manage the certificate authority.'"`
+	Key      Key      `kong:"cmd,help='Manage encryption of private keys stored in the database.'"`
+	Invite   Invite   `kong:"cmd,help='Manage invitations for remote users.'"`
+	Open     Open     `kong:"cmd,help='Grant clients access to services.'"`
+	Close    Close    `kong:"cmd,help='Deny clients access to services.'"`
+	Block    Block    `kong:"cmd,help='Block clients from accessing services.'"`
+	Unblock  Unblock  `kong:"cmd,help='Remove blocks of clients from accessing services.'"`
+	Cert     Cert     `kong:"cmd,help='Manage TLS client certificates.'"`
+	Firewall Firewall `kong:"cmd,help='Manage the firewall state.'"`
+	Remote   Remote   `kong:"cmd,help='Manage remote Sesame nodes.'"`
+	Serve    Serve    `kong:"cmd,help='Start the web server.'"`
+	Service  Service  `kong:"cmd,help='Manage services.'"`
+	Status   Status   `kong:"cmd,help='Show clients currently allowed access to, or blocked from services.'"`
+	User     User     `kong:"cmd,help='Manage remote users.'"`
+	Audit    Audit    `kong:"cmd,help='Show the audit log.'"`
+	Ban      Ban      `kong:"cmd,help='Manage clients banned after repeated failed authentication attempts.'"`
 
 	Log struct {
 		Level slog.Level `enum:"DEBUG,INFO,WARN,ERROR" default:"INFO" help:"Set the app logging level."`
@@ -31,6 +40,7 @@ type CLI struct {
 	// independently from the CLI.
 	ConfigFile string           `kong:"default='${configFile}',help='Path to the Sesame configuration file.'"`
 	DataDir    string           `kong:"default='${dataDir}',help='Path to the directory where Sesame data is stored.'"`
+	KeyFile    string           `kong:"help='Path to a file that contains the database encryption passphrase.'"`
 	Version    kong.VersionFlag `kong:"help='Output version and exit.'"`
 
 	kong *kong.Kong
@@ -45,6 +55,7 @@ func New(appCtx *actx.Context, configFilePath, dataDir, version string) (*CLI, e
 		kong.UsageOnError(),
 		kong.DefaultEnvars("SESAME"),
 		kong.NamedMapper("expiration", &ExpirationMapper{timeNow: appCtx.TimeNow}),
+		kong.NamedMapper("time", &TimeMapper{timeNow: appCtx.TimeNow}),
 		kong.ConfigureHelp(kong.HelpOptions{
 			Compact:             true,
 			Summary:             true,
@@ -59,9 +70,10 @@ func New(appCtx *actx.Context, configFilePath, dataDir, version string) (*CLI, e
 			return value.Help
 		}),
 		kong.Vars{
-			"configFile": configFilePath,
-			"dataDir":    dataDir,
-			"version":    version,
+			"configFile":      configFilePath,
+			"dataDir":         dataDir,
+			"version":         version,
+			"auditEventTypes": auditEventTypes(),
 		},
 	)
 	if err != nil {
@@ -80,9 +92,10 @@ func (c *CLI) Execute(appCtx *actx.Context) error {
 	}
 	c.kong.Stdout = appCtx.Stdout
 	c.kong.Stderr = appCtx.Stderr
+	appCtx.DB.SetKeyFunc(encryptionKeyFunc(appCtx, c.KeyFile))
 
 	//nolint:wrapcheck // This is fine.
-	return c.kctx.Run(appCtx)
+	return c.kctx.Run(appCtx, c)
 }
 
 // Parse the given command line arguments. This method must be called before
@@ -8,7 +8,6 @@ import (
 	aerrors "go.hackfix.me/sesame/app/errors"
 	"go.hackfix.me/sesame/db/models"
 	"go.hackfix.me/sesame/firewall"
-	"go.hackfix.me/sesame/web/client"
 )
 
 // Close denies clients access to services.
@@ -17,6 +16,8 @@ type Close struct {
 	//nolint:lll // Long struct tags are unavoidable.
 	Clients []string `arg:"" optional:"" help:"Zero or more client IP addresses in plain, CIDR or range notation. \n Examples: 10.0.0.10, 192.168.1.0/24, 172.16.1.10-172.16.1.100, a3:bc00::/32 \n If no clients are specified, the service will be closed for all."`
 	Remote  string   `help:"Name of the remote Sesame node on which to grant access."`
+	//nolint:lll // Long struct tags are unavoidable.
+	KillConnections bool `help:"Terminate the established connections of the clients to the service. \n This is always done for services configured to kill connections."`
 }
 
 // Run the close command.
@@ -28,12 +29,7 @@ func (c *Close) Run(appCtx *actx.Context) error {
 	}
 
 	if c.Remote != "" { //nolint:nestif // It's fine.
-		r := &models.Remote{Name: c.Remote}
-		if err := r.Load(appCtx.DB.NewContext(), appCtx.DB); err != nil {
-			return err
-		}
-
-		tlsConfig, err := r.ClientTLSConfig()
+		rc, remote, err := remoteClient(appCtx, c.Remote)
 		if err != nil {
 			return err
 		}
@@ -41,11 +37,14 @@ func (c *Close) Run(appCtx *actx.Context) error {
 		clientCtx, cancelClientCtx := context.WithTimeout(appCtx.Ctx, 10*time.Second)
 		defer cancelClientCtx()
 
-		client := client.New(r.Address, tlsConfig, appCtx.Logger)
-		err = client.Close(clientCtx, clients, c.ServiceName)
+		err = rc.Close(clientCtx, clients, c.ServiceName, c.KillConnections)
 		if err != nil {
 			return err
 		}
+
+		if err = updateRemoteCACert(appCtx, remote, rc); err != nil {
+			return err
+		}
 	} else {
 		if !appCtx.Config.Firewall.Type.Valid {
 			return aerrors.NewWith(
@@ -71,13 +70,18 @@ func (c *Close) Run(appCtx *actx.Context) error {
 			return aerrors.NewWithCause("unknown service", err, "service.name", c.ServiceName)
 		}
 
-		err = fwMgr.DenyAccess(ipSet, svc, nil)
+		err = fwMgr.DenyAccess(ipSet, svc, nil, c.KillConnections)
 		if err != nil {
 			return aerrors.NewWithCause(
 				"failed denying access", err,
 				"service.name", c.ServiceName,
 				"firewall.type", appCtx.Config.Firewall.Type.V)
 		}
+
+		appCtx.Audit(&models.AuditEvent{
+			Type: models.AuditEventClose, ServiceName: svc.Name,
+			Payload: map[string]any{"clients": c.Clients, "kill_connections": c.KillConnections},
+		})
 	}
 
 	return nil
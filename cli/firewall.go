@@ -0,0 +1,40 @@
+package cli
+
+import (
+	"github.com/alecthomas/kong"
+
+	actx "go.hackfix.me/sesame/app/context"
+	aerrors "go.hackfix.me/sesame/app/errors"
+	"go.hackfix.me/sesame/firewall"
+)
+
+// The Firewall command manages the state of the configured firewall.
+type Firewall struct {
+	//nolint:lll // Long struct tags are unavoidable.
+	Sync struct{} `cmd:"" help:"Reconcile the firewall state with the access grants and blocks stored in the database. \n Unexpired grants and blocks missing from the firewall are restored, and entries not created by Sesame are removed."`
+}
+
+// Run the firewall command.
+func (c *Firewall) Run(kctx *kong.Context, appCtx *actx.Context) error {
+	if !appCtx.Config.Firewall.Type.Valid {
+		return aerrors.NewWith(
+			"no firewall was configured on this system", "hint", "Did you forget to run 'sesame init'?")
+	}
+
+	_, fwMgr, err := firewall.Setup(
+		appCtx, appCtx.Config.Firewall.Type.V, appCtx.Config.Firewall.DefaultAccessDuration.V, appCtx.Logger,
+	)
+	if err != nil {
+		return aerrors.NewWithCause(
+			"failed setting up firewall", err, "firewall.type", appCtx.Config.Firewall.Type.V)
+	}
+
+	if kctx.Command() == "firewall sync" {
+		if err = fwMgr.Sync(); err != nil {
+			return aerrors.NewWithCause(
+				"failed syncing firewall state", err, "firewall.type", appCtx.Config.Firewall.Type.V)
+		}
+	}
+
+	return nil
+}
@@ -10,19 +10,25 @@ import (
 	actx "go.hackfix.me/sesame/app/context"
 	aerrors "go.hackfix.me/sesame/app/errors"
 	"go.hackfix.me/sesame/crypto"
+	"go.hackfix.me/sesame/db/queries"
 	"go.hackfix.me/sesame/firewall"
 	ftypes "go.hackfix.me/sesame/firewall/types"
 )
 
 // The Init command creates initial Sesame artifacts, such as firewall rules,
-// the API server TLS key and certificate, and the Sesame database.
+// the CA and API server TLS keys and certificates, and the Sesame database.
 type Init struct {
-	FirewallType                  ftypes.FirewallType `help:"The firewall to initialize. Valid values: nftables"`
+	FirewallType                  ftypes.FirewallType `help:"The firewall to initialize. Valid values: nftables, iptables"`
 	FirewallDefaultAccessDuration time.Duration       `default:"5m" help:"The default duration to allow access if unspecified."` //nolint:lll // Long struct tags are unavoidable.
+	//nolint:lll // Long struct tags are unavoidable.
+	FirewallStrictEstablished bool `help:"Only accept packets that clients send on established connections while they're allowed access, so that their connections are cut off once their access expires."`
 }
 
 // Run the init command.
 func (c *Init) Run(appCtx *actx.Context) error {
+	cfg := appCtx.Config
+	cfg.SetDefaults()
+
 	if appCtx.VersionInit != "" {
 		appCtx.Logger.Warn("The Sesame database is already initialized, skipping", "version", appCtx.VersionInit)
 	} else {
@@ -31,11 +37,14 @@ func (c *Init) Run(appCtx *actx.Context) error {
 		}
 	}
 
-	cfg := appCtx.Config
 	if c.FirewallType != "" { //nolint:nestif // Meh, it's fine.
 		if cfg.Firewall.Type.Valid {
 			appCtx.Logger.Warn("A firewall is already initialized, skipping", "type", cfg.Firewall.Type.V)
 		} else {
+			// The firewall is set up in strict established mode from the configuration.
+			cfg.Firewall.StrictEstablished.V = c.FirewallStrictEstablished
+			cfg.Firewall.StrictEstablished.Valid = true
+
 			fw, _, err := firewall.Setup(appCtx, c.FirewallType, c.FirewallDefaultAccessDuration, appCtx.Logger)
 			if err != nil {
 				return err
@@ -52,8 +61,6 @@ func (c *Init) Run(appCtx *actx.Context) error {
 		}
 	}
 
-	cfg.SetDefaults()
-
 	if err := cfg.Save(); err != nil {
 		return aerrors.NewWithCause("failed saving configuration", err)
 	}
@@ -70,14 +77,25 @@ func initDB(appCtx *actx.Context) error {
 	rndSAN := base58.Encode(rndSANb)
 
 	timeNow := appCtx.TimeNow()
-	// TODO: Figure out certificate lifecycle management, make expiration configurable, etc.
-	tlsCert, err := crypto.NewTLSCert(
-		"Sesame server", []string{rndSAN}, timeNow, timeNow.Add(24*time.Hour), nil,
+	caTLSCert, err := crypto.NewTLSCert(
+		"Sesame CA", []string{rndSAN}, timeNow, timeNow.Add(appCtx.Config.Server.CACertExpiration.V), nil,
+	)
+	if err != nil {
+		return fmt.Errorf("failed generating the CA TLS certificate: %w", err)
+	}
+
+	tlsCert, err := crypto.NewServerTLSCert(
+		"Sesame server", []string{rndSAN}, timeNow, timeNow.Add(appCtx.Config.Server.TLSCertExpiration.V), caTLSCert,
 	)
 	if err != nil {
 		return fmt.Errorf("failed generating the server TLS certificate: %w", err)
 	}
 
+	caTLSCertPEM, err := crypto.EncodeTLSCert(caTLSCert)
+	if err != nil {
+		return fmt.Errorf("failed encoding the CA TLS certificate: %w", err)
+	}
+
 	tlsCertPEM, err := crypto.EncodeTLSCert(tlsCert)
 	if err != nil {
 		return fmt.Errorf("failed encoding the server TLS certificate: %w", err)
@@ -88,5 +106,5 @@ func initDB(appCtx *actx.Context) error {
 		return err
 	}
 
-	return nil
+	return queries.SetCATLSCert(appCtx.DB.NewContext(), appCtx.DB, caTLSCertPEM, tlsCertPEM, nil)
 }
@@ -54,6 +54,12 @@ func (c *Invite) Run(kctx *kong.Context, appCtx *actx.Context) error {
 		if err = inv.Save(dbCtx, appCtx.DB, false); err != nil {
 			return aerrors.NewWithCause("failed saving invite to the database", err)
 		}
+		appCtx.Audit(&models.AuditEvent{
+			Type: models.AuditEventInviteCreate, SiteID: inv.SiteID,
+			Payload: map[string]any{
+				"invite_id": inv.UUID, "user.name": user.Name, "expires_at": inv.ExpiresAt.UTC(),
+			},
+		})
 		token, err := inv.Token()
 		if err != nil {
 			return aerrors.NewWithCause("failed generating invitation token", err)
@@ -99,6 +105,9 @@ Expires At: %s
 			if err := inv.Delete(dbCtx, appCtx.DB); err != nil {
 				return err
 			}
+			appCtx.Audit(&models.AuditEvent{
+				Type: models.AuditEventInviteDelete, Payload: map[string]any{"invite_id": inv.UUID},
+			})
 		}
 
 	case "invite update <id>":
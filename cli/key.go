@@ -0,0 +1,182 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/alecthomas/kong"
+	"github.com/mandelsoft/vfs/pkg/vfs"
+
+	actx "go.hackfix.me/sesame/app/context"
+	aerrors "go.hackfix.me/sesame/app/errors"
+	"go.hackfix.me/sesame/crypto"
+	"go.hackfix.me/sesame/db"
+	"go.hackfix.me/sesame/db/queries"
+)
+
+const (
+	// Environment variable that contains the encryption passphrase.
+	envPassphrase = "SESAME_PASSPHRASE"
+	// Environment variable that contains the new encryption passphrase, when
+	// changing it.
+	envNewPassphrase = "SESAME_NEW_PASSPHRASE"
+	// Size of the salt used to derive the encryption key from a passphrase.
+	keySaltSize = 16
+)
+
+// The Key command manages the encryption of private keys stored in the
+// database.
+type Key struct {
+	//nolint:lll // Long struct tags are unavoidable.
+	Enable struct{} `cmd:"" help:"Encrypt private keys stored in the database. \n The passphrase is read from the file set with --key-file, the SESAME_PASSPHRASE environment variable, or is prompted for."`
+	Change struct {
+		NewKeyFile string `help:"Path to a file that contains the new passphrase."`
+	} `cmd:"" help:"Change the encryption passphrase, and re-encrypt private keys stored in the database."`
+	Disable struct{} `cmd:"" help:"Decrypt private keys stored in the database, and disable encryption."`
+}
+
+// Run the key command.
+func (c *Key) Run(kctx *kong.Context, appCtx *actx.Context, cli *CLI) error {
+	_, keyCheck, err := queries.GetEncryption(appCtx.DB.NewContext(), appCtx.DB)
+	if err != nil {
+		return aerrors.NewWithCause("failed reading encryption state", err)
+	}
+	enabled := keyCheck != nil
+
+	switch kctx.Command() {
+	case "key enable":
+		if enabled {
+			return aerrors.NewWith("encryption is already enabled",
+				"hint", "Use 'sesame key change' to change the passphrase.")
+		}
+
+		err = rekey(appCtx, cli.KeyFile, envPassphrase, "Encryption passphrase: ")
+		if err != nil {
+			return aerrors.NewWithCause("failed enabling encryption", err)
+		}
+
+		appCtx.Logger.Info("enabled encryption")
+	case "key change":
+		if !enabled {
+			return aerrors.NewWith("encryption is not enabled",
+				"hint", "Use 'sesame key enable' to enable it.")
+		}
+
+		// Verify the current passphrase before asking for the new one.
+		if err = appCtx.DB.LoadKey(); err != nil {
+			return fmt.Errorf("failed loading encryption key: %w", err)
+		}
+
+		err = rekey(appCtx, c.Change.NewKeyFile, envNewPassphrase, "New encryption passphrase: ")
+		if err != nil {
+			return aerrors.NewWithCause("failed changing encryption passphrase", err)
+		}
+
+		appCtx.Logger.Info("changed encryption passphrase")
+	case "key disable":
+		if !enabled {
+			return aerrors.NewWith("encryption is not enabled")
+		}
+
+		if err = appCtx.DB.LoadKey(); err != nil {
+			return fmt.Errorf("failed loading encryption key: %w", err)
+		}
+
+		if err = appCtx.DB.Rekey(nil, nil); err != nil {
+			return aerrors.NewWithCause("failed disabling encryption", err)
+		}
+
+		appCtx.Logger.Info("disabled encryption")
+	}
+
+	return nil
+}
+
+// rekey derives a new encryption key from a new passphrase, and re-encrypts
+// the sensitive data in the database with it. The current key, if any, is
+// retrieved with the key function set on the database.
+func rekey(appCtx *actx.Context, keyFile, envVar, prompt string) error {
+	passphrase, err := readPassphrase(appCtx, keyFile, envVar, prompt, true)
+	if err != nil {
+		return err
+	}
+
+	salt, err := crypto.RandomData(keySaltSize)
+	if err != nil {
+		return err
+	}
+
+	key, err := crypto.DeriveKeyFromPassphrase(passphrase, salt)
+	if err != nil {
+		return err
+	}
+
+	return appCtx.DB.Rekey(key, salt)
+}
+
+// encryptionKeyFunc returns the function used by the database to retrieve the
+// encryption key. The passphrase is only read if encryption is enabled, and
+// the derived key is verified against the value stored in the database.
+func encryptionKeyFunc(appCtx *actx.Context, keyFile string) db.KeyFunc {
+	return func() (*[32]byte, error) {
+		salt, keyCheck, err := queries.GetEncryption(appCtx.DB.NewContext(), appCtx.DB)
+		if err != nil {
+			return nil, err
+		}
+		if keyCheck == nil {
+			return nil, nil //nolint:nilnil // Encryption is disabled.
+		}
+
+		passphrase, err := readPassphrase(appCtx, keyFile, envPassphrase, "Encryption passphrase: ", false)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := crypto.DeriveKeyFromPassphrase(passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = db.VerifyKey(key, keyCheck); err != nil {
+			return nil, err
+		}
+
+		return key, nil
+	}
+}
+
+// readPassphrase reads the encryption passphrase from keyFile, if set, from the
+// envVar environment variable, or prompts for it. If confirm is true, the
+// prompted passphrase must be entered twice.
+func readPassphrase(appCtx *actx.Context, keyFile, envVar, prompt string, confirm bool) ([]byte, error) {
+	if keyFile != "" {
+		data, err := vfs.ReadFile(appCtx.FS, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading key file: %w", err)
+		}
+		return bytes.TrimSpace(data), nil
+	}
+
+	if passphrase := appCtx.Env.Get(envVar); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	passphrase, err := promptSecret(appCtx, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	if confirm {
+		var passphraseConf []byte
+		passphraseConf, err = promptSecret(appCtx, "Confirm passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, passphraseConf) {
+			return nil, errors.New("passphrases don't match")
+		}
+	}
+
+	return passphrase, nil
+}
@@ -2,40 +2,63 @@ package cli
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
+	"net/netip"
 	"time"
 
+	"go4.org/netipx"
+
 	actx "go.hackfix.me/sesame/app/context"
 	aerrors "go.hackfix.me/sesame/app/errors"
 	"go.hackfix.me/sesame/db/models"
 	"go.hackfix.me/sesame/firewall"
 	"go.hackfix.me/sesame/web/client"
+	stypes "go.hackfix.me/sesame/web/server/types"
 )
 
 // Open grants clients access to services.
 type Open struct {
 	ServiceName string `arg:"" required:"" help:"The name of the service."`
 	//nolint:lll // Long struct tags are unavoidable.
-	Clients  []string      `arg:"" required:"" help:"One or more client IP addresses in plain, CIDR or range notation. \n Examples: 10.0.0.10, 192.168.1.0/24, 172.16.1.10-172.16.1.100, a3:bc00::/32"`
+	Clients  []string      `arg:"" optional:"" help:"One or more client IP addresses in plain, CIDR or range notation. \n Examples: 10.0.0.10, 192.168.1.0/24, 172.16.1.10-172.16.1.100, a3:bc00::/32"`
 	Duration time.Duration `short:"d" help:"Duration of the access."`
 	Remote   string        `help:"Name of the remote Sesame node on which to grant access."`
+	//nolint:lll // Long struct tags are unavoidable.
+	Self bool `help:"Grant access to the address the remote Sesame node observes requests of this node from, instead of specifying clients. Requires --remote."`
 }
 
-// Run the open command.
-func (c *Open) Run(appCtx *actx.Context) error {
-	ipSet, err := firewall.ParseToIPSet(c.Clients...)
-	if err != nil {
-		return err
+// Validate checks that either clients or --self were specified.
+func (c *Open) Validate() error {
+	switch {
+	case c.Self && len(c.Clients) > 0:
+		return errors.New("clients can't be specified together with --self")
+	case c.Self && c.Remote == "":
+		return errors.New("--self requires --remote")
+	case !c.Self && len(c.Clients) == 0:
+		return errors.New("one or more clients, or --self, must be specified")
 	}
 
-	if c.Remote != "" { //nolint:nestif // It's fine.
-		r := &models.Remote{Name: c.Remote}
-		if err = r.Load(appCtx.DB.NewContext(), appCtx.DB); err != nil {
+	return nil
+}
+
+// Run the open command.
+func (c *Open) Run(appCtx *actx.Context) error {
+	var (
+		ipSet *netipx.IPSet
+		err   error
+	)
+	if !c.Self {
+		if ipSet, err = firewall.ParseToIPSet(c.Clients...); err != nil {
 			return err
 		}
+	}
 
-		var tlsConfig *tls.Config
-		tlsConfig, err = r.ClientTLSConfig()
+	if c.Remote != "" { //nolint:nestif // It's fine.
+		var (
+			rc     *client.Client
+			remote *models.Remote
+		)
+		rc, remote, err = remoteClient(appCtx, c.Remote)
 		if err != nil {
 			return err
 		}
@@ -43,11 +66,25 @@ func (c *Open) Run(appCtx *actx.Context) error {
 		clientCtx, cancelClientCtx := context.WithTimeout(appCtx.Ctx, 10*time.Second)
 		defer cancelClientCtx()
 
-		client := client.New(r.Address, tlsConfig, appCtx.Logger)
-		err = client.Open(clientCtx, c.Clients, c.ServiceName, c.Duration)
+		clients := c.Clients
+		if c.Self {
+			var whoami stypes.WhoamiResponseData
+			if whoami, err = rc.Whoami(clientCtx); err != nil {
+				return err
+			}
+			clients = []string{whoami.SourceAddress.String()}
+			appCtx.Logger.Info("granting access to the address observed by the remote",
+				"remote.name", c.Remote, "address", clients[0])
+		}
+
+		err = rc.Open(clientCtx, clients, c.ServiceName, c.Duration)
 		if err != nil {
 			return err
 		}
+
+		if err = updateRemoteCACert(appCtx, remote, rc); err != nil {
+			return err
+		}
 	} else {
 		if !appCtx.Config.Firewall.Type.Valid {
 			return aerrors.NewWith(
@@ -68,13 +105,18 @@ func (c *Open) Run(appCtx *actx.Context) error {
 			return aerrors.NewWithCause("unknown service", err, "service.name", c.ServiceName)
 		}
 
-		err = fwMgr.GrantAccess(ipSet, svc, c.Duration, nil)
+		err = fwMgr.GrantAccess(ipSet, svc, c.Duration, nil, netip.Addr{})
 		if err != nil {
 			return aerrors.NewWithCause(
 				"failed granting access", err,
 				"service.name", c.ServiceName,
 				"firewall.type", appCtx.Config.Firewall.Type.V)
 		}
+
+		appCtx.Audit(&models.AuditEvent{
+			Type: models.AuditEventOpen, ServiceName: svc.Name,
+			Payload: map[string]any{"clients": c.Clients, "duration": c.Duration.String()},
+		})
 	}
 
 	return nil
@@ -45,3 +45,34 @@ func (em ExpirationMapper) Decode(kctx *kong.DecodeContext, target reflect.Value
 
 	return nil
 }
+
+// TimeMapper parses a point in time, either as a time duration before now, or
+// as a timestamp.
+type TimeMapper struct {
+	timeNow func() time.Time
+}
+
+var _ kong.Mapper = (*TimeMapper)(nil)
+
+// Decode implements the kong.Mapper interface.
+func (tm TimeMapper) Decode(kctx *kong.DecodeContext, target reflect.Value) error {
+	var value string
+	err := kctx.Scan.PopValueInto("time", &value)
+	if err != nil {
+		return err //nolint:wrapcheck // It's fine, this is used internally by kong.
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		var dur time.Duration
+		dur, err = xtime.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		t = tm.timeNow().UTC().Add(-dur)
+	}
+
+	target.Set(reflect.ValueOf(t))
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/term"
+
+	actx "go.hackfix.me/sesame/app/context"
+)
+
+// promptSecret writes prompt to stderr, and reads a single line from stdin.
+// If stdin is a terminal, the input isn't echoed while reading.
+func promptSecret(appCtx *actx.Context, prompt string) ([]byte, error) {
+	if appCtx.Stdin == nil {
+		return nil, errors.New("no input available to read the secret from")
+	}
+
+	if _, err := fmt.Fprint(appCtx.Stderr, prompt); err != nil {
+		return nil, fmt.Errorf("failed writing prompt: %w", err)
+	}
+
+	if f, ok := appCtx.Stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) { //nolint:gosec // File descriptors fit in an int.
+		secret, err := term.ReadPassword(int(f.Fd())) //nolint:gosec // Same as above.
+		// The newline typed by the user isn't echoed.
+		_, _ = fmt.Fprintln(appCtx.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading input: %w", err)
+		}
+		return secret, nil
+	}
+
+	return readLine(appCtx.Stdin)
+}
+
+// readLine reads from r until a newline or EOF, one byte at a time, so that no
+// input after the newline is consumed.
+func readLine(r io.Reader) ([]byte, error) {
+	var (
+		line []byte
+		buf  [1]byte
+	)
+	for {
+		n, err := r.Read(buf[:])
+		if n > 0 {
+			if buf[0] == '\n' {
+				break
+			}
+			line = append(line, buf[0])
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed reading input: %w", err)
+		}
+	}
+
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
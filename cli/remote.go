@@ -8,6 +8,7 @@ import (
 
 	actx "go.hackfix.me/sesame/app/context"
 	aerrors "go.hackfix.me/sesame/app/errors"
+	"go.hackfix.me/sesame/crypto"
 	"go.hackfix.me/sesame/db/models"
 	"go.hackfix.me/sesame/web/client"
 )
@@ -30,6 +31,9 @@ type Remote struct {
 		//nolint:lll // Long struct tags are unavoidable.
 		Address string `help:"The remote address in 'host[:port]' format, where 'host' can be a DNS hostname or an IP address."`
 	} `cmd:"" help:"Update a remote node."`
+	Renew struct {
+		Name string `arg:"" help:"The unique name of the remote."`
+	} `cmd:"" help:"Renew the TLS client certificate used to authenticate with a remote node."`
 }
 
 // Run the remote command.
@@ -51,6 +55,8 @@ func (r *Remote) Run(kctx *kong.Context, appCtx *actx.Context) error {
 		remote := models.NewRemote(
 			r.Add.Name, r.Add.Address, response.TLSCACert, response.TLSClientCert,
 		)
+		remote.RenewalToken = response.RenewalToken
+		remote.RenewalTokenExpiresAt = response.RenewalTokenExpiresAt
 		if err = remote.Save(dbCtx, appCtx.DB, false); err != nil {
 			return aerrors.NewWithCause("failed saving remote to the database", err)
 		}
@@ -60,13 +66,18 @@ func (r *Remote) Run(kctx *kong.Context, appCtx *actx.Context) error {
 			return aerrors.NewWithCause("failed listing remotes", err)
 		}
 
+		timeNow := appCtx.TimeNow().UTC()
 		data := make([][]string, len(remotes))
 		for i, r := range remotes {
-			data[i] = []string{r.Name, r.Address}
+			expires := "-"
+			if leaf, lerr := crypto.ExtractLeafCert(*r.TLSClientCert); lerr == nil {
+				expires = formatTimeRel(leaf.NotAfter, timeNow)
+			}
+			data[i] = []string{r.Name, r.Address, expires}
 		}
 
 		if len(data) > 0 {
-			header := []string{"Name", "Address"}
+			header := []string{"Name", "Address", "Certificate Expires"}
 			err = renderTable(header, data, appCtx.Stdout)
 			if err != nil {
 				return aerrors.NewWithCause("failed rendering table", err)
@@ -91,7 +102,146 @@ func (r *Remote) Run(kctx *kong.Context, appCtx *actx.Context) error {
 		if err := remote.Save(dbCtx, appCtx.DB, true); err != nil {
 			return aerrors.NewWithCause("failed saving remote to the database", err)
 		}
+	case "remote renew <name>":
+		remote := &models.Remote{Name: r.Renew.Name}
+		if err := remote.Load(dbCtx, appCtx.DB); err != nil {
+			return aerrors.NewWithCause("failed loading remote", err, "name", r.Renew.Name)
+		}
+		if err := renewRemote(appCtx, remote); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remoteClient returns a client for the remote with the given name. The TLS
+// client certificate of the remote is renewed if it's due for renewal before
+// the client is created. After a successful request, updateRemoteCACert should
+// be called with the returned remote, to store a rotated CA certificate.
+func remoteClient(appCtx *actx.Context, name string) (*client.Client, *models.Remote, error) {
+	remote := &models.Remote{Name: name}
+	if err := remote.Load(appCtx.DB.NewContext(), appCtx.DB); err != nil {
+		return nil, nil, err
+	}
+
+	if err := renewRemoteIfDue(appCtx, remote); err != nil {
+		return nil, nil, err
 	}
 
+	tlsConfig, err := remote.ClientTLSConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client.New(remote.Address, tlsConfig, appCtx.Logger), remote, nil
+}
+
+// updateRemoteCACert stores the CA certificate advertised by the remote, if it
+// differs from the one currently trusted, which happens after the CA of the
+// remote is rotated. Since the advertised certificate was received over a
+// connection to the verified server, it can be trusted.
+func updateRemoteCACert(appCtx *actx.Context, remote *models.Remote, rc *client.Client) error {
+	caCert := rc.CACert()
+	if caCert == nil || caCert.Equal(remote.TLSCACert) {
+		return nil
+	}
+
+	remote.TLSCACert = caCert
+	if err := remote.Save(appCtx.DB.NewContext(), appCtx.DB, true); err != nil {
+		return aerrors.NewWithCause("failed saving remote to the database", err)
+	}
+
+	appCtx.Logger.Info("updated TLS CA certificate",
+		"remote.name", remote.Name, "serial_number", caCert.SerialNumber.Text(16), "expires_at", caCert.NotAfter)
+
+	return nil
+}
+
+// renewRemoteIfDue renews the TLS client certificate of the remote if it's past
+// the configured renewal threshold, or has expired. If renewal of a certificate
+// that hasn't expired yet fails, the failure is logged, and the current
+// certificate is kept. It also warns if the renewal token is close to expiry,
+// after which the certificate can't be renewed once it expires.
+func renewRemoteIfDue(appCtx *actx.Context, remote *models.Remote) error {
+	leaf, err := crypto.ExtractLeafCert(*remote.TLSClientCert)
+	if err != nil {
+		return aerrors.NewWithCause("failed reading the TLS client certificate", err, "remote.name", remote.Name)
+	}
+
+	var (
+		timeNow   = appCtx.TimeNow()
+		threshold = appCtx.Config.Client.TLSCertRenewalThreshold.V
+		status    = models.CertStatusAt(leaf.NotBefore, leaf.NotAfter, false, timeNow, threshold)
+	)
+	if status == models.CertStatusValid {
+		return nil
+	}
+
+	// The renewal token should be used before it expires, so warn if it expires
+	// within the renewal period of the certificate.
+	renewalPeriod := time.Duration(float64(leaf.NotAfter.Sub(leaf.NotBefore)) * (1 - threshold))
+	if tokenExp := remote.RenewalTokenExpiresAt; !tokenExp.IsZero() && tokenExp.Sub(timeNow) < renewalPeriod {
+		appCtx.Logger.Warn("the renewal token is close to expiry; once it expires, a new invitation will be required",
+			"remote.name", remote.Name, "expires_at", tokenExp)
+	}
+
+	appCtx.Logger.Debug("renewing TLS client certificate",
+		"remote.name", remote.Name, "status", status, "expires_at", leaf.NotAfter)
+	if err = renewRemote(appCtx, remote); err != nil {
+		if status == models.CertStatusExpired {
+			return err
+		}
+		appCtx.Logger.Warn("failed renewing TLS client certificate", "remote.name", remote.Name, "error", err)
+	}
+
+	return nil
+}
+
+// renewRemote renews the TLS client certificate of the remote, and stores the
+// renewed certificate and renewal token. If the certificate has expired, the
+// renewal token is used for authentication instead.
+func renewRemote(appCtx *actx.Context, remote *models.Remote) error {
+	tlsConfig, err := remote.ClientTLSConfig()
+	if err != nil {
+		return err
+	}
+
+	leaf, err := crypto.ExtractLeafCert(*remote.TLSClientCert)
+	if err != nil {
+		return aerrors.NewWithCause("failed reading the TLS client certificate", err, "remote.name", remote.Name)
+	}
+
+	var renewalToken []byte
+	if !appCtx.TimeNow().Before(leaf.NotAfter) {
+		if len(remote.RenewalToken) == 0 {
+			return aerrors.NewWith("the TLS client certificate has expired, and no renewal token is available",
+				"remote.name", remote.Name, "hint", "Ask for a new invitation token, and add the remote again.")
+		}
+		// The expired certificate would be rejected during the TLS handshake.
+		tlsConfig.Certificates = nil
+		renewalToken = remote.RenewalToken
+	}
+
+	clientCtx, cancelClientCtx := context.WithTimeout(appCtx.Ctx, 10*time.Second)
+	defer cancelClientCtx()
+
+	c := client.New(remote.Address, tlsConfig, appCtx.Logger)
+	response, err := c.Renew(clientCtx, *remote.TLSClientCert, renewalToken)
+	if err != nil {
+		return err
+	}
+
+	remote.TLSCACert = response.TLSCACert
+	remote.TLSClientCert = response.TLSClientCert
+	remote.RenewalToken = response.RenewalToken
+	remote.RenewalTokenExpiresAt = response.RenewalTokenExpiresAt
+	if err = remote.Save(appCtx.DB.NewContext(), appCtx.DB, true); err != nil {
+		return aerrors.NewWithCause("failed saving remote to the database", err)
+	}
+
+	appCtx.Logger.Info("renewed TLS client certificate",
+		"remote.name", remote.Name, "expires_at", response.TLSClientCert.Leaf.NotAfter)
+
 	return nil
 }
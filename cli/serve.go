@@ -9,17 +9,26 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	actx "go.hackfix.me/sesame/app/context"
 	"go.hackfix.me/sesame/web/server"
 	stypes "go.hackfix.me/sesame/web/server/types"
 )
 
+// tlsCertCheckInterval is how often the server TLS certificate is checked for
+// renewal while serving.
+const tlsCertCheckInterval = time.Hour
+
 // Serve starts the web server.
 type Serve struct {
 	Address string `arg:"" help:"[host]:port to listen on"`
 	//nolint:lll // Long struct tags are unavoidable.
 	ErrorLevel stypes.ErrorLevel `default:"none" enum:"none,minimal,full" help:"Detail level of error messages returned to clients from untrusted HTTP endpoints (e.g. /join), in order to avoid leaking sensitive information. This doesn't affect response status codes. Valid values: ${enum} \n none: hide all error messages; minimal: sanitize error messages; full: keep error messages intact"`
+	//nolint:lll // Long struct tags are unavoidable.
+	MetricsAddress string `help:"[host]:port to serve Prometheus metrics on over HTTP, without authentication. If unset, metrics are only served on the main address to clients authenticated with a TLS certificate."`
+	//nolint:lll // Long struct tags are unavoidable.
+	TrustedProxies cidrsField `help:"Comma-separated list of IP addresses in plain or CIDR notation of trusted proxies. Connections from these addresses may start with a PROXY protocol v1 or v2 header, and the client address it contains is used instead of the proxy address. \n Example: 10.0.0.1,fd00::/64"`
 }
 
 // Run the serve command.
@@ -33,6 +42,13 @@ func (c *Serve) Run(appCtx *actx.Context) error {
 	if err != nil {
 		return err
 	}
+	srv.MetricsAddr = c.MetricsAddress
+	srv.TrustedProxies = c.TrustedProxies.Prefixes()
+
+	// Renew the server TLS certificate in the background while serving.
+	rotateCtx, cancelRotate := context.WithCancel(appCtx.Ctx)
+	defer cancelRotate()
+	go srv.RotateTLSCert(rotateCtx, tlsCertCheckInterval)
 
 	// Gracefully shutdown the server if a process signal is received, or the
 	// main context is done.
@@ -59,7 +75,10 @@ func (c *Serve) Run(appCtx *actx.Context) error {
 		return nil
 	}
 
-	if err = srv.Shutdown(appCtx.Ctx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+	// If the app context is done, Shutdown returns without waiting for active
+	// connections to finish, which is expected.
+	if err = srv.Shutdown(appCtx.Ctx); err != nil &&
+		!errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
 		return fmt.Errorf("failed shutting down web server: %w", err)
 	}
 
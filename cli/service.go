@@ -1,7 +1,6 @@
 package cli
 
 import (
-	"errors"
 	"strconv"
 	"time"
 
@@ -10,56 +9,101 @@ import (
 	actx "go.hackfix.me/sesame/app/context"
 	aerrors "go.hackfix.me/sesame/app/errors"
 	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/firewall"
+	ftypes "go.hackfix.me/sesame/firewall/types"
 	"go.hackfix.me/sesame/xtime"
 )
 
 // Service manages the services clients are allowed to access.
 type Service struct {
+	//nolint:lll // Long struct tags are unavoidable.
 	Add struct {
-		Name              string        `arg:"" help:"Service name."`
-		Port              portField     `arg:"" help:"Service port."`
-		MaxAccessDuration time.Duration `default:"1h" help:"The maximum access duration per client."`
+		Name              string          `arg:"" help:"Service name."`
+		Ports             portsField      `arg:"" help:"Comma-separated list of service ports and port ranges. \n Example: 22,60000-61000"`
+		Protocol          ftypes.Protocol `default:"tcp" enum:"tcp,udp,both" help:"Service protocol. Valid values: ${enum}"`
+		MaxAccessDuration time.Duration   `default:"1h" help:"The maximum access duration per client."`
+		KillConnections   bool            `help:"Terminate the established connections of clients when their access is denied."`
 	} `cmd:"" help:"Add a new service."`
 	Remove struct {
 		Name string `arg:"" help:"Service name."`
 	} `cmd:"" aliases:"rm" help:"Remove a service."`
+	//nolint:lll // Long struct tags are unavoidable.
 	Update struct {
-		Name              string        `arg:"" help:"Service name."`
-		Port              portField     `arg:"" help:"Service port."`
-		MaxAccessDuration time.Duration `required:"" help:"The maximum access duration per client."`
+		Name              string           `arg:"" help:"Service name."`
+		Ports             portsField       `arg:"" help:"Comma-separated list of service ports and port ranges. \n Example: 22,60000-61000"`
+		Protocol          *ftypes.Protocol `enum:"tcp,udp,both" help:"Service protocol. The current protocol is kept if not set. Valid values: ${enum}"`
+		MaxAccessDuration time.Duration    `required:"" help:"The maximum access duration per client."`
+		ClampGrants       bool             `help:"Shorten the active access to the service that exceeds the new maximum access duration."`
+		KillConnections   *bool            `negatable:"" help:"Terminate the established connections of clients when their access is denied. The current setting is kept if not set."`
 	} `cmd:"" help:"Update a service."`
 	List struct{} `cmd:"" aliases:"ls" help:"List all services."`
 }
 
-// Run the service command.
+// Run the service command. Removing or updating a service also updates the
+// access granted to it, if a firewall was configured.
 func (c *Service) Run(kctx *kong.Context, appCtx *actx.Context) error {
-	// TODO: Update firewall rules.
 	dbCtx := appCtx.DB.NewContext()
 
 	switch kctx.Command() {
-	case "service add <name> <port>":
+	case "service add <name> <ports>":
 		svc := &models.Service{
 			Name:              c.Add.Name,
-			Port:              uint16(c.Add.Port),
+			Ports:             c.Add.Ports.PortRanges(),
+			Protocol:          c.Add.Protocol,
 			MaxAccessDuration: c.Add.MaxAccessDuration,
+			KillConnections:   c.Add.KillConnections,
 		}
 		if err := svc.Save(dbCtx, appCtx.DB, false); err != nil {
 			return aerrors.NewWithCause("failed adding service", err)
 		}
+		appCtx.Audit(&models.AuditEvent{
+			Type: models.AuditEventServiceAdd, ServiceName: svc.Name, Payload: serviceAuditPayload(svc),
+		})
 	case "service remove <name>":
+		fwMgr, err := serviceFirewallManager(appCtx)
+		if err != nil {
+			return err
+		}
+
 		svc := &models.Service{Name: c.Remove.Name}
-		if err := svc.Delete(dbCtx, appCtx.DB); err != nil {
+		if fwMgr != nil {
+			err = fwMgr.RemoveService(svc)
+		} else {
+			err = svc.Delete(dbCtx, appCtx.DB)
+		}
+		if err != nil {
 			return aerrors.NewWithCause("failed removing service", err)
 		}
-	case "service update <name> <port>":
-		svc := &models.Service{
-			Name:              c.Update.Name,
-			Port:              uint16(c.Update.Port),
-			MaxAccessDuration: c.Update.MaxAccessDuration,
+		appCtx.Audit(&models.AuditEvent{Type: models.AuditEventServiceRemove, ServiceName: svc.Name})
+	case "service update <name> <ports>":
+		svc := &models.Service{Name: c.Update.Name}
+		if err := svc.Load(dbCtx, appCtx.DB); err != nil {
+			return aerrors.NewWithCause("failed loading service", err)
+		}
+		svc.Ports = c.Update.Ports.PortRanges()
+		svc.MaxAccessDuration = c.Update.MaxAccessDuration
+		if c.Update.Protocol != nil {
+			svc.Protocol = *c.Update.Protocol
 		}
-		if err := svc.Save(dbCtx, appCtx.DB, true); err != nil {
+		if c.Update.KillConnections != nil {
+			svc.KillConnections = *c.Update.KillConnections
+		}
+
+		fwMgr, err := serviceFirewallManager(appCtx)
+		if err != nil {
+			return err
+		}
+		if fwMgr != nil {
+			err = fwMgr.UpdateService(svc, c.Update.ClampGrants)
+		} else {
+			err = svc.Save(dbCtx, appCtx.DB, true)
+		}
+		if err != nil {
 			return aerrors.NewWithCause("failed updating service", err)
 		}
+		appCtx.Audit(&models.AuditEvent{
+			Type: models.AuditEventServiceUpdate, ServiceName: svc.Name, Payload: serviceAuditPayload(svc),
+		})
 	case "service list":
 		services, err := models.Services(dbCtx, appCtx.DB, nil)
 		if err != nil {
@@ -68,11 +112,17 @@ func (c *Service) Run(kctx *kong.Context, appCtx *actx.Context) error {
 
 		data := make([][]string, len(services))
 		for i, svc := range services {
-			data[i] = []string{svc.Name, strconv.Itoa(int(svc.Port)), xtime.FormatDuration(svc.MaxAccessDuration, time.Second)}
+			data[i] = []string{
+				svc.Name,
+				svc.Ports.String(),
+				string(svc.Protocol),
+				xtime.FormatDuration(svc.MaxAccessDuration, time.Second),
+				strconv.FormatBool(svc.KillConnections),
+			}
 		}
 
 		if len(data) > 0 {
-			header := []string{"Name", "Port", "Max Access Duration"}
+			header := []string{"Name", "Ports", "Protocol", "Max Access Duration", "Kill Connections"}
 			err = renderTable(header, data, appCtx.Stdout)
 			if err != nil {
 				return aerrors.NewWithCause("failed rendering table", err)
@@ -83,11 +133,46 @@ func (c *Service) Run(kctx *kong.Context, appCtx *actx.Context) error {
 	return nil
 }
 
-type portField uint16
+// serviceAuditPayload returns the service settings recorded in audit events.
+func serviceAuditPayload(svc *models.Service) map[string]any {
+	return map[string]any{
+		"service.ports":               svc.Ports.String(),
+		"service.protocol":            svc.Protocol,
+		"service.max_access_duration": svc.MaxAccessDuration.String(),
+		"service.kill_connections":    svc.KillConnections,
+	}
+}
+
+// serviceFirewallManager returns the firewall manager used to apply service
+// changes to the access granted to them. It returns nil if no firewall was
+// configured, in which case no access could have been granted.
+func serviceFirewallManager(appCtx *actx.Context) (*firewall.Manager, error) {
+	if !appCtx.Config.Firewall.Type.Valid {
+		return nil, nil //nolint:nilnil // A missing manager is not an error.
+	}
 
-func (p portField) Validate() error {
-	if p == 0 {
-		return errors.New("must be greater than 0")
+	_, fwMgr, err := firewall.Setup(
+		appCtx, appCtx.Config.Firewall.Type.V, appCtx.Config.Firewall.DefaultAccessDuration.V, appCtx.Logger,
+	)
+	if err != nil {
+		return nil, aerrors.NewWithCause(
+			"failed setting up firewall", err, "firewall.type", appCtx.Config.Firewall.Type.V)
 	}
-	return nil
+
+	return fwMgr, nil
+}
+
+// portsField is a comma-separated list of ports and port ranges.
+type portsField string
+
+func (p portsField) Validate() error {
+	_, err := ftypes.ParsePortRanges(string(p))
+	return err
+}
+
+// PortRanges returns the parsed port ranges. It assumes that the value was
+// previously validated.
+func (p portsField) PortRanges() ftypes.PortRanges {
+	prs, _ := ftypes.ParsePortRanges(string(p))
+	return prs
 }
@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"go4.org/netipx"
+
+	actx "go.hackfix.me/sesame/app/context"
+	aerrors "go.hackfix.me/sesame/app/errors"
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/firewall"
+	ftypes "go.hackfix.me/sesame/firewall/types"
+	"go.hackfix.me/sesame/xtime"
+)
+
+// The Status command lists the clients that are currently allowed access to
+// services, or blocked from accessing them.
+type Status struct {
+	Blocked bool `help:"Show clients currently blocked from accessing services instead."`
+}
+
+// Run the status command.
+func (c *Status) Run(appCtx *actx.Context) error {
+	if !appCtx.Config.Firewall.Type.Valid {
+		return aerrors.NewWith(
+			"no firewall was configured on this system", "hint", "Did you forget to run 'sesame init'?")
+	}
+
+	fw, _, err := firewall.Setup(
+		appCtx, appCtx.Config.Firewall.Type.V, appCtx.Config.Firewall.DefaultAccessDuration.V, appCtx.Logger,
+	)
+	if err != nil {
+		return aerrors.NewWithCause(
+			"failed setting up firewall", err, "firewall.type", appCtx.Config.Firewall.Type.V)
+	}
+
+	list := fw.Elements
+	if c.Blocked {
+		list = fw.Blocks
+	}
+	elements, err := list()
+	if err != nil {
+		return aerrors.NewWithCause(
+			"failed listing firewall elements", err, "firewall.type", appCtx.Config.Firewall.Type.V)
+	}
+
+	services, err := models.Services(appCtx.DB.NewContext(), appCtx.DB, nil)
+	if err != nil {
+		return aerrors.NewWithCause("failed querying services", err)
+	}
+
+	// Services are sorted by name, so multiple services on the same ports will
+	// also be listed in order.
+	type svcKey struct {
+		proto ftypes.Protocol
+		ports ftypes.PortRange
+	}
+	svcNames := make(map[svcKey][]string)
+	for _, svc := range services {
+		for _, proto := range svc.Protocol.Expand() {
+			for _, pr := range svc.Ports {
+				key := svcKey{proto, pr}
+				svcNames[key] = append(svcNames[key], svc.Name)
+			}
+		}
+	}
+
+	data := make([][]string, len(elements))
+	for i, el := range elements {
+		svcName := "-"
+		if names, ok := svcNames[svcKey{el.Protocol, el.DestPorts}]; ok {
+			svcName = strings.Join(names, ",")
+		}
+		// Blocks without a timeout never expire.
+		expires := "never"
+		if !c.Blocked || el.Expires > 0 {
+			expires = xtime.FormatDuration(el.Expires, time.Second)
+		}
+		data[i] = []string{
+			svcName,
+			fmt.Sprintf("%s/%s", el.DestPorts, el.Protocol),
+			formatIPRange(el.IPRange),
+			expires,
+		}
+	}
+
+	// Sort by service name, keeping the firewall order of clients.
+	slices.SortStableFunc(data, func(a, b []string) int {
+		return cmp.Compare(a[0], b[0])
+	})
+
+	if len(data) > 0 {
+		header := []string{"Service", "Port", "Client", "Expires In"}
+		err = renderTable(header, data, appCtx.Stdout)
+		if err != nil {
+			return aerrors.NewWithCause("failed rendering table", err)
+		}
+	}
+
+	return nil
+}
+
+// formatIPRange returns the shortest representation of the IP range: a single
+// address, a CIDR prefix, or the full range.
+func formatIPRange(ipRange netipx.IPRange) string {
+	if ipRange.From() == ipRange.To() {
+		return ipRange.From().String()
+	}
+	if prefix, ok := ipRange.Prefix(); ok {
+		return prefix.String()
+	}
+	return ipRange.String()
+}
@@ -2,6 +2,7 @@ package cli
 
 import (
 	"io"
+	"strings"
 
 	"github.com/olekukonko/tablewriter"
 	"github.com/olekukonko/tablewriter/renderer"
@@ -31,8 +32,11 @@ func renderTable(header []string, data [][]string, w io.Writer) error {
 			},
 		)),
 		tablewriter.WithConfig(tablewriter.Config{
+			// Auto formatting splits headers on case changes (e.g. "CIDRs"
+			// becomes "CID RS"), so headers are only uppercased.
 			Header: tw.CellConfig{
-				Alignment: tw.CellAlignment{Global: tw.AlignLeft},
+				Formatting: tw.CellFormatting{AutoFormat: tw.Off},
+				Alignment:  tw.CellAlignment{Global: tw.AlignLeft},
 			},
 			Row: tw.CellConfig{
 				Formatting:   tw.CellFormatting{AutoWrap: tw.WrapNone},
@@ -42,7 +46,11 @@ func renderTable(header []string, data [][]string, w io.Writer) error {
 		}),
 	)
 
-	table.Header(header)
+	upperHeader := make([]string, len(header))
+	for i, h := range header {
+		upperHeader[i] = strings.ToUpper(h)
+	}
+	table.Header(upperHeader)
 	err := table.Bulk(data)
 	if err != nil {
 		return err //nolint:wrapcheck // This is wrapped by the caller.
@@ -1,11 +1,17 @@
 package cli
 
 import (
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/alecthomas/kong"
 
 	actx "go.hackfix.me/sesame/app/context"
 	aerrors "go.hackfix.me/sesame/app/errors"
 	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/xtime"
 )
 
 // The User command manages remote Sesame users.
@@ -16,7 +22,21 @@ type User struct {
 	Remove struct {
 		Name string `arg:"" help:"The unique name of the user."`
 	} `cmd:"" aliases:"rm" help:"Remove a user."`
-	List struct{} `cmd:"" aliases:"ls" help:"List users."`
+	//nolint:lll // Long struct tags are unavoidable.
+	Update struct {
+		Name              string         `arg:"" help:"The unique name of the user."`
+		MaxAccessDuration *time.Duration `help:"The maximum access duration the user can grant. If 0, only the service maximum applies."`
+		AllowedCIDRs      *cidrsField    `name:"allowed-cidrs" help:"Comma-separated list of IP addresses in plain or CIDR notation the user can grant access to. If empty, any address is allowed. \n Example: 10.0.0.0/8,2001:db8::/32"`
+		SelfOnly          *bool          `negatable:"" help:"Only allow the user to grant access to the address their request originates from."`
+	} `cmd:"" help:"Update the access policy of a user."`
+	List   struct{}       `cmd:"" aliases:"ls" help:"List users."`
+	Grant  userPermission `cmd:"" help:"Allow a user to manage access to a service."`
+	Revoke userPermission `cmd:"" help:"Disallow a user from managing access to a service."`
+}
+
+type userPermission struct {
+	User    string `arg:"" help:"The unique name of the user."`
+	Service string `arg:"" help:"The unique name of the service."`
 }
 
 // Run the user command.
@@ -29,30 +49,150 @@ func (c *User) Run(kctx *kong.Context, appCtx *actx.Context) error {
 		if err := user.Save(dbCtx, appCtx.DB, false); err != nil {
 			return aerrors.NewWithCause("failed adding user", err)
 		}
+		appCtx.Audit(&models.AuditEvent{
+			Type: models.AuditEventUserAdd, Payload: map[string]any{"user.name": user.Name},
+		})
 	case "user remove <name>":
 		user := &models.User{Name: c.Remove.Name}
 		if err := user.Delete(dbCtx, appCtx.DB); err != nil {
 			return aerrors.NewWithCause("failed removing user", err)
 		}
+		appCtx.Audit(&models.AuditEvent{
+			Type: models.AuditEventUserRemove, Payload: map[string]any{"user.name": user.Name},
+		})
+	case "user update <name>":
+		user := &models.User{Name: c.Update.Name}
+		if err := user.Load(dbCtx, appCtx.DB); err != nil {
+			return aerrors.NewWithCause("failed loading user", err)
+		}
+		if c.Update.MaxAccessDuration != nil {
+			user.MaxAccessDuration = *c.Update.MaxAccessDuration
+		}
+		if c.Update.AllowedCIDRs != nil {
+			user.AllowedCIDRs = c.Update.AllowedCIDRs.Prefixes()
+		}
+		if c.Update.SelfOnly != nil {
+			user.SelfOnly = *c.Update.SelfOnly
+		}
+		if err := user.Save(dbCtx, appCtx.DB, true); err != nil {
+			return aerrors.NewWithCause("failed updating user", err)
+		}
+		appCtx.Audit(&models.AuditEvent{
+			Type: models.AuditEventUserUpdate,
+			Payload: map[string]any{
+				"user.name":                user.Name,
+				"user.max_access_duration": user.MaxAccessDuration.String(),
+				"user.allowed_cidrs":       user.AllowedCIDRs,
+				"user.self_only":           user.SelfOnly,
+			},
+		})
 	case "user list":
-		users, err := models.Users(dbCtx, appCtx.DB, nil)
+		return c.list(appCtx)
+	case "user grant <user> <service>":
+		perm, err := c.Grant.load(appCtx)
 		if err != nil {
-			return aerrors.NewWithCause("failed querying users", err)
+			return aerrors.NewWithCause("failed granting permission", err)
 		}
-
-		data := make([][]string, len(users))
-		for i, user := range users {
-			data[i] = []string{user.Name}
+		if err = perm.Save(dbCtx, appCtx.DB); err != nil {
+			return aerrors.NewWithCause("failed granting permission", err)
+		}
+		appCtx.Audit(&models.AuditEvent{
+			Type: models.AuditEventUserGrant, ServiceName: perm.Service.Name,
+			Payload: map[string]any{"user.name": perm.User.Name},
+		})
+	case "user revoke <user> <service>":
+		perm, err := c.Revoke.load(appCtx)
+		if err != nil {
+			return aerrors.NewWithCause("failed revoking permission", err)
 		}
+		if err = perm.Delete(dbCtx, appCtx.DB); err != nil {
+			return aerrors.NewWithCause("failed revoking permission", err)
+		}
+		appCtx.Audit(&models.AuditEvent{
+			Type: models.AuditEventUserRevoke, ServiceName: perm.Service.Name,
+			Payload: map[string]any{"user.name": perm.User.Name},
+		})
+	}
+
+	return nil
+}
+
+func (c *User) list(appCtx *actx.Context) error {
+	dbCtx := appCtx.DB.NewContext()
+	users, err := models.Users(dbCtx, appCtx.DB, nil)
+	if err != nil {
+		return aerrors.NewWithCause("failed querying users", err)
+	}
+
+	perms, err := models.UserServicePermissions(dbCtx, appCtx.DB, nil)
+	if err != nil {
+		return aerrors.NewWithCause("failed querying permissions", err)
+	}
 
-		if len(data) > 0 {
-			header := []string{"Name"}
-			err = renderTable(header, data, appCtx.Stdout)
-			if err != nil {
-				return aerrors.NewWithCause("failed rendering table", err)
+	userServices := make(map[uint64][]string)
+	for _, perm := range perms {
+		userServices[perm.User.ID] = append(userServices[perm.User.ID], perm.Service.Name)
+	}
+
+	data := make([][]string, len(users))
+	for i, user := range users {
+		maxDuration := "-"
+		if user.MaxAccessDuration > 0 {
+			maxDuration = xtime.FormatDuration(user.MaxAccessDuration, time.Second)
+		}
+		cidrs := "-"
+		if len(user.AllowedCIDRs) > 0 {
+			cidrsStr := make([]string, len(user.AllowedCIDRs))
+			for j, prefix := range user.AllowedCIDRs {
+				cidrsStr[j] = prefix.String()
 			}
+			cidrs = strings.Join(cidrsStr, ", ")
+		}
+		data[i] = []string{
+			user.Name, strings.Join(userServices[user.ID], ", "),
+			maxDuration, cidrs, strconv.FormatBool(user.SelfOnly),
+		}
+	}
+
+	if len(data) > 0 {
+		header := []string{"Name", "Services", "Max Access Duration", "Allowed CIDRs", "Self Only"}
+		err = renderTable(header, data, appCtx.Stdout)
+		if err != nil {
+			return aerrors.NewWithCause("failed rendering table", err)
 		}
 	}
 
 	return nil
 }
+
+// load returns the permission for the user and service, which must both exist.
+func (p *userPermission) load(appCtx *actx.Context) (*models.UserServicePermission, error) {
+	dbCtx := appCtx.DB.NewContext()
+
+	user := &models.User{Name: p.User}
+	if err := user.Load(dbCtx, appCtx.DB); err != nil {
+		return nil, err
+	}
+
+	svc := &models.Service{Name: p.Service}
+	if err := svc.Load(dbCtx, appCtx.DB); err != nil {
+		return nil, err
+	}
+
+	return &models.UserServicePermission{User: user, Service: svc}, nil
+}
+
+// cidrsField is a comma-separated list of IP addresses in plain or CIDR notation.
+type cidrsField string
+
+func (c cidrsField) Validate() error {
+	_, err := models.ParseCIDRs(string(c))
+	return err
+}
+
+// Prefixes returns the parsed IP address prefixes. It assumes that the value
+// was previously validated.
+func (c cidrsField) Prefixes() []netip.Prefix {
+	prefixes, _ := models.ParseCIDRs(string(c))
+	return prefixes
+}
@@ -2,7 +2,9 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/pbkdf2"
 	"crypto/rand"
+	"crypto/sha512"
 	"errors"
 	"fmt"
 	"io"
@@ -17,6 +19,8 @@ const (
 	// encrypting "small" messages, so large data is split into 16KB chunks.
 	chunkSize = 16 * 1024 // 16KB
 	nonceSize = 24
+	// Number of PBKDF2 iterations used to derive a key from a passphrase.
+	passphraseIterations = 600_000
 )
 
 // EncryptSym performs symmetric encryption of the plaintext data using NaCl
@@ -177,6 +181,24 @@ func DecodeKey(keyEnc string) (*[32]byte, error) {
 	return &key, nil
 }
 
+// DeriveKeyFromPassphrase derives an encryption key from a passphrase and
+// salt using PBKDF2 with SHA-512/256.
+func DeriveKeyFromPassphrase(passphrase, salt []byte) (*[32]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase cannot be empty")
+	}
+
+	keyDer, err := pbkdf2.Key(sha512.New512_256, string(passphrase), salt, passphraseIterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed deriving key: %w", err)
+	}
+
+	var key [32]byte
+	copy(key[:], keyDer)
+
+	return &key, nil
+}
+
 func generateNonce() (*[nonceSize]byte, error) {
 	nonce := new([nonceSize]byte)
 	_, err := io.ReadFull(rand.Reader, nonce[:])
@@ -27,6 +27,7 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"slices"
 	"time"
 )
 
@@ -46,6 +47,48 @@ func DefaultTLSConfig() *tls.Config {
 	}
 }
 
+// VerifyServerCert returns a function to be used as tls.Config.VerifyConnection,
+// which verifies that the server certificate was issued by caCert for
+// serverName. Since the server certificate is self-signed, and renewed with the
+// same key and subject, the stdlib wouldn't verify a renewed certificate with
+// a previous caCert. So a self-signed certificate with the same subject and
+// public key as caCert is accepted as well, which allows clients to keep
+// connecting to the server after its certificate is renewed.
+// tls.Config.InsecureSkipVerify must be enabled for this function to replace
+// the default verification.
+func VerifyServerCert(caCert *x509.Certificate, serverName string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no server certificate found")
+		}
+		leaf := cs.PeerCertificates[0]
+
+		roots := x509.NewCertPool()
+		roots.AddCert(caCert)
+		if bytes.Equal(leaf.RawSubject, caCert.RawSubject) &&
+			bytes.Equal(leaf.RawSubjectPublicKeyInfo, caCert.RawSubjectPublicKeyInfo) {
+			roots = x509.NewCertPool()
+			roots.AddCert(leaf)
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		_, err := leaf.Verify(x509.VerifyOptions{
+			DNSName:       serverName,
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return fmt.Errorf("failed verifying server certificate: %w", err)
+		}
+
+		return nil
+	}
+}
+
 // NewTLSCert creates an X.509 v3 certificate for TLS operations using the
 // provided subjectName, Subject Alternative Names and expiration date. If
 // parent is nil, the certificate is self-signed using a new Ed25519 private
@@ -68,6 +111,68 @@ func NewTLSCert(
 	return createTLSCertFromTemplate(template, pubKey, privKey, parent)
 }
 
+// NewServerTLSCert creates an X.509 v3 certificate for TLS servers using the
+// provided subjectName, Subject Alternative Names and expiration date. It uses
+// a new Ed25519 private key, and is signed by the parent CA certificate.
+func NewServerTLSCert(
+	subjectName string, san []string, timeNow, expiration time.Time, parent tls.Certificate,
+) (tls.Certificate, error) {
+	template, err := createCertTemplate(subjectName, san, timeNow, expiration, false)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed generating Ed25519 key pair: %w", err)
+	}
+
+	return createTLSCertFromTemplate(template, pubKey, privKey, &parent)
+}
+
+// CrossSignCert creates a copy of the CA certificate cert signed by the parent
+// CA certificate, preserving its subject and public key, and valid until
+// expiration. This allows clients that only trust parent to verify
+// certificates issued by cert, when the cross-signed certificate is sent as an
+// intermediate.
+func CrossSignCert(cert *x509.Certificate, expiration time.Time, parent tls.Certificate) (*x509.Certificate, error) {
+	serialNumber, err := generateSerialNumber()
+	if err != nil {
+		return nil, fmt.Errorf("failed generating serial number: %w", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               cert.Subject,
+		SubjectKeyId:          cert.SubjectKeyId,
+		IsCA:                  cert.IsCA,
+		DNSNames:              cert.DNSNames,
+		NotBefore:             cert.NotBefore,
+		NotAfter:              expiration,
+		KeyUsage:              cert.KeyUsage,
+		ExtKeyUsage:           cert.ExtKeyUsage,
+		BasicConstraintsValid: cert.BasicConstraintsValid,
+	}
+
+	parentCert, err := ExtractCACert(parent)
+	if err != nil {
+		return nil, fmt.Errorf("failed extracting CA certificate: %w", err)
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parentCert, cert.PublicKey, parent.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating cross-signed certificate: %w", err)
+	}
+
+	crossCert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing cross-signed certificate: %w", err)
+	}
+
+	return crossCert, nil
+}
+
 // RenewTLSCert creates a renewed certificate using the existing private key
 // and preserving the original certificate's properties (subject, SANs, etc.).
 // The returned certificate will have a new serial number and validity period.
@@ -209,9 +314,50 @@ func NewCSR(cert tls.Certificate) (*x509.CertificateRequest, error) {
 	return csr, nil
 }
 
+// NewKeyCSR creates a Certificate Signing Request with the provided subjectName
+// for a new Ed25519 private key, which is also returned.
+func NewKeyCSR(subjectName string) (*x509.CertificateRequest, crypto.PrivateKey, error) {
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed generating Ed25519 key pair: %w", err)
+	}
+
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: subjectName},
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, template, privKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed creating CSR: %w", err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed parsing CSR: %w", err)
+	}
+
+	return csr, privKey, nil
+}
+
 // EncodeTLSCert converts a tls.Certificate into a PEM-encoded byte slice
 // containing the certificate chain followed by the private key.
 func EncodeTLSCert(cert tls.Certificate) ([]byte, error) {
+	certPEM, err := EncodeCert(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := encodePrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(certPEM, keyPEM...), nil
+}
+
+// EncodeCert converts the certificate chain of a tls.Certificate into a
+// PEM-encoded byte slice, without the private key.
+func EncodeCert(cert tls.Certificate) ([]byte, error) {
 	var buf bytes.Buffer
 
 	// Encode each certificate in the chain as a CERTIFICATE PEM block.
@@ -225,18 +371,6 @@ func EncodeTLSCert(cert tls.Certificate) ([]byte, error) {
 		}
 	}
 
-	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed marshalling private key: %w", err)
-	}
-
-	if err = pem.Encode(&buf, &pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: keyDER,
-	}); err != nil {
-		return nil, fmt.Errorf("failed encoding private key: %w", err)
-	}
-
 	return buf.Bytes(), nil
 }
 
@@ -277,6 +411,18 @@ func DecodeTLSCert(data []byte) (tls.Certificate, error) {
 	return cert, nil
 }
 
+// DecodeTLSCertWithKey reconstructs a tls.Certificate from PEM-encoded data
+// containing a certificate chain, and the private key of the leaf certificate.
+// It returns an error if the private key doesn't match the leaf certificate.
+func DecodeTLSCertWithKey(certPEM []byte, privKey crypto.PrivateKey) (tls.Certificate, error) {
+	keyPEM, err := encodePrivateKey(privKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return DecodeTLSCert(slices.Concat(certPEM, keyPEM))
+}
+
 // EncodeCSR converts an x509.CertificateRequest into a PEM-encoded byte slice.
 func EncodeCSR(csr *x509.CertificateRequest) ([]byte, error) {
 	csrPEM := pem.EncodeToMemory(&pem.Block{
@@ -453,3 +599,19 @@ func extractPublicKey(privKey crypto.PrivateKey) (crypto.PublicKey, error) {
 		return nil, fmt.Errorf("unsupported private key type: %T", priv)
 	}
 }
+
+// encodePrivateKey converts a private key into a PKCS #8 PEM-encoded byte
+// slice.
+func encodePrivateKey(privKey crypto.PrivateKey) ([]byte, error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed marshalling private key: %w", err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: keyDER,
+	})
+
+	return keyPEM, nil
+}
@@ -9,6 +9,7 @@ import (
 	"log/slog"
 	"math"
 	"strings"
+	"sync"
 	"time"
 
 	//nolint:revive,nolintlint // Idiomatic way of loading DB libraries.
@@ -28,6 +29,12 @@ type DB struct {
 	timeNow    func() time.Time
 	path       string
 	migrations []*migrator.Migration
+
+	// Encryption at rest of sensitive data. See encryption.go.
+	keyMx     sync.Mutex
+	keyFn     KeyFunc
+	key       *[32]byte
+	keyLoaded bool
 }
 
 var _ types.Querier = (*DB)(nil)
@@ -56,6 +63,12 @@ func (d *DB) Init(
 	return nil
 }
 
+// PendingMigrations returns the names of the migrations that haven't been
+// applied to the database, or an error if it was migrated by a newer version.
+func (d *DB) PendingMigrations() ([]string, error) {
+	return migrator.Pending(d, d.migrations)
+}
+
 // NewContext returns a new child context of the main database context.
 func (d *DB) NewContext() context.Context {
 	// TODO: Return cancel func?
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"go.hackfix.me/sesame/crypto"
+)
+
+// KeyFunc returns the key used to encrypt sensitive data stored in the
+// database, or nil if encryption at rest is disabled.
+type KeyFunc func() (*[32]byte, error)
+
+var (
+	// ErrEncryptionKeyRequired is returned when encrypted data is read without
+	// an encryption key.
+	ErrEncryptionKeyRequired = errors.New("data is encrypted, but no encryption key was provided")
+	// ErrInvalidEncryptionKey is returned when the encryption key doesn't match
+	// the key the data was encrypted with.
+	ErrInvalidEncryptionKey = errors.New("invalid encryption key")
+)
+
+// encryptedPrefix is prepended to encrypted values, in order to distinguish
+// them from values stored before encryption was enabled.
+var encryptedPrefix = []byte("sesame:enc:v1:")
+
+// keyCheckData is encrypted with the encryption key and stored in the database,
+// in order to verify the key when it's provided.
+var keyCheckData = []byte("sesame")
+
+// encryptedColumns are the columns that contain sensitive data, which is
+// encrypted at rest when encryption is enabled.
+var encryptedColumns = []struct{ table, column string }{
+	{"_meta", "server_tls_cert"},
+	{"_meta", "ca_tls_cert"},
+	{"invites", "private_key"},
+	{"remotes", "tls_client_cert"},
+}
+
+// SetKeyFunc sets the function used to retrieve the encryption key. It's
+// called once, the first time sensitive data is encrypted or decrypted, so
+// that the key is only requested when it's needed.
+func (d *DB) SetKeyFunc(fn KeyFunc) {
+	d.keyMx.Lock()
+	defer d.keyMx.Unlock()
+	d.keyFn = fn
+	d.key = nil
+	d.keyLoaded = false
+}
+
+// Encrypt encrypts data with the encryption key. If encryption at rest is
+// disabled, data is returned unchanged.
+func (d *DB) Encrypt(data []byte) ([]byte, error) {
+	key, err := d.encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return encrypt(data, key)
+}
+
+// Decrypt decrypts data encrypted with Encrypt. Data that isn't encrypted is
+// returned unchanged.
+func (d *DB) Decrypt(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptedPrefix) {
+		return data, nil
+	}
+
+	key, err := d.encryptionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return decrypt(data, key)
+}
+
+// LoadKey retrieves the encryption key with the key function, unless it was
+// already retrieved. This is useful to verify the key before it's needed.
+func (d *DB) LoadKey() error {
+	_, err := d.encryptionKey()
+	return err
+}
+
+// Rekey re-encrypts all sensitive data with newKey, and stores the salt used
+// to derive it, if any. If newKey is nil, the data is decrypted, and
+// encryption at rest is disabled. Data that isn't encrypted yet is also
+// encrypted with newKey. All changes are done in a single transaction.
+func (d *DB) Rekey(newKey *[32]byte, salt []byte) error {
+	oldKey, err := d.encryptionKey()
+	if err != nil {
+		return err
+	}
+
+	var keyCheck []byte
+	if newKey != nil {
+		if keyCheck, err = encrypt(keyCheckData, newKey); err != nil {
+			return err
+		}
+	} else {
+		salt = nil
+	}
+
+	ctx := d.NewContext()
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed starting transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	for _, col := range encryptedColumns {
+		if err = rekeyColumn(ctx, tx, col.table, col.column, oldKey, newKey); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE _meta SET encryption_salt = ?, encryption_key_check = ?`, salt, keyCheck)
+	if err != nil {
+		return fmt.Errorf("failed updating encryption metadata: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed committing transaction: %w", err)
+	}
+
+	d.keyMx.Lock()
+	d.key = newKey
+	d.keyLoaded = true
+	d.keyMx.Unlock()
+
+	return nil
+}
+
+// VerifyKey checks that key is the one the stored keyCheck value was encrypted
+// with.
+func VerifyKey(key *[32]byte, keyCheck []byte) error {
+	data, err := decrypt(keyCheck, key)
+	if err != nil || !bytes.Equal(data, keyCheckData) {
+		return ErrInvalidEncryptionKey
+	}
+
+	return nil
+}
+
+func (d *DB) encryptionKey() (*[32]byte, error) {
+	d.keyMx.Lock()
+	defer d.keyMx.Unlock()
+
+	if d.keyLoaded || d.keyFn == nil {
+		return d.key, nil
+	}
+
+	key, err := d.keyFn()
+	if err != nil {
+		return nil, err
+	}
+	d.key = key
+	d.keyLoaded = true
+
+	return key, nil
+}
+
+type execQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// rekeyColumn re-encrypts the values of a single column with newKey.
+func rekeyColumn(ctx context.Context, q execQuerier, table, column string, oldKey, newKey *[32]byte) error {
+	rows, err := q.QueryContext(ctx,
+		fmt.Sprintf(`SELECT rowid, %s FROM %s WHERE %[1]s IS NOT NULL`, column, table))
+	if err != nil {
+		return fmt.Errorf("failed querying %s.%s: %w", table, column, err)
+	}
+
+	values := make(map[int64][]byte)
+	for rows.Next() {
+		var (
+			rowID int64
+			value []byte
+		)
+		if err = rows.Scan(&rowID, &value); err != nil {
+			_ = rows.Close()
+			return fmt.Errorf("failed scanning %s.%s: %w", table, column, err)
+		}
+		values[rowID] = value
+	}
+	if err = rows.Close(); err != nil {
+		return fmt.Errorf("failed closing %s rows: %w", table, err)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed iterating over %s rows: %w", table, err)
+	}
+
+	for rowID, value := range values {
+		if bytes.HasPrefix(value, encryptedPrefix) {
+			if value, err = decrypt(value, oldKey); err != nil {
+				return fmt.Errorf("failed decrypting %s.%s: %w", table, column, err)
+			}
+		}
+
+		if value, err = encrypt(value, newKey); err != nil {
+			return fmt.Errorf("failed encrypting %s.%s: %w", table, column, err)
+		}
+
+		_, err = q.ExecContext(ctx,
+			fmt.Sprintf(`UPDATE %s SET %s = ? WHERE rowid = ?`, table, column), value, rowID)
+		if err != nil {
+			return fmt.Errorf("failed updating %s.%s: %w", table, column, err)
+		}
+	}
+
+	return nil
+}
+
+func encrypt(data []byte, key *[32]byte) ([]byte, error) {
+	if key == nil {
+		return data, nil
+	}
+
+	ciphertext, err := crypto.EncryptSymInMemory(data, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed encrypting data: %w", err)
+	}
+
+	return append(bytes.Clone(encryptedPrefix), ciphertext...), nil
+}
+
+func decrypt(data []byte, key *[32]byte) ([]byte, error) {
+	if key == nil {
+		return nil, ErrEncryptionKeyRequired
+	}
+
+	plaintext, err := crypto.DecryptSymInMemory(bytes.TrimPrefix(data, encryptedPrefix), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed decrypting data: %w", err)
+	}
+
+	return plaintext, nil
+}
@@ -0,0 +1,11 @@
+CREATE TABLE access_grants (
+  id           INTEGER       PRIMARY KEY,
+  created_at   TIMESTAMP     NOT NULL,
+  expires_at   TIMESTAMP     NOT NULL,
+  service_id   INTEGER       NOT NULL,
+  ip_range     VARCHAR(128)  NOT NULL,
+  user_id      INTEGER,
+  FOREIGN KEY(service_id) REFERENCES services(id) ON DELETE CASCADE,
+  FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE SET NULL,
+  UNIQUE(service_id, ip_range)
+);
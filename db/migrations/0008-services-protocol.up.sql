@@ -0,0 +1 @@
+ALTER TABLE services ADD COLUMN protocol VARCHAR(8) NOT NULL DEFAULT 'tcp';
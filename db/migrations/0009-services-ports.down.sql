@@ -0,0 +1,4 @@
+ALTER TABLE services ADD COLUMN port INTEGER NOT NULL DEFAULT 0;
+-- Only the first port is kept, since casting stops at the first non-digit.
+UPDATE services SET port = CAST(ports AS INTEGER);
+ALTER TABLE services DROP COLUMN ports;
@@ -0,0 +1,3 @@
+ALTER TABLE services ADD COLUMN ports VARCHAR(256) NOT NULL DEFAULT '';
+UPDATE services SET ports = CAST(port AS TEXT);
+ALTER TABLE services DROP COLUMN port;
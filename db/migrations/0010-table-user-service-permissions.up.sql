@@ -0,0 +1,13 @@
+CREATE TABLE user_service_permissions (
+  id           INTEGER       PRIMARY KEY,
+  created_at   TIMESTAMP     NOT NULL,
+  user_id      INTEGER       NOT NULL,
+  service_id   INTEGER       NOT NULL,
+  FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+  FOREIGN KEY(service_id) REFERENCES services(id) ON DELETE CASCADE,
+  UNIQUE(user_id, service_id)
+);
+-- Existing users could manage access to all services, so they're allowed to
+-- keep doing so after the upgrade.
+INSERT INTO user_service_permissions (created_at, user_id, service_id)
+  SELECT max(u.created_at, s.created_at), u.id, s.id FROM users u CROSS JOIN services s;
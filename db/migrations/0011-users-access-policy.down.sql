@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN self_only;
+ALTER TABLE users DROP COLUMN allowed_cidrs;
+ALTER TABLE users DROP COLUMN max_access_duration;
@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN max_access_duration INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN allowed_cidrs VARCHAR(1024) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN self_only BOOLEAN NOT NULL DEFAULT FALSE;
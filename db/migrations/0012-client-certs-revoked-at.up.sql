@@ -0,0 +1 @@
+ALTER TABLE client_certs ADD COLUMN revoked_at TIMESTAMP;
@@ -0,0 +1 @@
+ALTER TABLE client_certs DROP COLUMN last_seen_at;
@@ -0,0 +1 @@
+ALTER TABLE client_certs ADD COLUMN last_seen_at TIMESTAMP;
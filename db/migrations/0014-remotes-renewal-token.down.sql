@@ -0,0 +1,2 @@
+ALTER TABLE remotes DROP COLUMN renewal_token_expires_at;
+ALTER TABLE remotes DROP COLUMN renewal_token;
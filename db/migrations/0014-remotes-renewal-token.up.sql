@@ -0,0 +1,2 @@
+ALTER TABLE remotes ADD COLUMN renewal_token BLOB;
+ALTER TABLE remotes ADD COLUMN renewal_token_expires_at TIMESTAMP;
@@ -0,0 +1,4 @@
+ALTER TABLE _meta DROP COLUMN ca_rollover_ends_at;
+ALTER TABLE _meta DROP COLUMN ca_cross_cert;
+ALTER TABLE _meta DROP COLUMN prev_ca_cert;
+ALTER TABLE _meta DROP COLUMN ca_tls_cert;
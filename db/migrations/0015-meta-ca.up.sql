@@ -0,0 +1,4 @@
+ALTER TABLE _meta ADD COLUMN ca_tls_cert BLOB;
+ALTER TABLE _meta ADD COLUMN prev_ca_cert BLOB;
+ALTER TABLE _meta ADD COLUMN ca_cross_cert BLOB;
+ALTER TABLE _meta ADD COLUMN ca_rollover_ends_at TIMESTAMP;
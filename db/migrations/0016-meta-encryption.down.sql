@@ -0,0 +1,2 @@
+ALTER TABLE _meta DROP COLUMN encryption_key_check;
+ALTER TABLE _meta DROP COLUMN encryption_salt;
@@ -0,0 +1,2 @@
+ALTER TABLE _meta ADD COLUMN encryption_salt BLOB;
+ALTER TABLE _meta ADD COLUMN encryption_key_check BLOB;
@@ -0,0 +1,11 @@
+CREATE TABLE audit_events (
+  id            INTEGER       PRIMARY KEY,
+  created_at    TIMESTAMP     NOT NULL,
+  type          VARCHAR(32)   NOT NULL,
+  user_name     VARCHAR(32),
+  site_id       VARCHAR(32),
+  source_ip     VARCHAR(64),
+  service_name  VARCHAR(32),
+  payload       TEXT          NOT NULL
+);
+CREATE INDEX audit_events_created_at_idx ON audit_events(created_at);
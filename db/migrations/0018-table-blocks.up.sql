@@ -0,0 +1,8 @@
+CREATE TABLE blocks (
+  id           INTEGER       PRIMARY KEY,
+  created_at   TIMESTAMP     NOT NULL,
+  expires_at   TIMESTAMP,
+  service_id   INTEGER,
+  ip_range     VARCHAR(128)  NOT NULL,
+  FOREIGN KEY(service_id) REFERENCES services(id) ON DELETE CASCADE
+);
@@ -0,0 +1 @@
+ALTER TABLE services ADD COLUMN kill_connections BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/sesame/db/migrator"
+)
+
+func TestMigrationUserServicePermissions(t *testing.T) {
+	t.Parallel()
+
+	timeNow := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	d, err := Open(t.Context(), "file:sesame-migration-perms?mode=memory&cache=shared",
+		func() time.Time { return timeNow })
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = d.Close() })
+
+	logger := slog.New(slog.DiscardHandler)
+	err = migrator.RunMigrations(d, d.migrations, migrator.MigrationUp, "0009-services-ports", logger)
+	require.NoError(t, err)
+
+	ctx := d.NewContext()
+	for _, name := range []string{"alice", "bob"} {
+		_, err = d.ExecContext(ctx,
+			`INSERT INTO users (created_at, updated_at, name) VALUES (?, ?, ?)`, timeNow, timeNow, name)
+		require.NoError(t, err)
+	}
+	for _, name := range []string{"ssh", "web"} {
+		_, err = d.ExecContext(ctx,
+			`INSERT INTO services (created_at, updated_at, name, ports) VALUES (?, ?, ?, '22')`,
+			timeNow, timeNow, name)
+		require.NoError(t, err)
+	}
+
+	err = migrator.RunMigrations(d, d.migrations, migrator.MigrationUp,
+		"0010-table-user-service-permissions", logger)
+	require.NoError(t, err)
+
+	rows, err := d.QueryContext(ctx, `SELECT usp.created_at, u.name, s.name
+		FROM user_service_permissions usp
+		INNER JOIN users u ON u.id = usp.user_id
+		INNER JOIN services s ON s.id = usp.service_id
+		ORDER BY u.name, s.name`)
+	require.NoError(t, err)
+	defer rows.Close()
+
+	// Existing users keep being allowed to manage access to all services.
+	var perms []string
+	for rows.Next() {
+		var (
+			createdAt         time.Time
+			userName, svcName string
+		)
+		require.NoError(t, rows.Scan(&createdAt, &userName, &svcName))
+		assert.True(t, timeNow.Equal(createdAt))
+		perms = append(perms, userName+"/"+svcName)
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []string{"alice/ssh", "alice/web", "bob/ssh", "bob/web"}, perms)
+}
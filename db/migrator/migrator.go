@@ -149,6 +149,30 @@ func loadHistory(d types.Querier, migrations []*Migration) (rerr error) {
 	return nil
 }
 
+// Pending returns the names of the migrations that haven't been applied to the
+// database. It returns an error if the migration history contains unknown
+// migrations, e.g. if the database was migrated by a newer version. The passed
+// migrations aren't modified.
+func Pending(d types.Querier, migrations []*Migration) ([]string, error) {
+	migrationsCopy := make([]*Migration, len(migrations))
+	for i, m := range migrations {
+		migrationsCopy[i] = &Migration{ID: m.ID, Name: m.Name, Up: m.Up, Down: m.Down}
+	}
+
+	if err := loadHistory(d, migrationsCopy); err != nil {
+		return nil, err
+	}
+
+	pending := []string{}
+	for _, m := range migrationsCopy {
+		if !m.Applied {
+			pending = append(pending, m.Name)
+		}
+	}
+
+	return pending, nil
+}
+
 // RunMigrations applies or rolls back migrations.
 // to can either be a migration name, or "all".
 func RunMigrations(
@@ -0,0 +1,190 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"go4.org/netipx"
+
+	"go.hackfix.me/sesame/db/types"
+)
+
+// AccessGrant is a record of access granted to a service from a range of IP
+// addresses. It is the source of truth for the firewall state, and is used to
+// restore it after a reboot or a firewall reload.
+type AccessGrant struct {
+	ID        uint64
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	Service   *Service
+	IPRange   netipx.IPRange
+	// The remote user who granted access. If nil, access was granted by the
+	// local admin user.
+	User *User
+}
+
+// Save stores the access grant in the database. If a grant for the same
+// service and IP range already exists, its expiration date and user are
+// updated instead.
+func (ag *AccessGrant) Save(ctx context.Context, d types.Querier) error {
+	if ag.Service == nil || ag.Service.ID == 0 {
+		return types.InvalidInputError{Msg: "access grant service ID must be set"}
+	}
+	if !ag.IPRange.IsValid() {
+		return types.InvalidInputError{Msg: fmt.Sprintf("invalid IP address range: %s", ag.IPRange)}
+	}
+
+	var userID sql.Null[uint64]
+	if ag.User != nil {
+		userID = sql.Null[uint64]{V: ag.User.ID, Valid: true}
+	}
+
+	timeNow := d.TimeNow().UTC()
+	stmt := `INSERT INTO access_grants
+		(id, created_at, expires_at, service_id, ip_range, user_id)
+		VALUES (NULL, ?, ?, ?, ?, ?)
+		ON CONFLICT(service_id, ip_range) DO UPDATE
+		SET created_at = excluded.created_at,
+		    expires_at = excluded.expires_at,
+		    user_id = excluded.user_id
+		RETURNING id`
+	err := d.QueryRowContext(ctx, stmt,
+		timeNow, ag.ExpiresAt.UTC(), ag.Service.ID, ag.IPRange.String(), userID,
+	).Scan(&ag.ID)
+	if err != nil {
+		return fmt.Errorf("failed saving access grant for service '%s' and IP range %s: %w",
+			ag.Service.Name, ag.IPRange, err)
+	}
+	ag.CreatedAt = timeNow
+
+	return nil
+}
+
+// Delete removes the access grant from the database. The access grant ID must
+// be set for the lookup. It returns an error if the access grant doesn't exist.
+func (ag *AccessGrant) Delete(ctx context.Context, d types.Querier) error {
+	if ag.ID == 0 {
+		return types.InvalidInputError{Msg: "access grant ID must be set"}
+	}
+
+	n, err := DeleteAccessGrants(ctx, d, types.NewFilter("id = ?", []any{ag.ID}))
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return types.NoResultError{ModelName: "access grant", ID: fmt.Sprintf("ID %d", ag.ID)}
+	}
+
+	return nil
+}
+
+// DeleteAccessGrants removes all access grants matching the filter from the
+// database, and returns the number of deleted records. Filter fields must not
+// be prefixed with the table alias.
+func DeleteAccessGrants(ctx context.Context, d types.Querier, filter *types.Filter) (int64, error) {
+	where := "1=1"
+	args := []any{}
+	if filter != nil {
+		where = filter.Where
+		args = filter.Args
+	}
+
+	stmt := fmt.Sprintf(`DELETE FROM access_grants WHERE %s`, where)
+	res, err := d.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed deleting access grants: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed getting affected rows: %w", err)
+	}
+
+	return n, nil
+}
+
+// AccessGrants returns one or more access grants from the database. An optional
+// filter can be passed to limit the results.
+func AccessGrants(
+	ctx context.Context, d types.Querier, filter *types.Filter,
+) (ags []*AccessGrant, rerr error) {
+	queryFmt := `SELECT
+			ag.id, ag.created_at, ag.expires_at, ag.service_id, ag.ip_range, ag.user_id
+		FROM access_grants ag
+		%s ORDER BY ag.expires_at ASC %s`
+
+	where := "1=1"
+	var limit string
+	args := []any{}
+	if filter != nil {
+		where = filter.Where
+		args = filter.Args
+		if filter.Limit > 0 {
+			limit = fmt.Sprintf("LIMIT %d", filter.Limit)
+		}
+	}
+
+	query := fmt.Sprintf(queryFmt, fmt.Sprintf("WHERE %s", where), limit)
+
+	rows, err := d.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, types.LoadError{ModelName: "access grants", Err: err}
+	}
+	defer func() {
+		if err = rows.Close(); err != nil {
+			rerr = fmt.Errorf("failed closing access_grants rows: %w", err)
+		}
+	}()
+
+	ags = make([]*AccessGrant, 0)
+	services := make(map[uint64]*Service)
+	users := make(map[uint64]*User)
+	for rows.Next() {
+		var (
+			ag         = &AccessGrant{}
+			serviceID  uint64
+			ipRangeStr string
+			userID     sql.Null[uint64]
+		)
+		err = rows.Scan(&ag.ID, &ag.CreatedAt, &ag.ExpiresAt, &serviceID, &ipRangeStr, &userID)
+		if err != nil {
+			return nil, types.ScanError{ModelName: "access grant", Err: err}
+		}
+
+		ag.IPRange, err = netipx.ParseIPRange(ipRangeStr)
+		if err != nil {
+			return nil, types.ScanError{ModelName: "access grant", Err: err}
+		}
+
+		svc, ok := services[serviceID]
+		if !ok {
+			svc = &Service{ID: serviceID}
+			if err = svc.Load(ctx, d); err != nil {
+				return nil, types.LoadError{ModelName: "access grant service", Err: err}
+			}
+			services[serviceID] = svc
+		}
+		ag.Service = svc
+
+		if userID.Valid {
+			user, ok := users[userID.V]
+			if !ok {
+				user = &User{ID: userID.V}
+				if err = user.Load(ctx, d); err != nil {
+					return nil, types.LoadError{ModelName: "access grant user", Err: err}
+				}
+				users[userID.V] = user
+			}
+			ag.User = user
+		}
+
+		ags = append(ags, ag)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed iterating over access grant rows: %w", err)
+	}
+
+	return ags, nil
+}
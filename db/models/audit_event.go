@@ -0,0 +1,205 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"go.hackfix.me/sesame/db/types"
+)
+
+// AuditEventType is the type of action recorded by an audit event.
+type AuditEventType string
+
+// Valid audit event types.
+const (
+	AuditEventOpen            AuditEventType = "open"
+	AuditEventClose           AuditEventType = "close"
+	AuditEventJoin            AuditEventType = "join"
+	AuditEventInviteCreate    AuditEventType = "invite.create"
+	AuditEventInviteRedeem    AuditEventType = "invite.redeem"
+	AuditEventInviteDelete    AuditEventType = "invite.delete"
+	AuditEventUserAdd         AuditEventType = "user.add"
+	AuditEventUserUpdate      AuditEventType = "user.update"
+	AuditEventUserRemove      AuditEventType = "user.remove"
+	AuditEventUserGrant       AuditEventType = "user.grant"
+	AuditEventUserRevoke      AuditEventType = "user.revoke"
+	AuditEventServiceAdd      AuditEventType = "service.add"
+	AuditEventServiceUpdate   AuditEventType = "service.update"
+	AuditEventServiceRemove   AuditEventType = "service.remove"
+	AuditEventCertRenew       AuditEventType = "cert.renew"
+	AuditEventCertRevoke      AuditEventType = "cert.revoke"
+	AuditEventServerCertRenew AuditEventType = "cert.server_renew"
+	AuditEventCARotate        AuditEventType = "ca.rotate"
+	AuditEventBanAdd          AuditEventType = "ban.add"
+	AuditEventBanRemove       AuditEventType = "ban.remove"
+	AuditEventBlock           AuditEventType = "block"
+	AuditEventUnblock         AuditEventType = "unblock"
+)
+
+// AuditEventTypes returns all valid audit event types.
+func AuditEventTypes() []AuditEventType {
+	return []AuditEventType{
+		AuditEventOpen, AuditEventClose, AuditEventJoin,
+		AuditEventInviteCreate, AuditEventInviteRedeem, AuditEventInviteDelete,
+		AuditEventUserAdd, AuditEventUserUpdate, AuditEventUserRemove, AuditEventUserGrant, AuditEventUserRevoke,
+		AuditEventServiceAdd, AuditEventServiceUpdate, AuditEventServiceRemove,
+		AuditEventCertRenew, AuditEventCertRevoke, AuditEventServerCertRenew, AuditEventCARotate,
+		AuditEventBanAdd, AuditEventBanRemove, AuditEventBlock, AuditEventUnblock,
+	}
+}
+
+// AuditEvent is a durable record of an action that changed the state of this
+// node. The actor is stored by name, so that the record is kept even if the
+// user is removed.
+type AuditEvent struct {
+	ID        uint64         `json:"id"`
+	CreatedAt time.Time      `json:"created_at"`
+	Type      AuditEventType `json:"type"`
+	// The name of the remote user who performed the action. If empty, the
+	// action was performed by the local admin user, or by Sesame itself.
+	UserName string `json:"user_name,omitempty"`
+	// The ID of the remote site the action was performed from, if any.
+	SiteID string `json:"site_id,omitempty"`
+	// The address the request originated from, if the action was performed
+	// remotely.
+	SourceIP netip.Addr `json:"source_ip,omitzero"`
+	// The name of the service affected by the action, if any.
+	ServiceName string `json:"service_name,omitempty"`
+	// Additional details about the action.
+	Payload map[string]any `json:"payload,omitempty"`
+}
+
+// Save stores the audit event in the database.
+func (ae *AuditEvent) Save(ctx context.Context, d types.Querier) error {
+	if ae.Type == "" {
+		return types.InvalidInputError{Msg: "audit event type must be set"}
+	}
+
+	payload, err := json.Marshal(ae.Payload)
+	if err != nil {
+		return fmt.Errorf("failed encoding audit event payload: %w", err)
+	}
+
+	var sourceIP sql.Null[string]
+	if ae.SourceIP.IsValid() {
+		sourceIP = sql.Null[string]{V: ae.SourceIP.String(), Valid: true}
+	}
+
+	timeNow := d.TimeNow().UTC()
+	stmt := `INSERT INTO audit_events
+		(id, created_at, type, user_name, site_id, source_ip, service_name, payload)
+		VALUES (NULL, ?, ?, ?, ?, ?, ?, ?)`
+	res, err := d.ExecContext(ctx, stmt, timeNow, ae.Type, nullString(ae.UserName),
+		nullString(ae.SiteID), sourceIP, nullString(ae.ServiceName), string(payload))
+	if err != nil {
+		return fmt.Errorf("failed saving %s audit event: %w", ae.Type, err)
+	}
+
+	ae.ID, err = lastInsertID(res)
+	if err != nil {
+		return err
+	}
+	ae.CreatedAt = timeNow
+
+	return nil
+}
+
+// DeleteAuditEvents removes all audit events matching the filter from the
+// database, and returns the number of deleted records.
+func DeleteAuditEvents(ctx context.Context, d types.Querier, filter *types.Filter) (int64, error) {
+	where := "1=1"
+	args := []any{}
+	if filter != nil {
+		where = filter.Where
+		args = filter.Args
+	}
+
+	stmt := fmt.Sprintf(`DELETE FROM audit_events WHERE %s`, where)
+	res, err := d.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed deleting audit events: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed getting affected rows: %w", err)
+	}
+
+	return n, nil
+}
+
+// AuditEvents returns one or more audit events from the database, ordered by
+// creation time. An optional filter can be passed to limit the results.
+func AuditEvents(
+	ctx context.Context, d types.Querier, filter *types.Filter,
+) (aes []*AuditEvent, rerr error) {
+	queryFmt := `SELECT
+			ae.id, ae.created_at, ae.type, ae.user_name, ae.site_id, ae.source_ip,
+			ae.service_name, ae.payload
+		FROM audit_events ae
+		%s ORDER BY ae.created_at ASC, ae.id ASC %s`
+
+	where := "1=1"
+	var limit string
+	args := []any{}
+	if filter != nil {
+		where = filter.Where
+		args = filter.Args
+		if filter.Limit > 0 {
+			limit = fmt.Sprintf("LIMIT %d", filter.Limit)
+		}
+	}
+
+	query := fmt.Sprintf(queryFmt, fmt.Sprintf("WHERE %s", where), limit)
+
+	rows, err := d.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, types.LoadError{ModelName: "audit events", Err: err}
+	}
+	defer func() {
+		if err = rows.Close(); err != nil {
+			rerr = fmt.Errorf("failed closing audit_events rows: %w", err)
+		}
+	}()
+
+	aes = make([]*AuditEvent, 0)
+	for rows.Next() {
+		var (
+			ae                                  = &AuditEvent{}
+			userName, siteID, sourceIP, svcName sql.Null[string]
+			payload                             string
+		)
+		err = rows.Scan(&ae.ID, &ae.CreatedAt, &ae.Type, &userName, &siteID, &sourceIP, &svcName, &payload)
+		if err != nil {
+			return nil, types.ScanError{ModelName: "audit event", Err: err}
+		}
+		ae.UserName, ae.SiteID, ae.ServiceName = userName.V, siteID.V, svcName.V
+
+		if sourceIP.Valid {
+			ae.SourceIP, err = netip.ParseAddr(sourceIP.V)
+			if err != nil {
+				return nil, types.ScanError{ModelName: "audit event", Err: err}
+			}
+		}
+
+		if err = json.Unmarshal([]byte(payload), &ae.Payload); err != nil {
+			return nil, types.ScanError{ModelName: "audit event", Err: err}
+		}
+
+		aes = append(aes, ae)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed iterating over audit event rows: %w", err)
+	}
+
+	return aes, nil
+}
+
+func nullString(s string) sql.Null[string] {
+	return sql.Null[string]{V: s, Valid: s != ""}
+}
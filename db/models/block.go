@@ -0,0 +1,179 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"go4.org/netipx"
+
+	"go.hackfix.me/sesame/db/types"
+)
+
+// Block is a record of access to a service blocked from a range of IP
+// addresses. It is the source of truth for the blocks in the firewall, and is
+// used to restore them after a reboot or a firewall reload.
+type Block struct {
+	ID        uint64
+	CreatedAt time.Time
+	// The time the block expires. If not set, the block never expires.
+	ExpiresAt sql.Null[time.Time]
+	// The blocked service. If nil, access to all services is blocked.
+	Service *Service
+	IPRange netipx.IPRange
+}
+
+// Save stores the block in the database.
+func (b *Block) Save(ctx context.Context, d types.Querier) error {
+	if b.Service != nil && b.Service.ID == 0 {
+		return types.InvalidInputError{Msg: "block service ID must be set"}
+	}
+	if !b.IPRange.IsValid() {
+		return types.InvalidInputError{Msg: fmt.Sprintf("invalid IP address range: %s", b.IPRange)}
+	}
+
+	var serviceID sql.Null[uint64]
+	if b.Service != nil {
+		serviceID = sql.Null[uint64]{V: b.Service.ID, Valid: true}
+	}
+	var expiresAt sql.Null[time.Time]
+	if b.ExpiresAt.Valid {
+		expiresAt = sql.Null[time.Time]{V: b.ExpiresAt.V.UTC(), Valid: true}
+	}
+
+	timeNow := d.TimeNow().UTC()
+	stmt := `INSERT INTO blocks
+		(id, created_at, expires_at, service_id, ip_range)
+		VALUES (NULL, ?, ?, ?, ?)
+		RETURNING id`
+	err := d.QueryRowContext(ctx, stmt,
+		timeNow, expiresAt, serviceID, b.IPRange.String(),
+	).Scan(&b.ID)
+	if err != nil {
+		return fmt.Errorf("failed saving block for IP range %s: %w", b.IPRange, err)
+	}
+	b.CreatedAt = timeNow
+
+	return nil
+}
+
+// Delete removes the block from the database. The block ID must be set for the
+// lookup. It returns an error if the block doesn't exist.
+func (b *Block) Delete(ctx context.Context, d types.Querier) error {
+	if b.ID == 0 {
+		return types.InvalidInputError{Msg: "block ID must be set"}
+	}
+
+	n, err := DeleteBlocks(ctx, d, types.NewFilter("id = ?", []any{b.ID}))
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return types.NoResultError{ModelName: "block", ID: fmt.Sprintf("ID %d", b.ID)}
+	}
+
+	return nil
+}
+
+// DeleteBlocks removes all blocks matching the filter from the database, and
+// returns the number of deleted records. Filter fields must not be prefixed
+// with the table alias.
+func DeleteBlocks(ctx context.Context, d types.Querier, filter *types.Filter) (int64, error) {
+	where := "1=1"
+	args := []any{}
+	if filter != nil {
+		where = filter.Where
+		args = filter.Args
+	}
+
+	stmt := fmt.Sprintf(`DELETE FROM blocks WHERE %s`, where)
+	res, err := d.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed deleting blocks: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed getting affected rows: %w", err)
+	}
+
+	return n, nil
+}
+
+// Blocks returns one or more blocks from the database. An optional filter can
+// be passed to limit the results.
+func Blocks(
+	ctx context.Context, d types.Querier, filter *types.Filter,
+) (bs []*Block, rerr error) {
+	queryFmt := `SELECT
+			b.id, b.created_at, b.expires_at, b.service_id, b.ip_range
+		FROM blocks b
+		%s ORDER BY b.created_at ASC, b.id ASC %s`
+
+	where := "1=1"
+	var limit string
+	args := []any{}
+	if filter != nil {
+		where = filter.Where
+		args = filter.Args
+		if filter.Limit > 0 {
+			limit = fmt.Sprintf("LIMIT %d", filter.Limit)
+		}
+	}
+
+	query := fmt.Sprintf(queryFmt, fmt.Sprintf("WHERE %s", where), limit)
+
+	rows, err := d.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, types.LoadError{ModelName: "blocks", Err: err}
+	}
+	defer func() {
+		if err = rows.Close(); err != nil {
+			rerr = fmt.Errorf("failed closing blocks rows: %w", err)
+		}
+	}()
+
+	bs = make([]*Block, 0)
+	services := make(map[uint64]*Service)
+	for rows.Next() {
+		var (
+			b          = &Block{}
+			serviceID  sql.Null[uint64]
+			ipRangeStr string
+		)
+		err = rows.Scan(&b.ID, &b.CreatedAt, &b.ExpiresAt, &serviceID, &ipRangeStr)
+		if err != nil {
+			return nil, types.ScanError{ModelName: "block", Err: err}
+		}
+
+		b.IPRange, err = netipx.ParseIPRange(ipRangeStr)
+		if err != nil {
+			return nil, types.ScanError{ModelName: "block", Err: err}
+		}
+
+		if serviceID.Valid {
+			svc, ok := services[serviceID.V]
+			if !ok {
+				svc = &Service{ID: serviceID.V}
+				if err = svc.Load(ctx, d); err != nil {
+					return nil, types.LoadError{ModelName: "block service", Err: err}
+				}
+				services[serviceID.V] = svc
+			}
+			b.Service = svc
+		}
+
+		bs = append(bs, b)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed iterating over block rows: %w", err)
+	}
+
+	return bs, nil
+}
+
+// IsExpired returns true if the block expired at the given time.
+func (b *Block) IsExpired(t time.Time) bool {
+	return b.ExpiresAt.Valid && !b.ExpiresAt.V.After(t)
+}
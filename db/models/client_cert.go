@@ -3,14 +3,59 @@ package models
 import (
 	"context"
 	"crypto/x509"
+	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"go.hackfix.me/sesame/crypto"
 	"go.hackfix.me/sesame/db/types"
 )
 
+// CertStatus is a computed status of a TLS certificate based on its issue,
+// expiration and revocation dates.
+type CertStatus string
+
+// Valid certificate status values.
+const (
+	// CertStatusValid represents a certificate that hasn't expired nor been revoked.
+	CertStatusValid CertStatus = "valid"
+	// CertStatusExpiring represents a valid certificate that is past its
+	// renewal threshold, and should be renewed.
+	CertStatusExpiring CertStatus = "expiring"
+	// CertStatusExpired represents a certificate that has expired.
+	CertStatusExpired CertStatus = "expired"
+	// CertStatusRevoked represents a certificate that was revoked.
+	CertStatusRevoked CertStatus = "revoked"
+)
+
+// Title returns the status text in title case.
+func (s CertStatus) Title() string {
+	return fmt.Sprintf("%s%s", strings.ToUpper(string(s[0])), s[1:])
+}
+
+// CertStatusAt returns the status at time now of a certificate valid between
+// issuedAt and expiresAt. renewalThreshold is the proportion of the
+// certificate lifetime after which it is considered to be expiring. A
+// threshold outside of the (0, 1) range disables the expiring status.
+func CertStatusAt(issuedAt, expiresAt time.Time, revoked bool, now time.Time, renewalThreshold float64) CertStatus {
+	switch {
+	case revoked:
+		return CertStatusRevoked
+	case !now.Before(expiresAt):
+		return CertStatusExpired
+	case renewalThreshold > 0 && renewalThreshold < 1:
+		lifetime := expiresAt.Sub(issuedAt)
+		renewAt := issuedAt.Add(time.Duration(float64(lifetime) * renewalThreshold))
+		if !now.Before(renewAt) {
+			return CertStatusExpiring
+		}
+	}
+
+	return CertStatusValid
+}
+
 // ClientCertificate is a record of a TLS client certificate issued for a remote
 // Sesame user.
 type ClientCertificate struct {
@@ -34,6 +79,11 @@ type ClientCertificate struct {
 	// certificate expiration date. If the renewal token also expires, the user
 	// will have to go through the invitation process again.
 	RenewalTokenExpiresAt time.Time
+	// The time the certificate was revoked at. Revoked certificates are
+	// rejected by the server, even if they haven't expired yet.
+	RevokedAt sql.Null[time.Time]
+	// The last time the certificate was used to authenticate with the server.
+	LastSeenAt sql.Null[time.Time]
 }
 
 // NewClientCertificate returns a new client certificate record for the remote
@@ -84,6 +134,14 @@ func (cc *ClientCertificate) Save(ctx context.Context, d types.Querier, update b
 			additional += ", site_id = ?"
 			args = append(args, cc.SiteID)
 		}
+		if cc.RevokedAt.Valid {
+			additional += ", revoked_at = ?"
+			args = append(args, cc.RevokedAt.V.UTC())
+		}
+		if cc.LastSeenAt.Valid {
+			additional += ", last_seen_at = ?"
+			args = append(args, cc.LastSeenAt.V.UTC())
+		}
 		args = append(args, filter.Args...)
 		stmt = fmt.Sprintf(`UPDATE client_certs
 			SET updated_at = ?%s
@@ -148,6 +206,29 @@ func (cc *ClientCertificate) Load(ctx context.Context, d types.Querier) error {
 	return nil
 }
 
+// Revoke marks the client certificate as revoked at time t. It returns an
+// error if the certificate is already revoked.
+func (cc *ClientCertificate) Revoke(ctx context.Context, d types.Querier, t time.Time) error {
+	if cc.IsRevoked() {
+		return errors.New("client certificate is already revoked")
+	}
+
+	cc.RevokedAt = sql.Null[time.Time]{V: t, Valid: true}
+
+	return cc.Save(ctx, d, true)
+}
+
+// IsRevoked returns true if the client certificate was revoked.
+func (cc *ClientCertificate) IsRevoked() bool {
+	return cc.RevokedAt.Valid && !cc.RevokedAt.V.IsZero()
+}
+
+// Status returns the status of the client certificate at time now. See
+// CertStatusAt for details about renewalThreshold.
+func (cc *ClientCertificate) Status(now time.Time, renewalThreshold float64) CertStatus {
+	return CertStatusAt(cc.CreatedAt, cc.ExpiresAt, cc.IsRevoked(), now, renewalThreshold)
+}
+
 // Delete removes the client certificate record from the database. The ID,
 // serial number, or renewal token must be set for the lookup. It returns an
 // error if the client certificate doesn't exist, or if more than one record
@@ -194,7 +275,7 @@ func (cc *ClientCertificate) createFilter(
 		return nil, "", errors.New("must provide either a client certificate ID, serial number or renewal token")
 	}
 
-	if count, err := filterCount(ctx, d, "client certificates", filter); err != nil {
+	if count, err := filterCount(ctx, d, "client_certs", filter); err != nil {
 		return nil, "", err
 	} else if count > limit {
 		return nil, "", fmt.Errorf("filter with %s returns %d results; make the filter more specific", filterStr, count)
@@ -212,7 +293,8 @@ func ClientCertificates(
 ) (ccs []*ClientCertificate, rerr error) {
 	queryFmt := `SELECT
 			cc.id, cc.created_at, cc.updated_at, cc.expires_at, cc.serial_number, cc.user_id,
-			cc.site_id, cc.renewal_token, cc.renewal_token_expires_at)
+			cc.site_id, cc.renewal_token, cc.renewal_token_expires_at, cc.revoked_at,
+			cc.last_seen_at
 		FROM client_certs cc
 		%s ORDER BY cc.expires_at ASC %s`
 
@@ -248,7 +330,8 @@ func ClientCertificates(
 		)
 		err = rows.Scan(
 			&cc.ID, &cc.CreatedAt, &cc.UpdatedAt, &cc.ExpiresAt, &cc.SerialNumber,
-			&userID, &cc.SiteID, cc.RenewalToken, &cc.RenewalTokenExpiresAt)
+			&userID, &cc.SiteID, &cc.RenewalToken, &cc.RenewalTokenExpiresAt, &cc.RevokedAt,
+			&cc.LastSeenAt)
 		if err != nil {
 			return nil, types.ScanError{ModelName: "client certificate", Err: err}
 		}
@@ -126,12 +126,16 @@ func (inv *Invite) Save(ctx context.Context, d types.Querier, update bool) error
 			WHERE %s`, additional, filter.Where)
 		op = fmt.Sprintf("updating invite with %s", filterStr)
 	} else {
+		privKey, err := d.Encrypt(inv.privKey.Bytes())
+		if err != nil {
+			return fmt.Errorf("failed encrypting invite private key: %w", err)
+		}
 		stmt = `INSERT INTO invites (
 				id, uuid, created_at, updated_at, expires_at, user_id, site_id, private_key, nonce)
 				VALUES (NULL, ?, ?, ?, ?, ?, ?, ?, ?)`
 		args = []any{
 			inv.UUID, timeNow, timeNow, inv.ExpiresAt, inv.User.ID, inv.SiteID,
-			inv.privKey.Bytes(), inv.Nonce,
+			privKey, inv.Nonce,
 		}
 		op = "saving new invite"
 	}
@@ -361,6 +365,10 @@ func Invites(
 		}
 		inv.User = user
 
+		if privKeyBytes, err = d.Decrypt(privKeyBytes); err != nil {
+			return nil, fmt.Errorf("failed decrypting invite private key: %w", err)
+		}
+
 		inv.privKey, err = ecdh.X25519().NewPrivateKey(privKeyBytes)
 		if err != nil {
 			return nil, fmt.Errorf("failed loading X25519 private key: %w", err)
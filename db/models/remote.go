@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"database/sql"
 	"errors"
 	"fmt"
 	"time"
@@ -22,6 +23,10 @@ type Remote struct {
 	Address       string
 	TLSCACert     *x509.Certificate
 	TLSClientCert *tls.Certificate
+	// The renewal token is used for renewing the client certificate after it
+	// has expired. It is issued by the remote node along with the certificate.
+	RenewalToken          []byte
+	RenewalTokenExpiresAt time.Time
 }
 
 // NewRemote creates a new remote object.
@@ -46,11 +51,22 @@ func (r *Remote) Save(ctx context.Context, d types.Querier, update bool) error {
 		args      []any
 		timeNow   = d.TimeNow().UTC()
 	)
+
+	tlsClientCertPEM, err := crypto.EncodeTLSCert(*r.TLSClientCert)
+	if err != nil {
+		return fmt.Errorf("failed encoding the client TLS certificate: %w", err)
+	}
+	if tlsClientCertPEM, err = d.Encrypt(tlsClientCertPEM); err != nil {
+		return fmt.Errorf("failed encrypting the client TLS certificate: %w", err)
+	}
+
+	var renewalTokenExpiresAt sql.Null[time.Time]
+	if !r.RenewalTokenExpiresAt.IsZero() {
+		renewalTokenExpiresAt = sql.Null[time.Time]{V: r.RenewalTokenExpiresAt.UTC(), Valid: true}
+	}
+
 	if update {
-		var (
-			filter *types.Filter
-			err    error
-		)
+		var filter *types.Filter
 		filter, filterStr, err = r.createFilter(ctx, d, 1)
 		if err != nil {
 			return fmt.Errorf("failed creating query filter: %w", err)
@@ -58,22 +74,25 @@ func (r *Remote) Save(ctx context.Context, d types.Querier, update bool) error {
 		stmt = fmt.Sprintf(`UPDATE remotes
 			SET updated_at = ?,
 				name = ?,
-				address = ?
+				address = ?,
+				tls_ca_cert = ?,
+				tls_client_cert = ?,
+				renewal_token = ?,
+				renewal_token_expires_at = ?
 			WHERE %s`, filter.Where)
-		args = append([]any{timeNow, r.Name, r.Address}, filter.Args...)
+		args = append([]any{
+			timeNow, r.Name, r.Address, r.TLSCACert.Raw, tlsClientCertPEM,
+			r.RenewalToken, renewalTokenExpiresAt,
+		}, filter.Args...)
 		op = fmt.Sprintf("updating remote with %s", filterStr)
 	} else {
-		tlsClientCertPEM, err := crypto.EncodeTLSCert(*r.TLSClientCert)
-		if err != nil {
-			return fmt.Errorf("failed encoding the client TLS certificate: %w", err)
-		}
-
 		stmt = `INSERT INTO remotes (
 					id, created_at, updated_at, name, address,
-					tls_ca_cert, tls_client_cert)
-				VALUES (NULL, ?, ?, ?, ?, ?, ?)`
+					tls_ca_cert, tls_client_cert, renewal_token, renewal_token_expires_at)
+				VALUES (NULL, ?, ?, ?, ?, ?, ?, ?, ?)`
 		args = []any{
 			timeNow, timeNow, r.Name, r.Address, r.TLSCACert.Raw, tlsClientCertPEM,
+			r.RenewalToken, renewalTokenExpiresAt,
 		}
 		op = "saving new remote"
 	}
@@ -162,13 +181,14 @@ func (r *Remote) Delete(ctx context.Context, d types.Querier) error {
 }
 
 // ClientTLSConfig returns the TLS configuration used to authenticate a user
-// with the Sesame HTTP API.
+// with the Sesame HTTP API. The server certificate is verified against the
+// stored CA certificate, or a renewal of it (see [crypto.VerifyServerCert]).
 func (r *Remote) ClientTLSConfig() (*tls.Config, error) {
-	tlsConfig := crypto.DefaultTLSConfig()
+	if r.TLSClientCert == nil {
+		return nil, errors.New("no client TLS certificate found")
+	}
 
-	caCertPool := x509.NewCertPool()
-	caCertPool.AddCert(r.TLSCACert)
-	tlsConfig.RootCAs = caCertPool
+	tlsConfig := crypto.DefaultTLSConfig()
 
 	tlsConfig.Certificates = []tls.Certificate{*r.TLSClientCert}
 	if len(r.TLSCACert.DNSNames) == 0 {
@@ -176,6 +196,9 @@ func (r *Remote) ClientTLSConfig() (*tls.Config, error) {
 	}
 	tlsConfig.ServerName = r.TLSCACert.DNSNames[0]
 
+	tlsConfig.InsecureSkipVerify = true //nolint:gosec // The server certificate is verified by VerifyConnection.
+	tlsConfig.VerifyConnection = crypto.VerifyServerCert(r.TLSCACert, tlsConfig.ServerName)
+
 	return tlsConfig, nil
 }
 
@@ -210,7 +233,8 @@ func (r *Remote) createFilter(ctx context.Context, d types.Querier, limit int) (
 // be passed to limit the results.
 func Remotes(ctx context.Context, d types.Querier, filter *types.Filter) (remotes []*Remote, rerr error) {
 	queryFmt := `SELECT r.id, r.created_at, r.updated_at, r.name, r.address,
-					r.tls_ca_cert, r.tls_client_cert
+					r.tls_ca_cert, r.tls_client_cert, r.renewal_token,
+					r.renewal_token_expires_at
 				FROM remotes r
 				%s ORDER BY r.name ASC %s`
 
@@ -240,21 +264,27 @@ func Remotes(ctx context.Context, d types.Querier, filter *types.Filter) (remote
 	remotes = make([]*Remote, 0)
 	for rows.Next() {
 		var (
-			r                Remote
-			tlsCACertRaw     []byte
-			tlsClientCertRaw []byte
+			r                     Remote
+			tlsCACertRaw          []byte
+			tlsClientCertRaw      []byte
+			renewalTokenExpiresAt sql.Null[time.Time]
 		)
 		err = rows.Scan(&r.ID, &r.CreatedAt, &r.UpdatedAt, &r.Name, &r.Address,
-			&tlsCACertRaw, &tlsClientCertRaw)
+			&tlsCACertRaw, &tlsClientCertRaw, &r.RenewalToken, &renewalTokenExpiresAt)
 		if err != nil {
 			return nil, types.ScanError{ModelName: "remote", Err: err}
 		}
+		r.RenewalTokenExpiresAt = renewalTokenExpiresAt.V
 
 		r.TLSCACert, err = x509.ParseCertificate(tlsCACertRaw)
 		if err != nil {
 			return nil, fmt.Errorf("failed parsing raw TLS CA certificate: %w", err)
 		}
 
+		if tlsClientCertRaw, err = d.Decrypt(tlsClientCertRaw); err != nil {
+			return nil, fmt.Errorf("failed decrypting TLS client certificate: %w", err)
+		}
+
 		var tlsClientCert tls.Certificate
 		tlsClientCert, err = crypto.DecodeTLSCert(tlsClientCertRaw)
 		if err != nil {
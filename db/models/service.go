@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"go.hackfix.me/sesame/db/types"
+	ftypes "go.hackfix.me/sesame/firewall/types"
 )
 
 // Service represents a system service whose access can be managed by a firewall.
@@ -15,12 +16,20 @@ type Service struct {
 	CreatedAt         time.Time
 	UpdatedAt         time.Time
 	Name              string
-	Port              uint16
+	Ports             ftypes.PortRanges
+	Protocol          ftypes.Protocol
 	MaxAccessDuration time.Duration
+	// KillConnections terminates the established connections of clients whose
+	// access to the service is denied.
+	KillConnections bool
 }
 
 // Save stores the service data in the database.
 func (s *Service) Save(ctx context.Context, d types.Querier, update bool) error {
+	if len(s.Ports) == 0 {
+		return types.InvalidInputError{Msg: "service must have at least one port"}
+	}
+
 	timeNow := d.TimeNow().UTC()
 	if update { //nolint:nestif // It's fine.
 		var filter *types.Filter
@@ -36,11 +45,15 @@ func (s *Service) Save(ctx context.Context, d types.Querier, update bool) error
 			return errors.New("must provide either a service name or ID to update")
 		}
 
-		args := append([]any{timeNow, s.Port, s.MaxAccessDuration}, filter.Args...)
+		args := append([]any{
+			timeNow, s.Ports.String(), s.protocol(), s.MaxAccessDuration, s.KillConnections,
+		}, filter.Args...)
 		updateStmt := fmt.Sprintf(`UPDATE services
 			SET updated_at = ?,
-			    port = ?,
-			    max_access_duration = ?
+			    ports = ?,
+			    protocol = ?,
+			    max_access_duration = ?,
+			    kill_connections = ?
 			WHERE %s`, filter.Where)
 		res, err := d.ExecContext(ctx, updateStmt, args...)
 		if err != nil {
@@ -60,9 +73,10 @@ func (s *Service) Save(ctx context.Context, d types.Querier, update bool) error
 		s.UpdatedAt = timeNow
 	} else {
 		insertStmt := `INSERT INTO services
-		(id, created_at, updated_at, name, port, max_access_duration)
-		VALUES (NULL, ?, ?, ?, ?, ?)`
-		res, err := d.ExecContext(ctx, insertStmt, timeNow, timeNow, s.Name, s.Port, s.MaxAccessDuration)
+		(id, created_at, updated_at, name, ports, protocol, max_access_duration, kill_connections)
+		VALUES (NULL, ?, ?, ?, ?, ?, ?, ?)`
+		res, err := d.ExecContext(ctx, insertStmt,
+			timeNow, timeNow, s.Name, s.Ports.String(), s.protocol(), s.MaxAccessDuration, s.KillConnections)
 		if err != nil {
 			return types.Err("service", fmt.Sprintf("name '%s'", s.Name), err)
 		}
@@ -74,10 +88,19 @@ func (s *Service) Save(ctx context.Context, d types.Querier, update bool) error
 		s.CreatedAt = timeNow
 		s.UpdatedAt = timeNow
 	}
+	s.Protocol = s.protocol()
 
 	return nil
 }
 
+// protocol returns the service protocol, defaulting to TCP if it's unset.
+func (s *Service) protocol() ftypes.Protocol {
+	if s.Protocol == "" {
+		return ftypes.ProtocolTCP
+	}
+	return s.Protocol
+}
+
 // Load the service data from the database. Either the service ID or Name must be set
 // for the lookup.
 //
@@ -156,7 +179,8 @@ func (s *Service) Delete(ctx context.Context, d types.Querier) error {
 // passed to limit the results.
 func Services(ctx context.Context, d types.Querier, filter *types.Filter) (services []*Service, rerr error) {
 	query := `SELECT
-			s.id, s.created_at, s.updated_at, s.name, s.port, s.max_access_duration
+			s.id, s.created_at, s.updated_at, s.name, s.ports, s.protocol, s.max_access_duration,
+			s.kill_connections
 		FROM services s %s
 		ORDER BY s.name ASC`
 
@@ -181,11 +205,18 @@ func Services(ctx context.Context, d types.Querier, filter *types.Filter) (servi
 
 	services = make([]*Service, 0)
 	for rows.Next() {
-		var s Service
-		err = rows.Scan(&s.ID, &s.CreatedAt, &s.UpdatedAt, &s.Name, &s.Port, &s.MaxAccessDuration)
+		var (
+			s        Service
+			portsStr string
+		)
+		err = rows.Scan(&s.ID, &s.CreatedAt, &s.UpdatedAt, &s.Name, &portsStr, &s.Protocol,
+			&s.MaxAccessDuration, &s.KillConnections)
 		if err != nil {
 			return nil, types.ScanError{ModelName: "service", Err: err}
 		}
+		if s.Ports, err = ftypes.ParsePortRanges(portsStr); err != nil {
+			return nil, types.ScanError{ModelName: "service", Err: err}
+		}
 		services = append(services, &s)
 	}
 
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/netip"
+	"strings"
 	"time"
 
 	"go.hackfix.me/sesame/db/types"
@@ -15,6 +17,15 @@ type User struct {
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	Name      string
+	// The maximum duration of access the user can grant. If 0, only the
+	// maximum access duration of the service applies.
+	MaxAccessDuration time.Duration
+	// The IP address ranges the user can grant access to. If empty, access
+	// can be granted to any address.
+	AllowedCIDRs []netip.Prefix
+	// If true, the user can only grant access to the address their request
+	// originated from.
+	SelfOnly bool
 }
 
 // Save stores the user data in the database.
@@ -34,9 +45,12 @@ func (u *User) Save(ctx context.Context, d types.Querier, update bool) error {
 			return errors.New("must provide either a user name or ID to update")
 		}
 
-		args := append([]any{timeNow}, filter.Args...)
+		args := append([]any{timeNow, u.MaxAccessDuration, u.allowedCIDRs(), u.SelfOnly}, filter.Args...)
 		updateStmt := fmt.Sprintf(`UPDATE users
-			SET updated_at = ?
+			SET updated_at = ?,
+			    max_access_duration = ?,
+			    allowed_cidrs = ?,
+			    self_only = ?
 			WHERE %s`, filter.Where)
 		res, err := d.ExecContext(ctx, updateStmt, args...)
 		if err != nil {
@@ -56,9 +70,10 @@ func (u *User) Save(ctx context.Context, d types.Querier, update bool) error {
 		u.UpdatedAt = timeNow
 	} else {
 		insertStmt := `INSERT INTO users
-		(id, created_at, updated_at, name)
-		VALUES (NULL, ?, ?, ?)`
-		res, err := d.ExecContext(ctx, insertStmt, timeNow, timeNow, u.Name)
+		(id, created_at, updated_at, name, max_access_duration, allowed_cidrs, self_only)
+		VALUES (NULL, ?, ?, ?, ?, ?, ?)`
+		res, err := d.ExecContext(ctx, insertStmt,
+			timeNow, timeNow, u.Name, u.MaxAccessDuration, u.allowedCIDRs(), u.SelfOnly)
 		if err != nil {
 			return types.Err("user", fmt.Sprintf("name '%s'", u.Name), err)
 		}
@@ -74,6 +89,15 @@ func (u *User) Save(ctx context.Context, d types.Querier, update bool) error {
 	return nil
 }
 
+// allowedCIDRs returns the allowed CIDRs as a comma-separated string.
+func (u *User) allowedCIDRs() string {
+	cidrs := make([]string, len(u.AllowedCIDRs))
+	for i, p := range u.AllowedCIDRs {
+		cidrs[i] = p.String()
+	}
+	return strings.Join(cidrs, ",")
+}
+
 // Load the user data from the database. Either the user ID or Name must be set
 // for the lookup.
 //
@@ -151,7 +175,8 @@ func (u *User) Delete(ctx context.Context, d types.Querier) error {
 // Users returns one or more users from the database. An optional filter can be
 // passed to limit the results.
 func Users(ctx context.Context, d types.Querier, filter *types.Filter) (users []*User, rerr error) {
-	query := `SELECT u.id, u.created_at, u.updated_at, u.name
+	query := `SELECT
+			u.id, u.created_at, u.updated_at, u.name, u.max_access_duration, u.allowed_cidrs, u.self_only
 		FROM users u %s
 		ORDER BY u.name ASC`
 
@@ -176,11 +201,17 @@ func Users(ctx context.Context, d types.Querier, filter *types.Filter) (users []
 
 	users = make([]*User, 0)
 	for rows.Next() {
-		var u User
-		err = rows.Scan(&u.ID, &u.CreatedAt, &u.UpdatedAt, &u.Name)
+		var (
+			u        User
+			cidrsStr string
+		)
+		err = rows.Scan(&u.ID, &u.CreatedAt, &u.UpdatedAt, &u.Name, &u.MaxAccessDuration, &cidrsStr, &u.SelfOnly)
 		if err != nil {
 			return nil, types.ScanError{ModelName: "user", Err: err}
 		}
+		if u.AllowedCIDRs, err = ParseCIDRs(cidrsStr); err != nil {
+			return nil, types.ScanError{ModelName: "user", Err: err}
+		}
 		users = append(users, &u)
 	}
 
@@ -190,3 +221,32 @@ func Users(ctx context.Context, d types.Querier, filter *types.Filter) (users []
 
 	return users, nil
 }
+
+// ParseCIDRs parses a comma-separated list of IP address prefixes in CIDR
+// notation. Plain IP addresses are parsed as single address prefixes.
+func ParseCIDRs(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for cidr := range strings.SplitSeq(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR '%s': %w", cidr, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%s': %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
@@ -0,0 +1,176 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.hackfix.me/sesame/db/types"
+)
+
+// UserServicePermission is a record of a remote user being allowed to manage
+// access to a service. Remote users can only open and close access to services
+// they have been granted permission for.
+type UserServicePermission struct {
+	ID        uint64
+	CreatedAt time.Time
+	User      *User
+	Service   *Service
+}
+
+// Save stores the user service permission in the database. It returns an error
+// if the permission already exists.
+func (p *UserServicePermission) Save(ctx context.Context, d types.Querier) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	timeNow := d.TimeNow().UTC()
+	stmt := `INSERT INTO user_service_permissions
+		(id, created_at, user_id, service_id)
+		VALUES (NULL, ?, ?, ?)`
+	res, err := d.ExecContext(ctx, stmt, timeNow, p.User.ID, p.Service.ID)
+	if err != nil {
+		return types.Err("permission", p.filterStr(), err)
+	}
+
+	p.ID, err = lastInsertID(res)
+	if err != nil {
+		return err
+	}
+	p.CreatedAt = timeNow
+
+	return nil
+}
+
+// Load the user service permission from the database. The user and service IDs
+// must be set for the lookup. It returns a NoResultError if the user doesn't
+// have permission for the service.
+func (p *UserServicePermission) Load(ctx context.Context, d types.Querier) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	perms, err := UserServicePermissions(ctx, d, types.NewFilter(
+		"usp.user_id = ? AND usp.service_id = ?", []any{p.User.ID, p.Service.ID}))
+	if err != nil {
+		return err
+	}
+
+	if len(perms) == 0 {
+		return types.NoResultError{ModelName: "permission", ID: p.filterStr()}
+	}
+	*p = *perms[0]
+
+	return nil
+}
+
+// Delete removes the user service permission from the database. The user and
+// service IDs must be set for the lookup. It returns an error if the permission
+// doesn't exist.
+func (p *UserServicePermission) Delete(ctx context.Context, d types.Querier) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	stmt := `DELETE FROM user_service_permissions WHERE user_id = ? AND service_id = ?`
+	res, err := d.ExecContext(ctx, stmt, p.User.ID, p.Service.ID)
+	if err != nil {
+		return fmt.Errorf("failed deleting permission for %s: %w", p.filterStr(), err)
+	}
+
+	var n int64
+	if n, err = res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed getting affected rows: %w", err)
+	} else if n == 0 {
+		return types.NoResultError{ModelName: "permission", ID: p.filterStr()}
+	}
+
+	return nil
+}
+
+func (p *UserServicePermission) validate() error {
+	if p.User == nil || p.User.ID == 0 {
+		return types.InvalidInputError{Msg: "permission user ID must be set"}
+	}
+	if p.Service == nil || p.Service.ID == 0 {
+		return types.InvalidInputError{Msg: "permission service ID must be set"}
+	}
+
+	return nil
+}
+
+func (p *UserServicePermission) filterStr() string {
+	return fmt.Sprintf("user '%s' and service '%s'", p.User.Name, p.Service.Name)
+}
+
+// UserServicePermissions returns one or more user service permissions from the
+// database. An optional filter can be passed to limit the results.
+func UserServicePermissions(
+	ctx context.Context, d types.Querier, filter *types.Filter,
+) (perms []*UserServicePermission, rerr error) {
+	query := `SELECT usp.id, usp.created_at, usp.user_id, usp.service_id
+		FROM user_service_permissions usp %s
+		ORDER BY usp.user_id ASC, usp.service_id ASC`
+
+	where := "1=1"
+	args := []any{}
+	if filter != nil {
+		where = filter.Where
+		args = filter.Args
+	}
+
+	query = fmt.Sprintf(query, fmt.Sprintf("WHERE %s", where))
+
+	rows, err := d.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, types.LoadError{ModelName: "permissions", Err: err}
+	}
+	defer func() {
+		if err = rows.Close(); err != nil {
+			rerr = fmt.Errorf("failed closing user_service_permissions rows: %w", err)
+		}
+	}()
+
+	perms = make([]*UserServicePermission, 0)
+	services := make(map[uint64]*Service)
+	users := make(map[uint64]*User)
+	for rows.Next() {
+		var (
+			p                 = &UserServicePermission{}
+			userID, serviceID uint64
+		)
+		err = rows.Scan(&p.ID, &p.CreatedAt, &userID, &serviceID)
+		if err != nil {
+			return nil, types.ScanError{ModelName: "permission", Err: err}
+		}
+
+		user, ok := users[userID]
+		if !ok {
+			user = &User{ID: userID}
+			if err = user.Load(ctx, d); err != nil {
+				return nil, types.LoadError{ModelName: "permission user", Err: err}
+			}
+			users[userID] = user
+		}
+		p.User = user
+
+		svc, ok := services[serviceID]
+		if !ok {
+			svc = &Service{ID: serviceID}
+			if err = svc.Load(ctx, d); err != nil {
+				return nil, types.LoadError{ModelName: "permission service", Err: err}
+			}
+			services[serviceID] = svc
+		}
+		p.Service = svc
+
+		perms = append(perms, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed iterating over permission rows: %w", err)
+	}
+
+	return perms, nil
+}
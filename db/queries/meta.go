@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"go.hackfix.me/sesame/db/types"
 )
@@ -24,9 +25,138 @@ func GetServerTLSCert(ctx context.Context, d types.Querier) (
 		return cert, errors.New("server TLS certificate not found")
 	}
 
+	if cert.V, err = d.Decrypt(cert.V); err != nil {
+		return cert, fmt.Errorf("failed decrypting server TLS certificate: %w", err)
+	}
+
 	return
 }
 
+// SetServerTLSCert replaces the server TLS certificate stored in the database.
+func SetServerTLSCert(ctx context.Context, d types.Querier, cert []byte) error {
+	cert, err := d.Encrypt(cert)
+	if err != nil {
+		return fmt.Errorf("failed encrypting server TLS certificate: %w", err)
+	}
+
+	res, err := d.ExecContext(ctx, `UPDATE _meta SET server_tls_cert = ?`, cert)
+	if err != nil {
+		return fmt.Errorf("failed updating server TLS certificate: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed getting affected rows: %w", err)
+	} else if n == 0 {
+		return errors.New("server TLS certificate not found")
+	}
+
+	return nil
+}
+
+// GetCATLSCert retrieves the CA TLS certificate from the database. The returned
+// value is invalid if the database was initialized before the CA certificate
+// was separated from the server TLS certificate.
+func GetCATLSCert(ctx context.Context, d types.Querier) (cert sql.Null[[]byte], err error) {
+	err = d.QueryRowContext(ctx, `SELECT ca_tls_cert FROM _meta`).Scan(&cert)
+	if err != nil {
+		return cert, fmt.Errorf("failed scanning _meta row: %w", err)
+	}
+
+	if cert.Valid {
+		if cert.V, err = d.Decrypt(cert.V); err != nil {
+			return cert, fmt.Errorf("failed decrypting CA TLS certificate: %w", err)
+		}
+	}
+
+	return cert, nil
+}
+
+// CARollover is the state of a CA certificate rollover, during which the
+// previous CA certificate is still trusted.
+type CARollover struct {
+	// PrevCACert is the DER-encoded previous CA certificate.
+	PrevCACert []byte
+	// CrossCert is the DER-encoded current CA certificate signed by the
+	// previous CA, which allows clients that only trust the previous CA to
+	// verify certificates issued by the current CA.
+	CrossCert []byte
+	// EndsAt is the time after which the previous CA is no longer trusted.
+	EndsAt time.Time
+}
+
+// GetCARollover retrieves the state of the last CA certificate rollover from
+// the database. It returns nil if the CA certificate was never rotated.
+func GetCARollover(ctx context.Context, d types.Querier) (*CARollover, error) {
+	var (
+		prevCACert, crossCert sql.Null[[]byte]
+		endsAt                sql.Null[time.Time]
+	)
+	err := d.QueryRowContext(ctx,
+		`SELECT prev_ca_cert, ca_cross_cert, ca_rollover_ends_at FROM _meta`).
+		Scan(&prevCACert, &crossCert, &endsAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed scanning _meta row: %w", err)
+	}
+
+	if !prevCACert.Valid || !crossCert.Valid || !endsAt.Valid {
+		return nil, nil //nolint:nilnil // A missing rollover is not an error.
+	}
+
+	return &CARollover{PrevCACert: prevCACert.V, CrossCert: crossCert.V, EndsAt: endsAt.V}, nil
+}
+
+// SetCATLSCert replaces the CA and server TLS certificates stored in the
+// database. If rollover is not nil, it's stored as well.
+func SetCATLSCert(ctx context.Context, d types.Querier, caCert, serverCert []byte, rollover *CARollover) error {
+	caCert, err := d.Encrypt(caCert)
+	if err != nil {
+		return fmt.Errorf("failed encrypting CA TLS certificate: %w", err)
+	}
+	serverCert, err = d.Encrypt(serverCert)
+	if err != nil {
+		return fmt.Errorf("failed encrypting server TLS certificate: %w", err)
+	}
+
+	var (
+		prevCACert, crossCert sql.Null[[]byte]
+		endsAt                sql.Null[time.Time]
+	)
+	if rollover != nil {
+		prevCACert = sql.Null[[]byte]{V: rollover.PrevCACert, Valid: true}
+		crossCert = sql.Null[[]byte]{V: rollover.CrossCert, Valid: true}
+		endsAt = sql.Null[time.Time]{V: rollover.EndsAt.UTC(), Valid: true}
+	}
+
+	res, err := d.ExecContext(ctx,
+		`UPDATE _meta SET ca_tls_cert = ?, server_tls_cert = ?, prev_ca_cert = ?,
+			ca_cross_cert = ?, ca_rollover_ends_at = ?`,
+		caCert, serverCert, prevCACert, crossCert, endsAt)
+	if err != nil {
+		return fmt.Errorf("failed updating CA TLS certificate: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed getting affected rows: %w", err)
+	} else if n == 0 {
+		return errors.New("database is not initialized")
+	}
+
+	return nil
+}
+
+// GetEncryption retrieves the salt used to derive the encryption key from a
+// passphrase, and the value used to verify the encryption key. The key check
+// is nil if encryption at rest is disabled.
+func GetEncryption(ctx context.Context, d types.Querier) (salt, keyCheck []byte, err error) {
+	err = d.QueryRowContext(ctx, `SELECT encryption_salt, encryption_key_check FROM _meta`).
+		Scan(&salt, &keyCheck)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, fmt.Errorf("failed scanning _meta row: %w", err)
+	}
+
+	return salt, keyCheck, nil
+}
+
 // GetAllTables returns a map of all table names in the database that contain user data.
 func GetAllTables(ctx context.Context, d types.Querier) (allTables map[string]struct{}, rerr error) {
 	allTables = make(map[string]struct{})
@@ -12,6 +12,12 @@ import (
 type Querier interface {
 	NewContext() context.Context
 	TimeNow() time.Time
+	// Encrypt encrypts sensitive data before it's stored, if encryption at
+	// rest is enabled. Otherwise, the data is returned unchanged.
+	Encrypt(data []byte) ([]byte, error)
+	// Decrypt decrypts sensitive data encrypted with Encrypt. Data that isn't
+	// encrypted is returned unchanged.
+	Decrypt(data []byte) ([]byte, error)
 	ExecContext(ctx context.Context, sql string, arguments ...any) (sql.Result, error)
 	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
 	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
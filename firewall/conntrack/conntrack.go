@@ -0,0 +1,223 @@
+package conntrack
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/mdlayher/netlink"
+	"go4.org/netipx"
+	"golang.org/x/sys/unix"
+
+	ftypes "go.hackfix.me/sesame/firewall/types"
+)
+
+// Message types and attributes of the ctnetlink subsystem.
+// See include/uapi/linux/netfilter/nfnetlink_conntrack.h in the Linux source.
+const (
+	msgCtGet    = 1
+	msgCtDelete = 2
+
+	attrTupleOrig = 1
+	attrID        = 12
+	attrZone      = 18
+
+	attrTupleIP    = 1
+	attrTupleProto = 2
+
+	attrIPv4Src = 1
+	attrIPv6Src = 3
+
+	attrProtoNum     = 1
+	attrProtoDstPort = 3
+
+	// The length of the nfgenmsg header that precedes the attributes.
+	nfgenmsgLen = 4
+)
+
+// Conntrack deletes entries of the Linux connection tracking table via
+// netlink. Since firewall rules usually accept packets of established
+// connections without further checks, deleting their entries causes the
+// following packets to be evaluated again by the firewall rules.
+type Conntrack struct {
+	dial func() (*netlink.Conn, error)
+}
+
+var _ ftypes.ConnTracker = (*Conntrack)(nil)
+
+// New returns a new Conntrack instance. A new netlink connection is
+// established for every operation, since they're infrequent.
+func New(opts ...Option) *Conntrack {
+	c := &Conntrack{
+		dial: func() (*netlink.Conn, error) {
+			return netlink.Dial(unix.NETLINK_NETFILTER, nil)
+		},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Delete removes the entries of connections from a set of IP addresses to the
+// destination ports of the protocol, and returns the number of removed entries.
+// Entries that are removed by the kernel while this runs are ignored.
+func (c *Conntrack) Delete(
+	ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges,
+) (n int, rerr error) {
+	conn, err := c.dial()
+	if err != nil {
+		return 0, fmt.Errorf("failed establishing netlink connection: %w", err)
+	}
+	defer func() {
+		if err = conn.Close(); err != nil {
+			rerr = fmt.Errorf("failed closing netlink connection: %w", err)
+		}
+	}()
+
+	// Entries of both IP address families are listed, and then filtered here,
+	// since the kernel only supports filtering by mark and zone.
+	msgs, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  msgType(msgCtGet),
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: nfgenmsg(unix.AF_UNSPEC),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed listing connection tracking entries: %w", err)
+	}
+
+	protos := make([]uint8, 0, 2)
+	for _, p := range proto.Expand() {
+		protos = append(protos, protoNum(p))
+	}
+
+	for _, msg := range msgs {
+		var e *entry
+		if e, err = parseEntry(msg.Data); err != nil {
+			return n, err
+		}
+
+		if !ipSet.Contains(e.src) || !slices.Contains(protos, e.proto) ||
+			!slices.ContainsFunc(destPorts, func(pr ftypes.PortRange) bool { return pr.Contains(e.dstPort) }) {
+			continue
+		}
+
+		_, err = conn.Execute(netlink.Message{
+			Header: netlink.Header{
+				Type:  msgType(msgCtDelete),
+				Flags: netlink.Request | netlink.Acknowledge,
+			},
+			Data: append(nfgenmsg(e.family), e.key...),
+		})
+		if errors.Is(err, unix.ENOENT) {
+			continue
+		} else if err != nil {
+			return n, fmt.Errorf("failed deleting connection tracking entry of %s: %w", e.src, err)
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// entry is a connection tracking entry.
+type entry struct {
+	family  uint8
+	src     netip.Addr
+	proto   uint8
+	dstPort uint16
+	// The encoded attributes that identify the entry in delete requests.
+	key []byte
+}
+
+// parseEntry parses the entry from the data of a ctnetlink message. Only the
+// source address, protocol and destination port of the original direction are
+// parsed.
+func parseEntry(data []byte) (*entry, error) {
+	if len(data) < nfgenmsgLen {
+		return nil, fmt.Errorf("invalid connection tracking message length %d", len(data))
+	}
+
+	ad, err := netlink.NewAttributeDecoder(data[nfgenmsgLen:])
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding connection tracking attributes: %w", err)
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	e := &entry{family: data[0]}
+	ae := netlink.NewAttributeEncoder()
+	for ad.Next() {
+		switch ad.Type() {
+		case attrTupleOrig:
+			ae.Bytes(attrTupleOrig|unix.NLA_F_NESTED, ad.Bytes())
+			ad.Nested(e.parseTuple)
+		case attrID, attrZone:
+			ae.Bytes(ad.Type(), ad.Bytes())
+		}
+	}
+	if err = ad.Err(); err != nil {
+		return nil, fmt.Errorf("failed decoding connection tracking attributes: %w", err)
+	}
+
+	if e.key, err = ae.Encode(); err != nil {
+		return nil, fmt.Errorf("failed encoding connection tracking attributes: %w", err)
+	}
+
+	return e, nil
+}
+
+// parseTuple parses the attributes of a connection tuple.
+func (e *entry) parseTuple(ad *netlink.AttributeDecoder) error {
+	for ad.Next() {
+		switch ad.Type() {
+		case attrTupleIP:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					if t := nad.Type(); t == attrIPv4Src || t == attrIPv6Src {
+						e.src, _ = netip.AddrFromSlice(nad.Bytes())
+					}
+				}
+				return nil
+			})
+		case attrTupleProto:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					switch nad.Type() {
+					case attrProtoNum:
+						e.proto = nad.Uint8()
+					case attrProtoDstPort:
+						e.dstPort = nad.Uint16()
+					}
+				}
+				return nil
+			})
+		}
+	}
+
+	return nil
+}
+
+// msgType returns the netlink message type of the ctnetlink message type.
+func msgType(t uint16) netlink.HeaderType {
+	return netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | t)
+}
+
+// nfgenmsg returns the nfgenmsg header of ctnetlink messages for the address
+// family.
+func nfgenmsg(family uint8) []byte {
+	return []byte{family, unix.NFNETLINK_V0, 0, 0}
+}
+
+// protoNum returns the IP protocol number of the protocol.
+func protoNum(p ftypes.Protocol) uint8 {
+	if p == ftypes.ProtocolUDP {
+		return unix.IPPROTO_UDP
+	}
+	return unix.IPPROTO_TCP
+}
@@ -0,0 +1,134 @@
+package conntrack_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"go.hackfix.me/sesame/firewall"
+	"go.hackfix.me/sesame/firewall/conntrack"
+	ftypes "go.hackfix.me/sesame/firewall/types"
+)
+
+func TestConntrackDelete(t *testing.T) {
+	t.Parallel()
+
+	entries := []netlink.Message{
+		ctEntry(t, "10.0.0.1", unix.IPPROTO_TCP, 22, 1),
+		ctEntry(t, "10.0.0.2", unix.IPPROTO_UDP, 22, 2),
+		ctEntry(t, "10.0.0.3", unix.IPPROTO_TCP, 80, 3),
+		ctEntry(t, "192.168.1.1", unix.IPPROTO_TCP, 22, 4),
+		ctEntry(t, "2001:db8::1", unix.IPPROTO_TCP, 22, 5),
+		// Removed by the kernel before the delete request.
+		ctEntry(t, "10.0.0.4", unix.IPPROTO_TCP, 22, 6),
+	}
+
+	var deleted []netlink.Message
+	dial := func() (*netlink.Conn, error) {
+		return nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+			req := reqs[0]
+			switch req.Header.Type {
+			case netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | 1):
+				assert.Equal(t, netlink.Request|netlink.Dump, req.Header.Flags)
+				assert.Equal(t, []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, 0}, req.Data)
+				// The last message is replaced by the final "done" message.
+				return nltest.Multipart(reply(req, append(entries, netlink.Message{})...))
+			case netlink.HeaderType(unix.NFNL_SUBSYS_CTNETLINK<<8 | 2):
+				assert.Equal(t, netlink.Request|netlink.Acknowledge, req.Header.Flags)
+				if string(req.Data) == string(entries[5].Data) {
+					return nltest.Error(int(unix.ENOENT), reqs)
+				}
+				deleted = append(deleted, req)
+				return nltest.Error(0, reqs)
+			}
+			return nil, errors.New("unexpected request")
+		}), nil
+	}
+	ct := conntrack.New(conntrack.WithDialer(dial))
+
+	ipSet, err := firewall.ParseToIPSet("10.0.0.0/24", "2001:db8::/32")
+	require.NoError(t, err)
+
+	n, err := ct.Delete(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 22, To: 22}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// The delete requests contain the original tuple and ID of the entries.
+	require.Len(t, deleted, 2)
+	assert.Equal(t, entries[0].Data, deleted[0].Data)
+	assert.Equal(t, entries[4].Data, deleted[1].Data)
+}
+
+func TestConntrackDeleteError(t *testing.T) {
+	t.Parallel()
+
+	dial := func() (*netlink.Conn, error) {
+		return nltest.Dial(func(reqs []netlink.Message) ([]netlink.Message, error) {
+			if reqs[0].Header.Flags&netlink.Dump != 0 {
+				return reply(reqs[0], ctEntry(t, "10.0.0.1", unix.IPPROTO_TCP, 22, 1)), nil
+			}
+			return nltest.Error(int(unix.EPERM), reqs)
+		}), nil
+	}
+	ct := conntrack.New(conntrack.WithDialer(dial))
+
+	ipSet, err := firewall.ParseToIPSet("10.0.0.1")
+	require.NoError(t, err)
+
+	n, err := ct.Delete(ipSet, ftypes.ProtocolBoth, ftypes.PortRanges{{From: 1, To: 1024}})
+	require.ErrorIs(t, err, unix.EPERM)
+	assert.ErrorContains(t, err, "failed deleting connection tracking entry of 10.0.0.1")
+	assert.Equal(t, 0, n)
+}
+
+// reply returns copies of the messages with the header fields of a reply to req.
+func reply(req netlink.Message, msgs ...netlink.Message) []netlink.Message {
+	replies := make([]netlink.Message, len(msgs))
+	for i, msg := range msgs {
+		msg.Header.Sequence = req.Header.Sequence
+		msg.Header.PID = nltest.PID
+		replies[i] = msg
+	}
+	return replies
+}
+
+// ctEntry returns a ctnetlink message of a connection tracking entry, with the
+// original tuple and ID attributes the kernel would send.
+func ctEntry(t *testing.T, src string, proto uint8, dstPort uint16, id uint32) netlink.Message {
+	t.Helper()
+
+	addr := netip.MustParseAddr(src)
+	family, srcAttr := uint8(unix.AF_INET), uint16(1)
+	if addr.Is6() {
+		family, srcAttr = unix.AF_INET6, 3
+	}
+
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Nested(1, func(tae *netlink.AttributeEncoder) error {
+		tae.Nested(1, func(iae *netlink.AttributeEncoder) error {
+			iae.Bytes(srcAttr, addr.AsSlice())
+			return nil
+		})
+		tae.Nested(2, func(pae *netlink.AttributeEncoder) error {
+			pae.Uint8(1, proto)
+			pae.Uint16(2, 50000)
+			pae.Uint16(3, dstPort)
+			return nil
+		})
+		return nil
+	})
+	ae.Uint32(12, id)
+
+	attrs, err := ae.Encode()
+	require.NoError(t, err)
+
+	return netlink.Message{Data: append([]byte{family, unix.NFNETLINK_V0, 0, 0}, attrs...)}
+}
@@ -0,0 +1,4 @@
+// Package conntrack contains an abstraction over the Linux connection tracking
+// table, used for terminating established connections of clients whose access
+// was denied.
+package conntrack
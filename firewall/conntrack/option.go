@@ -0,0 +1,14 @@
+package conntrack
+
+import "github.com/mdlayher/netlink"
+
+// Option is a function that allows configuring Conntrack.
+type Option func(*Conntrack)
+
+// WithDialer sets the function used to establish the netlink connection to the
+// kernel.
+func WithDialer(dial func() (*netlink.Conn, error)) Option {
+	return func(c *Conntrack) {
+		c.dial = dial
+	}
+}
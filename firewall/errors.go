@@ -0,0 +1,12 @@
+package firewall
+
+// AccessPolicyError is returned when a user isn't allowed to grant the
+// requested access by their access policy.
+type AccessPolicyError struct {
+	Msg string
+}
+
+// Error returns a string representation of the error.
+func (e AccessPolicyError) Error() string {
+	return e.Msg
+}
@@ -0,0 +1,3 @@
+// Package iptables contains an abstraction over the legacy Linux iptables
+// firewall, using ipset for managing allowed clients.
+package iptables
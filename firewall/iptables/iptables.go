@@ -0,0 +1,608 @@
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"go4.org/netipx"
+
+	ftypes "go.hackfix.me/sesame/firewall/types"
+)
+
+const (
+	chainName       = "SESAME"
+	setAllowed4Name = "sesame_allowed_clients4"
+	setAllowed6Name = "sesame_allowed_clients6"
+	setBlocked4Name = "sesame_blocked_clients4"
+	setBlocked6Name = "sesame_blocked_clients6"
+	setDenied4Name  = "sesame_denied_clients4"
+	setDenied6Name  = "sesame_denied_clients6"
+	// setMaxElements is the maximum number of entries of each ipset. IP ranges
+	// are split into prefixes, and port ranges into individual ports, so a
+	// single element can take up many entries, and the default of 65536 is
+	// easily reached.
+	setMaxElements = 1 << 20
+)
+
+// family contains the commands and set names specific to an IP address family.
+type family struct {
+	iptables       string // iptables or ip6tables
+	ipset          string // ipset family name
+	setName        string
+	blockedSetName string
+	deniedSetName  string
+}
+
+// IPTables is an abstraction over the legacy Linux iptables firewall. Allowed
+// clients are stored in ipsets, which are matched by rules in a dedicated chain.
+type IPTables struct {
+	runner Runner
+	// IPv4/6 specific commands and sets, keyed by the IP address bit length.
+	families              map[int]family
+	defaultAccessDuration time.Duration
+	// If true, only packets of established connections in the reply direction
+	// are accepted regardless of the allowed sets.
+	strictEstablished bool
+	logger            *slog.Logger
+}
+
+var _ ftypes.Firewall = (*IPTables)(nil)
+
+// New returns a new IPTables instance.
+func New(defaultAccessDuration time.Duration, logger *slog.Logger, opts ...Option) *IPTables {
+	ipt := &IPTables{
+		runner: execRunner{},
+		families: map[int]family{
+			32: {
+				iptables: "iptables", ipset: "inet", setName: setAllowed4Name,
+				blockedSetName: setBlocked4Name, deniedSetName: setDenied4Name,
+			},
+			128: {
+				iptables: "ip6tables", ipset: "inet6", setName: setAllowed6Name,
+				blockedSetName: setBlocked6Name, deniedSetName: setDenied6Name,
+			},
+		},
+		defaultAccessDuration: defaultAccessDuration,
+		logger:                logger.With("firewall_type", "iptables"),
+	}
+
+	for _, opt := range opts {
+		opt(ipt)
+	}
+
+	return ipt
+}
+
+// Init initializes the firewall by creating the ipsets and the iptables and
+// ip6tables rules. It is idempotent, and won't recreate objects if they
+// already exist.
+//
+// It is equivalent to running the following commands:
+//
+//	ipset create sesame_allowed_clients4 hash:net,port family inet maxelem 1048576 timeout 300 comment
+//	ipset create sesame_blocked_clients4 hash:ip family inet maxelem 1048576 timeout 300
+//	ipset create sesame_denied_clients4 hash:net,port family inet maxelem 1048576 timeout 300 comment
+//	ipset create sesame_allowed_clients6 hash:net,port family inet6 maxelem 1048576 timeout 300 comment
+//	ipset create sesame_blocked_clients6 hash:ip family inet6 maxelem 1048576 timeout 300
+//	ipset create sesame_denied_clients6 hash:net,port family inet6 maxelem 1048576 timeout 300 comment
+//
+//	iptables -N SESAME
+//	iptables -A SESAME -m mark --mark 0x1 -j ACCEPT
+//	iptables -A SESAME -m set --match-set sesame_blocked_clients4 src -j DROP
+//	iptables -A SESAME -m set --match-set sesame_denied_clients4 src,dst -j DROP
+//	iptables -A SESAME -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
+//	iptables -A SESAME -m set --match-set sesame_allowed_clients4 src,dst -j ACCEPT
+//	iptables -A SESAME -j DROP
+//	iptables -I INPUT -j SESAME
+//
+// The same rules are created with ip6tables, matching on the IPv6 sets instead.
+// The final DROP rule acts as the drop policy of the chain, since user-defined
+// chains can't have one. See the NFTables.Init documentation for the reason of
+// accepting packets with mark 1.
+//
+// If strict established mode is enabled, the rule that accepts packets of
+// established connections also matches on '--ctdir REPLY'. Packets that clients
+// send on established connections are then only accepted while they're in the
+// allowed sets, so their connections are cut off once their access expires.
+//
+// If the chain was created by an older Sesame version without the rules that
+// drop packets from banned or blocked clients, the missing rules are inserted
+// after the first one. If it was created with a different strict established
+// mode, the rule that accepts packets of established connections is replaced.
+//
+//nolint:funlen // This is easier to understand as a single long function.
+func (ipt *IPTables) Init() error {
+	var init bool
+	for _, bitLen := range []int{32, 128} {
+		fam := ipt.families[bitLen]
+
+		_, err := ipt.runner.Run(nil, "ipset", "create", fam.setName, "hash:net,port",
+			"family", fam.ipset, "maxelem", strconv.Itoa(setMaxElements), "timeout", timeoutSeconds(ipt.defaultAccessDuration), "comment", "-exist")
+		if err != nil {
+			return fmt.Errorf("failed creating ipset '%s': %w", fam.setName, err)
+		}
+
+		_, err = ipt.runner.Run(nil, "ipset", "create", fam.blockedSetName, "hash:ip",
+			"family", fam.ipset, "maxelem", strconv.Itoa(setMaxElements), "timeout", timeoutSeconds(ipt.defaultAccessDuration), "-exist")
+		if err != nil {
+			return fmt.Errorf("failed creating ipset '%s': %w", fam.blockedSetName, err)
+		}
+
+		_, err = ipt.runner.Run(nil, "ipset", "create", fam.deniedSetName, "hash:net,port",
+			"family", fam.ipset, "maxelem", strconv.Itoa(setMaxElements), "timeout", timeoutSeconds(ipt.defaultAccessDuration), "comment", "-exist")
+		if err != nil {
+			return fmt.Errorf("failed creating ipset '%s': %w", fam.deniedSetName, err)
+		}
+
+		// Rules added in later Sesame versions, in the order they should
+		// appear after the first rule.
+		dropRules := [][]string{
+			{"-m", "set", "--match-set", fam.blockedSetName, "src", "-j", "DROP"},
+			{"-m", "set", "--match-set", fam.deniedSetName, "src,dst", "-j", "DROP"},
+		}
+
+		_, err = ipt.runner.Run(nil, fam.iptables, "-w", "-n", "-L", chainName)
+		switch {
+		case err != nil && strings.Contains(err.Error(), "No chain"):
+		case err != nil:
+			return fmt.Errorf("failed getting %s chain '%s': %w", fam.iptables, chainName, err)
+		default:
+			// The chain exists, so assume that all rules were previously created
+			// as well, in order to avoid adding duplicate rules. The exception are
+			// the rules added in later Sesame versions.
+			for i, rule := range dropRules {
+				args := append([]string{"-w", "-C", chainName}, rule...)
+				if _, err = ipt.runner.Run(nil, fam.iptables, args...); err == nil {
+					continue
+				}
+				args = append([]string{"-w", "-I", chainName, strconv.Itoa(2 + i)}, rule...)
+				if _, err = ipt.runner.Run(nil, fam.iptables, args...); err != nil {
+					return fmt.Errorf("failed adding %s rule: %w", fam.iptables, err)
+				}
+			}
+			if err = ipt.updateEstablishedRule(fam, 2+len(dropRules)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !init {
+			ipt.logger.Debug("initializing firewall")
+			init = true
+		}
+
+		rules := [][]string{
+			{"-N", chainName},
+			{"-A", chainName, "-m", "mark", "--mark", "0x1", "-j", "ACCEPT"},
+			append([]string{"-A", chainName}, dropRules[0]...),
+			append([]string{"-A", chainName}, dropRules[1]...),
+			append([]string{"-A", chainName}, establishedRule(ipt.strictEstablished)...),
+			{"-A", chainName, "-m", "set", "--match-set", fam.setName, "src,dst", "-j", "ACCEPT"},
+			{"-A", chainName, "-j", "DROP"},
+			{"-I", "INPUT", "-j", chainName},
+		}
+		for _, rule := range rules {
+			if _, err = ipt.runner.Run(nil, fam.iptables, append([]string{"-w"}, rule...)...); err != nil {
+				return fmt.Errorf("failed adding %s rule: %w", fam.iptables, err)
+			}
+		}
+	}
+
+	if init {
+		ipt.logger.Info("firewall initialized")
+	}
+
+	return nil
+}
+
+// Check returns an error if the ipsets, the chain, or the rule that jumps to
+// the chain from the INPUT chain don't exist.
+func (ipt *IPTables) Check() error {
+	for _, bitLen := range []int{32, 128} {
+		fam := ipt.families[bitLen]
+
+		for _, setName := range []string{fam.setName, fam.blockedSetName, fam.deniedSetName} {
+			if _, err := ipt.runner.Run(nil, "ipset", "list", "-name", setName); err != nil {
+				return fmt.Errorf("failed getting ipset '%s': %w", setName, err)
+			}
+		}
+
+		if _, err := ipt.runner.Run(nil, fam.iptables, "-w", "-n", "-L", chainName); err != nil {
+			return fmt.Errorf("failed getting %s chain '%s': %w", fam.iptables, chainName, err)
+		}
+
+		if _, err := ipt.runner.Run(nil, fam.iptables, "-w", "-C", "INPUT", "-j", chainName); err != nil {
+			return fmt.Errorf("failed checking %s rule: %w", fam.iptables, err)
+		}
+	}
+
+	return nil
+}
+
+// Allow grants access to the destination ports of the protocol from a set of IP
+// addresses for a specific amount of time. Existing entries that overlap with
+// the IP set are replaced, so that the overlapping IP addresses are granted
+// access for the new duration, and the rest keep their remaining time.
+func (ipt *IPTables) Allow(
+	ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges, duration time.Duration,
+) error {
+	removed, remainder, err := ipt.subtract(ipt.Elements, ipSet, proto, destPorts)
+	if err != nil {
+		return err
+	}
+
+	return ipt.restore(allowedSetName, removed,
+		append(remainder, ftypes.NewElements(ipSet, proto, destPorts, duration)...))
+}
+
+// Deny blocks access to the destination ports of the protocol from a set of IP
+// addresses. Existing entries that overlap with the IP set are replaced by the
+// remainder of their IP range, which keeps the remaining time until expiration.
+func (ipt *IPTables) Deny(ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges) error {
+	removed, remainder, err := ipt.subtract(ipt.Elements, ipSet, proto, destPorts)
+	if err != nil {
+		return err
+	}
+
+	return ipt.restore(allowedSetName, removed, remainder)
+}
+
+// Elements returns all unexpired entries in the allowed ipsets, along with
+// their remaining time until expiration. The total timeout of entries isn't
+// stored by ipset, so it's always 0.
+func (ipt *IPTables) Elements() ([]ftypes.Element, error) {
+	return ipt.elements(allowedSetName)
+}
+
+// Ban blocks all traffic from an IP address for a specific amount of time. If
+// the IP address is already banned, the timeout of the entry is replaced.
+func (ipt *IPTables) Ban(addr netip.Addr, duration time.Duration) error {
+	addr = addr.Unmap()
+	setName := ipt.families[addr.BitLen()].blockedSetName
+	_, err := ipt.runner.Run(nil, "ipset", "add", setName, addr.String(),
+		"timeout", timeoutSeconds(duration), "-exist")
+	if err != nil {
+		return fmt.Errorf("failed adding entry to ipset '%s': %w", setName, err)
+	}
+
+	return nil
+}
+
+// Unban removes the ban of an IP address.
+func (ipt *IPTables) Unban(addr netip.Addr) error {
+	addr = addr.Unmap()
+	setName := ipt.families[addr.BitLen()].blockedSetName
+	if _, err := ipt.runner.Run(nil, "ipset", "del", setName, addr.String(), "-exist"); err != nil {
+		return fmt.Errorf("failed deleting entry from ipset '%s': %w", setName, err)
+	}
+
+	return nil
+}
+
+// Bans returns all unexpired entries in the blocked ipsets, along with their
+// remaining time until expiration. The total timeout of entries isn't stored
+// by ipset, so it's always 0.
+func (ipt *IPTables) Bans() ([]ftypes.Ban, error) {
+	bans := []ftypes.Ban{}
+	for _, bitLen := range []int{32, 128} {
+		setName := ipt.families[bitLen].blockedSetName
+		out, err := ipt.runner.Run(nil, "ipset", "save", setName)
+		if err != nil {
+			return nil, fmt.Errorf("failed listing ipset '%s': %w", setName, err)
+		}
+
+		setBans, err := parseSaveBans(out)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing ipset '%s': %w", setName, err)
+		}
+		bans = append(bans, setBans...)
+	}
+
+	return bans, nil
+}
+
+// Block denies access to the destination ports of the protocol from a set of
+// IP addresses for a specific amount of time. A duration of 0 blocks access
+// until it's unblocked. Existing entries that overlap with the IP set are
+// replaced, so that the overlapping IP addresses are blocked for the new
+// duration, and the rest keep their remaining time.
+func (ipt *IPTables) Block(
+	ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges, duration time.Duration,
+) error {
+	removed, remainder, err := ipt.subtract(ipt.Blocks, ipSet, proto, destPorts)
+	if err != nil {
+		return err
+	}
+
+	return ipt.restore(deniedSetName, removed,
+		append(remainder, ftypes.NewElements(ipSet, proto, destPorts, duration)...))
+}
+
+// Unblock removes the blocks of the destination ports of the protocol from a
+// set of IP addresses. Existing entries that overlap with the IP set are
+// replaced by the remainder of their IP range, which keeps the remaining time
+// until expiration.
+func (ipt *IPTables) Unblock(ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges) error {
+	removed, remainder, err := ipt.subtract(ipt.Blocks, ipSet, proto, destPorts)
+	if err != nil {
+		return err
+	}
+
+	return ipt.restore(deniedSetName, removed, remainder)
+}
+
+// Blocks returns all unexpired entries in the denied ipsets, along with their
+// remaining time until expiration. Like Elements, the total timeout of entries
+// is always 0, and so is the remaining time of entries that never expire.
+func (ipt *IPTables) Blocks() ([]ftypes.Element, error) {
+	return ipt.elements(deniedSetName)
+}
+
+// elements returns all unexpired entries in the IPv4 and IPv6 ipsets with the
+// name returned by setName.
+func (ipt *IPTables) elements(setName func(family) string) ([]ftypes.Element, error) {
+	elements := []ftypes.Element{}
+	for _, bitLen := range []int{32, 128} {
+		name := setName(ipt.families[bitLen])
+		out, err := ipt.runner.Run(nil, "ipset", "save", name)
+		if err != nil {
+			return nil, fmt.Errorf("failed listing ipset '%s': %w", name, err)
+		}
+
+		setEls, err := parseSave(out)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing ipset '%s': %w", name, err)
+		}
+		elements = append(elements, setEls...)
+	}
+
+	return elements, nil
+}
+
+// subtract returns the existing elements listed by list that overlap with the
+// IP set, and the remainder of their IP ranges. See ftypes.Subtract.
+func (ipt *IPTables) subtract(
+	list func() ([]ftypes.Element, error), ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges,
+) (removed, remainder []ftypes.Element, err error) {
+	elements, err := list()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ftypes.Subtract(elements, ipSet, proto, destPorts)
+}
+
+// restore deletes and adds entries for the elements in the ipsets with the name
+// returned by setName, in a single `ipset restore` invocation. Since ipset only
+// supports CIDR notation for hash:net sets, each IP range is split into
+// prefixes (see setPrefixes), and ipset stores port ranges as individual ports. So the original
+// IP and port ranges are stored in the entry comment, in order for them to be
+// reconstructed by Elements. Entries of the denied ipsets without a timeout
+// never expire.
+func (ipt *IPTables) restore(setName func(family) string, del, add []ftypes.Element) error {
+	if len(del) == 0 && len(add) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, el := range del {
+		name := setName(ipt.families[el.IPRange.From().BitLen()])
+		for _, prefix := range setPrefixes(el.IPRange) {
+			fmt.Fprintf(&buf, "del %s %s,%s:%s\n", name, prefix, el.Protocol, el.DestPorts)
+		}
+	}
+	for _, el := range add {
+		fam := ipt.families[el.IPRange.From().BitLen()]
+		name := setName(fam)
+		timeout := timeoutSeconds(el.Timeout)
+		if el.Timeout == 0 && name == fam.deniedSetName {
+			timeout = "0"
+		}
+		for _, prefix := range setPrefixes(el.IPRange) {
+			fmt.Fprintf(&buf, "add %s %s,%s:%s timeout %s comment \"%s,%s\"\n", name, prefix,
+				el.Protocol, el.DestPorts, timeout, el.IPRange, el.DestPorts)
+		}
+	}
+
+	if _, err := ipt.runner.Run(&buf, "ipset", "restore", "-exist"); err != nil {
+		return fmt.Errorf("failed updating ipset entries: %w", err)
+	}
+
+	return nil
+}
+
+// setPrefixes returns the prefixes that cover the IP range. hash:net sets don't
+// support zero-length prefixes, so a prefix covering all addresses of a family
+// is split into its two halves.
+func setPrefixes(ipRange netipx.IPRange) []netip.Prefix {
+	prefixes := ipRange.Prefixes()
+	if len(prefixes) != 1 || prefixes[0].Bits() != 0 {
+		return prefixes
+	}
+
+	lower := netip.PrefixFrom(prefixes[0].Addr(), 1)
+	upper := netip.PrefixFrom(netipx.PrefixLastIP(lower).Next(), 1)
+
+	return []netip.Prefix{lower, upper}
+}
+
+// parseSave parses the output of `ipset save`, and returns the firewall
+// elements it contains. Entries with the same IP and port range comment are
+// merged into a single element.
+//
+//nolint:funlen // Parsing is easier to follow in a single function.
+func parseSave(out []byte) ([]ftypes.Element, error) {
+	type elKey struct {
+		ipRange netipx.IPRange
+		proto   ftypes.Protocol
+		ports   ftypes.PortRange
+	}
+	var (
+		elements []ftypes.Element
+		seen     = make(map[elKey]struct{})
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// add <set> <prefix>,<proto>:<port> timeout <seconds> comment "<IP range>,<port range>"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != "add" {
+			continue
+		}
+
+		addr, dest, ok := strings.Cut(fields[2], ",")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry '%s'", fields[2])
+		}
+		protoStr, portStr, ok := strings.Cut(dest, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry '%s'", fields[2])
+		}
+		proto, err := ftypes.ProtocolFromString(protoStr)
+		if err != nil || proto == ftypes.ProtocolBoth {
+			return nil, fmt.Errorf("invalid protocol in entry '%s'", fields[2])
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in entry '%s': %w", fields[2], err)
+		}
+
+		var ipRange netipx.IPRange
+		if prefix, perr := netip.ParsePrefix(addr); perr == nil {
+			ipRange = netipx.RangeOfPrefix(prefix)
+		} else if ip, aerr := netip.ParseAddr(addr); aerr == nil {
+			ipRange = netipx.IPRangeFrom(ip, ip)
+		} else {
+			return nil, fmt.Errorf("invalid address in entry '%s': %w", fields[2], perr)
+		}
+
+		ports := ftypes.PortRange{From: uint16(port), To: uint16(port)}
+		var expires time.Duration
+		for i := 3; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case "timeout":
+				secs, serr := strconv.ParseUint(fields[i+1], 10, 32)
+				if serr != nil {
+					return nil, fmt.Errorf("invalid timeout in entry '%s': %w", fields[2], serr)
+				}
+				expires = time.Duration(secs) * time.Second
+			case "comment":
+				ipRangeStr, portsStr, _ := strings.Cut(strings.Trim(fields[i+1], `"`), ",")
+				if r, rerr := netipx.ParseIPRange(ipRangeStr); rerr == nil {
+					ipRange = r
+				}
+				if pr, perr := ftypes.ParsePortRange(portsStr); perr == nil && pr.Contains(uint16(port)) {
+					ports = pr
+				}
+			}
+		}
+
+		key := elKey{ipRange, proto, ports}
+		if _, ok = seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		elements = append(elements, ftypes.Element{
+			IPRange:   ipRange,
+			Protocol:  proto,
+			DestPorts: ports,
+			Expires:   expires,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading output: %w", err)
+	}
+
+	return elements, nil
+}
+
+// parseSaveBans parses the output of `ipset save` for a blocked ipset, and
+// returns the bans it contains.
+func parseSaveBans(out []byte) ([]ftypes.Ban, error) {
+	var bans []ftypes.Ban
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// add <set> <IP> timeout <seconds>
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != "add" {
+			continue
+		}
+
+		addr, err := netip.ParseAddr(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid address in entry '%s': %w", fields[2], err)
+		}
+
+		var expires time.Duration
+		if len(fields) >= 5 && fields[3] == "timeout" {
+			secs, serr := strconv.ParseUint(fields[4], 10, 32)
+			if serr != nil {
+				return nil, fmt.Errorf("invalid timeout in entry '%s': %w", fields[2], serr)
+			}
+			expires = time.Duration(secs) * time.Second
+		}
+
+		bans = append(bans, ftypes.Ban{Addr: addr, Expires: expires})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed reading output: %w", err)
+	}
+
+	return bans, nil
+}
+
+// updateEstablishedRule replaces the rule that accepts packets of established
+// connections at position pos, if it was created with a different strict
+// established mode.
+func (ipt *IPTables) updateEstablishedRule(fam family, pos int) error {
+	rule := establishedRule(ipt.strictEstablished)
+	args := append([]string{"-w", "-C", chainName}, rule...)
+	if _, err := ipt.runner.Run(nil, fam.iptables, args...); err == nil {
+		return nil
+	}
+
+	args = append([]string{"-w", "-D", chainName}, establishedRule(!ipt.strictEstablished)...)
+	if _, err := ipt.runner.Run(nil, fam.iptables, args...); err != nil {
+		return fmt.Errorf("failed deleting %s rule: %w", fam.iptables, err)
+	}
+	args = append([]string{"-w", "-I", chainName, strconv.Itoa(pos)}, rule...)
+	if _, err := ipt.runner.Run(nil, fam.iptables, args...); err != nil {
+		return fmt.Errorf("failed adding %s rule: %w", fam.iptables, err)
+	}
+	ipt.logger.Info("updated established connections rule",
+		"command", fam.iptables, "strict", ipt.strictEstablished)
+
+	return nil
+}
+
+// establishedRule returns the rule specification that accepts packets of
+// established connections. If strict is true, only packets in the reply
+// direction, i.e. of connections initiated by this host, are accepted.
+func establishedRule(strict bool) []string {
+	rule := []string{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED"}
+	if strict {
+		rule = append(rule, "--ctdir", "REPLY")
+	}
+	return append(rule, "-j", "ACCEPT")
+}
+
+func allowedSetName(f family) string { return f.setName }
+
+func deniedSetName(f family) string { return f.deniedSetName }
+
+// timeoutSeconds returns the duration in whole seconds, as expected by ipset.
+// Durations are rounded up, since a timeout of 0 means the entry never expires.
+func timeoutSeconds(d time.Duration) string {
+	secs := math.Ceil(d.Seconds())
+	return strconv.FormatFloat(max(secs, 1), 'f', 0, 64)
+}
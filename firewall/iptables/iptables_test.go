@@ -0,0 +1,616 @@
+package iptables_test
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go4.org/netipx"
+
+	"go.hackfix.me/sesame/firewall"
+	"go.hackfix.me/sesame/firewall/iptables"
+	ftypes "go.hackfix.me/sesame/firewall/types"
+)
+
+func TestIPTablesInit(t *testing.T) {
+	t.Parallel()
+
+	t.Run("ok/new", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{results: map[string]fakeResult{
+			"iptables -w -n -L SESAME":  {err: errors.New("iptables: No chain/target/match by that name.")},
+			"ip6tables -w -n -L SESAME": {err: errors.New("ip6tables: No chain/target/match by that name.")},
+		}}
+		ipt := iptables.New(5*time.Minute, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+		err := ipt.Init()
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			"ipset create sesame_allowed_clients4 hash:net,port family inet maxelem 1048576 timeout 300 comment -exist",
+			"ipset create sesame_blocked_clients4 hash:ip family inet maxelem 1048576 timeout 300 -exist",
+			"ipset create sesame_denied_clients4 hash:net,port family inet maxelem 1048576 timeout 300 comment -exist",
+			"iptables -w -n -L SESAME",
+			"iptables -w -N SESAME",
+			"iptables -w -A SESAME -m mark --mark 0x1 -j ACCEPT",
+			"iptables -w -A SESAME -m set --match-set sesame_blocked_clients4 src -j DROP",
+			"iptables -w -A SESAME -m set --match-set sesame_denied_clients4 src,dst -j DROP",
+			"iptables -w -A SESAME -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+			"iptables -w -A SESAME -m set --match-set sesame_allowed_clients4 src,dst -j ACCEPT",
+			"iptables -w -A SESAME -j DROP",
+			"iptables -w -I INPUT -j SESAME",
+			"ipset create sesame_allowed_clients6 hash:net,port family inet6 maxelem 1048576 timeout 300 comment -exist",
+			"ipset create sesame_blocked_clients6 hash:ip family inet6 maxelem 1048576 timeout 300 -exist",
+			"ipset create sesame_denied_clients6 hash:net,port family inet6 maxelem 1048576 timeout 300 comment -exist",
+			"ip6tables -w -n -L SESAME",
+			"ip6tables -w -N SESAME",
+			"ip6tables -w -A SESAME -m mark --mark 0x1 -j ACCEPT",
+			"ip6tables -w -A SESAME -m set --match-set sesame_blocked_clients6 src -j DROP",
+			"ip6tables -w -A SESAME -m set --match-set sesame_denied_clients6 src,dst -j DROP",
+			"ip6tables -w -A SESAME -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+			"ip6tables -w -A SESAME -m set --match-set sesame_allowed_clients6 src,dst -j ACCEPT",
+			"ip6tables -w -A SESAME -j DROP",
+			"ip6tables -w -I INPUT -j SESAME",
+		}, runner.cmds)
+	})
+
+	t.Run("ok/existing", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{}
+		ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+		err := ipt.Init()
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			"ipset create sesame_allowed_clients4 hash:net,port family inet maxelem 1048576 timeout 3600 comment -exist",
+			"ipset create sesame_blocked_clients4 hash:ip family inet maxelem 1048576 timeout 3600 -exist",
+			"ipset create sesame_denied_clients4 hash:net,port family inet maxelem 1048576 timeout 3600 comment -exist",
+			"iptables -w -n -L SESAME",
+			"iptables -w -C SESAME -m set --match-set sesame_blocked_clients4 src -j DROP",
+			"iptables -w -C SESAME -m set --match-set sesame_denied_clients4 src,dst -j DROP",
+			"iptables -w -C SESAME -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+			"ipset create sesame_allowed_clients6 hash:net,port family inet6 maxelem 1048576 timeout 3600 comment -exist",
+			"ipset create sesame_blocked_clients6 hash:ip family inet6 maxelem 1048576 timeout 3600 -exist",
+			"ipset create sesame_denied_clients6 hash:net,port family inet6 maxelem 1048576 timeout 3600 comment -exist",
+			"ip6tables -w -n -L SESAME",
+			"ip6tables -w -C SESAME -m set --match-set sesame_blocked_clients6 src -j DROP",
+			"ip6tables -w -C SESAME -m set --match-set sesame_denied_clients6 src,dst -j DROP",
+			"ip6tables -w -C SESAME -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+		}, runner.cmds)
+	})
+
+	t.Run("ok/existing_outdated", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{results: map[string]fakeResult{
+			"iptables -w -C SESAME -m set --match-set sesame_blocked_clients4 src -j DROP": {
+				err: errors.New("iptables: Bad rule (does a matching rule exist in that chain?)."),
+			},
+			"iptables -w -C SESAME -m set --match-set sesame_denied_clients4 src,dst -j DROP": {
+				err: errors.New("iptables: Bad rule (does a matching rule exist in that chain?)."),
+			},
+		}}
+		ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+		err := ipt.Init()
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			"ipset create sesame_allowed_clients4 hash:net,port family inet maxelem 1048576 timeout 3600 comment -exist",
+			"ipset create sesame_blocked_clients4 hash:ip family inet maxelem 1048576 timeout 3600 -exist",
+			"ipset create sesame_denied_clients4 hash:net,port family inet maxelem 1048576 timeout 3600 comment -exist",
+			"iptables -w -n -L SESAME",
+			"iptables -w -C SESAME -m set --match-set sesame_blocked_clients4 src -j DROP",
+			"iptables -w -I SESAME 2 -m set --match-set sesame_blocked_clients4 src -j DROP",
+			"iptables -w -C SESAME -m set --match-set sesame_denied_clients4 src,dst -j DROP",
+			"iptables -w -I SESAME 3 -m set --match-set sesame_denied_clients4 src,dst -j DROP",
+			"iptables -w -C SESAME -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+			"ipset create sesame_allowed_clients6 hash:net,port family inet6 maxelem 1048576 timeout 3600 comment -exist",
+			"ipset create sesame_blocked_clients6 hash:ip family inet6 maxelem 1048576 timeout 3600 -exist",
+			"ipset create sesame_denied_clients6 hash:net,port family inet6 maxelem 1048576 timeout 3600 comment -exist",
+			"ip6tables -w -n -L SESAME",
+			"ip6tables -w -C SESAME -m set --match-set sesame_blocked_clients6 src -j DROP",
+			"ip6tables -w -C SESAME -m set --match-set sesame_denied_clients6 src,dst -j DROP",
+			"ip6tables -w -C SESAME -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+		}, runner.cmds)
+	})
+
+	t.Run("ok/existing_strict", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{results: map[string]fakeResult{
+			"iptables -w -C SESAME -m conntrack --ctstate ESTABLISHED,RELATED --ctdir REPLY -j ACCEPT": {
+				err: errors.New("iptables: Bad rule (does a matching rule exist in that chain?)."),
+			},
+		}}
+		ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler),
+			iptables.WithRunner(runner), iptables.WithStrictEstablished(true))
+
+		err := ipt.Init()
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			"ipset create sesame_allowed_clients4 hash:net,port family inet maxelem 1048576 timeout 3600 comment -exist",
+			"ipset create sesame_blocked_clients4 hash:ip family inet maxelem 1048576 timeout 3600 -exist",
+			"ipset create sesame_denied_clients4 hash:net,port family inet maxelem 1048576 timeout 3600 comment -exist",
+			"iptables -w -n -L SESAME",
+			"iptables -w -C SESAME -m set --match-set sesame_blocked_clients4 src -j DROP",
+			"iptables -w -C SESAME -m set --match-set sesame_denied_clients4 src,dst -j DROP",
+			"iptables -w -C SESAME -m conntrack --ctstate ESTABLISHED,RELATED --ctdir REPLY -j ACCEPT",
+			"iptables -w -D SESAME -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+			"iptables -w -I SESAME 4 -m conntrack --ctstate ESTABLISHED,RELATED --ctdir REPLY -j ACCEPT",
+			"ipset create sesame_allowed_clients6 hash:net,port family inet6 maxelem 1048576 timeout 3600 comment -exist",
+			"ipset create sesame_blocked_clients6 hash:ip family inet6 maxelem 1048576 timeout 3600 -exist",
+			"ipset create sesame_denied_clients6 hash:net,port family inet6 maxelem 1048576 timeout 3600 comment -exist",
+			"ip6tables -w -n -L SESAME",
+			"ip6tables -w -C SESAME -m set --match-set sesame_blocked_clients6 src -j DROP",
+			"ip6tables -w -C SESAME -m set --match-set sesame_denied_clients6 src,dst -j DROP",
+			"ip6tables -w -C SESAME -m conntrack --ctstate ESTABLISHED,RELATED --ctdir REPLY -j ACCEPT",
+		}, runner.cmds)
+	})
+
+	t.Run("err/list_chain", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{results: map[string]fakeResult{
+			"iptables -w -n -L SESAME": {err: errors.New("permission denied")},
+		}}
+		ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+		err := ipt.Init()
+		assert.EqualError(t, err, "failed getting iptables chain 'SESAME': permission denied")
+	})
+}
+
+func TestIPTablesCheck(t *testing.T) {
+	t.Parallel()
+
+	t.Run("ok", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{}
+		ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+		err := ipt.Check()
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			"ipset list -name sesame_allowed_clients4",
+			"ipset list -name sesame_blocked_clients4",
+			"ipset list -name sesame_denied_clients4",
+			"iptables -w -n -L SESAME",
+			"iptables -w -C INPUT -j SESAME",
+			"ipset list -name sesame_allowed_clients6",
+			"ipset list -name sesame_blocked_clients6",
+			"ipset list -name sesame_denied_clients6",
+			"ip6tables -w -n -L SESAME",
+			"ip6tables -w -C INPUT -j SESAME",
+		}, runner.cmds)
+	})
+
+	t.Run("err/missing_rule", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{results: map[string]fakeResult{
+			"ip6tables -w -C INPUT -j SESAME": {err: errors.New("ip6tables: Bad rule")},
+		}}
+		ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+		err := ipt.Check()
+		assert.EqualError(t, err, "failed checking ip6tables rule: ip6tables: Bad rule")
+	})
+
+	t.Run("err/missing_set", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{results: map[string]fakeResult{
+			"ipset list -name sesame_allowed_clients4": {err: errors.New("The set with the given name does not exist")},
+		}}
+		ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+		err := ipt.Check()
+		assert.EqualError(t, err,
+			"failed getting ipset 'sesame_allowed_clients4': The set with the given name does not exist")
+		assert.Len(t, runner.cmds, 1)
+	})
+}
+
+func TestIPTablesAllowDeny(t *testing.T) {
+	t.Parallel()
+
+	t.Run("ok/new", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{}
+		ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+		ipSet, err := firewall.ParseToIPSet("10.0.0.1-10.0.0.10", "192.168.1.0/24", "2001:db8::/32")
+		require.NoError(t, err)
+
+		err = ipt.Allow(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 22, To: 22}, {From: 60000, To: 61000}},
+			90*time.Second+time.Millisecond)
+		require.NoError(t, err)
+
+		// There are no existing entries to remove.
+		err = ipt.Deny(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 22, To: 22}})
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			"ipset save sesame_allowed_clients4",
+			"ipset save sesame_allowed_clients6",
+			"ipset restore -exist",
+			"ipset save sesame_allowed_clients4",
+			"ipset save sesame_allowed_clients6",
+		}, runner.cmds)
+		assert.Equal(t, []string{
+			`add sesame_allowed_clients4 10.0.0.1/32,tcp:22 timeout 91 comment "10.0.0.1-10.0.0.10,22"
+add sesame_allowed_clients4 10.0.0.2/31,tcp:22 timeout 91 comment "10.0.0.1-10.0.0.10,22"
+add sesame_allowed_clients4 10.0.0.4/30,tcp:22 timeout 91 comment "10.0.0.1-10.0.0.10,22"
+add sesame_allowed_clients4 10.0.0.8/31,tcp:22 timeout 91 comment "10.0.0.1-10.0.0.10,22"
+add sesame_allowed_clients4 10.0.0.10/32,tcp:22 timeout 91 comment "10.0.0.1-10.0.0.10,22"
+add sesame_allowed_clients4 192.168.1.0/24,tcp:22 timeout 91 comment "192.168.1.0-192.168.1.255,22"
+add sesame_allowed_clients6 2001:db8::/32,tcp:22 timeout 91 comment "2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff,22"
+add sesame_allowed_clients4 10.0.0.1/32,tcp:60000-61000 timeout 91 comment "10.0.0.1-10.0.0.10,60000-61000"
+add sesame_allowed_clients4 10.0.0.2/31,tcp:60000-61000 timeout 91 comment "10.0.0.1-10.0.0.10,60000-61000"
+add sesame_allowed_clients4 10.0.0.4/30,tcp:60000-61000 timeout 91 comment "10.0.0.1-10.0.0.10,60000-61000"
+add sesame_allowed_clients4 10.0.0.8/31,tcp:60000-61000 timeout 91 comment "10.0.0.1-10.0.0.10,60000-61000"
+add sesame_allowed_clients4 10.0.0.10/32,tcp:60000-61000 timeout 91 comment "10.0.0.1-10.0.0.10,60000-61000"
+add sesame_allowed_clients4 192.168.1.0/24,tcp:60000-61000 timeout 91 comment "192.168.1.0-192.168.1.255,60000-61000"
+add sesame_allowed_clients6 2001:db8::/32,tcp:60000-61000 timeout 91 comment "2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff,60000-61000"
+`,
+		}, runner.stdin)
+	})
+
+	t.Run("ok/overlapping", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{results: map[string]fakeResult{
+			"ipset save sesame_allowed_clients4": {out: `create sesame_allowed_clients4 hash:net,port family inet hashsize 1024 maxelem 65536 timeout 300 comment
+add sesame_allowed_clients4 10.0.0.0/24,tcp:22 timeout 50 comment "10.0.0.0-10.0.0.255,22"
+add sesame_allowed_clients4 10.0.0.0/24,udp:22 timeout 50 comment "10.0.0.0-10.0.0.255,22"
+`},
+		}}
+		ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+		ipSet, err := firewall.ParseToIPSet("10.0.0.5")
+		require.NoError(t, err)
+		err = ipt.Deny(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 22, To: 22}})
+		require.NoError(t, err)
+
+		ipSet, err = firewall.ParseToIPSet("10.0.0.128/25")
+		require.NoError(t, err)
+		err = ipt.Allow(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 22, To: 22}}, time.Minute)
+		require.NoError(t, err)
+
+		// The fake runner always returns the same entries, so the original
+		// entry is replaced in both cases.
+		assert.Equal(t, []string{
+			`del sesame_allowed_clients4 10.0.0.0/24,tcp:22
+add sesame_allowed_clients4 10.0.0.0/30,tcp:22 timeout 50 comment "10.0.0.0-10.0.0.4,22"
+add sesame_allowed_clients4 10.0.0.4/32,tcp:22 timeout 50 comment "10.0.0.0-10.0.0.4,22"
+add sesame_allowed_clients4 10.0.0.6/31,tcp:22 timeout 50 comment "10.0.0.6-10.0.0.255,22"
+add sesame_allowed_clients4 10.0.0.8/29,tcp:22 timeout 50 comment "10.0.0.6-10.0.0.255,22"
+add sesame_allowed_clients4 10.0.0.16/28,tcp:22 timeout 50 comment "10.0.0.6-10.0.0.255,22"
+add sesame_allowed_clients4 10.0.0.32/27,tcp:22 timeout 50 comment "10.0.0.6-10.0.0.255,22"
+add sesame_allowed_clients4 10.0.0.64/26,tcp:22 timeout 50 comment "10.0.0.6-10.0.0.255,22"
+add sesame_allowed_clients4 10.0.0.128/25,tcp:22 timeout 50 comment "10.0.0.6-10.0.0.255,22"
+`,
+			`del sesame_allowed_clients4 10.0.0.0/24,tcp:22
+add sesame_allowed_clients4 10.0.0.0/25,tcp:22 timeout 50 comment "10.0.0.0-10.0.0.127,22"
+add sesame_allowed_clients4 10.0.0.128/25,tcp:22 timeout 60 comment "10.0.0.128-10.0.0.255,22"
+`,
+		}, runner.stdin)
+	})
+
+	t.Run("ok/all_addresses", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{results: map[string]fakeResult{
+			"ipset save sesame_allowed_clients4": {out: `create sesame_allowed_clients4 hash:net,port family inet hashsize 1024 maxelem 1048576 timeout 300 comment
+add sesame_allowed_clients4 0.0.0.0/1,tcp:22 timeout 50 comment "0.0.0.0-255.255.255.255,22"
+add sesame_allowed_clients4 128.0.0.0/1,tcp:22 timeout 50 comment "0.0.0.0-255.255.255.255,22"
+`},
+		}}
+		ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+		// hash:net sets don't support /0 prefixes, so they're split in half.
+		ipSet, err := firewall.ParseToIPSet("0.0.0.0/0", "::/0")
+		require.NoError(t, err)
+		err = ipt.Allow(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 22, To: 22}}, time.Minute)
+		require.NoError(t, err)
+
+		// The entries of both halves are merged into a single element.
+		elements, err := ipt.Elements()
+		require.NoError(t, err)
+		assert.Equal(t, []ftypes.Element{{
+			IPRange:   netipx.MustParseIPRange("0.0.0.0-255.255.255.255"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ftypes.PortRange{From: 22, To: 22},
+			Expires:   50 * time.Second,
+		}}, elements)
+
+		ipSet, err = firewall.ParseToIPSet("0.0.0.0/0")
+		require.NoError(t, err)
+		err = ipt.Deny(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 22, To: 22}})
+		require.NoError(t, err)
+
+		// The fake runner always returns the same entries, so the IPv4 entries
+		// are replaced by the new ones in the first case.
+		assert.Equal(t, []string{
+			`del sesame_allowed_clients4 0.0.0.0/1,tcp:22
+del sesame_allowed_clients4 128.0.0.0/1,tcp:22
+add sesame_allowed_clients4 0.0.0.0/1,tcp:22 timeout 60 comment "0.0.0.0-255.255.255.255,22"
+add sesame_allowed_clients4 128.0.0.0/1,tcp:22 timeout 60 comment "0.0.0.0-255.255.255.255,22"
+add sesame_allowed_clients6 ::/1,tcp:22 timeout 60 comment "::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff,22"
+add sesame_allowed_clients6 8000::/1,tcp:22 timeout 60 comment "::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff,22"
+`,
+			`del sesame_allowed_clients4 0.0.0.0/1,tcp:22
+del sesame_allowed_clients4 128.0.0.0/1,tcp:22
+`,
+		}, runner.stdin)
+	})
+
+	t.Run("err/restore", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{results: map[string]fakeResult{
+			"ipset restore -exist": {err: errors.New("ipset error")},
+		}}
+		ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+		ipSet, err := firewall.ParseToIPSet("10.0.0.1")
+		require.NoError(t, err)
+
+		err = ipt.Allow(ipSet, ftypes.ProtocolBoth, ftypes.PortRanges{{From: 22, To: 22}}, time.Minute)
+		assert.EqualError(t, err, "failed updating ipset entries: ipset error")
+	})
+
+	t.Run("err/save", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{results: map[string]fakeResult{
+			"ipset save sesame_allowed_clients4": {err: errors.New("ipset error")},
+		}}
+		ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+		ipSet, err := firewall.ParseToIPSet("10.0.0.1")
+		require.NoError(t, err)
+
+		err = ipt.Deny(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 22, To: 22}})
+		assert.EqualError(t, err, "failed listing ipset 'sesame_allowed_clients4': ipset error")
+	})
+}
+
+func TestIPTablesElements(t *testing.T) {
+	t.Parallel()
+
+	runner := &fakeRunner{results: map[string]fakeResult{
+		"ipset save sesame_allowed_clients4": {out: `create sesame_allowed_clients4 hash:net,port family inet hashsize 1024 maxelem 65536 timeout 300 comment
+add sesame_allowed_clients4 10.0.0.1,tcp:22 timeout 57 comment "10.0.0.1-10.0.0.10"
+add sesame_allowed_clients4 10.0.0.2/31,tcp:22 timeout 57 comment "10.0.0.1-10.0.0.10"
+add sesame_allowed_clients4 10.0.0.1,tcp:443 timeout 12 comment "10.0.0.1-10.0.0.1"
+add sesame_allowed_clients4 172.16.0.0/16,tcp:80 timeout 200
+add sesame_allowed_clients4 172.16.0.0/16,udp:53 timeout 200
+add sesame_allowed_clients4 10.0.0.20,udp:60000 timeout 30 comment "10.0.0.20-10.0.0.20,60000-60001"
+add sesame_allowed_clients4 10.0.0.20,udp:60001 timeout 30 comment "10.0.0.20-10.0.0.20,60000-60001"
+`},
+		"ipset save sesame_allowed_clients6": {out: `create sesame_allowed_clients6 hash:net,port family inet6 hashsize 1024 maxelem 65536 timeout 300 comment
+add sesame_allowed_clients6 2001:db8::/32,tcp:22 timeout 3 comment "2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"
+`},
+	}}
+	ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+	elements, err := ipt.Elements()
+	require.NoError(t, err)
+
+	assert.Equal(t, []ftypes.Element{
+		{
+			IPRange:   netipx.MustParseIPRange("10.0.0.1-10.0.0.10"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ftypes.PortRange{From: 22, To: 22},
+			Expires:   57 * time.Second,
+		},
+		{
+			IPRange:   netipx.MustParseIPRange("10.0.0.1-10.0.0.1"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ftypes.PortRange{From: 443, To: 443},
+			Expires:   12 * time.Second,
+		},
+		{
+			IPRange:   netipx.MustParseIPRange("172.16.0.0-172.16.255.255"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ftypes.PortRange{From: 80, To: 80},
+			Expires:   200 * time.Second,
+		},
+		{
+			IPRange:   netipx.MustParseIPRange("172.16.0.0-172.16.255.255"),
+			Protocol:  ftypes.ProtocolUDP,
+			DestPorts: ftypes.PortRange{From: 53, To: 53},
+			Expires:   200 * time.Second,
+		},
+		{
+			IPRange:   netipx.MustParseIPRange("10.0.0.20-10.0.0.20"),
+			Protocol:  ftypes.ProtocolUDP,
+			DestPorts: ftypes.PortRange{From: 60000, To: 60001},
+			Expires:   30 * time.Second,
+		},
+		{
+			IPRange:   netipx.MustParseIPRange("2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ftypes.PortRange{From: 22, To: 22},
+			Expires:   3 * time.Second,
+		},
+	}, elements)
+}
+
+func TestIPTablesBans(t *testing.T) {
+	t.Parallel()
+
+	t.Run("ok", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{results: map[string]fakeResult{
+			"ipset save sesame_blocked_clients4": {out: `create sesame_blocked_clients4 hash:ip family inet hashsize 1024 maxelem 65536 timeout 300
+add sesame_blocked_clients4 10.0.0.1 timeout 3590
+add sesame_blocked_clients4 10.0.0.2 timeout 12
+`},
+			"ipset save sesame_blocked_clients6": {out: `create sesame_blocked_clients6 hash:ip family inet6 hashsize 1024 maxelem 65536 timeout 300
+add sesame_blocked_clients6 2001:db8::1 timeout 60
+`},
+		}}
+		ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+		err := ipt.Ban(netip.MustParseAddr("::ffff:10.0.0.1"), time.Hour+time.Millisecond)
+		require.NoError(t, err)
+		err = ipt.Ban(netip.MustParseAddr("2001:db8::1"), time.Minute)
+		require.NoError(t, err)
+		err = ipt.Unban(netip.MustParseAddr("10.0.0.2"))
+		require.NoError(t, err)
+
+		bans, err := ipt.Bans()
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{
+			"ipset add sesame_blocked_clients4 10.0.0.1 timeout 3601 -exist",
+			"ipset add sesame_blocked_clients6 2001:db8::1 timeout 60 -exist",
+			"ipset del sesame_blocked_clients4 10.0.0.2 -exist",
+			"ipset save sesame_blocked_clients4",
+			"ipset save sesame_blocked_clients6",
+		}, runner.cmds)
+		assert.Equal(t, []ftypes.Ban{
+			{Addr: netip.MustParseAddr("10.0.0.1"), Expires: 3590 * time.Second},
+			{Addr: netip.MustParseAddr("10.0.0.2"), Expires: 12 * time.Second},
+			{Addr: netip.MustParseAddr("2001:db8::1"), Expires: time.Minute},
+		}, bans)
+	})
+
+	t.Run("err/ban", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{results: map[string]fakeResult{
+			"ipset add sesame_blocked_clients4 10.0.0.1 timeout 60 -exist": {err: errors.New("ipset error")},
+		}}
+		ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+		err := ipt.Ban(netip.MustParseAddr("10.0.0.1"), time.Minute)
+		assert.EqualError(t, err, "failed adding entry to ipset 'sesame_blocked_clients4': ipset error")
+	})
+
+	t.Run("err/parse", func(t *testing.T) {
+		t.Parallel()
+
+		runner := &fakeRunner{results: map[string]fakeResult{
+			"ipset save sesame_blocked_clients4": {out: "add sesame_blocked_clients4 10.0.0.1 timeout abc\n"},
+		}}
+		ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+		_, err := ipt.Bans()
+		assert.EqualError(t, err, "failed parsing ipset 'sesame_blocked_clients4': invalid timeout in entry "+
+			`'10.0.0.1': strconv.ParseUint: parsing "abc": invalid syntax`)
+	})
+}
+
+func TestIPTablesBlocks(t *testing.T) {
+	t.Parallel()
+
+	runner := &fakeRunner{results: map[string]fakeResult{
+		"ipset save sesame_denied_clients4": {out: `create sesame_denied_clients4 hash:net,port family inet hashsize 1024 maxelem 65536 timeout 300 comment
+add sesame_denied_clients4 10.0.0.0/24,tcp:22 timeout 0 comment "10.0.0.0-10.0.0.255,22"
+add sesame_denied_clients4 172.16.0.1,udp:53 timeout 120 comment "172.16.0.1-172.16.0.1,53"
+`},
+	}}
+	ipt := iptables.New(time.Hour, slog.New(slog.DiscardHandler), iptables.WithRunner(runner))
+
+	ipSet, err := firewall.ParseToIPSet("10.0.0.5", "2001:db8::1")
+	require.NoError(t, err)
+	err = ipt.Block(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 22, To: 22}}, 0)
+	require.NoError(t, err)
+
+	ipSet, err = firewall.ParseToIPSet("172.16.0.1")
+	require.NoError(t, err)
+	err = ipt.Unblock(ipSet, ftypes.ProtocolUDP, ftypes.PortRanges{{From: 53, To: 53}})
+	require.NoError(t, err)
+
+	blocks, err := ipt.Blocks()
+	require.NoError(t, err)
+
+	// The allowed ipsets aren't modified, and blocks without a duration never
+	// expire.
+	assert.Equal(t, []string{
+		"ipset save sesame_denied_clients4",
+		"ipset save sesame_denied_clients6",
+		"ipset restore -exist",
+		"ipset save sesame_denied_clients4",
+		"ipset save sesame_denied_clients6",
+		"ipset restore -exist",
+		"ipset save sesame_denied_clients4",
+		"ipset save sesame_denied_clients6",
+	}, runner.cmds)
+	assert.Equal(t, []string{
+		`del sesame_denied_clients4 10.0.0.0/24,tcp:22
+add sesame_denied_clients4 10.0.0.0/30,tcp:22 timeout 0 comment "10.0.0.0-10.0.0.4,22"
+add sesame_denied_clients4 10.0.0.4/32,tcp:22 timeout 0 comment "10.0.0.0-10.0.0.4,22"
+add sesame_denied_clients4 10.0.0.6/31,tcp:22 timeout 0 comment "10.0.0.6-10.0.0.255,22"
+add sesame_denied_clients4 10.0.0.8/29,tcp:22 timeout 0 comment "10.0.0.6-10.0.0.255,22"
+add sesame_denied_clients4 10.0.0.16/28,tcp:22 timeout 0 comment "10.0.0.6-10.0.0.255,22"
+add sesame_denied_clients4 10.0.0.32/27,tcp:22 timeout 0 comment "10.0.0.6-10.0.0.255,22"
+add sesame_denied_clients4 10.0.0.64/26,tcp:22 timeout 0 comment "10.0.0.6-10.0.0.255,22"
+add sesame_denied_clients4 10.0.0.128/25,tcp:22 timeout 0 comment "10.0.0.6-10.0.0.255,22"
+add sesame_denied_clients4 10.0.0.5/32,tcp:22 timeout 0 comment "10.0.0.5-10.0.0.5,22"
+add sesame_denied_clients6 2001:db8::1/128,tcp:22 timeout 0 comment "2001:db8::1-2001:db8::1,22"
+`,
+		`del sesame_denied_clients4 172.16.0.1/32,udp:53
+`,
+	}, runner.stdin)
+	assert.Equal(t, []ftypes.Element{
+		{
+			IPRange:   netipx.MustParseIPRange("10.0.0.0-10.0.0.255"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ftypes.PortRange{From: 22, To: 22},
+		},
+		{
+			IPRange:   netipx.MustParseIPRange("172.16.0.1-172.16.0.1"),
+			Protocol:  ftypes.ProtocolUDP,
+			DestPorts: ftypes.PortRange{From: 53, To: 53},
+			Expires:   2 * time.Minute,
+		},
+	}, blocks)
+}
+
+type fakeResult struct {
+	out string
+	err error
+}
+
+// fakeRunner records the executed commands, and returns preconfigured results.
+type fakeRunner struct {
+	cmds    []string
+	stdin   []string
+	results map[string]fakeResult
+}
+
+var _ iptables.Runner = (*fakeRunner)(nil)
+
+func (r *fakeRunner) Run(stdin io.Reader, name string, args ...string) ([]byte, error) {
+	cmd := strings.Join(append([]string{name}, args...), " ")
+	r.cmds = append(r.cmds, cmd)
+	if stdin != nil {
+		in, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, err
+		}
+		r.stdin = append(r.stdin, string(in))
+	}
+
+	res := r.results[cmd]
+	return []byte(res.out), res.err
+}
@@ -0,0 +1,20 @@
+package iptables
+
+// Option is a function that allows configuring IPTables.
+type Option func(*IPTables)
+
+// WithRunner sets the runner used to execute the iptables, ip6tables and ipset
+// commands.
+func WithRunner(r Runner) Option {
+	return func(ipt *IPTables) {
+		ipt.runner = r
+	}
+}
+
+// WithStrictEstablished sets whether packets that clients send on established
+// connections are only accepted while the clients are allowed access.
+func WithStrictEstablished(strict bool) Option {
+	return func(ipt *IPTables) {
+		ipt.strictEstablished = strict
+	}
+}
@@ -0,0 +1,36 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Runner executes external commands.
+type Runner interface {
+	// Run executes the named program with the given arguments, optionally
+	// writing stdin to its standard input, and returns its standard output.
+	Run(stdin io.Reader, name string, args ...string) ([]byte, error)
+}
+
+// execRunner is a Runner that executes commands on the system.
+type execRunner struct{}
+
+var _ Runner = execRunner{}
+
+func (execRunner) Run(stdin io.Reader, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...) //nolint:gosec // The arguments are created internally.
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed running '%s %s': %w: %s",
+			name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
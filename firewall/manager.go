@@ -1,14 +1,21 @@
 package firewall
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/netip"
+	"slices"
 	"time"
 
 	"go4.org/netipx"
 
 	actx "go.hackfix.me/sesame/app/context"
 	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/db/types"
+	"go.hackfix.me/sesame/firewall/conntrack"
+	"go.hackfix.me/sesame/firewall/iptables"
 	"go.hackfix.me/sesame/firewall/mock"
 	"go.hackfix.me/sesame/firewall/nftables"
 	ftypes "go.hackfix.me/sesame/firewall/types"
@@ -17,6 +24,8 @@ import (
 // Manager manages access of client IPs to services.
 type Manager struct {
 	firewall              ftypes.Firewall
+	connTracker           ftypes.ConnTracker
+	db                    types.Querier
 	defaultAccessDuration time.Duration
 	logger                *slog.Logger
 }
@@ -42,9 +51,11 @@ func NewManager(firewall ftypes.Firewall, opts ...Option) (*Manager, error) {
 // GrantAccess to the specified service from a set of IP addresses for a
 // specific amount of time. The passed IPSet must consist of valid IPRanges.
 // The User argument indicates the remote user who initiated this change.
-// If nil, it means that the author is the local admin user.
+// If nil, it means that the author is the local admin user. Otherwise, the
+// access policy of the user is enforced, and source must be the address the
+// request of the user originated from.
 func (m *Manager) GrantAccess(
-	ipSet *netipx.IPSet, svc *models.Service, duration time.Duration, user *models.User,
+	ipSet *netipx.IPSet, svc *models.Service, duration time.Duration, user *models.User, source netip.Addr,
 ) error {
 	ipRanges := ipSet.Ranges()
 	ipRangesStr := make([]string, len(ipRanges))
@@ -57,28 +68,55 @@ func (m *Manager) GrantAccess(
 
 	logger := m.logger.With(
 		"service.name", svc.Name,
-		"service.port", svc.Port,
+		"service.ports", svc.Ports,
+		"service.protocol", svc.Protocol,
 	)
 	if user != nil {
 		logger = logger.With("user.name", user.Name)
 	}
 
-	if duration > svc.MaxAccessDuration {
-		logger.Warn("requested duration exceeds configured service max; clamping to max",
+	maxDuration := svc.MaxAccessDuration
+	if user != nil {
+		if err := checkUserPolicy(ipSet, user, source); err != nil {
+			return err
+		}
+		if user.MaxAccessDuration > 0 {
+			maxDuration = min(maxDuration, user.MaxAccessDuration)
+		}
+	}
+
+	if duration > maxDuration {
+		logger.Warn("requested duration exceeds configured max; clamping to max",
 			"requested_duration", duration,
-			"service.max_access_duration", svc.MaxAccessDuration,
+			"max_access_duration", maxDuration,
 		)
-		duration = min(duration, svc.MaxAccessDuration)
+		duration = maxDuration
 	}
 	if duration == 0 {
-		duration = m.defaultAccessDuration
+		duration = min(m.defaultAccessDuration, maxDuration)
 	}
 	logger = logger.With("duration", duration)
 
-	if err := m.firewall.Allow(ipSet, svc.Port, duration); err != nil {
+	if err := m.firewall.Allow(ipSet, svc.Protocol, svc.Ports, duration); err != nil {
 		return err
 	}
 
+	if m.db != nil {
+		// Overlapping grants are replaced, as they are in the firewall.
+		if err := m.subtractGrants(ipSet, svc); err != nil {
+			return err
+		}
+
+		expiresAt := m.db.TimeNow().UTC().Add(duration)
+		dbCtx := m.db.NewContext()
+		for _, r := range ipRanges {
+			ag := &models.AccessGrant{ExpiresAt: expiresAt, Service: svc, IPRange: r, User: user}
+			if err := ag.Save(dbCtx, m.db); err != nil {
+				return err
+			}
+		}
+	}
+
 	logger.Info("granted access", "ip_ranges", ipRangesStr)
 
 	return nil
@@ -88,7 +126,12 @@ func (m *Manager) GrantAccess(
 // IPSet must consist of valid IPRanges.
 // The User argument indicates the remote user who initiated this change.
 // If nil, it means that the author is the local admin user.
-func (m *Manager) DenyAccess(ipSet *netipx.IPSet, svc *models.Service, user *models.User) error {
+// If killConns is true, or the service is configured to kill connections, the
+// established connections from the IP addresses to the service are terminated.
+// This requires a connection tracker, which is checked before access is denied.
+func (m *Manager) DenyAccess(
+	ipSet *netipx.IPSet, svc *models.Service, user *models.User, killConns bool,
+) error {
 	ipRanges := ipSet.Ranges()
 	ipRangesStr := make([]string, len(ipRanges))
 	for i, r := range ipRanges {
@@ -100,37 +143,899 @@ func (m *Manager) DenyAccess(ipSet *netipx.IPSet, svc *models.Service, user *mod
 
 	logger := m.logger.With(
 		"service.name", svc.Name,
-		"service.port", svc.Port,
+		"service.ports", svc.Ports,
+		"service.protocol", svc.Protocol,
 	)
 	if user != nil {
 		logger = logger.With("user.name", user.Name)
 	}
 
-	if err := m.firewall.Deny(ipSet, svc.Port); err != nil {
+	killConns = killConns || svc.KillConnections
+	if killConns && m.connTracker == nil {
+		return errors.New("killing connections is not supported without a connection tracker")
+	}
+
+	if err := m.firewall.Deny(ipSet, svc.Protocol, svc.Ports); err != nil {
 		return err
 	}
 
+	if m.db != nil {
+		if err := m.subtractGrants(ipSet, svc); err != nil {
+			return err
+		}
+	}
+
+	if killConns {
+		n, err := m.connTracker.Delete(ipSet, svc.Protocol, svc.Ports)
+		if err != nil {
+			return fmt.Errorf("failed killing connections: %w", err)
+		}
+		logger = logger.With("connections_killed", n)
+	}
+
 	logger.Info("denied access", "ip_ranges", ipRangesStr)
 
 	return nil
 }
 
-// Setup creates a new Firewall with the given type and a Manager for it.
+// Ban blocks all traffic from an IP address for a specific amount of time. The
+// reason is only used for logging.
+func (m *Manager) Ban(addr netip.Addr, duration time.Duration, reason string) error {
+	if !addr.IsValid() {
+		return fmt.Errorf("invalid IP address: %s", addr)
+	}
+	addr = addr.Unmap()
+
+	if err := m.firewall.Ban(addr, duration); err != nil {
+		return err
+	}
+
+	m.logger.Warn("banned client", "ip", addr.String(), "duration", duration, "reason", reason)
+
+	return nil
+}
+
+// Unban removes the ban of an IP address. It returns an error if the IP
+// address isn't currently banned.
+func (m *Manager) Unban(addr netip.Addr) error {
+	addr = addr.Unmap()
+	banned, err := m.IsBanned(addr)
+	if err != nil {
+		return err
+	}
+	if !banned {
+		return fmt.Errorf("IP address %s is not banned", addr)
+	}
+
+	if err = m.firewall.Unban(addr); err != nil {
+		return err
+	}
+
+	m.logger.Info("unbanned client", "ip", addr.String())
+
+	return nil
+}
+
+// IsBanned returns true if the IP address is currently banned.
+func (m *Manager) IsBanned(addr netip.Addr) (bool, error) {
+	bans, err := m.firewall.Bans()
+	if err != nil {
+		return false, err
+	}
+
+	addr = addr.Unmap()
+	return slices.ContainsFunc(bans, func(b ftypes.Ban) bool { return b.Addr == addr }), nil
+}
+
+// BlockAccess to the specified service from a set of IP addresses for a
+// specific amount of time, regardless of the access granted to them. The
+// passed IPSet must consist of valid IPRanges. If svc is nil, access to all
+// services is blocked, which also applies to services added later once the
+// firewall state is synced. A duration of 0 blocks access until it's removed
+// with UnblockAccess.
+func (m *Manager) BlockAccess(ipSet *netipx.IPSet, svc *models.Service, duration time.Duration) error {
+	ipRangesStr, err := ipRangeStrings(ipSet)
+	if err != nil {
+		return err
+	}
+
+	svcs := []*models.Service{svc}
+	svcName := "all"
+	if svc == nil {
+		if m.db == nil {
+			return errors.New("a database is required to block access to all services")
+		}
+		if svcs, err = models.Services(m.db.NewContext(), m.db, nil); err != nil {
+			return err
+		}
+		if len(svcs) == 0 {
+			return errors.New("there are no services to block access to")
+		}
+	} else {
+		svcName = svc.Name
+	}
+
+	for _, s := range svcs {
+		if err = m.firewall.Block(ipSet, s.Protocol, s.Ports, duration); err != nil {
+			return fmt.Errorf("failed blocking access to service '%s': %w", s.Name, err)
+		}
+	}
+
+	if m.db != nil {
+		// Overlapping blocks of the same service are replaced, as they are in the
+		// firewall.
+		if err = m.subtractBlocks(ipSet, blockFilter(svc, false)); err != nil {
+			return err
+		}
+
+		var expiresAt sql.Null[time.Time]
+		if duration > 0 {
+			expiresAt = sql.Null[time.Time]{V: m.db.TimeNow().UTC().Add(duration), Valid: true}
+		}
+		dbCtx := m.db.NewContext()
+		for _, r := range ipSet.Ranges() {
+			b := &models.Block{ExpiresAt: expiresAt, Service: svc, IPRange: r}
+			if err = b.Save(dbCtx, m.db); err != nil {
+				return err
+			}
+		}
+	}
+
+	m.logger.Warn("blocked access",
+		"service.name", svcName, "duration", duration, "ip_ranges", ipRangesStr)
+
+	return nil
+}
+
+// UnblockAccess removes the blocks of the specified service from a set of IP
+// addresses. The passed IPSet must consist of valid IPRanges. If svc is nil,
+// all blocks of the IP addresses are removed. Otherwise, it returns an error if
+// access to all services is blocked from any of the IP addresses, since that
+// block would still apply to the service. Blocks of ports shared with other
+// services are kept for the addresses that those services still block.
+func (m *Manager) UnblockAccess(ipSet *netipx.IPSet, svc *models.Service) error {
+	ipRangesStr, err := ipRangeStrings(ipSet)
+	if err != nil {
+		return err
+	}
+
+	svcName := "all"
+	if svc != nil {
+		svcName = svc.Name
+		if err = m.checkBlockedAll(ipSet); err != nil {
+			return err
+		}
+		var shared map[destKey]*netipx.IPSet
+		if m.db != nil {
+			if shared, err = m.sharedBlocks(svc, m.db.TimeNow().UTC()); err != nil {
+				return err
+			}
+		}
+		if err = removeUnshared(ipSet, svc, shared, m.firewall.Unblock); err != nil {
+			return err
+		}
+	} else {
+		var elements []ftypes.Element
+		if elements, err = m.firewall.Blocks(); err != nil {
+			return fmt.Errorf("failed listing firewall blocks: %w", err)
+		}
+
+		type dest struct {
+			proto ftypes.Protocol
+			ports ftypes.PortRange
+		}
+		unblocked := make(map[dest]struct{})
+		for _, el := range elements {
+			d := dest{el.Protocol, el.DestPorts}
+			if _, ok := unblocked[d]; ok || !ipSet.OverlapsRange(el.IPRange) {
+				continue
+			}
+			if err = m.firewall.Unblock(ipSet, el.Protocol, ftypes.PortRanges{el.DestPorts}); err != nil {
+				return err
+			}
+			unblocked[d] = struct{}{}
+		}
+	}
+
+	if m.db != nil {
+		if err = m.subtractBlocks(ipSet, blockFilter(svc, true)); err != nil {
+			return err
+		}
+	}
+
+	m.logger.Info("unblocked access", "service.name", svcName, "ip_ranges", ipRangesStr)
+
+	return nil
+}
+
+// UpdateService stores the updated service data, and applies the changes to
+// the access granted to it. If the service ports or protocol changed, the
+// unexpired access grants are migrated to the new ones with their remaining
+// duration. If clampGrants is true, grants that exceed the new maximum access
+// duration of the service are shortened to it. Access to the old ports is kept
+// for the addresses that other services still allow to access them.
+// The database is updated first, so if updating the firewall fails, its state
+// will be fixed by the next Sync.
+func (m *Manager) UpdateService(svc *models.Service, clampGrants bool) error {
+	if m.db == nil {
+		return errors.New("a database is required to update services")
+	}
+
+	dbCtx := m.db.NewContext()
+	oldSvc := &models.Service{ID: svc.ID, Name: svc.Name}
+	if err := oldSvc.Load(dbCtx, m.db); err != nil {
+		return err
+	}
+
+	if err := svc.Save(dbCtx, m.db, true); err != nil {
+		return err
+	}
+
+	grants, err := models.AccessGrants(dbCtx, m.db, types.NewFilter("service_id = ?", []any{oldSvc.ID}))
+	if err != nil {
+		return err
+	}
+
+	migrate := oldSvc.Protocol != svc.Protocol || !slices.Equal(oldSvc.Ports, svc.Ports)
+	timeNow := m.db.TimeNow().UTC()
+	shared, err := m.sharedAccess(oldSvc, timeNow)
+	if err != nil {
+		return err
+	}
+
+	var migrated, clamped int
+	for _, ag := range grants {
+		remaining := ag.ExpiresAt.Sub(timeNow)
+		// Expired grants are deleted by Sync.
+		if remaining <= 0 {
+			continue
+		}
+
+		clamp := clampGrants && remaining > svc.MaxAccessDuration
+		if !migrate && !clamp {
+			continue
+		}
+
+		if clamp {
+			remaining = svc.MaxAccessDuration
+			ag.ExpiresAt = timeNow.Add(remaining)
+			if err = ag.Save(dbCtx, m.db); err != nil {
+				return err
+			}
+			clamped++
+		}
+
+		// Elements are replaced in order to reset their timeout.
+		err = removeUnshared(rangeToIPSet(ag.IPRange), oldSvc, shared, m.firewall.Deny)
+		if err != nil {
+			return fmt.Errorf("failed removing access to service '%s' from %s: %w", svc.Name, ag.IPRange, err)
+		}
+		if err = m.firewall.Allow(rangeToIPSet(ag.IPRange), svc.Protocol, svc.Ports, remaining); err != nil {
+			return fmt.Errorf("failed granting access to service '%s' from %s: %w", svc.Name, ag.IPRange, err)
+		}
+		if migrate {
+			migrated++
+		}
+	}
+
+	var blocksMigrated int
+	if migrate {
+		if blocksMigrated, err = m.migrateBlocks(oldSvc, svc, timeNow); err != nil {
+			return err
+		}
+	}
+
+	m.logger.Info("updated service",
+		"service.name", svc.Name,
+		"service.ports", svc.Ports,
+		"service.protocol", svc.Protocol,
+		"service.max_access_duration", svc.MaxAccessDuration,
+		"grants_migrated", migrated,
+		"grants_clamped", clamped,
+		"blocks_migrated", blocksMigrated,
+	)
+
+	return nil
+}
+
+// RemoveService deletes the service, and removes all access granted to it from
+// the firewall, except to the ports that other services still allow the same
+// addresses to access. Either the service ID or Name must be set.
+func (m *Manager) RemoveService(svc *models.Service) error {
+	if m.db == nil {
+		return errors.New("a database is required to remove services")
+	}
+
+	dbCtx := m.db.NewContext()
+	if err := svc.Load(dbCtx, m.db); err != nil {
+		return err
+	}
+
+	grants, err := models.AccessGrants(dbCtx, m.db, types.NewFilter("service_id = ?", []any{svc.ID}))
+	if err != nil {
+		return err
+	}
+
+	timeNow := m.db.TimeNow().UTC()
+	sharedGrants, err := m.sharedAccess(svc, timeNow)
+	if err != nil {
+		return err
+	}
+
+	var denied int
+	for _, ag := range grants {
+		// Expired elements were already removed by the firewall.
+		if !ag.ExpiresAt.After(timeNow) {
+			continue
+		}
+		if err = removeUnshared(rangeToIPSet(ag.IPRange), svc, sharedGrants, m.firewall.Deny); err != nil {
+			return fmt.Errorf("failed removing access to service '%s' from %s: %w", svc.Name, ag.IPRange, err)
+		}
+		denied++
+	}
+
+	blocks, err := m.serviceBlocks(svc, timeNow)
+	if err != nil {
+		return err
+	}
+	sharedBlocks, err := m.sharedBlocks(svc, timeNow)
+	if err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		if err = removeUnshared(rangeToIPSet(b.IPRange), svc, sharedBlocks, m.firewall.Unblock); err != nil {
+			return fmt.Errorf("failed removing block of service '%s' from %s: %w", svc.Name, b.IPRange, err)
+		}
+	}
+
+	// Access grants and blocks of the service are deleted by the foreign key
+	// constraint.
+	if err = svc.Delete(dbCtx, m.db); err != nil {
+		return err
+	}
+
+	m.logger.Info("removed service", "service.name", svc.Name, "grants_removed", denied, "blocks_removed", len(blocks))
+
+	return nil
+}
+
+// Sync reconciles the firewall state with the access grants and blocks stored
+// in the database. The firewall is initialized first, in case its state was
+// lost (e.g. after a reboot). Unexpired grants and blocks missing from the
+// firewall are re-added with their remaining duration, and firewall entries
+// without a matching grant or block are removed. Expired grants and blocks are
+// deleted from the database.
+func (m *Manager) Sync() error {
+	if m.db == nil {
+		return errors.New("a database is required to sync the firewall state")
+	}
+
+	if err := m.firewall.Init(); err != nil {
+		return fmt.Errorf("failed initializing firewall: %w", err)
+	}
+
+	dbCtx := m.db.NewContext()
+	timeNow := m.db.TimeNow().UTC()
+
+	_, err := models.DeleteAccessGrants(dbCtx, m.db, types.NewFilter("expires_at <= ?", []any{timeNow}))
+	if err != nil {
+		return err
+	}
+
+	grants, err := models.AccessGrants(dbCtx, m.db, nil)
+	if err != nil {
+		return err
+	}
+
+	elements, err := m.firewall.Elements()
+	if err != nil {
+		return fmt.Errorf("failed listing firewall elements: %w", err)
+	}
+
+	existing := make(map[accessKey]struct{}, len(elements))
+	for _, el := range elements {
+		existing[accessKey{el.IPRange, el.Protocol, el.DestPorts}] = struct{}{}
+	}
+
+	expected, restored, err := m.restoreGrants(grants, existing, timeNow)
+	if err != nil {
+		return err
+	}
+
+	removed, err := m.removeUnknown(elements, expected, m.firewall.Deny)
+	if err != nil {
+		return err
+	}
+
+	blocksRestored, blocksRemoved, err := m.syncBlocks(timeNow)
+	if err != nil {
+		return err
+	}
+
+	m.logger.Info("synced firewall state", "restored", restored, "removed", removed,
+		"blocks_restored", blocksRestored, "blocks_removed", blocksRemoved)
+
+	return nil
+}
+
+// accessKey uniquely identifies the access to a range of ports of a single
+// protocol from a range of IP addresses.
+type accessKey struct {
+	ipRange netipx.IPRange
+	proto   ftypes.Protocol
+	ports   ftypes.PortRange
+}
+
+// restoreGrants re-adds the access grants that are missing from the existing
+// firewall elements with their remaining duration. It returns the access
+// expected by all grants, and the number of restored grants per protocol.
+func (m *Manager) restoreGrants(
+	grants []*models.AccessGrant, existing map[accessKey]struct{}, timeNow time.Time,
+) (map[accessKey]struct{}, int, error) {
+	var restored int
+	expected := make(map[accessKey]struct{}, len(grants))
+	for _, ag := range grants {
+		for _, proto := range ag.Service.Protocol.Expand() {
+			// Collect the missing port ranges, in order to restore them in a
+			// single call.
+			var missing ftypes.PortRanges
+			for _, pr := range ag.Service.Ports {
+				key := accessKey{ag.IPRange, proto, pr}
+				expected[key] = struct{}{}
+				if _, ok := existing[key]; !ok {
+					missing = append(missing, pr)
+				}
+			}
+			if len(missing) == 0 {
+				continue
+			}
+
+			remaining := ag.ExpiresAt.Sub(timeNow)
+			if err := m.firewall.Allow(rangeToIPSet(ag.IPRange), proto, missing, remaining); err != nil {
+				return nil, 0, fmt.Errorf("failed restoring access to service '%s' from %s: %w",
+					ag.Service.Name, ag.IPRange, err)
+			}
+			m.logger.Debug("restored access",
+				"service.name", ag.Service.Name,
+				"service.ports", missing,
+				"service.protocol", proto,
+				"ip_range", ag.IPRange.String(),
+				"duration", remaining,
+			)
+			restored++
+		}
+	}
+
+	return expected, restored, nil
+}
+
+// removeUnknown removes the firewall elements that aren't expected by any
+// access grant or block with the remove function, which is either the Deny or
+// Unblock method of the firewall, and returns the number of removed elements.
+func (m *Manager) removeUnknown(
+	elements []ftypes.Element, expected map[accessKey]struct{},
+	remove func(*netipx.IPSet, ftypes.Protocol, ftypes.PortRanges) error,
+) (int, error) {
+	var removed int
+	for _, el := range elements {
+		if _, ok := expected[accessKey{el.IPRange, el.Protocol, el.DestPorts}]; ok {
+			continue
+		}
+
+		err := remove(rangeToIPSet(el.IPRange), el.Protocol, ftypes.PortRanges{el.DestPorts})
+		if err != nil {
+			return 0, fmt.Errorf("failed removing unknown firewall entry of ports %s/%s from %s: %w",
+				el.DestPorts, el.Protocol, el.IPRange, err)
+		}
+		m.logger.Debug("removed unknown firewall entry",
+			"ports", el.DestPorts,
+			"protocol", el.Protocol,
+			"ip_range", el.IPRange.String(),
+		)
+		removed++
+	}
+
+	return removed, nil
+}
+
+// subtractGrants removes the IP set from the access grants to the service,
+// mirroring the changes made by the firewall. Grants that overlap with the IP
+// set are deleted, and the remainder of their IP range is stored as new grants
+// with the same expiration time.
+func (m *Manager) subtractGrants(ipSet *netipx.IPSet, svc *models.Service) error {
+	dbCtx := m.db.NewContext()
+	grants, err := models.AccessGrants(dbCtx, m.db,
+		types.NewFilter("service_id = ?", []any{svc.ID}))
+	if err != nil {
+		return err
+	}
+
+	for _, ag := range grants {
+		if !ipSet.OverlapsRange(ag.IPRange) {
+			continue
+		}
+		if err = ag.Delete(dbCtx, m.db); err != nil {
+			return err
+		}
+
+		var b netipx.IPSetBuilder
+		b.AddRange(ag.IPRange)
+		b.RemoveSet(ipSet)
+		rest, berr := b.IPSet()
+		if berr != nil {
+			return fmt.Errorf("failed subtracting IP set from %s: %w", ag.IPRange, berr)
+		}
+
+		for _, r := range rest.Ranges() {
+			restAg := &models.AccessGrant{ExpiresAt: ag.ExpiresAt, Service: svc, IPRange: r, User: ag.User}
+			if err = restAg.Save(dbCtx, m.db); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// destKey identifies a range of ports of a single protocol.
+type destKey struct {
+	proto ftypes.Protocol
+	ports ftypes.PortRange
+}
+
+// serviceRange is the IP range of an access grant or block of a service.
+type serviceRange struct {
+	svc     *models.Service
+	ipRange netipx.IPRange
+}
+
+// sharedAccess returns the IP addresses that unexpired access grants of other
+// services allow to access each of the protocol and port ranges of the service.
+// Since firewall elements are only identified by their IP range, protocol and
+// port range, services with the same ports share them.
+func (m *Manager) sharedAccess(svc *models.Service, timeNow time.Time) (map[destKey]*netipx.IPSet, error) {
+	grants, err := models.AccessGrants(m.db.NewContext(), m.db,
+		types.NewFilter("service_id != ? AND expires_at > ?", []any{svc.ID, timeNow}))
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := make([]serviceRange, len(grants))
+	for i, ag := range grants {
+		ranges[i] = serviceRange{ag.Service, ag.IPRange}
+	}
+
+	return sharedDests(svc, ranges)
+}
+
+// sharedBlocks returns the IP addresses that unexpired blocks of other services
+// block from accessing each of the protocol and port ranges of the service.
+// Blocks of all services apply to every other service. See sharedAccess.
+func (m *Manager) sharedBlocks(svc *models.Service, timeNow time.Time) (map[destKey]*netipx.IPSet, error) {
+	dbCtx := m.db.NewContext()
+	blocks, err := models.Blocks(dbCtx, m.db, types.NewFilter(
+		"(b.service_id IS NULL OR b.service_id != ?) AND (b.expires_at IS NULL OR b.expires_at > ?)",
+		[]any{svc.ID, timeNow}))
+	if err != nil {
+		return nil, err
+	}
+
+	var others []*models.Service
+	ranges := make([]serviceRange, 0, len(blocks))
+	for _, b := range blocks {
+		if b.Service != nil {
+			ranges = append(ranges, serviceRange{b.Service, b.IPRange})
+			continue
+		}
+		if others == nil {
+			others, err = models.Services(dbCtx, m.db, types.NewFilter("s.id != ?", []any{svc.ID}))
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, other := range others {
+			ranges = append(ranges, serviceRange{other, b.IPRange})
+		}
+	}
+
+	return sharedDests(svc, ranges)
+}
+
+// sharedDests returns the IP addresses of the ranges of other services that
+// apply to each of the protocol and port ranges of the service. Destinations
+// without any addresses are omitted.
+func sharedDests(svc *models.Service, ranges []serviceRange) (map[destKey]*netipx.IPSet, error) {
+	builders := make(map[destKey]*netipx.IPSetBuilder)
+	for _, proto := range svc.Protocol.Expand() {
+		for _, pr := range svc.Ports {
+			builders[destKey{proto, pr}] = &netipx.IPSetBuilder{}
+		}
+	}
+	for _, sr := range ranges {
+		for _, proto := range sr.svc.Protocol.Expand() {
+			for _, pr := range sr.svc.Ports {
+				if b, ok := builders[destKey{proto, pr}]; ok {
+					b.AddRange(sr.ipRange)
+				}
+			}
+		}
+	}
+
+	shared := make(map[destKey]*netipx.IPSet, len(builders))
+	for key, b := range builders {
+		ipSet, err := b.IPSet()
+		if err != nil {
+			return nil, fmt.Errorf("failed building IP set of ports %s/%s: %w", key.ports, key.proto, err)
+		}
+		if len(ipSet.Ranges()) > 0 {
+			shared[key] = ipSet
+		}
+	}
+
+	return shared, nil
+}
+
+// removeUnshared removes the firewall entries of the service from the IP set
+// with the remove function, which is either the Deny or Unblock method of the
+// firewall, except from the addresses that other services still apply to the
+// same ports, as returned by sharedAccess or sharedBlocks.
+func removeUnshared(
+	ipSet *netipx.IPSet, svc *models.Service, shared map[destKey]*netipx.IPSet,
+	remove func(*netipx.IPSet, ftypes.Protocol, ftypes.PortRanges) error,
+) error {
+	for _, proto := range svc.Protocol.Expand() {
+		// Ports that aren't shared are removed in a single call.
+		var unshared ftypes.PortRanges
+		for _, pr := range svc.Ports {
+			sharedSet, ok := shared[destKey{proto, pr}]
+			if !ok {
+				unshared = append(unshared, pr)
+				continue
+			}
+
+			var b netipx.IPSetBuilder
+			b.AddSet(ipSet)
+			b.RemoveSet(sharedSet)
+			rest, err := b.IPSet()
+			if err != nil {
+				return fmt.Errorf("failed subtracting shared IP addresses of ports %s/%s: %w", pr, proto, err)
+			}
+			if len(rest.Ranges()) == 0 {
+				continue
+			}
+			if err = remove(rest, proto, ftypes.PortRanges{pr}); err != nil {
+				return err
+			}
+		}
+
+		if len(unshared) > 0 {
+			if err := remove(ipSet, proto, unshared); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// syncBlocks reconciles the firewall blocks with the blocks stored in the
+// database, the same way Sync does for access grants. Blocks of all services
+// are expected for every current service. It returns the number of restored
+// and removed blocks.
+func (m *Manager) syncBlocks(timeNow time.Time) (restored, removed int, err error) {
+	dbCtx := m.db.NewContext()
+	_, err = models.DeleteBlocks(dbCtx, m.db,
+		types.NewFilter("expires_at IS NOT NULL AND expires_at <= ?", []any{timeNow}))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	blocks, err := models.Blocks(dbCtx, m.db, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	services, err := models.Services(dbCtx, m.db, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	elements, err := m.firewall.Blocks()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed listing firewall blocks: %w", err)
+	}
+
+	existing := make(map[accessKey]struct{}, len(elements))
+	for _, el := range elements {
+		existing[accessKey{el.IPRange, el.Protocol, el.DestPorts}] = struct{}{}
+	}
+
+	expected := make(map[accessKey]struct{}, len(blocks))
+	for _, b := range blocks {
+		svcs := services
+		if b.Service != nil {
+			svcs = []*models.Service{b.Service}
+		}
+		for _, svc := range svcs {
+			var n int
+			if n, err = m.restoreBlock(b, svc, existing, expected, timeNow); err != nil {
+				return 0, 0, err
+			}
+			restored += n
+		}
+	}
+
+	removed, err = m.removeUnknown(elements, expected, m.firewall.Unblock)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return restored, removed, nil
+}
+
+// restoreBlock re-adds the block of the service if it's missing from the
+// existing firewall elements, and adds the blocked access to expected. It
+// returns the number of restored blocks per protocol.
+func (m *Manager) restoreBlock(
+	b *models.Block, svc *models.Service, existing, expected map[accessKey]struct{}, timeNow time.Time,
+) (int, error) {
+	var restored int
+	for _, proto := range svc.Protocol.Expand() {
+		var missing ftypes.PortRanges
+		for _, pr := range svc.Ports {
+			key := accessKey{b.IPRange, proto, pr}
+			expected[key] = struct{}{}
+			if _, ok := existing[key]; !ok {
+				missing = append(missing, pr)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		remaining := blockRemaining(b, timeNow)
+		if err := m.firewall.Block(rangeToIPSet(b.IPRange), proto, missing, remaining); err != nil {
+			return 0, fmt.Errorf("failed restoring block of service '%s' from %s: %w", svc.Name, b.IPRange, err)
+		}
+		m.logger.Debug("restored block",
+			"service.name", svc.Name,
+			"service.ports", missing,
+			"service.protocol", proto,
+			"ip_range", b.IPRange.String(),
+			"duration", remaining,
+		)
+		restored++
+	}
+
+	return restored, nil
+}
+
+// migrateBlocks moves the unexpired blocks that apply to the service from its
+// old ports and protocol to the new ones, with their remaining duration. It
+// returns the number of migrated blocks.
+func (m *Manager) migrateBlocks(oldSvc, svc *models.Service, timeNow time.Time) (int, error) {
+	blocks, err := m.serviceBlocks(oldSvc, timeNow)
+	if err != nil {
+		return 0, err
+	}
+	shared, err := m.sharedBlocks(oldSvc, timeNow)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, b := range blocks {
+		ipSet := rangeToIPSet(b.IPRange)
+		if err = removeUnshared(ipSet, oldSvc, shared, m.firewall.Unblock); err != nil {
+			return 0, fmt.Errorf("failed removing block of service '%s' from %s: %w", svc.Name, b.IPRange, err)
+		}
+		if err = m.firewall.Block(ipSet, svc.Protocol, svc.Ports, blockRemaining(b, timeNow)); err != nil {
+			return 0, fmt.Errorf("failed blocking access to service '%s' from %s: %w", svc.Name, b.IPRange, err)
+		}
+	}
+
+	return len(blocks), nil
+}
+
+// serviceBlocks returns the unexpired blocks of the service, and the blocks of
+// all services.
+func (m *Manager) serviceBlocks(svc *models.Service, timeNow time.Time) ([]*models.Block, error) {
+	blocks, err := models.Blocks(m.db.NewContext(), m.db, types.NewFilter(
+		"(b.service_id = ? OR b.service_id IS NULL) AND (b.expires_at IS NULL OR b.expires_at > ?)",
+		[]any{svc.ID, timeNow}))
+	if err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+// checkBlockedAll returns an error if access to all services is blocked from
+// any of the IP addresses.
+func (m *Manager) checkBlockedAll(ipSet *netipx.IPSet) error {
+	if m.db == nil {
+		return nil
+	}
+
+	blocks, err := models.Blocks(m.db.NewContext(), m.db, types.NewFilter(
+		"b.service_id IS NULL AND (b.expires_at IS NULL OR b.expires_at > ?)",
+		[]any{m.db.TimeNow().UTC()}))
+	if err != nil {
+		return err
+	}
+
+	for _, b := range blocks {
+		if ipSet.OverlapsRange(b.IPRange) {
+			return fmt.Errorf("access to all services is blocked from %s; unblock it without a service", b.IPRange)
+		}
+	}
+
+	return nil
+}
+
+// subtractBlocks removes the IP set from the blocks matching the filter,
+// mirroring the changes made by the firewall. Blocks that overlap with the IP
+// set are deleted, and the remainder of their IP range is stored as new blocks
+// with the same expiration time.
+func (m *Manager) subtractBlocks(ipSet *netipx.IPSet, filter *types.Filter) error {
+	dbCtx := m.db.NewContext()
+	blocks, err := models.Blocks(dbCtx, m.db, filter)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range blocks {
+		if !ipSet.OverlapsRange(b.IPRange) {
+			continue
+		}
+		if err = b.Delete(dbCtx, m.db); err != nil {
+			return err
+		}
+
+		var sb netipx.IPSetBuilder
+		sb.AddRange(b.IPRange)
+		sb.RemoveSet(ipSet)
+		rest, berr := sb.IPSet()
+		if berr != nil {
+			return fmt.Errorf("failed subtracting IP set from %s: %w", b.IPRange, berr)
+		}
+
+		for _, r := range rest.Ranges() {
+			restB := &models.Block{ExpiresAt: b.ExpiresAt, Service: b.Service, IPRange: r}
+			if err = restB.Save(dbCtx, m.db); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Setup creates a new Firewall with the given type and a Manager for it. The
+// strict established mode of the firewall is read from the configuration.
+// Additional options are applied to the Manager after the default ones.
 //
 //nolint:ireturn,nolintlint // Intentional, this is a generic function.
 func Setup(
 	appCtx *actx.Context, ft ftypes.FirewallType, defaultAccessDuration time.Duration,
-	logger *slog.Logger,
+	logger *slog.Logger, opts ...Option,
 ) (ftypes.Firewall, *Manager, error) {
 	var (
 		fw  ftypes.Firewall
+		ct  ftypes.ConnTracker = conntrack.New()
 		err error
 	)
+	strict := appCtx.Config != nil && appCtx.Config.Firewall.StrictEstablished.V
 	switch ft {
 	case ftypes.FirewallMock:
-		fw = mock.New(appCtx.TimeNow)
+		fw = appCtx.MockFirewall
+		if fw == nil {
+			fw = mock.New(appCtx.TimeNow)
+		}
+		ct = &mock.ConnTracker{}
 	case ftypes.FirewallNFTables:
-		fw, err = nftables.New(defaultAccessDuration, logger)
+		fw, err = nftables.New(defaultAccessDuration, logger, nftables.WithStrictEstablished(strict))
+	case ftypes.FirewallIPTables:
+		fw = iptables.New(defaultAccessDuration, logger, iptables.WithStrictEstablished(strict))
 	default:
 		return nil, nil, fmt.Errorf("unsupported firewall type '%s'", ft)
 	}
@@ -138,8 +1043,13 @@ func Setup(
 		return nil, nil, fmt.Errorf("failed creating %s firewall: %w", ft, err)
 	}
 
+	mgrOpts := []Option{WithLogger(logger), WithConnTracker(ct)}
+	if appCtx.DB != nil {
+		mgrOpts = append(mgrOpts, WithDB(appCtx.DB))
+	}
+
 	var fwMgr *Manager
-	fwMgr, err = NewManager(fw, WithLogger(logger))
+	fwMgr, err = NewManager(fw, append(mgrOpts, opts...)...)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed creating the firewall manager: %w", err)
 	}
@@ -3,11 +3,41 @@ package firewall
 import (
 	"log/slog"
 	"time"
+
+	"go.hackfix.me/sesame/db/types"
+	ftypes "go.hackfix.me/sesame/firewall/types"
 )
 
 // Option is a function that allows configuring the Manager.
 type Option func(*Manager) error
 
+// WithDB sets the database used to persist access grants. If unset, access
+// grants are only stored in the firewall.
+func WithDB(d types.Querier) Option {
+	return func(m *Manager) error {
+		m.db = d
+		return nil
+	}
+}
+
+// WithFirewallWrapper replaces the firewall used by the Manager with the one
+// returned by wrap, which is typically a decorator of the passed firewall.
+func WithFirewallWrapper(wrap func(ftypes.Firewall) ftypes.Firewall) Option {
+	return func(m *Manager) error {
+		m.firewall = wrap(m.firewall)
+		return nil
+	}
+}
+
+// WithConnTracker sets the connection tracker used to kill the established
+// connections of clients whose access is denied.
+func WithConnTracker(ct ftypes.ConnTracker) Option {
+	return func(m *Manager) error {
+		m.connTracker = ct
+		return nil
+	}
+}
+
 // WithDefaultAccessDuration sets the default duration to allow access if unspecified.
 func WithDefaultAccessDuration(dur time.Duration) Option {
 	return func(m *Manager) error {
@@ -2,13 +2,18 @@ package firewall_test
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
+	"net/netip"
+	"net/url"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go4.org/netipx"
 
+	"go.hackfix.me/sesame/db"
 	"go.hackfix.me/sesame/db/models"
 	"go.hackfix.me/sesame/firewall"
 	"go.hackfix.me/sesame/firewall/mock"
@@ -124,8 +129,12 @@ func TestManager_GrantAccess(t *testing.T) {
 			ipSet, err := firewall.ParseToIPSet(tt.ipAddr...)
 			require.NoError(t, err)
 
-			svc := &models.Service{Name: "web", Port: 8080, MaxAccessDuration: time.Hour}
-			err = manager.GrantAccess(ipSet, svc, tt.duration, nil)
+			svc := &models.Service{
+				Name:              "web",
+				Ports:             types.PortRanges{{From: 8080, To: 8080}, {From: 60000, To: 61000}},
+				MaxAccessDuration: time.Hour,
+			}
+			err = manager.GrantAccess(ipSet, svc, tt.duration, nil, netip.Addr{})
 			if tt.expErr != "" {
 				require.Error(t, err)
 				assert.ErrorContains(t, err, tt.expErr)
@@ -136,12 +145,130 @@ func TestManager_GrantAccess(t *testing.T) {
 			for _, ipRange := range ipSet.Ranges() {
 				require.Contains(t, mockFirewall.Allowed, ipRange.String())
 
-				ports := mockFirewall.Allowed[ipRange.String()]
+				dests := mockFirewall.Allowed[ipRange.String()]
 				expectedDuration := min(tt.duration, svc.MaxAccessDuration)
 				expectedExpiry := timeNow.Add(expectedDuration)
-				actualExpiry, portExists := ports[svc.Port]
-				assert.True(t, portExists, "Port %d should be allowed for IP range %s", svc.Port, ipRange)
-				assert.Equal(t, expectedExpiry, actualExpiry)
+				for _, pr := range svc.Ports {
+					actualExpiry, portExists := dests[mock.Dest{Protocol: types.ProtocolTCP, Ports: pr}]
+					assert.True(t, portExists, "Ports %s should be allowed for IP range %s", pr, ipRange)
+					assert.Equal(t, expectedExpiry, actualExpiry)
+				}
+			}
+		})
+	}
+}
+
+func TestManager_GrantAccessUserPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		user        *models.User
+		ipAddr      []string
+		source      netip.Addr
+		duration    time.Duration
+		expDuration time.Duration
+		expErr      string
+	}{
+		{
+			name:        "ok/no_policy",
+			user:        &models.User{Name: "alice"},
+			ipAddr:      []string{"192.168.1.0/24"},
+			duration:    2 * time.Hour,
+			expDuration: time.Hour,
+		},
+		{
+			name:        "ok/user_max_duration",
+			user:        &models.User{Name: "alice", MaxAccessDuration: 10 * time.Minute},
+			ipAddr:      []string{"192.168.1.100"},
+			duration:    30 * time.Minute,
+			expDuration: 10 * time.Minute,
+		},
+		{
+			name:        "ok/user_max_duration_default",
+			user:        &models.User{Name: "alice", MaxAccessDuration: time.Minute},
+			ipAddr:      []string{"192.168.1.100"},
+			expDuration: time.Minute,
+		},
+		{
+			name:        "ok/service_max_duration",
+			user:        &models.User{Name: "alice", MaxAccessDuration: 2 * time.Hour},
+			ipAddr:      []string{"192.168.1.100"},
+			duration:    3 * time.Hour,
+			expDuration: time.Hour,
+		},
+		{
+			name: "ok/allowed_cidrs",
+			user: &models.User{Name: "alice", AllowedCIDRs: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.168.1.0/24"),
+			}},
+			ipAddr:      []string{"10.1.0.0/16", "192.168.1.10-192.168.1.20"},
+			duration:    30 * time.Minute,
+			expDuration: 30 * time.Minute,
+		},
+		{
+			name:        "ok/self_only",
+			user:        &models.User{Name: "alice", SelfOnly: true},
+			ipAddr:      []string{"192.168.1.100"},
+			source:      netip.MustParseAddr("::ffff:192.168.1.100"),
+			duration:    30 * time.Minute,
+			expDuration: 30 * time.Minute,
+		},
+		{
+			name: "err/allowed_cidrs",
+			user: &models.User{Name: "alice", AllowedCIDRs: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/8"),
+			}},
+			ipAddr: []string{"10.0.0.1", "192.168.1.100"},
+			expErr: "user 'alice' is not allowed to grant access to 192.168.1.100-192.168.1.100",
+		},
+		{
+			name:   "err/self_only_other_address",
+			user:   &models.User{Name: "alice", SelfOnly: true},
+			ipAddr: []string{"192.168.1.0/24"},
+			source: netip.MustParseAddr("192.168.1.100"),
+			expErr: "user 'alice' can only grant access to their own address",
+		},
+		{
+			name:   "err/self_only_unknown_source",
+			user:   &models.User{Name: "alice", SelfOnly: true},
+			ipAddr: []string{"192.168.1.100"},
+			expErr: "user 'alice' can only grant access to their own address",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			mockFirewall := mock.New(timeNowFn)
+			manager, err := firewall.NewManager(
+				mockFirewall, firewall.WithLogger(slog.New(slog.DiscardHandler)),
+			)
+			require.NoError(t, err)
+
+			ipSet, err := firewall.ParseToIPSet(tt.ipAddr...)
+			require.NoError(t, err)
+
+			svc := &models.Service{
+				Name:              "web",
+				Ports:             types.PortRanges{{From: 8080, To: 8080}},
+				Protocol:          types.ProtocolTCP,
+				MaxAccessDuration: time.Hour,
+			}
+			err = manager.GrantAccess(ipSet, svc, tt.duration, tt.user, tt.source)
+			if tt.expErr != "" {
+				var errPolicy firewall.AccessPolicyError
+				require.ErrorAs(t, err, &errPolicy)
+				assert.EqualError(t, err, tt.expErr)
+				assert.Empty(t, mockFirewall.Allowed)
+				return
+			}
+			require.NoError(t, err)
+
+			for _, ipRange := range ipSet.Ranges() {
+				dests := mockFirewall.Allowed[ipRange.String()]
+				assert.Equal(t, timeNow.Add(tt.expDuration), dests[mock.Dest{Protocol: types.ProtocolTCP, Ports: svc.Ports[0]}])
 			}
 		})
 	}
@@ -151,10 +278,14 @@ func TestManager_DenyAccess(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
-		name       string
-		ipAddr     []string
-		setupError bool
-		expErr     string
+		name          string
+		ipAddr        []string
+		killConns     bool
+		svcKillConns  bool
+		noConnTracker bool
+		setupError    bool
+		expKilled     int
+		expErr        string
 	}{
 		{
 			name:   "ok/single_ip",
@@ -172,6 +303,25 @@ func TestManager_DenyAccess(t *testing.T) {
 			name:   "ok/ip_range",
 			ipAddr: []string{"192.168.1.1-192.168.1.10"},
 		},
+		{
+			name:      "ok/kill_connections",
+			ipAddr:    []string{"192.168.1.100"},
+			killConns: true,
+			expKilled: 1,
+		},
+		{
+			name:         "ok/service_kill_connections",
+			ipAddr:       []string{"192.168.1.100", "10.0.0.5"},
+			svcKillConns: true,
+			expKilled:    2,
+		},
+		{
+			name:          "err/kill_connections_no_tracker",
+			ipAddr:        []string{"192.168.1.100"},
+			killConns:     true,
+			noConnTracker: true,
+			expErr:        "killing connections is not supported without a connection tracker",
+		},
 		{
 			name:       "err/firewall_deny_fails",
 			ipAddr:     []string{"192.168.1.100"},
@@ -185,33 +335,45 @@ func TestManager_DenyAccess(t *testing.T) {
 			t.Parallel()
 
 			mockFirewall := mock.New(timeNowFn)
+			connTracker := &mock.ConnTracker{}
+			opts := []firewall.Option{firewall.WithLogger(slog.New(slog.DiscardHandler))}
+			if !tt.noConnTracker {
+				opts = append(opts, firewall.WithConnTracker(connTracker))
+			}
 			// For the firewall deny failure test, we need to create the manager first
 			// (without error) then set the error before Deny operation.
-			manager, err := firewall.NewManager(
-				mockFirewall, firewall.WithLogger(slog.New(slog.DiscardHandler)),
-			)
+			manager, err := firewall.NewManager(mockFirewall, opts...)
 			require.NoError(t, err)
 
 			if tt.setupError {
 				mockFirewall.SetFailError(errors.New("firewall error"))
 			}
 
-			svc := &models.Service{Name: "web", Port: 8080, MaxAccessDuration: time.Hour}
+			svc := &models.Service{
+				Name:              "web",
+				Ports:             types.PortRanges{{From: 8080, To: 8080}},
+				MaxAccessDuration: time.Hour,
+				KillConnections:   tt.svcKillConns,
+			}
 
 			ipSet, err := firewall.ParseToIPSet(tt.ipAddr...)
 			require.NoError(t, err)
 
 			// Mock a previously allowed access
 			for _, ipRange := range ipSet.Ranges() {
-				mockFirewall.Allowed[ipRange.String()] = map[uint16]time.Time{
-					svc.Port: timeNow.Add(30 * time.Minute),
+				mockFirewall.Allowed[ipRange.String()] = map[mock.Dest]time.Time{
+					{Protocol: types.ProtocolTCP, Ports: svc.Ports[0]}: timeNow.Add(30 * time.Minute),
 				}
 			}
 
-			err = manager.DenyAccess(ipSet, svc, nil)
+			err = manager.DenyAccess(ipSet, svc, nil, tt.killConns)
 			if tt.expErr != "" {
 				require.Error(t, err)
 				assert.ErrorContains(t, err, tt.expErr)
+				// Access isn't denied if the operation fails.
+				for _, ipRange := range ipSet.Ranges() {
+					assert.Contains(t, mockFirewall.Allowed, ipRange.String())
+				}
 				return
 			}
 			require.NoError(t, err)
@@ -219,10 +381,279 @@ func TestManager_DenyAccess(t *testing.T) {
 			for _, ipRange := range ipSet.Ranges() {
 				assert.NotContains(t, mockFirewall.Allowed, ipRange.String())
 			}
+			assert.Len(t, connTracker.Deleted, tt.expKilled)
 		})
 	}
 }
 
+func TestManager_BanUnban(t *testing.T) {
+	t.Parallel()
+
+	mockFirewall := mock.New(timeNowFn)
+	manager, err := firewall.NewManager(mockFirewall, firewall.WithLogger(slog.New(slog.DiscardHandler)))
+	require.NoError(t, err)
+
+	addr := netip.MustParseAddr("::ffff:10.0.0.1")
+	err = manager.Ban(addr, time.Hour, "test")
+	require.NoError(t, err)
+	assert.Equal(t, map[netip.Addr]time.Time{
+		netip.MustParseAddr("10.0.0.1"): timeNow.Add(time.Hour),
+	}, mockFirewall.Banned)
+
+	err = manager.Ban(netip.Addr{}, time.Hour, "test")
+	require.EqualError(t, err, "invalid IP address: invalid IP")
+
+	err = manager.Unban(addr)
+	require.NoError(t, err)
+	assert.Empty(t, mockFirewall.Banned)
+
+	err = manager.Unban(addr)
+	require.EqualError(t, err, "IP address 10.0.0.1 is not banned")
+}
+
+func TestManager_BlockUnblock(t *testing.T) {
+	t.Parallel()
+
+	mockFirewall := mock.New(timeNowFn)
+	manager, err := firewall.NewManager(mockFirewall, firewall.WithLogger(slog.New(slog.DiscardHandler)))
+	require.NoError(t, err)
+
+	ssh := &models.Service{Name: "ssh", Protocol: types.ProtocolTCP, Ports: types.PortRanges{{From: 22, To: 22}}}
+	dns := &models.Service{Name: "dns", Protocol: types.ProtocolUDP, Ports: types.PortRanges{{From: 53, To: 53}}}
+
+	ipSet, err := firewall.ParseToIPSet("10.0.0.0/24")
+	require.NoError(t, err)
+
+	err = manager.BlockAccess(ipSet, ssh, 0)
+	require.NoError(t, err)
+	err = manager.BlockAccess(ipSet, dns, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[mock.Dest]time.Time{
+		"10.0.0.0-10.0.0.255": {
+			{Protocol: types.ProtocolTCP, Ports: types.PortRange{From: 22, To: 22}}: {},
+			{Protocol: types.ProtocolUDP, Ports: types.PortRange{From: 53, To: 53}}: timeNow.Add(time.Hour),
+		},
+	}, mockFirewall.Blocked)
+
+	// Blocking all services requires listing them from the database.
+	err = manager.BlockAccess(ipSet, nil, 0)
+	require.EqualError(t, err, "a database is required to block access to all services")
+
+	ipSet, err = firewall.ParseToIPSet("10.0.0.128/25")
+	require.NoError(t, err)
+	err = manager.UnblockAccess(ipSet, ssh)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[mock.Dest]time.Time{
+		"10.0.0.0-10.0.0.127": {
+			{Protocol: types.ProtocolTCP, Ports: types.PortRange{From: 22, To: 22}}: {},
+		},
+		"10.0.0.0-10.0.0.255": {
+			{Protocol: types.ProtocolUDP, Ports: types.PortRange{From: 53, To: 53}}: timeNow.Add(time.Hour),
+		},
+	}, mockFirewall.Blocked)
+
+	// Without a service, all blocks of the IP addresses are removed.
+	ipSet, err = firewall.ParseToIPSet("10.0.0.0/24")
+	require.NoError(t, err)
+	err = manager.UnblockAccess(ipSet, nil)
+	require.NoError(t, err)
+	assert.Empty(t, mockFirewall.Blocked)
+}
+
+func TestManager_UnblockSharedPorts(t *testing.T) {
+	t.Parallel()
+
+	d := newTestDB(t)
+	dbCtx := d.NewContext()
+
+	// Both services block access to port 22, so they share firewall elements.
+	ssh := &models.Service{Name: "ssh", Protocol: types.ProtocolTCP, Ports: types.PortRanges{{From: 22, To: 22}}}
+	alt := &models.Service{Name: "alt", Protocol: types.ProtocolTCP, Ports: types.PortRanges{
+		{From: 22, To: 22}, {From: 2222, To: 2222},
+	}}
+	for _, svc := range []*models.Service{ssh, alt} {
+		require.NoError(t, svc.Save(dbCtx, d, false))
+	}
+
+	mockFirewall := mock.New(timeNowFn)
+	manager, err := firewall.NewManager(mockFirewall,
+		firewall.WithDB(d), firewall.WithLogger(slog.New(slog.DiscardHandler)))
+	require.NoError(t, err)
+
+	ipSet, err := firewall.ParseToIPSet("10.0.0.0/24")
+	require.NoError(t, err)
+	require.NoError(t, manager.BlockAccess(ipSet, ssh, 0))
+	altIPSet, err := firewall.ParseToIPSet("10.0.0.5")
+	require.NoError(t, err)
+	require.NoError(t, manager.BlockAccess(altIPSet, alt, time.Hour))
+
+	// Port 22 stays blocked from the address that the alt service still blocks.
+	err = manager.UnblockAccess(ipSet, ssh)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[mock.Dest]time.Time{
+		"10.0.0.5-10.0.0.5": {
+			{Protocol: types.ProtocolTCP, Ports: types.PortRange{From: 22, To: 22}}:     timeNow.Add(time.Hour),
+			{Protocol: types.ProtocolTCP, Ports: types.PortRange{From: 2222, To: 2222}}: timeNow.Add(time.Hour),
+		},
+	}, mockFirewall.Blocked)
+
+	err = manager.UnblockAccess(altIPSet, alt)
+	require.NoError(t, err)
+	assert.Empty(t, mockFirewall.Blocked)
+
+	blocks, err := models.Blocks(dbCtx, d, nil)
+	require.NoError(t, err)
+	assert.Empty(t, blocks)
+}
+
+func TestManager_Sync(t *testing.T) {
+	t.Parallel()
+
+	d := newTestDB(t)
+	dbCtx := d.NewContext()
+	ssh := &models.Service{Name: "ssh", Protocol: types.ProtocolTCP, Ports: types.PortRanges{{From: 22, To: 22}}}
+	web := &models.Service{Name: "web", Protocol: types.ProtocolTCP, Ports: types.PortRanges{
+		{From: 80, To: 80}, {From: 443, To: 443},
+	}}
+	for _, svc := range []*models.Service{ssh, web} {
+		require.NoError(t, svc.Save(dbCtx, d, false))
+	}
+
+	grants := []*models.AccessGrant{
+		// Active, and present in the firewall.
+		{Service: ssh, IPRange: netipx.MustParseIPRange("10.0.0.1-10.0.0.1"), ExpiresAt: timeNow.Add(time.Hour)},
+		// Active, but missing from the firewall.
+		{Service: web, IPRange: netipx.MustParseIPRange("10.0.0.2-10.0.0.2"), ExpiresAt: timeNow.Add(30 * time.Minute)},
+		// Expired, but still present in the firewall.
+		{Service: ssh, IPRange: netipx.MustParseIPRange("10.0.0.3-10.0.0.3"), ExpiresAt: timeNow.Add(-time.Minute)},
+	}
+	for _, ag := range grants {
+		require.NoError(t, ag.Save(dbCtx, d))
+	}
+
+	mockFirewall := mock.New(timeNowFn)
+	allow := func(ipAddr string, port uint16, duration time.Duration) {
+		ipSet, perr := firewall.ParseToIPSet(ipAddr)
+		require.NoError(t, perr)
+		require.NoError(t, mockFirewall.Allow(ipSet, types.ProtocolTCP,
+			types.PortRanges{{From: port, To: port}}, duration))
+	}
+	allow("10.0.0.1", 22, time.Hour)
+	allow("10.0.0.3", 22, time.Hour)
+	// Foreign elements that don't match any access grant.
+	allow("192.168.1.0/24", 22, time.Hour)
+	allow("10.0.0.1", 8080, time.Hour)
+
+	manager, err := firewall.NewManager(mockFirewall,
+		firewall.WithDB(d), firewall.WithLogger(slog.New(slog.DiscardHandler)))
+	require.NoError(t, err)
+
+	err = manager.Sync()
+	require.NoError(t, err)
+
+	// The foreign elements and the element of the expired grant are removed,
+	// and the missing element of the active grant is restored.
+	assert.Equal(t, map[string]map[mock.Dest]time.Time{
+		"10.0.0.1-10.0.0.1": {
+			{Protocol: types.ProtocolTCP, Ports: types.PortRange{From: 22, To: 22}}: timeNow.Add(time.Hour),
+		},
+		"10.0.0.2-10.0.0.2": {
+			{Protocol: types.ProtocolTCP, Ports: types.PortRange{From: 80, To: 80}}:   timeNow.Add(30 * time.Minute),
+			{Protocol: types.ProtocolTCP, Ports: types.PortRange{From: 443, To: 443}}: timeNow.Add(30 * time.Minute),
+		},
+	}, mockFirewall.Allowed)
+
+	remaining, err := models.AccessGrants(dbCtx, d, nil)
+	require.NoError(t, err)
+	ipRanges := make([]string, len(remaining))
+	for i, ag := range remaining {
+		ipRanges[i] = ag.IPRange.String()
+	}
+	assert.ElementsMatch(t, []string{"10.0.0.1-10.0.0.1", "10.0.0.2-10.0.0.2"}, ipRanges)
+
+	// Syncing again doesn't change anything.
+	err = manager.Sync()
+	require.NoError(t, err)
+	assert.Len(t, mockFirewall.Allowed, 2)
+}
+
+func TestManager_UpdateRemoveServiceSharedPorts(t *testing.T) {
+	t.Parallel()
+
+	d := newTestDB(t)
+	dbCtx := d.NewContext()
+
+	// Both services allow access to port 443, so they share firewall elements.
+	web := &models.Service{
+		Name: "web", Protocol: types.ProtocolTCP, MaxAccessDuration: 2 * time.Hour,
+		Ports: types.PortRanges{{From: 443, To: 443}},
+	}
+	alt := &models.Service{
+		Name: "alt", Protocol: types.ProtocolTCP, MaxAccessDuration: 2 * time.Hour,
+		Ports: types.PortRanges{{From: 443, To: 443}, {From: 8443, To: 8443}},
+	}
+	for _, svc := range []*models.Service{web, alt} {
+		require.NoError(t, svc.Save(dbCtx, d, false))
+	}
+
+	mockFirewall := mock.New(timeNowFn)
+	manager, err := firewall.NewManager(mockFirewall,
+		firewall.WithDB(d), firewall.WithLogger(slog.New(slog.DiscardHandler)))
+	require.NoError(t, err)
+
+	grant := func(svc *models.Service, ipAddr string, duration time.Duration) {
+		ipSet, perr := firewall.ParseToIPSet(ipAddr)
+		require.NoError(t, perr)
+		require.NoError(t, manager.GrantAccess(ipSet, svc, duration, nil, netip.Addr{}))
+	}
+	grant(alt, "10.0.0.5", 30*time.Minute)
+	grant(web, "10.0.0.0/24", time.Hour)
+
+	// Moving the web service to another port keeps the access to port 443 from
+	// the address that is still allowed to access the alt service.
+	err = manager.UpdateService(&models.Service{
+		ID: web.ID, Name: "web", Protocol: types.ProtocolTCP, MaxAccessDuration: 2 * time.Hour,
+		Ports: types.PortRanges{{From: 8080, To: 8080}},
+	}, false)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[mock.Dest]time.Time{
+		"10.0.0.0-10.0.0.255": {
+			{Protocol: types.ProtocolTCP, Ports: types.PortRange{From: 8080, To: 8080}}: timeNow.Add(time.Hour),
+		},
+		"10.0.0.5-10.0.0.5": {
+			{Protocol: types.ProtocolTCP, Ports: types.PortRange{From: 443, To: 443}}:   timeNow.Add(time.Hour),
+			{Protocol: types.ProtocolTCP, Ports: types.PortRange{From: 8443, To: 8443}}: timeNow.Add(30 * time.Minute),
+		},
+	}, mockFirewall.Allowed)
+
+	// The ports of the alt service aren't shared anymore, so all its access is
+	// removed.
+	err = manager.RemoveService(&models.Service{Name: "alt"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[mock.Dest]time.Time{
+		"10.0.0.0-10.0.0.255": {
+			{Protocol: types.ProtocolTCP, Ports: types.PortRange{From: 8080, To: 8080}}: timeNow.Add(time.Hour),
+		},
+	}, mockFirewall.Allowed)
+}
+
+// newTestDB returns a new initialized in-memory database, unique to the test.
+func newTestDB(t *testing.T) *db.DB {
+	t.Helper()
+
+	// Not using just :memory: to avoid 'no such table' issue.
+	// See https://github.com/mattn/go-sqlite3#faq
+	d, err := db.Open(t.Context(),
+		fmt.Sprintf("file:sesame-%s?mode=memory&cache=shared", url.PathEscape(t.Name())), timeNowFn)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = d.Close() })
+
+	err = d.Init("test", []byte{}, slog.New(slog.DiscardHandler))
+	require.NoError(t, err)
+
+	return d
+}
+
 var timeNow = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
 
 func timeNowFn() time.Time {
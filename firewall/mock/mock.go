@@ -1,6 +1,10 @@
 package mock
 
 import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
 	"time"
 
 	"go4.org/netipx"
@@ -12,19 +16,37 @@ import (
 // and ports with expiration times. It can be configured to simulate errors for
 // testing failure scenarios.
 type Mock struct {
-	Allowed map[string]map[uint16]time.Time
-	failErr error // to simulate errors
-	timeNow func() time.Time
+	Allowed map[string]map[Dest]time.Time
+	Banned  map[netip.Addr]time.Time
+	// Blocked entries that never expire have a zero expiration time.
+	Blocked       map[string]map[Dest]time.Time
+	timeouts      map[string]map[Dest]time.Duration
+	banTimeouts   map[netip.Addr]time.Duration
+	blockTimeouts map[string]map[Dest]time.Duration
+	failErr       error // to simulate errors
+	timeNow       func() time.Time
 }
 
 var _ ftypes.Firewall = (*Mock)(nil)
 
+// Dest is a range of destination ports of a specific protocol, which is either
+// TCP or UDP.
+type Dest struct {
+	Protocol ftypes.Protocol
+	Ports    ftypes.PortRange
+}
+
 // New creates a new Mock firewall instance with the provided time function.
 // The timeNow function is used to determine current time for expiration calculations.
 func New(timeNow func() time.Time) *Mock {
 	return &Mock{
-		Allowed: make(map[string]map[uint16]time.Time),
-		timeNow: timeNow,
+		Allowed:       make(map[string]map[Dest]time.Time),
+		Banned:        make(map[netip.Addr]time.Time),
+		Blocked:       make(map[string]map[Dest]time.Time),
+		timeouts:      make(map[string]map[Dest]time.Duration),
+		banTimeouts:   make(map[netip.Addr]time.Duration),
+		blockTimeouts: make(map[string]map[Dest]time.Duration),
+		timeNow:       timeNow,
 	}
 }
 
@@ -34,59 +56,266 @@ func (m *Mock) Init() error {
 	return m.failErr
 }
 
-// Allow grants access to the destination port from a set of IP addresses for a
-// specific amount of time. It returns the configured failure error if one is
-// set, otherwise tracks the allowance with expiration time.
-// Note that this implementation doesn't handle overlapping IP addresses as a
-// real firewall would. It identifies IP ranges based only on their string
-// representation.
-func (m *Mock) Allow(ipSet *netipx.IPSet, destPort uint16, duration time.Duration) error {
+// Check returns the configured failure error if one is set.
+func (m *Mock) Check() error {
+	return m.failErr
+}
+
+// Allow grants access to the destination ports of the protocol from a set of IP
+// addresses for a specific amount of time. It returns the configured failure
+// error if one is set, otherwise tracks the allowance with expiration time.
+// Like a real firewall, existing entries that overlap with the IP set are
+// replaced, so that the overlapping IP addresses are granted access for the new
+// duration, and the rest keep their remaining time.
+func (m *Mock) Allow(
+	ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges, duration time.Duration,
+) error {
+	removed, remainder, err := m.subtract(m.Elements, ipSet, proto, destPorts)
+	if err != nil {
+		return err
+	}
+
+	update(m.Allowed, m.timeouts, m.timeNow(), removed,
+		append(remainder, ftypes.NewElements(ipSet, proto, destPorts, duration)...))
+
+	return nil
+}
+
+// Deny blocks access to the destination ports of the protocol from a set of IP
+// addresses. Like a real firewall, existing entries that overlap with the IP
+// set are replaced by the remainder of their IP range, which keeps the
+// remaining time until expiration.
+func (m *Mock) Deny(ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges) error {
+	removed, remainder, err := m.subtract(m.Elements, ipSet, proto, destPorts)
+	if err != nil {
+		return err
+	}
+
+	update(m.Allowed, m.timeouts, m.timeNow(), removed, remainder)
+
+	return nil
+}
+
+// Elements returns all unexpired entries that currently grant access, sorted
+// by IP range, destination ports and protocol. Entries added directly to the
+// Allowed map have a zero timeout.
+func (m *Mock) Elements() ([]ftypes.Element, error) {
 	if m.failErr != nil {
-		return m.failErr
+		return nil, m.failErr
 	}
-	ipRanges := ipSet.Ranges()
-	for _, ipRange := range ipRanges {
-		ipStr := ipRange.String()
-		ports, ok := m.Allowed[ipStr]
-		if !ok {
-			ports = make(map[uint16]time.Time)
-			m.Allowed[ipStr] = ports
-		}
-		ports[destPort] = m.timeNow().Add(duration)
+
+	return elements(m.Allowed, m.timeouts, m.timeNow())
+}
+
+// Ban blocks all traffic from an IP address for a specific amount of time. It
+// returns the configured failure error if one is set.
+func (m *Mock) Ban(addr netip.Addr, duration time.Duration) error {
+	if m.failErr != nil {
+		return m.failErr
 	}
 
+	addr = addr.Unmap()
+	m.Banned[addr] = m.timeNow().Add(duration)
+	m.banTimeouts[addr] = duration
+
 	return nil
 }
 
-// Deny blocks access to the destination port from a set of IP addresses.
-// Note that this implementation doesn't handle overlapping IP addresses as a
-// real firewall would. It identifies IP ranges based only on their string
-// representation.
-func (m *Mock) Deny(ipSet *netipx.IPSet, destPort uint16) error {
+// Unban removes the ban of an IP address. It returns the configured failure
+// error if one is set.
+func (m *Mock) Unban(addr netip.Addr) error {
 	if m.failErr != nil {
 		return m.failErr
 	}
 
-	for _, ipRange := range ipSet.Ranges() {
-		ipStr := ipRange.String()
-		ports, ok := m.Allowed[ipStr]
-		if !ok {
+	addr = addr.Unmap()
+	delete(m.Banned, addr)
+	delete(m.banTimeouts, addr)
+
+	return nil
+}
+
+// Bans returns all unexpired bans, sorted by IP address.
+func (m *Mock) Bans() ([]ftypes.Ban, error) {
+	if m.failErr != nil {
+		return nil, m.failErr
+	}
+
+	timeNow := m.timeNow()
+	bans := []ftypes.Ban{}
+	for addr, expiresAt := range m.Banned {
+		if !expiresAt.After(timeNow) {
 			continue
 		}
+		bans = append(bans, ftypes.Ban{
+			Addr:    addr,
+			Timeout: m.banTimeouts[addr],
+			Expires: expiresAt.Sub(timeNow),
+		})
+	}
 
-		delete(ports, destPort)
-		m.Allowed[ipStr] = ports
+	slices.SortFunc(bans, func(a, b ftypes.Ban) int {
+		return a.Addr.Compare(b.Addr)
+	})
 
-		if len(ports) == 0 {
-			delete(m.Allowed, ipStr)
-		}
+	return bans, nil
+}
+
+// Block denies access to the destination ports of the protocol from a set of
+// IP addresses for a specific amount of time. A duration of 0 blocks access
+// until it's unblocked. Like a real firewall, existing entries that overlap
+// with the IP set are replaced, so that the overlapping IP addresses are
+// blocked for the new duration, and the rest keep their remaining time.
+func (m *Mock) Block(
+	ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges, duration time.Duration,
+) error {
+	removed, remainder, err := m.subtract(m.Blocks, ipSet, proto, destPorts)
+	if err != nil {
+		return err
 	}
 
+	update(m.Blocked, m.blockTimeouts, m.timeNow(), removed,
+		append(remainder, ftypes.NewElements(ipSet, proto, destPorts, duration)...))
+
 	return nil
 }
 
+// Unblock removes the blocks of the destination ports of the protocol from a
+// set of IP addresses. Like a real firewall, existing entries that overlap with
+// the IP set are replaced by the remainder of their IP range, which keeps the
+// remaining time until expiration.
+func (m *Mock) Unblock(ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges) error {
+	removed, remainder, err := m.subtract(m.Blocks, ipSet, proto, destPorts)
+	if err != nil {
+		return err
+	}
+
+	update(m.Blocked, m.blockTimeouts, m.timeNow(), removed, remainder)
+
+	return nil
+}
+
+// Blocks returns all unexpired entries that currently block access, sorted by
+// IP range, destination ports and protocol.
+func (m *Mock) Blocks() ([]ftypes.Element, error) {
+	if m.failErr != nil {
+		return nil, m.failErr
+	}
+
+	return elements(m.Blocked, m.blockTimeouts, m.timeNow())
+}
+
+// subtract returns the existing elements listed by list that overlap with the
+// IP set, and the remainder of their IP ranges. See ftypes.Subtract.
+func (m *Mock) subtract(
+	list func() ([]ftypes.Element, error), ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges,
+) (removed, remainder []ftypes.Element, err error) {
+	elements, err := list()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ftypes.Subtract(elements, ipSet, proto, destPorts)
+}
+
+// elements returns the unexpired entries, sorted by IP range, destination
+// ports and protocol. Entries with a zero expiration time never expire, and
+// entries without a timeout have a zero timeout.
+func elements(
+	entries map[string]map[Dest]time.Time, timeouts map[string]map[Dest]time.Duration, timeNow time.Time,
+) ([]ftypes.Element, error) {
+	els := []ftypes.Element{}
+	for ipStr, dests := range entries {
+		ipRange, err := netipx.ParseIPRange(ipStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing IP range '%s': %w", ipStr, err)
+		}
+		for dest, expiresAt := range dests {
+			var expires time.Duration
+			if !expiresAt.IsZero() {
+				if !expiresAt.After(timeNow) {
+					continue
+				}
+				expires = expiresAt.Sub(timeNow)
+			}
+			els = append(els, ftypes.Element{
+				IPRange:   ipRange,
+				Protocol:  dest.Protocol,
+				DestPorts: dest.Ports,
+				Timeout:   timeouts[ipStr][dest],
+				Expires:   expires,
+			})
+		}
+	}
+
+	slices.SortFunc(els, func(a, b ftypes.Element) int {
+		return cmp.Or(
+			a.IPRange.From().Compare(b.IPRange.From()),
+			a.IPRange.To().Compare(b.IPRange.To()),
+			cmp.Compare(a.DestPorts.From, b.DestPorts.From),
+			cmp.Compare(a.DestPorts.To, b.DestPorts.To),
+			cmp.Compare(a.Protocol, b.Protocol),
+		)
+	})
+
+	return els, nil
+}
+
+// update deletes and adds entries for the elements. Elements without a timeout
+// are added with a zero expiration time.
+func update(
+	entries map[string]map[Dest]time.Time, timeouts map[string]map[Dest]time.Duration, timeNow time.Time,
+	del, add []ftypes.Element,
+) {
+	for _, el := range del {
+		ipStr := el.IPRange.String()
+		dest := Dest{Protocol: el.Protocol, Ports: el.DestPorts}
+		delete(entries[ipStr], dest)
+		delete(timeouts[ipStr], dest)
+		if len(entries[ipStr]) == 0 {
+			delete(entries, ipStr)
+			delete(timeouts, ipStr)
+		}
+	}
+
+	for _, el := range add {
+		ipStr := el.IPRange.String()
+		if _, ok := entries[ipStr]; !ok {
+			entries[ipStr] = make(map[Dest]time.Time)
+		}
+		if _, ok := timeouts[ipStr]; !ok {
+			timeouts[ipStr] = make(map[Dest]time.Duration)
+		}
+		dest := Dest{Protocol: el.Protocol, Ports: el.DestPorts}
+		var expiresAt time.Time
+		if el.Timeout > 0 {
+			expiresAt = timeNow.Add(el.Timeout)
+		}
+		entries[ipStr][dest] = expiresAt
+		timeouts[ipStr][dest] = el.Timeout
+	}
+}
+
 // SetFailError configures the mock to return the specified error from Setup()
 // and Allow() calls. Pass nil to disable error simulation.
 func (m *Mock) SetFailError(err error) {
 	m.failErr = err
 }
+
+// ConnTracker is a connection tracker implementation for testing that records
+// the connections it was asked to remove.
+type ConnTracker struct {
+	// Deleted are the elements matching the removed connections, without a
+	// timeout.
+	Deleted []ftypes.Element
+}
+
+var _ ftypes.ConnTracker = (*ConnTracker)(nil)
+
+// Delete records the elements matching the connections from a set of IP
+// addresses to the destination ports of the protocol, and returns their number.
+func (c *ConnTracker) Delete(ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges) (int, error) {
+	elements := ftypes.NewElements(ipSet, proto, destPorts, 0)
+	c.Deleted = append(c.Deleted, elements...)
+	return len(elements), nil
+}
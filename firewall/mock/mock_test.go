@@ -0,0 +1,265 @@
+package mock_test
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go4.org/netipx"
+
+	"go.hackfix.me/sesame/firewall"
+	"go.hackfix.me/sesame/firewall/mock"
+	ftypes "go.hackfix.me/sesame/firewall/types"
+)
+
+func TestMockElements(t *testing.T) {
+	t.Parallel()
+
+	timeNow := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := mock.New(func() time.Time { return timeNow })
+
+	var b netipx.IPSetBuilder
+	b.AddRange(netipx.MustParseIPRange("10.0.0.1-10.0.0.10"))
+	b.AddRange(netipx.MustParseIPRange("2001:db8::-2001:db8::ff"))
+	ipSet, err := b.IPSet()
+	require.NoError(t, err)
+
+	require.NoError(t, m.Allow(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 443, To: 443}}, time.Hour))
+	require.NoError(t, m.Allow(ipSet, ftypes.ProtocolBoth, ftypes.PortRanges{{From: 22, To: 22}}, 10*time.Minute))
+	// Expired entry
+	m.Allowed["192.168.1.1-192.168.1.1"] = map[mock.Dest]time.Time{
+		{Protocol: ftypes.ProtocolTCP, Ports: ftypes.PortRange{From: 80, To: 80}}: timeNow.Add(-time.Second),
+	}
+
+	elements, err := m.Elements()
+	require.NoError(t, err)
+
+	expElements := []ftypes.Element{
+		{
+			IPRange:   netipx.MustParseIPRange("10.0.0.1-10.0.0.10"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ftypes.PortRange{From: 22, To: 22},
+			Timeout:   10 * time.Minute,
+			Expires:   10 * time.Minute,
+		},
+		{
+			IPRange:   netipx.MustParseIPRange("10.0.0.1-10.0.0.10"),
+			Protocol:  ftypes.ProtocolUDP,
+			DestPorts: ftypes.PortRange{From: 22, To: 22},
+			Timeout:   10 * time.Minute,
+			Expires:   10 * time.Minute,
+		},
+		{
+			IPRange:   netipx.MustParseIPRange("10.0.0.1-10.0.0.10"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ftypes.PortRange{From: 443, To: 443},
+			Timeout:   time.Hour,
+			Expires:   time.Hour,
+		},
+		{
+			IPRange:   netipx.MustParseIPRange("2001:db8::-2001:db8::ff"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ftypes.PortRange{From: 22, To: 22},
+			Timeout:   10 * time.Minute,
+			Expires:   10 * time.Minute,
+		},
+		{
+			IPRange:   netipx.MustParseIPRange("2001:db8::-2001:db8::ff"),
+			Protocol:  ftypes.ProtocolUDP,
+			DestPorts: ftypes.PortRange{From: 22, To: 22},
+			Timeout:   10 * time.Minute,
+			Expires:   10 * time.Minute,
+		},
+		{
+			IPRange:   netipx.MustParseIPRange("2001:db8::-2001:db8::ff"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ftypes.PortRange{From: 443, To: 443},
+			Timeout:   time.Hour,
+			Expires:   time.Hour,
+		},
+	}
+	assert.Equal(t, expElements, elements)
+
+	require.NoError(t, m.Deny(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 22, To: 22}}))
+	elements, err = m.Elements()
+	require.NoError(t, err)
+	// Only the UDP entries for port 22 remain.
+	assert.Len(t, elements, 4)
+
+	m.SetFailError(errors.New("firewall error"))
+	_, err = m.Elements()
+	assert.EqualError(t, err, "firewall error")
+}
+
+func TestMockAllowDenyOverlapping(t *testing.T) {
+	t.Parallel()
+
+	timeNow := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := mock.New(func() time.Time { return timeNow })
+	ports := ftypes.PortRanges{{From: 22, To: 22}}
+
+	ipSet, err := firewall.ParseToIPSet("10.0.0.0/24")
+	require.NoError(t, err)
+	require.NoError(t, m.Allow(ipSet, ftypes.ProtocolTCP, ports, time.Hour))
+
+	ipSet, err = firewall.ParseToIPSet("10.0.0.5")
+	require.NoError(t, err)
+	require.NoError(t, m.Deny(ipSet, ftypes.ProtocolTCP, ports))
+
+	elements, err := m.Elements()
+	require.NoError(t, err)
+	assert.Equal(t, []ftypes.Element{
+		{
+			IPRange:   netipx.MustParseIPRange("10.0.0.0-10.0.0.4"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ports[0],
+			Timeout:   time.Hour,
+			Expires:   time.Hour,
+		},
+		{
+			IPRange:   netipx.MustParseIPRange("10.0.0.6-10.0.0.255"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ports[0],
+			Timeout:   time.Hour,
+			Expires:   time.Hour,
+		},
+	}, elements)
+
+	// Opening an overlapping range replaces the overlapping part, and the rest
+	// keeps its remaining time.
+	timeNow = timeNow.Add(30 * time.Minute)
+	ipSet, err = firewall.ParseToIPSet("10.0.0.0-10.0.0.10")
+	require.NoError(t, err)
+	require.NoError(t, m.Allow(ipSet, ftypes.ProtocolTCP, ports, 10*time.Minute))
+
+	elements, err = m.Elements()
+	require.NoError(t, err)
+	assert.Equal(t, []ftypes.Element{
+		{
+			IPRange:   netipx.MustParseIPRange("10.0.0.0-10.0.0.10"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ports[0],
+			Timeout:   10 * time.Minute,
+			Expires:   10 * time.Minute,
+		},
+		{
+			IPRange:   netipx.MustParseIPRange("10.0.0.11-10.0.0.255"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ports[0],
+			Timeout:   30 * time.Minute,
+			Expires:   30 * time.Minute,
+		},
+	}, elements)
+
+	// Other protocols and ports are unaffected.
+	require.NoError(t, m.Deny(ipSet, ftypes.ProtocolUDP, ports))
+	require.NoError(t, m.Deny(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 80, To: 80}}))
+	elements, err = m.Elements()
+	require.NoError(t, err)
+	assert.Len(t, elements, 2)
+}
+
+func TestMockBans(t *testing.T) {
+	t.Parallel()
+
+	timeNow := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := mock.New(func() time.Time { return timeNow })
+
+	require.NoError(t, m.Ban(netip.MustParseAddr("2001:db8::1"), time.Hour))
+	require.NoError(t, m.Ban(netip.MustParseAddr("::ffff:10.0.0.2"), time.Minute))
+	require.NoError(t, m.Ban(netip.MustParseAddr("10.0.0.1"), time.Minute))
+	// Banning again replaces the previous ban.
+	require.NoError(t, m.Ban(netip.MustParseAddr("10.0.0.1"), 2*time.Hour))
+	// Expired ban
+	m.Banned[netip.MustParseAddr("10.0.0.3")] = timeNow.Add(-time.Second)
+
+	bans, err := m.Bans()
+	require.NoError(t, err)
+	assert.Equal(t, []ftypes.Ban{
+		{Addr: netip.MustParseAddr("10.0.0.1"), Timeout: 2 * time.Hour, Expires: 2 * time.Hour},
+		{Addr: netip.MustParseAddr("10.0.0.2"), Timeout: time.Minute, Expires: time.Minute},
+		{Addr: netip.MustParseAddr("2001:db8::1"), Timeout: time.Hour, Expires: time.Hour},
+	}, bans)
+
+	require.NoError(t, m.Unban(netip.MustParseAddr("10.0.0.1")))
+	// Unbanning an address that isn't banned does nothing.
+	require.NoError(t, m.Unban(netip.MustParseAddr("10.0.0.4")))
+
+	bans, err = m.Bans()
+	require.NoError(t, err)
+	assert.Equal(t, []ftypes.Ban{
+		{Addr: netip.MustParseAddr("10.0.0.2"), Timeout: time.Minute, Expires: time.Minute},
+		{Addr: netip.MustParseAddr("2001:db8::1"), Timeout: time.Hour, Expires: time.Hour},
+	}, bans)
+
+	errFail := errors.New("fail")
+	m.SetFailError(errFail)
+	require.ErrorIs(t, m.Ban(netip.MustParseAddr("10.0.0.1"), time.Minute), errFail)
+	_, err = m.Bans()
+	require.ErrorIs(t, err, errFail)
+}
+
+func TestMockBlocks(t *testing.T) {
+	t.Parallel()
+
+	timeNow := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := mock.New(func() time.Time { return timeNow })
+
+	ipSet, err := firewall.ParseToIPSet("10.0.0.0/24")
+	require.NoError(t, err)
+	require.NoError(t, m.Block(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 22, To: 22}}, 0))
+
+	ipSet, err = firewall.ParseToIPSet("2001:db8::1")
+	require.NoError(t, err)
+	require.NoError(t, m.Block(ipSet, ftypes.ProtocolBoth, ftypes.PortRanges{{From: 53, To: 53}}, time.Hour))
+
+	// Blocks don't affect the access granted to the same clients.
+	require.NoError(t, m.Allow(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 53, To: 53}}, time.Minute))
+
+	ipSet, err = firewall.ParseToIPSet("10.0.0.128/25")
+	require.NoError(t, err)
+	require.NoError(t, m.Unblock(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 22, To: 22}}))
+
+	blocks, err := m.Blocks()
+	require.NoError(t, err)
+	assert.Equal(t, []ftypes.Element{
+		{
+			// The remainder of a block that never expires doesn't expire either.
+			IPRange:   netipx.MustParseIPRange("10.0.0.0-10.0.0.127"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ftypes.PortRange{From: 22, To: 22},
+		},
+		{
+			IPRange:   netipx.MustParseIPRange("2001:db8::1-2001:db8::1"),
+			Protocol:  ftypes.ProtocolTCP,
+			DestPorts: ftypes.PortRange{From: 53, To: 53},
+			Timeout:   time.Hour,
+			Expires:   time.Hour,
+		},
+		{
+			IPRange:   netipx.MustParseIPRange("2001:db8::1-2001:db8::1"),
+			Protocol:  ftypes.ProtocolUDP,
+			DestPorts: ftypes.PortRange{From: 53, To: 53},
+			Timeout:   time.Hour,
+			Expires:   time.Hour,
+		},
+	}, blocks)
+
+	elements, err := m.Elements()
+	require.NoError(t, err)
+	assert.Len(t, elements, 1)
+
+	timeNow = timeNow.Add(2 * time.Hour)
+	blocks, err = m.Blocks()
+	require.NoError(t, err)
+	assert.Len(t, blocks, 1)
+
+	errFail := errors.New("fail")
+	m.SetFailError(errFail)
+	require.ErrorIs(t, m.Block(ipSet, ftypes.ProtocolTCP, ftypes.PortRanges{{From: 22, To: 22}}, 0), errFail)
+	_, err = m.Blocks()
+	require.ErrorIs(t, err, errFail)
+}
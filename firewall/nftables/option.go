@@ -0,0 +1,12 @@
+package nftables
+
+// Option is a function that allows configuring NFTables.
+type Option func(*NFTables)
+
+// WithStrictEstablished sets whether packets that clients send on established
+// connections are only accepted while the clients are allowed access.
+func WithStrictEstablished(strict bool) Option {
+	return func(n *NFTables) {
+		n.strictEstablished = strict
+	}
+}
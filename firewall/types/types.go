@@ -1,7 +1,12 @@
 package types
 
 import (
+	"cmp"
 	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"go4.org/netipx"
@@ -14,6 +19,7 @@ type FirewallType string
 const (
 	FirewallMock     FirewallType = "mock"
 	FirewallNFTables FirewallType = "nftables"
+	FirewallIPTables FirewallType = "iptables"
 )
 
 // FirewallTypeFromString returns a valid FirewallType for the given string, or
@@ -24,19 +30,295 @@ func FirewallTypeFromString(val string) (FirewallType, error) {
 		return FirewallMock, nil
 	case FirewallNFTables:
 		return FirewallNFTables, nil
+	case FirewallIPTables:
+		return FirewallIPTables, nil
 	}
 	return "", fmt.Errorf("unsupported firewall type '%s'", val)
 }
 
+// Protocol is the layer 4 protocol of a service.
+type Protocol string
+
+// All supported protocols.
+const (
+	ProtocolTCP  Protocol = "tcp"
+	ProtocolUDP  Protocol = "udp"
+	ProtocolBoth Protocol = "both" // TCP and UDP
+)
+
+// ProtocolFromString returns a valid Protocol for the given string, or an
+// error if the value is invalid.
+func ProtocolFromString(val string) (Protocol, error) {
+	switch Protocol(val) {
+	case ProtocolTCP:
+		return ProtocolTCP, nil
+	case ProtocolUDP:
+		return ProtocolUDP, nil
+	case ProtocolBoth:
+		return ProtocolBoth, nil
+	}
+	return "", fmt.Errorf("unsupported protocol '%s'", val)
+}
+
+// Expand returns the individual protocols represented by p. ProtocolBoth
+// expands to TCP and UDP, and an empty protocol is assumed to be TCP.
+func (p Protocol) Expand() []Protocol {
+	switch p {
+	case ProtocolUDP:
+		return []Protocol{ProtocolUDP}
+	case ProtocolBoth:
+		return []Protocol{ProtocolTCP, ProtocolUDP}
+	case ProtocolTCP:
+	}
+	return []Protocol{ProtocolTCP}
+}
+
+// PortRange is an inclusive range of ports. A single port is represented by a
+// range where From and To are equal.
+type PortRange struct {
+	From, To uint16
+}
+
+// ParsePortRange parses a single port (e.g. "22"), or a range of ports
+// separated by a hyphen (e.g. "60000-61000").
+func ParsePortRange(val string) (PortRange, error) {
+	fromStr, toStr, isRange := strings.Cut(strings.TrimSpace(val), "-")
+	if !isRange {
+		toStr = fromStr
+	}
+
+	from, err := parsePort(fromStr)
+	if err != nil {
+		return PortRange{}, err
+	}
+	to, err := parsePort(toStr)
+	if err != nil {
+		return PortRange{}, err
+	}
+	if from > to {
+		return PortRange{}, fmt.Errorf("invalid port range '%s': start is greater than end", val)
+	}
+
+	return PortRange{From: from, To: to}, nil
+}
+
+// Contains returns true if the port is within the range.
+func (pr PortRange) Contains(port uint16) bool {
+	return port >= pr.From && port <= pr.To
+}
+
+// String returns the port, or the range of ports separated by a hyphen.
+func (pr PortRange) String() string {
+	if pr.From == pr.To {
+		return strconv.Itoa(int(pr.From))
+	}
+	return fmt.Sprintf("%d-%d", pr.From, pr.To)
+}
+
+// PortRanges is a list of port ranges.
+type PortRanges []PortRange
+
+// ParsePortRanges parses a comma-separated list of ports and port ranges, e.g.
+// "22,60000-61000". The returned list is sorted, and overlapping or adjacent
+// ranges are merged.
+func ParsePortRanges(val string) (PortRanges, error) {
+	if strings.TrimSpace(val) == "" {
+		return nil, fmt.Errorf("no ports specified")
+	}
+
+	var prs PortRanges
+	for prStr := range strings.SplitSeq(val, ",") {
+		pr, err := ParsePortRange(prStr)
+		if err != nil {
+			return nil, err
+		}
+		prs = append(prs, pr)
+	}
+
+	return prs.Merge(), nil
+}
+
+// Merge returns a sorted copy of the port ranges, where overlapping or adjacent
+// ranges are merged into a single range.
+func (prs PortRanges) Merge() PortRanges {
+	sorted := slices.Clone(prs)
+	slices.SortFunc(sorted, func(a, b PortRange) int {
+		return cmp.Or(cmp.Compare(a.From, b.From), cmp.Compare(a.To, b.To))
+	})
+
+	merged := make(PortRanges, 0, len(sorted))
+	for _, pr := range sorted {
+		if n := len(merged); n > 0 && int(pr.From) <= int(merged[n-1].To)+1 {
+			merged[n-1].To = max(merged[n-1].To, pr.To)
+			continue
+		}
+		merged = append(merged, pr)
+	}
+
+	return merged
+}
+
+// String returns the comma-separated list of port ranges.
+func (prs PortRanges) String() string {
+	prsStr := make([]string, len(prs))
+	for i, pr := range prs {
+		prsStr[i] = pr.String()
+	}
+	return strings.Join(prsStr, ",")
+}
+
+func parsePort(val string) (uint16, error) {
+	port, err := strconv.ParseUint(val, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port '%s'", val)
+	}
+	if port == 0 {
+		return 0, fmt.Errorf("invalid port '%s': must be greater than 0", val)
+	}
+	return uint16(port), nil
+}
+
 // Firewall is the interface for managing firewall rules.
 type Firewall interface {
 	// Init initializes the firewall (creates tables, chains, etc.)
 	Init() error
 
-	// Allow grants access to the destination port from a set of IP addresses for
-	// a specific amount of time.
-	Allow(ipSet *netipx.IPSet, destPort uint16, duration time.Duration) error
+	// Allow grants access to the destination ports of the protocol from a set
+	// of IP addresses for a specific amount of time. IP addresses that already
+	// have access are granted it again for the new duration.
+	Allow(ipSet *netipx.IPSet, proto Protocol, destPorts PortRanges, duration time.Duration) error
+
+	// Deny blocks access to the destination ports of the protocol from a set of
+	// IP addresses. The IP addresses are removed from any previously allowed
+	// IP ranges, and the rest of the ranges keep their access.
+	Deny(ipSet *netipx.IPSet, proto Protocol, destPorts PortRanges) error
+
+	// Elements returns all unexpired entries that currently grant access.
+	Elements() ([]Element, error)
+
+	// Check returns an error if any of the objects created by Init (tables,
+	// chains, sets, etc.) don't exist.
+	Check() error
+
+	// Ban blocks all traffic from an IP address for a specific amount of time,
+	// regardless of the access it was granted. If the IP address is already
+	// banned, it's banned again for the new duration.
+	Ban(addr netip.Addr, duration time.Duration) error
+
+	// Unban removes the ban of an IP address. It does nothing if the IP
+	// address isn't banned.
+	Unban(addr netip.Addr) error
+
+	// Bans returns all unexpired bans.
+	Bans() ([]Ban, error)
+
+	// Block denies access to the destination ports of the protocol from a set
+	// of IP addresses for a specific amount of time, regardless of the access
+	// granted to them. A duration of 0 blocks access until it's unblocked. IP
+	// addresses that are already blocked are blocked again for the new duration.
+	Block(ipSet *netipx.IPSet, proto Protocol, destPorts PortRanges, duration time.Duration) error
+
+	// Unblock removes the blocks of the destination ports of the protocol from
+	// a set of IP addresses. The IP addresses are removed from any previously
+	// blocked IP ranges, and the rest of the ranges remain blocked.
+	Unblock(ipSet *netipx.IPSet, proto Protocol, destPorts PortRanges) error
+
+	// Blocks returns all unexpired entries that currently block access.
+	// Entries that never expire have a zero timeout.
+	Blocks() ([]Element, error)
+}
+
+// ConnTracker is the interface for managing the connections tracked by the
+// system.
+type ConnTracker interface {
+	// Delete removes the tracked connections from a set of IP addresses to the
+	// destination ports of the protocol, so that their established connections
+	// are no longer accepted by the firewall. It returns the number of removed
+	// connections.
+	Delete(ipSet *netipx.IPSet, proto Protocol, destPorts PortRanges) (int, error)
+}
+
+// Ban is a firewall entry that blocks all traffic from an IP address.
+type Ban struct {
+	Addr netip.Addr
+	// Total duration of the ban.
+	Timeout time.Duration
+	// Remaining time until the ban is removed.
+	Expires time.Duration
+}
+
+// Element is a firewall entry that grants or blocks access to a range of
+// destination ports from a range of IP addresses. The protocol is either TCP or
+// UDP.
+type Element struct {
+	IPRange   netipx.IPRange
+	Protocol  Protocol
+	DestPorts PortRange
+	// Total duration of the access.
+	Timeout time.Duration
+	// Remaining time until the entry is removed.
+	Expires time.Duration
+}
+
+// NewElements returns the elements that grant access to the destination ports
+// of the protocol from a set of IP addresses. One element is created per IP
+// range, individual protocol and port range.
+func NewElements(
+	ipSet *netipx.IPSet, proto Protocol, destPorts PortRanges, timeout time.Duration,
+) []Element {
+	var elements []Element
+	for _, p := range proto.Expand() {
+		for _, pr := range destPorts {
+			for _, ipRange := range ipSet.Ranges() {
+				elements = append(elements, Element{
+					IPRange:   ipRange,
+					Protocol:  p,
+					DestPorts: pr,
+					Timeout:   timeout,
+					Expires:   timeout,
+				})
+			}
+		}
+	}
+
+	return elements
+}
+
+// Subtract removes a set of IP addresses from the elements that grant access to
+// the destination ports of the protocol. It returns the elements whose IP range
+// overlaps with the IP set, which should be removed from the firewall, and the
+// remainder of their IP ranges as new elements, which should be added back with
+// the remaining time until expiration of the original element. Elements are
+// only matched if their port range is one of destPorts.
+func Subtract(
+	elements []Element, ipSet *netipx.IPSet, proto Protocol, destPorts PortRanges,
+) (removed, remainder []Element, err error) {
+	protos := proto.Expand()
+	for _, el := range elements {
+		if !slices.Contains(protos, el.Protocol) || !slices.Contains(destPorts, el.DestPorts) ||
+			!ipSet.OverlapsRange(el.IPRange) {
+			continue
+		}
+		removed = append(removed, el)
+
+		var b netipx.IPSetBuilder
+		b.AddRange(el.IPRange)
+		b.RemoveSet(ipSet)
+		rest, berr := b.IPSet()
+		if berr != nil {
+			return nil, nil, fmt.Errorf("failed subtracting IP set from %s: %w", el.IPRange, berr)
+		}
+
+		for _, ipRange := range rest.Ranges() {
+			remainder = append(remainder, Element{
+				IPRange:   ipRange,
+				Protocol:  el.Protocol,
+				DestPorts: el.DestPorts,
+				Timeout:   el.Expires,
+				Expires:   el.Expires,
+			})
+		}
+	}
 
-	// Deny blocks access to the destination port from a set of IP addresses.
-	Deny(ipSet *netipx.IPSet, destPort uint16) error
+	return removed, remainder, nil
 }
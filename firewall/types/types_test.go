@@ -0,0 +1,76 @@
+package types_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ftypes "go.hackfix.me/sesame/firewall/types"
+)
+
+func TestParsePortRanges(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		input  string
+		exp    ftypes.PortRanges
+		expStr string
+		expErr string
+	}{
+		{
+			name:   "ok/single",
+			input:  "22",
+			exp:    ftypes.PortRanges{{From: 22, To: 22}},
+			expStr: "22",
+		},
+		{
+			name:   "ok/mixed",
+			input:  "60000-61000, 22,21",
+			exp:    ftypes.PortRanges{{From: 21, To: 22}, {From: 60000, To: 61000}},
+			expStr: "21-22,60000-61000",
+		},
+		{
+			name:   "ok/overlapping",
+			input:  "100-200,150-300,50,301",
+			exp:    ftypes.PortRanges{{From: 50, To: 50}, {From: 100, To: 301}},
+			expStr: "50,100-301",
+		},
+		{
+			name:   "err/empty",
+			input:  " ",
+			expErr: "no ports specified",
+		},
+		{
+			name:   "err/zero",
+			input:  "0",
+			expErr: "invalid port '0': must be greater than 0",
+		},
+		{
+			name:   "err/out_of_range",
+			input:  "22,65536",
+			expErr: "invalid port '65536'",
+		},
+		{
+			name:   "err/reversed_range",
+			input:  "61000-60000",
+			expErr: "invalid port range '61000-60000': start is greater than end",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			prs, err := ftypes.ParsePortRanges(tt.input)
+			if tt.expErr != "" {
+				assert.EqualError(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.exp, prs)
+			assert.Equal(t, tt.expStr, prs.String())
+		})
+	}
+}
@@ -3,8 +3,12 @@ package firewall
 import (
 	"fmt"
 	"net/netip"
+	"time"
 
 	"go4.org/netipx"
+
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/db/types"
 )
 
 // ParseToIPSet parses one or more IP address strings in plain, CIDR or range
@@ -39,3 +43,84 @@ func ParseToIPSet(ipAddr ...string) (*netipx.IPSet, error) {
 
 	return ipSet, nil
 }
+
+// rangeToIPSet returns an IP set containing only the given IP range.
+func rangeToIPSet(ipRange netipx.IPRange) *netipx.IPSet {
+	var b netipx.IPSetBuilder
+	b.AddRange(ipRange)
+	// The builder only returns errors for invalid ranges, which it doesn't add.
+	ipSet, _ := b.IPSet()
+	return ipSet
+}
+
+// ipRangeStrings returns the IP ranges of the set as strings, or an error if
+// any of them is invalid.
+func ipRangeStrings(ipSet *netipx.IPSet) ([]string, error) {
+	ipRanges := ipSet.Ranges()
+	ipRangesStr := make([]string, len(ipRanges))
+	for i, r := range ipRanges {
+		if !r.IsValid() {
+			return nil, fmt.Errorf("invalid IP address range: %s", r)
+		}
+		ipRangesStr[i] = r.String()
+	}
+	return ipRangesStr, nil
+}
+
+// blockFilter returns the filter of the blocks of the service. If svc is nil,
+// it matches the blocks of all services, or every block if all is true.
+func blockFilter(svc *models.Service, all bool) *types.Filter {
+	switch {
+	case svc != nil:
+		return types.NewFilter("b.service_id = ?", []any{svc.ID})
+	case all:
+		return nil
+	default:
+		return types.NewFilter("b.service_id IS NULL", nil)
+	}
+}
+
+// blockRemaining returns the remaining duration of the block, which is 0 if
+// the block never expires.
+func blockRemaining(b *models.Block, timeNow time.Time) time.Duration {
+	if !b.ExpiresAt.Valid {
+		return 0
+	}
+	return b.ExpiresAt.V.Sub(timeNow)
+}
+
+// checkUserPolicy returns an AccessPolicyError if the user isn't allowed to
+// grant access to the IP addresses in the set. source is the address the
+// request of the user originated from.
+func checkUserPolicy(ipSet *netipx.IPSet, user *models.User, source netip.Addr) error {
+	if user.SelfOnly {
+		source = source.Unmap()
+		for _, r := range ipSet.Ranges() {
+			if !source.IsValid() || r.From() != source || r.To() != source {
+				return AccessPolicyError{
+					Msg: fmt.Sprintf("user '%s' can only grant access to their own address", user.Name),
+				}
+			}
+		}
+	}
+
+	if len(user.AllowedCIDRs) > 0 {
+		var b netipx.IPSetBuilder
+		for _, prefix := range user.AllowedCIDRs {
+			b.AddPrefix(prefix)
+		}
+		allowed, err := b.IPSet()
+		if err != nil {
+			return fmt.Errorf("failed building allowed IP set: %w", err)
+		}
+		for _, r := range ipSet.Ranges() {
+			if !allowed.ContainsRange(r) {
+				return AccessPolicyError{
+					Msg: fmt.Sprintf("user '%s' is not allowed to grant access to %s", user.Name, r),
+				}
+			}
+		}
+	}
+
+	return nil
+}
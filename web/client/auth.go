@@ -24,8 +24,8 @@ import (
 // with the given invitation token. The token is a concatenation of a 32-byte
 // nonce and the public X25519 key of the remote node, as generated by the
 // `invite user` command, and transmitted out-of-band by the user to the client
-// node. If the authentication is successful, it returns the TLS server (CA)
-// certificate and the TLS client certificate with its private key.
+// node. If the authentication is successful, it returns the TLS CA certificate
+// and the TLS client certificate issued for a private key generated locally.
 // See the inline comments for details about the process.
 //
 //nolint:funlen // A bit long, but splitting it would make it less legible.
@@ -56,12 +56,39 @@ func (c *Client) Auth(ctx context.Context, token string) (cresp ctypes.AuthRespo
 	hmac := crypto.GenerateHMAC(nonce, hmacKey)
 	authToken := slices.Concat(nonce, hmac)
 
-	// 4. Send a join request to the remote node, providing the token and the
-	// local X25519 public key. If the token is valid and not expired, the remote
-	// node will generate a TLS client certificate and private key, encrypt them
-	// with the shared key, and send them in the response, along with the server
-	// (CA) certificate.
-	respStatusCode, respBody, errFields, err := c.join(ctx, base58.Encode(authToken), base58.Encode(pubKeyData))
+	// 4. Generate the client's private key and a CSR for it, and a MAC of the
+	// CSR using a separate key derived from the ECDH key. This allows the
+	// server to verify that the CSR comes from the same client, while the
+	// private key never leaves this node. The subject of the certificate is set
+	// by the server.
+	csr, privKey, err := crypto.NewKeyCSR("")
+	if err != nil {
+		return cresp, err
+	}
+
+	csrPEM, err := crypto.EncodeCSR(csr)
+	if err != nil {
+		return cresp, fmt.Errorf("failed encoding CSR: %w", err)
+	}
+
+	csrMACKey, err := crypto.DeriveHMACKey(sharedKey, []byte("CSR HMAC key derivation"))
+	if err != nil {
+		return cresp, fmt.Errorf("failed deriving CSR HMAC key: %w", err)
+	}
+
+	reqData := stypes.JoinRequest{
+		Version: stypes.JoinProtocolV2,
+		CSR:     csrPEM,
+		CSRMAC:  crypto.GenerateHMAC(csrPEM, csrMACKey),
+	}
+
+	// 5. Send a join request to the remote node, providing the token, the
+	// local X25519 public key, and the CSR. If the token is valid and not
+	// expired, the remote node will issue a TLS client certificate for the CSR,
+	// encrypt it with the shared key, and send it in the response, along with
+	// the CA certificate.
+	respStatusCode, respBody, errFields, err := c.join(
+		ctx, base58.Encode(authToken), base58.Encode(pubKeyData), reqData)
 	if err != nil {
 		return cresp, err
 	}
@@ -73,7 +100,7 @@ func (c *Client) Auth(ctx context.Context, token string) (cresp ctypes.AuthRespo
 		reqFailed = true
 	}
 
-	// 5. Decode the response body.
+	// 6. Decode the response body.
 	respBodyDec, err := base58.Decode(string(respBody))
 	if err != nil {
 		if reqFailed {
@@ -95,7 +122,7 @@ func (c *Client) Auth(ctx context.Context, token string) (cresp ctypes.AuthRespo
 		return &rd, nil
 	}
 
-	// 6. Attempt decrypting the response data with the shared key.
+	// 7. Attempt decrypting the response data with the shared key.
 	// If decryption fails and the request *didn't* fail, then it's due to a
 	// protocol error, so return right away.
 	// However, if decryption fails and the request *did* fail, then attempt to
@@ -122,7 +149,7 @@ func (c *Client) Auth(ctx context.Context, token string) (cresp ctypes.AuthRespo
 		return cresp, aerrors.NewWith("request failed", errFields...)
 	}
 
-	// 7. Try unmarshalling the decrypted response data this time.
+	// 8. Try unmarshalling the decrypted response data this time.
 	resp, err := unmarshalResponse(respBodyJSON)
 	if err != nil {
 		if reqFailed {
@@ -136,19 +163,21 @@ func (c *Client) Auth(ctx context.Context, token string) (cresp ctypes.AuthRespo
 		return cresp, aerrors.NewWith("request failed", errFields...)
 	}
 
-	// 8. Parse and decode the certificates.
+	// 9. Parse and decode the certificates.
 	tlsCACert, err := x509.ParseCertificate(resp.Data.TLSCACert)
 	if err != nil {
 		return cresp, fmt.Errorf("failed parsing TLS CA certificate: %w", err)
 	}
 
-	tlsClientCert, err := crypto.DecodeTLSCert(resp.Data.TLSClientCert)
+	tlsClientCert, err := crypto.DecodeTLSCertWithKey(resp.Data.TLSClientCert, privKey)
 	if err != nil {
 		return cresp, fmt.Errorf("failed decoding TLS client certificate: %w", err)
 	}
 
 	cresp.TLSCACert = tlsCACert
 	cresp.TLSClientCert = &tlsClientCert
+	cresp.RenewalToken = resp.Data.RenewalToken
+	cresp.RenewalTokenExpiresAt = resp.Data.RenewalTokenExpiresAt
 
 	return cresp, nil
 }
@@ -158,17 +187,15 @@ func (c *Client) Auth(ctx context.Context, token string) (cresp ctypes.AuthRespo
 // such as changing firewall rules. The token is generated by the server using
 // the `invite user` command, and the pubKey is the client's X25519 public key.
 // Both are encoded in base58 and sent in the Authorization header. If the token
-// is valid and not expired, the server will generate a TLS client certificate,
-// and return it in the response body along with the client's Ed25519 private
-// key and the server's CA certificate, encrypted with the shared ECDH key. This
-// method returns the decoded but encrypted response body.
-func (c *Client) join(ctx context.Context, token, pubKey string) (
+// is valid and not expired, the server will issue a TLS client certificate for
+// the CSR in reqData, and return it in the response body along with the
+// server's CA certificate, encrypted with the shared ECDH key. This method
+// returns the decoded but encrypted response body.
+func (c *Client) join(ctx context.Context, token, pubKey string, reqData stypes.JoinRequest) (
 	statusCode int, respBody []byte, errFields []any, rerr error,
 ) {
 	url := &url.URL{Scheme: "http", Host: c.address, Path: "/api/v1/join"}
 
-	reqData := stypes.JoinRequest{}
-
 	errFields = []any{"url", url.String(), "method", http.MethodPost}
 
 	reqDataJSON, err := json.Marshal(reqData)
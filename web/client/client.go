@@ -2,11 +2,14 @@ package client
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"log/slog"
 	"net/http"
 	"time"
 
 	"go.hackfix.me/sesame/crypto"
+	"go.hackfix.me/sesame/web/common"
 )
 
 // Client is a friendly interface over the Sesame HTTP API.
@@ -14,6 +17,7 @@ type Client struct {
 	*http.Client
 	address string
 	logger  *slog.Logger
+	caCert  *x509.Certificate
 }
 
 // New returns a new client. Making priviledged requests, such as Open, requires passing
@@ -35,3 +39,47 @@ func New(address string, tlsConfig *tls.Config, logger *slog.Logger) *Client {
 		logger:  logger.With("component", "web-client"),
 	}
 }
+
+// Do sends an HTTP request and returns an HTTP response. It records the CA
+// certificate advertised by the server in successful responses over TLS.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err //nolint:wrapcheck // Wrapped by the caller.
+	}
+
+	if resp.StatusCode == http.StatusOK && resp.TLS != nil {
+		if caCertEnc := resp.Header.Get(common.HeaderCACert); caCertEnc != "" {
+			c.setCACert(caCertEnc)
+		}
+	}
+
+	return resp, nil
+}
+
+// CACert returns the CA certificate advertised by the server in the last
+// successful response, or nil if it wasn't advertised.
+func (c *Client) CACert() *x509.Certificate {
+	return c.caCert
+}
+
+func (c *Client) setCACert(caCertEnc string) {
+	caCertDER, err := base64.StdEncoding.DecodeString(caCertEnc)
+	if err != nil {
+		c.logger.Warn("failed decoding CA certificate", "error", err)
+		return
+	}
+
+	caCert, err := x509.ParseCertificate(caCertDER)
+	if err != nil {
+		c.logger.Warn("failed parsing CA certificate", "error", err)
+		return
+	}
+
+	if !caCert.IsCA {
+		c.logger.Warn("advertised certificate is not a CA certificate")
+		return
+	}
+
+	c.caCert = caCert
+}
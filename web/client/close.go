@@ -17,13 +17,17 @@ import (
 // on a remote Sesame node. The client is expected to have previously been
 // authenticated via an invitation token (see [Client.Auth]), after which it
 // would've been provided a TLS client certificate it can use for these
-// priviledged requests.
-func (c *Client) Close(ctx context.Context, clients []string, serviceName string) (rerr error) {
+// priviledged requests. If killConns is true, the established connections of
+// the clients to the service are terminated.
+func (c *Client) Close(
+	ctx context.Context, clients []string, serviceName string, killConns bool,
+) (rerr error) {
 	url := &url.URL{Scheme: "https", Host: c.address, Path: "/api/v1/close"}
 
 	reqData := stypes.CloseRequest{
-		Clients:     clients,
-		ServiceName: serviceName,
+		Clients:         clients,
+		ServiceName:     serviceName,
+		KillConnections: killConns,
 	}
 
 	errFields := []any{"url", url.String(), "method", http.MethodPost}
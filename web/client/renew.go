@@ -0,0 +1,135 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/mr-tron/base58"
+
+	aerrors "go.hackfix.me/sesame/app/errors"
+	"go.hackfix.me/sesame/crypto"
+	ctypes "go.hackfix.me/sesame/web/client/types"
+	stypes "go.hackfix.me/sesame/web/server/types"
+)
+
+// Renew requests a new TLS client certificate from a remote Sesame node,
+// keeping the private key of the given certificate. If renewalToken is empty,
+// the client must be configured to authenticate with the certificate, so it
+// must not have expired. Otherwise, the request is authenticated with the
+// renewal token, and the certificate is sent in the request instead, which
+// allows renewing expired certificates. In that case the client must not be
+// configured to present the expired certificate, as the TLS handshake would
+// fail. In both cases, the request contains a CSR signed with the private key,
+// which proves possession of it.
+//
+//nolint:funlen // A bit long, but splitting it would make it less legible.
+func (c *Client) Renew(
+	ctx context.Context, cert tls.Certificate, renewalToken []byte,
+) (cresp ctypes.RenewResponseData, rerr error) {
+	url := &url.URL{Scheme: "https", Host: c.address, Path: "/api/v1/renew"}
+
+	errFields := []any{"url", url.String(), "method", http.MethodPost}
+
+	csr, err := crypto.NewCSR(cert)
+	if err != nil {
+		return cresp, aerrors.NewWithCause("failed creating CSR", err, errFields...)
+	}
+
+	csrPEM, err := crypto.EncodeCSR(csr)
+	if err != nil {
+		return cresp, aerrors.NewWithCause("failed encoding CSR", err, errFields...)
+	}
+
+	reqData := stypes.RenewRequest{CSR: csrPEM}
+	if len(renewalToken) > 0 {
+		reqData.TLSClientCert = cert.Certificate[0]
+	}
+
+	reqDataJSON, err := json.Marshal(reqData)
+	if err != nil {
+		return cresp, aerrors.NewWithCause("failed marshalling request data", err, errFields...)
+	}
+
+	reqCtx, cancelReqCtx := context.WithCancel(ctx)
+	defer cancelReqCtx()
+
+	req, err := http.NewRequestWithContext(
+		reqCtx, http.MethodPost, url.String(), bytes.NewBuffer(reqDataJSON))
+	if err != nil {
+		return cresp, aerrors.NewWithCause("failed creating request", err, errFields...)
+	}
+
+	if len(renewalToken) > 0 {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", base58.Encode(renewalToken)))
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return cresp, aerrors.NewWithCause("failed sending request", err, errFields...)
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			rerr = fmt.Errorf("failed closing response body: %w", err)
+		}
+	}()
+	errFields = append(errFields, "status_code", resp.StatusCode, "status", resp.Status)
+
+	var reqFailed bool
+	if resp.StatusCode != http.StatusOK {
+		// The request failed, but we'll still try to read the response body as it
+		// might contain a useful error message.
+		reqFailed = true
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		if reqFailed {
+			return cresp, aerrors.NewWith("request failed", errFields...)
+		}
+		return cresp, aerrors.NewWithCause("failed reading response body", err, errFields...)
+	}
+
+	var respData stypes.RenewResponse
+	err = json.Unmarshal(respBody, &respData)
+	if err != nil {
+		if reqFailed {
+			return cresp, aerrors.NewWith("request failed", errFields...)
+		}
+		return cresp, aerrors.NewWithCause("failed unmarshalling response body", err, errFields...)
+	}
+
+	if respData.Error != nil && respData.Error.Message != "" {
+		errFields = append(errFields, "cause", respData.Error.Message)
+	}
+	if reqFailed {
+		return cresp, aerrors.NewWith("request failed", errFields...)
+	}
+
+	tlsCACert, err := x509.ParseCertificate(respData.Data.TLSCACert)
+	if err != nil {
+		return cresp, fmt.Errorf("failed parsing TLS CA certificate: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(respData.Data.TLSClientCert)
+	if err != nil {
+		return cresp, fmt.Errorf("failed parsing TLS client certificate: %w", err)
+	}
+
+	cresp.TLSCACert = tlsCACert
+	cresp.TLSClientCert = &tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  cert.PrivateKey,
+		Leaf:        leaf,
+	}
+	cresp.RenewalToken = respData.Data.RenewalToken
+	cresp.RenewalTokenExpiresAt = respData.Data.RenewalTokenExpiresAt
+
+	return cresp, nil
+}
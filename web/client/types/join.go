@@ -3,10 +3,14 @@ package types
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"time"
 )
 
 // AuthResponseData is the processed data returned by a successful join request.
 type AuthResponseData struct {
 	TLSCACert     *x509.Certificate
 	TLSClientCert *tls.Certificate
+	// RenewalToken is used for renewing the client certificate after it expires.
+	RenewalToken          []byte
+	RenewalTokenExpiresAt time.Time
 }
@@ -0,0 +1,18 @@
+package types
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+)
+
+// RenewResponseData is the processed data returned by a successful renewal
+// request.
+type RenewResponseData struct {
+	TLSCACert *x509.Certificate
+	// TLSClientCert is the renewed certificate, along with the private key of
+	// the certificate it replaces.
+	TLSClientCert         *tls.Certificate
+	RenewalToken          []byte
+	RenewalTokenExpiresAt time.Time
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	aerrors "go.hackfix.me/sesame/app/errors"
+	stypes "go.hackfix.me/sesame/web/server/types"
+)
+
+// Whoami returns the address the remote Sesame node observes the requests of
+// this client from, along with the user and site ID of the TLS client
+// certificate the client is authenticated with.
+func (c *Client) Whoami(ctx context.Context) (data stypes.WhoamiResponseData, rerr error) {
+	url := &url.URL{Scheme: "https", Host: c.address, Path: "/api/v1/whoami"}
+
+	errFields := []any{"url", url.String(), "method", http.MethodGet}
+
+	reqCtx, cancelReqCtx := context.WithCancel(ctx)
+	defer cancelReqCtx()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url.String(), nil)
+	if err != nil {
+		return data, aerrors.NewWithCause("failed creating request", err, errFields...)
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return data, aerrors.NewWithCause("failed sending request", err, errFields...)
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			rerr = fmt.Errorf("failed closing response body: %w", err)
+		}
+	}()
+	errFields = append(errFields, "status_code", resp.StatusCode, "status", resp.Status)
+
+	var reqFailed bool
+	if resp.StatusCode != http.StatusOK {
+		// The request failed, but we'll still try to read the response body as it
+		// might contain a useful error message.
+		reqFailed = true
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		if reqFailed {
+			return data, aerrors.NewWith("request failed", errFields...)
+		}
+		return data, aerrors.NewWithCause("failed reading response body", err, errFields...)
+	}
+
+	var respData stypes.WhoamiResponse
+	err = json.Unmarshal(respBody, &respData)
+	if err != nil {
+		if reqFailed {
+			return data, aerrors.NewWith("request failed", errFields...)
+		}
+		return data, aerrors.NewWithCause("failed unmarshalling response body", err, errFields...)
+	}
+
+	if respData.Error != nil && respData.Error.Message != "" {
+		errFields = append(errFields, "cause", respData.Error.Message)
+	}
+	if reqFailed {
+		return data, aerrors.NewWith("request failed", errFields...)
+	}
+
+	return respData.Data, nil
+}
@@ -0,0 +1,6 @@
+package common
+
+// HeaderCACert is the HTTP response header that contains the Base64-encoded
+// DER certificate of the CA currently used by the server to issue TLS
+// certificates. Clients use it to learn about a new CA after it's rotated.
+const HeaderCACert = "Sesame-CA-Cert"
@@ -8,8 +8,11 @@ import (
 	"log/slog"
 	"net/http"
 
+	"go.hackfix.me/sesame/app/config"
 	actx "go.hackfix.me/sesame/app/context"
 	"go.hackfix.me/sesame/crypto"
+	"go.hackfix.me/sesame/db/models"
+	dbtypes "go.hackfix.me/sesame/db/types"
 	"go.hackfix.me/sesame/firewall"
 	"go.hackfix.me/sesame/web/server/handler"
 	"go.hackfix.me/sesame/web/server/types"
@@ -17,50 +20,43 @@ import (
 
 // Handler is the API endpoint handler.
 type Handler struct {
-	appCtx        *actx.Context
-	logger        *slog.Logger
-	fwMgr         *firewall.Manager
-	tlsServerCert tls.Certificate
-	tlsCACert     *x509.Certificate
+	appCtx *actx.Context
+	logger *slog.Logger
+	fwMgr  *firewall.Manager
 }
 
-// SetupHandlers configures the web API handlers.
+// SetupHandlers configures the web API handlers. The firewall options are
+// passed to the firewall Manager.
 func SetupHandlers(
-	appCtx *actx.Context, errLvl types.ErrorLevel, logger *slog.Logger,
+	appCtx *actx.Context, errLvl types.ErrorLevel, logger *slog.Logger, fwOpts ...firewall.Option,
 ) (http.Handler, error) {
 	fwCfg := appCtx.Config.Firewall
 	if !fwCfg.Type.Valid {
 		return nil, fmt.Errorf("no firewall was configured on this system")
 	}
 
-	_, fwMgr, err := firewall.Setup(appCtx, fwCfg.Type.V, fwCfg.DefaultAccessDuration.V, logger)
+	_, fwMgr, err := firewall.Setup(appCtx, fwCfg.Type.V, fwCfg.DefaultAccessDuration.V, logger, fwOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed setting up firewall: %w", err)
 	}
 
-	tlsServerCert, err := appCtx.ServerTLSCert()
-	if err != nil {
-		return nil, err
-	}
-
-	tlsCACert, err := crypto.ExtractCACert(tlsServerCert)
-	if err != nil {
-		return nil, fmt.Errorf("failed extracting CA cert from TLS cert: %w", err)
+	// Restore access grants that might've been lost since the last run.
+	if err = fwMgr.Sync(); err != nil {
+		return nil, fmt.Errorf("failed syncing firewall state: %w", err)
 	}
 
-	if len(tlsCACert.DNSNames) == 0 {
-		return nil, errors.New("no Subject Alternative Name values found in server CA certificate")
+	h := Handler{
+		appCtx: appCtx,
+		fwMgr:  fwMgr,
+		logger: logger,
 	}
 
-	h := Handler{
-		appCtx:        appCtx,
-		fwMgr:         fwMgr,
-		tlsServerCert: tlsServerCert,
-		tlsCACert:     tlsCACert,
-		logger:        logger,
+	if _, _, err = h.caCerts(); err != nil {
+		return nil, err
 	}
 
 	httpPipeline := handler.NewPipeline(errLvl).
+		WithRateLimiter(newRateLimiter(appCtx, fwMgr)).
 		WithSerializer(handler.JSON()).
 		ProcessResponse(
 			handler.Encrypt,
@@ -69,13 +65,86 @@ func SetupHandlers(
 
 	httpsPipeline := handler.NewPipeline(types.ErrorLevelFull).
 		WithAuth(handler.TLSAuth(appCtx)).
-		WithSerializer(handler.JSON())
+		WithSerializer(handler.JSON()).
+		ProcessResponse(handler.CACert(appCtx))
 
 	mux := http.NewServeMux()
 	mux.Handle("POST /join", handler.Handle(h.Join,
 		httpPipeline.WithAuth(handler.InviteTokenAuth(appCtx))))
 	mux.Handle("POST /open", handler.Handle(h.Open, httpsPipeline))
 	mux.Handle("POST /close", handler.Handle(h.Close, httpsPipeline))
+	mux.Handle("GET /whoami", handler.Handle(h.Whoami, httpsPipeline))
+	mux.Handle("POST /renew", handler.Handle(h.Renew,
+		handler.NewPipeline(types.ErrorLevelFull).
+			WithAuth(handler.RenewalTokenAuth(appCtx)).
+			WithSerializer(handler.JSON()).
+			ProcessResponse(handler.CACert(appCtx))))
 
 	return mux, nil
 }
+
+// newRateLimiter returns the rate limiter of failed authentication attempts on
+// untrusted endpoints, which bans offending clients in the firewall. It returns
+// nil if banning is disabled. Settings missing from the configuration use the
+// default values.
+func newRateLimiter(appCtx *actx.Context, fwMgr *firewall.Manager) *handler.RateLimiter {
+	srvCfg := appCtx.Config.Server
+	threshold, window, banDuration := config.DefaultBanThreshold, config.DefaultBanWindow, config.DefaultBanDuration
+	if srvCfg.BanThreshold.Valid {
+		threshold = srvCfg.BanThreshold.V
+	}
+	if srvCfg.BanWindow.Valid {
+		window = srvCfg.BanWindow.V
+	}
+	if srvCfg.BanDuration.Valid {
+		banDuration = srvCfg.BanDuration.V
+	}
+
+	if threshold <= 0 || window <= 0 || banDuration <= 0 {
+		return nil
+	}
+
+	return handler.NewRateLimiter(appCtx, fwMgr, threshold, window, banDuration)
+}
+
+// caCerts returns the CA TLS certificate used to issue client certificates,
+// and the CA certificate extracted from it. They're loaded on every call, since
+// the CA can be rotated while the server is running.
+func (h *Handler) caCerts() (tls.Certificate, *x509.Certificate, error) {
+	tlsCACert, err := h.appCtx.CATLSCert()
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	caCert, err := crypto.ExtractCACert(tlsCACert)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed extracting CA cert from TLS cert: %w", err)
+	}
+
+	if len(caCert.DNSNames) == 0 {
+		return tls.Certificate{}, nil, errors.New(
+			"no Subject Alternative Name values found in server CA certificate")
+	}
+
+	return tlsCACert, caCert, nil
+}
+
+// authorize returns an error if the user doesn't have permission to manage
+// access to the service.
+func (h *Handler) authorize(user *models.User, svc *models.Service) error {
+	if user == nil {
+		return types.NewError(http.StatusForbidden, "unknown user")
+	}
+
+	perm := &models.UserServicePermission{User: user, Service: svc}
+	if err := perm.Load(h.appCtx.DB.NewContext(), h.appCtx.DB); err != nil {
+		var errNoRes dbtypes.NoResultError
+		if errors.As(err, &errNoRes) {
+			return types.NewError(http.StatusForbidden, fmt.Sprintf(
+				"user '%s' is not allowed to manage access to service '%s'", user.Name, svc.Name))
+		}
+		return types.NewError(http.StatusInternalServerError, err.Error())
+	}
+
+	return nil
+}
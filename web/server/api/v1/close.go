@@ -6,13 +6,15 @@ import (
 
 	"go.hackfix.me/sesame/db/models"
 	"go.hackfix.me/sesame/firewall"
+	"go.hackfix.me/sesame/web/server/handler"
 	"go.hackfix.me/sesame/web/server/types"
 )
 
 // Close creates firewall rules that block access from specified IP addresses
 // to services on this node. The client is expected to have previously been
-// authenticated with a valid TLS client certificate (mTLS).
-func (h *Handler) Close(_ context.Context, req *types.CloseRequest) (*types.CloseResponse, error) {
+// authenticated with a valid TLS client certificate (mTLS), and the user must
+// have permission to manage access to the service.
+func (h *Handler) Close(ctx context.Context, req *types.CloseRequest) (*types.CloseResponse, error) {
 	ipSet, err := firewall.ParseToIPSet(req.Clients...)
 	if err != nil {
 		return nil, types.NewError(http.StatusBadRequest, err.Error())
@@ -24,10 +26,20 @@ func (h *Handler) Close(_ context.Context, req *types.CloseRequest) (*types.Clos
 		return nil, types.NewError(http.StatusBadRequest, err.Error())
 	}
 
-	err = h.fwMgr.DenyAccess(ipSet, svc, req.User)
+	//nolint:contextcheck // This context is inherited from the global context.
+	if err = h.authorize(req.User, svc); err != nil {
+		return nil, err
+	}
+
+	err = h.fwMgr.DenyAccess(ipSet, svc, req.User, req.KillConnections)
 	if err != nil {
 		return nil, types.NewError(http.StatusBadRequest, err.Error())
 	}
 
+	handler.Audit(ctx, h.appCtx, req, &models.AuditEvent{
+		Type: models.AuditEventClose, ServiceName: svc.Name,
+		Payload: map[string]any{"clients": req.Clients, "kill_connections": req.KillConnections},
+	})
+
 	return types.NewCloseResponse()
 }
@@ -2,12 +2,14 @@ package api
 
 import (
 	"context"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"net/http"
-	"time"
 
 	"go.hackfix.me/sesame/crypto"
 	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/web/server/handler"
 	"go.hackfix.me/sesame/web/server/types"
 )
 
@@ -18,16 +20,34 @@ import (
 // produced by a successful ECDH key exchange. The bespoke authentication and
 // encryption are required because this handler is meant to be served from a
 // plain HTTP endpoint.
-func (h *Handler) Join(_ context.Context, req *types.JoinRequest) (*types.JoinResponse, error) {
-	timeNow := h.appCtx.TimeNow()
-	// TODO: Figure out certificate lifecycle management, make expiration configurable, etc.
-	clientTLSCert, err := crypto.NewTLSCert(
-		req.User.Name, []string{h.tlsCACert.DNSNames[0]}, timeNow, timeNow.Add(24*time.Hour), &h.tlsServerCert,
-	)
+// With JoinProtocolV2 the certificate is issued for the CSR sent by the client,
+// so that the client's private key never leaves the client. Older clients use
+// JoinProtocolV1, in which the private key is generated here and returned along
+// with the certificate.
+func (h *Handler) Join(ctx context.Context, req *types.JoinRequest) (*types.JoinResponse, error) {
+	//nolint:contextcheck // This context is inherited from the global context.
+	tlsCA, tlsCACert, err := h.caCerts()
 	if err != nil {
 		return nil, types.NewError(http.StatusInternalServerError, err.Error())
 	}
 
+	var clientTLSCert tls.Certificate
+	if req.ProtocolVersion() == types.JoinProtocolV2 {
+		clientTLSCert, err = h.newClientCertFromCSR(ctx, req, tlsCA, tlsCACert)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		timeNow := h.appCtx.TimeNow()
+		clientTLSCert, err = crypto.NewTLSCert(
+			req.User.Name, []string{tlsCACert.DNSNames[0]}, timeNow,
+			timeNow.Add(h.appCtx.Config.Client.TLSCertExpiration.V), &tlsCA,
+		)
+		if err != nil {
+			return nil, types.NewError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
 	// Store a record of the client certificate.
 	var clientTLSx509Cert *x509.Certificate
 	clientTLSx509Cert, err = crypto.ExtractLeafCert(clientTLSCert)
@@ -48,5 +68,51 @@ func (h *Handler) Join(_ context.Context, req *types.JoinRequest) (*types.JoinRe
 		return nil, types.NewError(http.StatusInternalServerError, err.Error())
 	}
 
-	return types.NewJoinResponse(h.tlsCACert, clientTLSCert)
+	handler.Audit(ctx, h.appCtx, req, &models.AuditEvent{
+		Type: models.AuditEventJoin, SiteID: req.SiteID,
+		Payload: map[string]any{"serial_number": cc.SerialNumber, "protocol_version": req.ProtocolVersion()},
+	})
+
+	return types.NewJoinResponse(tlsCACert, clientTLSCert, cc)
+}
+
+// newClientCertFromCSR issues a client certificate for the CSR in the request.
+// The CSR must be authenticated with a MAC generated with a key derived from
+// the ECDH shared key, which ensures that it was sent by the invited client.
+func (h *Handler) newClientCertFromCSR(
+	ctx context.Context, req *types.JoinRequest, tlsCA tls.Certificate, tlsCACert *x509.Certificate,
+) (tls.Certificate, error) {
+	macKey, err := crypto.DeriveHMACKey(handler.SharedKey(ctx), []byte("CSR HMAC key derivation"))
+	if err != nil {
+		return tls.Certificate{}, types.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if !crypto.CheckHMAC(req.CSR, req.CSRMAC, macKey) {
+		return tls.Certificate{}, types.NewError(http.StatusUnauthorized, "invalid CSR MAC")
+	}
+
+	csr, err := crypto.DecodeCSR(req.CSR)
+	if err != nil {
+		return tls.Certificate{}, types.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return tls.Certificate{}, types.NewError(http.StatusBadRequest, "invalid CSR signature")
+	}
+
+	// The client doesn't know the name of the user it was invited as, and
+	// shouldn't be able to choose its identity, so the subject and SANs are
+	// set here, as they would be for JoinProtocolV1 certificates. The CSR was
+	// already verified, so changing its parsed fields is safe.
+	csr.Subject = pkix.Name{CommonName: req.User.Name}
+	csr.DNSNames = []string{tlsCACert.DNSNames[0]}
+	csr.IPAddresses, csr.EmailAddresses, csr.URIs = nil, nil, nil
+
+	timeNow := h.appCtx.TimeNow()
+	clientTLSCert, err := crypto.NewTLSCertFromCSR(
+		csr, timeNow, timeNow.Add(h.appCtx.Config.Client.TLSCertExpiration.V), tlsCA,
+	)
+	if err != nil {
+		return tls.Certificate{}, types.NewError(http.StatusInternalServerError, err.Error())
+	}
+
+	return clientTLSCert, nil
 }
@@ -2,17 +2,21 @@ package api
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"net/netip"
 
 	"go.hackfix.me/sesame/db/models"
 	"go.hackfix.me/sesame/firewall"
+	"go.hackfix.me/sesame/web/server/handler"
 	"go.hackfix.me/sesame/web/server/types"
 )
 
 // Open creates firewall rules that grant access from specified IP addresses
 // to services on this node. The client is expected to have previously been
-// authenticated with a valid TLS client certificate (mTLS).
-func (h *Handler) Open(_ context.Context, req *types.OpenRequest) (*types.OpenResponse, error) {
+// authenticated with a valid TLS client certificate (mTLS), and the user must
+// have permission to manage access to the service.
+func (h *Handler) Open(ctx context.Context, req *types.OpenRequest) (*types.OpenResponse, error) {
 	ipSet, err := firewall.ParseToIPSet(req.Clients...)
 	if err != nil {
 		return nil, types.NewError(http.StatusBadRequest, err.Error())
@@ -24,10 +28,27 @@ func (h *Handler) Open(_ context.Context, req *types.OpenRequest) (*types.OpenRe
 		return nil, types.NewError(http.StatusBadRequest, err.Error())
 	}
 
-	err = h.fwMgr.GrantAccess(ipSet, svc, req.Duration, req.User)
+	//nolint:contextcheck // This context is inherited from the global context.
+	if err = h.authorize(req.User, svc); err != nil {
+		return nil, err
+	}
+
+	// The port is irrelevant, and the address is invalid if parsing fails,
+	// which is rejected by the self-only user policy.
+	source, _ := netip.ParseAddrPort(req.RemoteAddr)
+	err = h.fwMgr.GrantAccess(ipSet, svc, req.Duration, req.User, source.Addr())
 	if err != nil {
+		var errPolicy firewall.AccessPolicyError
+		if errors.As(err, &errPolicy) {
+			return nil, types.NewError(http.StatusForbidden, err.Error())
+		}
 		return nil, types.NewError(http.StatusBadRequest, err.Error())
 	}
 
+	handler.Audit(ctx, h.appCtx, req, &models.AuditEvent{
+		Type: models.AuditEventOpen, ServiceName: svc.Name,
+		Payload: map[string]any{"clients": req.Clients, "duration": req.Duration.String()},
+	})
+
 	return types.NewOpenResponse()
 }
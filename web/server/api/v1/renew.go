@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"net/http"
+	"slices"
+
+	"go.hackfix.me/sesame/crypto"
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/web/server/handler"
+	"go.hackfix.me/sesame/web/server/types"
+)
+
+// Renew issues a new TLS client certificate for a remote Sesame node, replacing
+// the one it currently uses. The client is expected to have previously been
+// authenticated either with a still valid TLS client certificate (mTLS), or
+// with the renewal token issued along with an expired certificate. In both
+// cases, the request must contain a CSR signed with the private key of the
+// certificate being renewed, which proves possession of the key. The renewed
+// certificate is revoked, and a new renewal token is issued.
+func (h *Handler) Renew(ctx context.Context, req *types.RenewRequest) (*types.RenewResponse, error) {
+	cc := handler.ClientCert(ctx)
+	if cc == nil {
+		return nil, types.NewError(http.StatusUnauthorized, "client certificate record not found in the request context")
+	}
+
+	//nolint:contextcheck // This context is inherited from the global context.
+	tlsCA, tlsCACert, err := h.caCerts()
+	if err != nil {
+		return nil, types.NewError(http.StatusInternalServerError, err.Error())
+	}
+
+	//nolint:contextcheck // This context is inherited from the global context.
+	trustedCACerts, err := h.appCtx.TrustedCACerts()
+	if err != nil {
+		return nil, types.NewError(http.StatusInternalServerError, err.Error())
+	}
+
+	oldCert, err := renewedCert(req, cc, trustedCACerts)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := crypto.DecodeCSR(req.CSR)
+	if err != nil {
+		return nil, types.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, types.NewError(http.StatusBadRequest, "invalid CSR signature")
+	}
+	if !bytes.Equal(csr.RawSubjectPublicKeyInfo, oldCert.RawSubjectPublicKeyInfo) {
+		return nil, types.NewError(http.StatusUnauthorized,
+			"CSR public key doesn't match the client TLS certificate")
+	}
+	if csr.Subject.CommonName != cc.User.Name {
+		return nil, types.NewError(http.StatusBadRequest, "CSR subject doesn't match the client TLS certificate")
+	}
+
+	timeNow := h.appCtx.TimeNow()
+	clientTLSCert, err := crypto.NewTLSCertFromCSR(
+		csr, timeNow, timeNow.Add(h.appCtx.Config.Client.TLSCertExpiration.V), tlsCA,
+	)
+	if err != nil {
+		return nil, types.NewError(http.StatusInternalServerError, err.Error())
+	}
+
+	newCC, err := models.NewClientCertificate(cc.User, cc.SiteID,
+		h.appCtx.Config.Client.TLSCertRenewalTokenExpiration.V, clientTLSCert.Leaf)
+	if err != nil {
+		return nil, types.NewError(http.StatusInternalServerError, err.Error())
+	}
+
+	//nolint:contextcheck // This context is inherited from the global context.
+	if err = newCC.Save(h.appCtx.DB.NewContext(), h.appCtx.DB, false); err != nil {
+		return nil, types.NewError(http.StatusInternalServerError, err.Error())
+	}
+
+	// Revoking the renewed certificate also invalidates its renewal token.
+	//nolint:contextcheck // This context is inherited from the global context.
+	if err = cc.Revoke(h.appCtx.DB.NewContext(), h.appCtx.DB, timeNow.UTC()); err != nil {
+		return nil, types.NewError(http.StatusInternalServerError, err.Error())
+	}
+
+	h.logger.Info("renewed client certificate", "user.name", cc.User.Name, "site_id", cc.SiteID,
+		"old_serial_number", cc.SerialNumber, "serial_number", newCC.SerialNumber)
+	handler.Audit(ctx, h.appCtx, req, &models.AuditEvent{
+		Type: models.AuditEventCertRenew,
+		Payload: map[string]any{
+			"old_serial_number": cc.SerialNumber, "serial_number": newCC.SerialNumber,
+		},
+	})
+
+	return types.NewRenewResponse(tlsCACert, clientTLSCert.Leaf, newCC)
+}
+
+// renewedCert returns the certificate being renewed. This is the verified
+// certificate used in the TLS handshake, or, when authenticating with a renewal
+// token, the certificate sent in the request, which must have been issued by
+// one of the trusted caCerts for the record identified by the token.
+func renewedCert(
+	req *types.RenewRequest, cc *models.ClientCertificate, caCerts []*x509.Certificate,
+) (*x509.Certificate, error) {
+	if tlsState := req.TLS; tlsState != nil && len(tlsState.VerifiedChains) > 0 {
+		return tlsState.VerifiedChains[0][0], nil
+	}
+
+	if len(req.TLSClientCert) == 0 {
+		return nil, types.NewError(http.StatusBadRequest,
+			"the client TLS certificate must be provided when renewing with a renewal token")
+	}
+
+	cert, err := x509.ParseCertificate(req.TLSClientCert)
+	if err != nil {
+		return nil, types.NewError(http.StatusBadRequest, err.Error())
+	}
+
+	if !slices.ContainsFunc(caCerts, func(caCert *x509.Certificate) bool {
+		return cert.CheckSignatureFrom(caCert) == nil
+	}) {
+		return nil, types.NewError(http.StatusUnauthorized, "client TLS certificate was not issued by this node")
+	}
+
+	if cert.SerialNumber.Text(16) != cc.SerialNumber {
+		return nil, types.NewError(http.StatusUnauthorized,
+			"client TLS certificate doesn't match the renewal token")
+	}
+
+	return cert, nil
+}
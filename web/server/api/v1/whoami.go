@@ -0,0 +1,31 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+
+	"go.hackfix.me/sesame/web/server/handler"
+	"go.hackfix.me/sesame/web/server/types"
+)
+
+// Whoami returns the address the request was received from, and the user and
+// site ID of the TLS client certificate the client was authenticated with. It
+// allows clients to find out their public IP address, in order to grant access
+// to it.
+func (h *Handler) Whoami(ctx context.Context, req *types.WhoamiRequest) (*types.WhoamiResponse, error) {
+	source, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return nil, types.NewError(http.StatusInternalServerError, err.Error())
+	}
+
+	data := types.WhoamiResponseData{
+		SourceAddress: source.Addr().Unmap(),
+		User:          req.User.Name,
+	}
+	if cc := handler.ClientCert(ctx); cc != nil {
+		data.SiteID = cc.SiteID
+	}
+
+	return types.NewWhoamiResponse(data)
+}
@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"context"
+	"net/netip"
+
+	actx "go.hackfix.me/sesame/app/context"
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/web/server/types"
+)
+
+// Audit records an audit event for an action performed by the authenticated
+// user of the request. The site ID is taken from the client certificate the
+// request was authenticated with, unless it's already set on the event.
+func Audit(ctx context.Context, appCtx *actx.Context, req types.Request, ev *models.AuditEvent) {
+	if user := req.GetUser(); user != nil {
+		ev.UserName = user.Name
+	}
+	if cc := ClientCert(ctx); cc != nil && ev.SiteID == "" {
+		ev.SiteID = cc.SiteID
+	}
+	if r := req.GetHTTPRequest(); r != nil {
+		if source, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+			ev.SourceIP = source.Addr().Unmap()
+		}
+	}
+
+	//nolint:contextcheck // This context is inherited from the global context.
+	appCtx.Audit(ev)
+}
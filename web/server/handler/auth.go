@@ -2,9 +2,11 @@ package handler
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/mr-tron/base58"
 
@@ -21,8 +23,11 @@ import (
 type Authenticator func(context.Context, types.Request) (context.Context, error)
 
 // TLSAuth creates an authenticator that validates requests using client TLS
-// certificates. It extracts the Common Name from the verified certificate chain
-// and loads the corresponding user.
+// certificates. It looks up the verified leaf certificate by its serial number,
+// rejecting certificates that were not issued by this node, were revoked, or
+// were issued for a different user. If successful, it records the time the
+// certificate was last seen, and sets the user of the certificate on the
+// request, and the certificate record on the context.
 func TLSAuth(appCtx *actx.Context) Authenticator {
 	return func(ctx context.Context, req types.Request) (context.Context, error) {
 		r := req.GetHTTPRequest()
@@ -30,14 +35,84 @@ func TLSAuth(appCtx *actx.Context) Authenticator {
 			return ctx, types.NewError(http.StatusUnauthorized, "failed TLS authentication")
 		}
 
-		subjectCN := r.TLS.VerifiedChains[0][0].Subject.CommonName
-		user := &models.User{Name: subjectCN}
-		if err := user.Load(appCtx.DB.NewContext(), appCtx.DB); err != nil {
+		leaf := r.TLS.VerifiedChains[0][0]
+		cc := &models.ClientCertificate{SerialNumber: leaf.SerialNumber.Text(16)}
+		if err := cc.Load(appCtx.DB.NewContext(), appCtx.DB); err != nil {
+			var errNoRes dbtypes.NoResultError
+			if errors.As(err, &errNoRes) {
+				return ctx, types.NewError(http.StatusUnauthorized, "unknown client TLS certificate")
+			}
+			return ctx, types.NewError(http.StatusInternalServerError, err.Error())
+		}
+
+		if cc.IsRevoked() {
+			return ctx, types.NewError(http.StatusUnauthorized, "client TLS certificate was revoked")
+		}
+
+		if cc.User.Name != leaf.Subject.CommonName {
 			return ctx, types.NewError(http.StatusUnauthorized,
-				"failed loading user identified in the client TLS certificate")
+				"client TLS certificate was not issued for the user identified in it")
+		}
+
+		// Failing to record the last use of the certificate shouldn't prevent
+		// the user from being authenticated.
+		cc.LastSeenAt = sql.Null[time.Time]{V: appCtx.TimeNow().UTC(), Valid: true}
+		if err := cc.Save(appCtx.DB.NewContext(), appCtx.DB, true); err != nil {
+			appCtx.Logger.Warn("failed updating client certificate last seen time",
+				"serial_number", cc.SerialNumber, "error", err)
+		}
+
+		req.SetUser(cc.User)
+		ctx = setClientCert(ctx, cc)
+
+		return ctx, nil
+	}
+}
+
+// RenewalTokenAuth creates an authenticator for TLS client certificate renewal
+// requests. If the client presented a valid TLS certificate, the request is
+// authenticated with TLSAuth. Otherwise, the client certificate record is looked
+// up by the renewal token sent in the Authorization header, which allows
+// renewing certificates that have already expired. The renewal token is only
+// accepted over TLS, and proof of possession of the certificate private key
+// must be verified by the handler.
+func RenewalTokenAuth(appCtx *actx.Context) Authenticator {
+	tlsAuth := TLSAuth(appCtx)
+	return func(ctx context.Context, req types.Request) (context.Context, error) {
+		r := req.GetHTTPRequest()
+		if r.TLS == nil {
+			return ctx, types.NewError(http.StatusUnauthorized, "renewal requests must be made over TLS")
+		}
+		if len(r.TLS.VerifiedChains) > 0 {
+			return tlsAuth(ctx, req)
+		}
+
+		tokenEnc, _, err := parseAuthHeader(r.Header.Get("Authorization"))
+		if err != nil {
+			return ctx, types.NewError(http.StatusUnauthorized, err.Error())
+		}
+
+		token, err := base58.Decode(tokenEnc)
+		if err != nil || len(token) == 0 {
+			return ctx, types.NewError(http.StatusUnauthorized, "invalid renewal token")
+		}
+
+		// Expired renewal tokens are excluded from the lookup.
+		cc := &models.ClientCertificate{RenewalToken: token}
+		if err = cc.Load(appCtx.DB.NewContext(), appCtx.DB); err != nil {
+			var errNoRes dbtypes.NoResultError
+			if errors.As(err, &errNoRes) {
+				return ctx, types.NewError(http.StatusUnauthorized, "invalid or expired renewal token")
+			}
+			return ctx, types.NewError(http.StatusInternalServerError, err.Error())
+		}
+
+		if cc.IsRevoked() {
+			return ctx, types.NewError(http.StatusUnauthorized, "client TLS certificate was revoked")
 		}
 
-		req.SetUser(user)
+		req.SetUser(cc.User)
+		ctx = setClientCert(ctx, cc)
 
 		return ctx, nil
 	}
@@ -111,6 +186,10 @@ func InviteTokenAuth(appCtx *actx.Context) Authenticator {
 		if r, ok := req.(interface{ SetSiteID(string) }); ok {
 			r.SetSiteID(inv.SiteID)
 		}
+		Audit(ctx, appCtx, req, &models.AuditEvent{
+			Type: models.AuditEventInviteRedeem, SiteID: inv.SiteID,
+			Payload: map[string]any{"invite_id": inv.UUID},
+		})
 
 		// Store the shared key in the context, since it has to be used for
 		// encrypting the response.
@@ -1,12 +1,17 @@
 package handler
 
-import "context"
+import (
+	"context"
+
+	"go.hackfix.me/sesame/db/models"
+)
 
 type contextKey string
 
 const (
 	contextKeySharedKey    contextKey = "shared_key"
 	contextKeyResponseData contextKey = "response_data"
+	contextKeyClientCert   contextKey = "client_cert"
 )
 
 func getSharedKey(ctx context.Context) []byte {
@@ -16,6 +21,12 @@ func getSharedKey(ctx context.Context) []byte {
 	return []byte{}
 }
 
+// SharedKey returns the ECDH shared key the request was authenticated with, or
+// an empty slice if it wasn't authenticated with InviteTokenAuth.
+func SharedKey(ctx context.Context) []byte {
+	return getSharedKey(ctx)
+}
+
 func setSharedKey(ctx context.Context, key []byte) context.Context {
 	return context.WithValue(ctx, contextKeySharedKey, key)
 }
@@ -30,3 +41,14 @@ func getResponseData(ctx context.Context) []byte {
 func setResponseData(ctx context.Context, data []byte) context.Context {
 	return context.WithValue(ctx, contextKeyResponseData, data)
 }
+
+// ClientCert returns the client certificate record of the TLS certificate the
+// request was authenticated with, or nil if it wasn't authenticated with TLSAuth.
+func ClientCert(ctx context.Context) *models.ClientCertificate {
+	cc, _ := ctx.Value(contextKeyClientCert).(*models.ClientCertificate)
+	return cc
+}
+
+func setClientCert(ctx context.Context, cc *models.ClientCertificate) context.Context {
+	return context.WithValue(ctx, contextKeyClientCert, cc)
+}
@@ -66,9 +66,17 @@ func Handle[Req types.Request, Resp types.Response](
 			}
 		}()
 
-		// 1. Authentication (optional)
+		// 1. Rate limiting and authentication (optional)
+		if p.rateLimiter != nil {
+			if err = p.rateLimiter.Check(r); handleErr(err) {
+				return
+			}
+		}
 		if p.auth != nil {
 			if ctx, err = p.auth(ctx, req); handleErr(err) {
+				if p.rateLimiter != nil {
+					p.rateLimiter.Fail(r, err)
+				}
 				return
 			}
 		}
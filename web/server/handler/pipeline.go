@@ -10,6 +10,7 @@ import (
 // It provides a fluent interface for configuring authentication and processors.
 type Pipeline struct {
 	auth               Authenticator
+	rateLimiter        *RateLimiter
 	serializer         Serializer
 	requestProcessors  []RequestProcessor
 	responseProcessors []ResponseProcessor
@@ -40,6 +41,13 @@ func (p *Pipeline) WithAuth(auth Authenticator) *Pipeline {
 	return p
 }
 
+// WithRateLimiter sets the rate limiter for failed authentication attempts of
+// this pipeline.
+func (p *Pipeline) WithRateLimiter(l *RateLimiter) *Pipeline {
+	p.rateLimiter = l
+	return p
+}
+
 // WithSerializer sets the request and response serializer for this pipeline.
 func (p *Pipeline) WithSerializer(s Serializer) *Pipeline {
 	p.serializer = s
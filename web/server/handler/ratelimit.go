@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	actx "go.hackfix.me/sesame/app/context"
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/web/server/types"
+)
+
+// Banner bans client IP addresses, typically in the firewall.
+type Banner interface {
+	// Ban blocks the IP address for a specific amount of time. The reason is
+	// only used for logging.
+	Ban(addr netip.Addr, duration time.Duration, reason string) error
+	// IsBanned returns true if the IP address is currently banned.
+	IsBanned(addr netip.Addr) (bool, error)
+}
+
+// RateLimiter limits the number of failed authentication attempts per client
+// IP address. Clients that fail to authenticate threshold times within the
+// window are banned for the ban duration, and their requests are rejected
+// before authentication.
+type RateLimiter struct {
+	appCtx      *actx.Context
+	banner      Banner
+	threshold   int
+	window      time.Duration
+	banDuration time.Duration
+
+	mu        sync.Mutex
+	clients   map[netip.Addr]*rateLimitClient
+	lastPrune time.Time
+}
+
+type rateLimitClient struct {
+	failures    []time.Time
+	bannedUntil time.Time
+}
+
+// NewRateLimiter returns a new RateLimiter that bans clients with banner after
+// threshold failed authentication attempts within window.
+func NewRateLimiter(
+	appCtx *actx.Context, banner Banner, threshold int, window, banDuration time.Duration,
+) *RateLimiter {
+	return &RateLimiter{
+		appCtx:      appCtx,
+		banner:      banner,
+		threshold:   threshold,
+		window:      window,
+		banDuration: banDuration,
+		clients:     make(map[netip.Addr]*rateLimitClient),
+	}
+}
+
+// Check returns an error if the client of the request is banned. Since bans can
+// be removed manually while the server is running, the ban is confirmed with
+// the Banner before rejecting the request.
+func (l *RateLimiter) Check(r *http.Request) error {
+	addr, ok := clientAddr(r)
+	if !ok {
+		return nil
+	}
+
+	l.mu.Lock()
+	c, ok := l.clients[addr]
+	banned := ok && l.appCtx.TimeNow().Before(c.bannedUntil)
+	l.mu.Unlock()
+
+	if !banned {
+		return nil
+	}
+
+	banned, err := l.banner.IsBanned(addr)
+	if err != nil {
+		l.appCtx.Logger.Warn("failed checking client ban", "ip", addr.String(), "error", err)
+		banned = true
+	}
+	if !banned {
+		l.mu.Lock()
+		delete(l.clients, addr)
+		l.mu.Unlock()
+		return nil
+	}
+
+	return types.NewError(http.StatusTooManyRequests, "too many failed authentication attempts")
+}
+
+// Fail records a failed authentication attempt of the client of the request,
+// and bans the client if it reached the threshold. Only client errors are
+// counted, since server errors aren't caused by invalid credentials.
+func (l *RateLimiter) Fail(r *http.Request, err error) {
+	var terr *types.Error
+	if !errors.As(err, &terr) ||
+		terr.StatusCode < http.StatusBadRequest || terr.StatusCode >= http.StatusInternalServerError {
+		return
+	}
+
+	addr, ok := clientAddr(r)
+	if !ok {
+		return
+	}
+
+	timeNow := l.appCtx.TimeNow()
+
+	l.mu.Lock()
+	l.prune(timeNow)
+	c, ok := l.clients[addr]
+	if !ok {
+		c = &rateLimitClient{}
+		l.clients[addr] = c
+	}
+	c.failures = append(c.failures, timeNow)
+	c.failures = recentFailures(c.failures, timeNow.Add(-l.window))
+	failures := len(c.failures)
+	ban := failures >= l.threshold
+	if ban {
+		c.failures = nil
+		c.bannedUntil = timeNow.Add(l.banDuration)
+	}
+	l.mu.Unlock()
+
+	if !ban {
+		return
+	}
+
+	reason := fmt.Sprintf("%d failed authentication attempts within %s", failures, l.window)
+	if berr := l.banner.Ban(addr, l.banDuration, reason); berr != nil {
+		l.appCtx.Logger.Error("failed banning client", "ip", addr.String(), "error", berr)
+		return
+	}
+
+	//nolint:contextcheck // This context is inherited from the global context.
+	l.appCtx.Audit(&models.AuditEvent{
+		Type: models.AuditEventBanAdd, SourceIP: addr,
+		Payload: map[string]any{"duration": l.banDuration.String(), "failures": failures, "path": r.URL.Path},
+	})
+}
+
+// prune removes clients without recent failures and unexpired bans. It runs at
+// most once per window, so that the clients don't have to be iterated on
+// every request.
+func (l *RateLimiter) prune(timeNow time.Time) {
+	if timeNow.Sub(l.lastPrune) < l.window {
+		return
+	}
+	l.lastPrune = timeNow
+
+	cutoff := timeNow.Add(-l.window)
+	for addr, c := range l.clients {
+		c.failures = recentFailures(c.failures, cutoff)
+		if len(c.failures) == 0 && !timeNow.Before(c.bannedUntil) {
+			delete(l.clients, addr)
+		}
+	}
+}
+
+// recentFailures returns the failure times after the cutoff time. The times
+// are expected to be in ascending order.
+func recentFailures(failures []time.Time, cutoff time.Time) []time.Time {
+	for i, t := range failures {
+		if t.After(cutoff) {
+			return failures[i:]
+		}
+	}
+	return nil
+}
+
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	source, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return source.Addr().Unmap(), true
+}
@@ -2,12 +2,15 @@ package handler
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 
 	"github.com/mr-tron/base58"
 
+	actx "go.hackfix.me/sesame/app/context"
 	"go.hackfix.me/sesame/crypto"
+	"go.hackfix.me/sesame/web/common"
 	"go.hackfix.me/sesame/web/server/types"
 )
 
@@ -51,6 +54,28 @@ func EncodeBase58(ctx context.Context, resp types.Response) (context.Context, er
 	return ctx, nil
 }
 
+// CACert creates a response processor that sets the current CA certificate in
+// the response headers, so that clients can start trusting it after the CA is
+// rotated. It should only be used for responses sent over TLS, where the
+// server certificate has been verified by the client.
+func CACert(appCtx *actx.Context) ResponseProcessor {
+	return func(ctx context.Context, resp types.Response) (context.Context, error) {
+		caTLSCert, err := appCtx.CATLSCert()
+		if err != nil {
+			return ctx, err
+		}
+
+		caCert, err := crypto.ExtractCACert(caTLSCert)
+		if err != nil {
+			return ctx, fmt.Errorf("failed extracting CA certificate: %w", err)
+		}
+
+		resp.GetHeader().Set(common.HeaderCACert, base64.StdEncoding.EncodeToString(caCert.Raw))
+
+		return ctx, nil
+	}
+}
+
 func writeResponse(ctx context.Context, w http.ResponseWriter, resp types.Response) error {
 	data := getResponseData(ctx)
 
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 
 	"go.hackfix.me/sesame/web/server/types"
 )
@@ -32,9 +33,14 @@ func JSON() JSONSerializer {
 
 // Deserialize decodes JSON from the request body into the request object.
 // It enforces a maximum body size limit to prevent resource exhaustion.
+// GET requests have no body, so they're left as is.
 func (JSONSerializer) Deserialize(ctx context.Context, req types.Request) (context.Context, error) {
 	httpReq := req.GetHTTPRequest()
 
+	if httpReq.Method == http.MethodGet {
+		return ctx, nil
+	}
+
 	if httpReq.Body == nil {
 		return ctx, errors.New("empty request body")
 	}
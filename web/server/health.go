@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	actx "go.hackfix.me/sesame/app/context"
+	"go.hackfix.me/sesame/crypto"
+	"go.hackfix.me/sesame/db/queries"
+	ftypes "go.hackfix.me/sesame/firewall/types"
+	"go.hackfix.me/sesame/web/server/types"
+)
+
+// Health serves the unauthenticated health and readiness endpoints.
+type Health struct {
+	appCtx *actx.Context
+	errLvl types.ErrorLevel
+	logger *slog.Logger
+	// The firewall used by the API, which is set once while setting up the
+	// handlers.
+	firewall ftypes.Firewall
+}
+
+// NewHealth returns a new Health instance. Error messages of failed readiness
+// checks are only returned if errLvl is ErrorLevelFull, but they're always
+// logged.
+func NewHealth(appCtx *actx.Context, errLvl types.ErrorLevel, logger *slog.Logger) *Health {
+	return &Health{appCtx: appCtx, errLvl: errLvl, logger: logger}
+}
+
+// Live responds with an OK status as long as the server is running.
+func (h *Health) Live(w http.ResponseWriter, _ *http.Request) {
+	h.writeResponse(w, http.StatusOK, &types.HealthResponse{Status: types.HealthStatusOK})
+}
+
+// Ready runs all readiness checks, and responds with the result of each one.
+// If any check fails, the response status is 503 Service Unavailable.
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(context.Context) error{
+		"database":    h.checkDB,
+		"schema":      h.checkSchema,
+		"firewall":    h.checkFirewall,
+		"server_cert": h.checkServerCert,
+	}
+
+	resp := &types.HealthResponse{
+		Status: types.HealthStatusOK,
+		Checks: make(map[string]*types.HealthCheck, len(checks)),
+	}
+	for name, check := range checks {
+		hc := &types.HealthCheck{Status: types.HealthStatusOK}
+		if err := check(r.Context()); err != nil {
+			h.logger.Warn("readiness check failed", "check", name, "error", err)
+			hc.Status = types.HealthStatusError
+			if h.errLvl == types.ErrorLevelFull {
+				hc.Error = err.Error()
+			}
+			resp.Status = types.HealthStatusError
+		}
+		resp.Checks[name] = hc
+	}
+
+	status := http.StatusOK
+	if resp.Status != types.HealthStatusOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	h.writeResponse(w, status, resp)
+}
+
+// checkDB checks that the database answers queries.
+func (h *Health) checkDB(ctx context.Context) error {
+	if err := h.appCtx.DB.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed pinging the database: %w", err)
+	}
+	return nil
+}
+
+// checkSchema checks that the database was initialized, and that its schema is
+// the one expected by this Sesame version.
+func (h *Health) checkSchema(_ context.Context) error {
+	//nolint:contextcheck // This context is inherited from the global context.
+	version, err := queries.Version(h.appCtx.DB.NewContext(), h.appCtx.DB)
+	if err != nil {
+		return err
+	}
+	if !version.Valid {
+		return errors.New("database is not initialized")
+	}
+
+	pending, err := h.appCtx.DB.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("database schema is outdated; pending migrations: %s", strings.Join(pending, ", "))
+	}
+
+	return nil
+}
+
+// checkFirewall checks that the firewall ruleset exists.
+func (h *Health) checkFirewall(_ context.Context) error {
+	if h.firewall == nil {
+		return errors.New("firewall is not set up")
+	}
+	return h.firewall.Check()
+}
+
+// checkServerCert checks that the server TLS certificate is currently valid.
+func (h *Health) checkServerCert(_ context.Context) error {
+	tlsCert, err := h.appCtx.ServerTLSCert()
+	if err != nil {
+		return err
+	}
+
+	cert, err := crypto.ExtractLeafCert(tlsCert)
+	if err != nil {
+		return fmt.Errorf("failed extracting server certificate: %w", err)
+	}
+
+	timeNow := h.appCtx.TimeNow()
+	if timeNow.After(cert.NotAfter) {
+		return fmt.Errorf("server certificate expired at %s", cert.NotAfter.UTC())
+	}
+	if timeNow.Before(cert.NotBefore) {
+		return fmt.Errorf("server certificate is not valid before %s", cert.NotBefore.UTC())
+	}
+
+	return nil
+}
+
+// setFirewall sets the firewall checked for readiness. It's meant to be used
+// with firewall.WithFirewallWrapper.
+//
+//nolint:ireturn // Intentional, the firewall is returned as is.
+func (h *Health) setFirewall(fw ftypes.Firewall) ftypes.Firewall {
+	h.firewall = fw
+	return fw
+}
+
+func (h *Health) writeResponse(w http.ResponseWriter, status int, resp *types.HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		h.logger.Error("failed writing response", "error", err)
+	}
+}
@@ -4,15 +4,25 @@ import (
 	"bufio"
 	"crypto/tls"
 	"errors"
-	"io"
+	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
+	"sync"
+	"time"
 )
 
+// inspectTimeout is the maximum time to wait for the PROXY protocol header of
+// connections from trusted proxies, and the first bytes of every connection.
+const inspectTimeout = 5 * time.Second
+
 // PeekConn is a buffered Conn for peeking into the connection.
 type PeekConn struct {
 	net.Conn
 	r *bufio.Reader
+	// The original address of the client, if the connection was made through a
+	// trusted proxy.
+	remoteAddr net.Addr
 }
 
 // Read reads data from the connection using the buffered reader.
@@ -27,42 +37,150 @@ func (c *PeekConn) Peek(n int) ([]byte, error) {
 	return c.r.Peek(n) //nolint:wrapcheck // It doesn't matter, this is a low-level method.
 }
 
+// RemoteAddr returns the address of the client. If the connection was made
+// through a trusted proxy, this is the address sent by the proxy in the PROXY
+// protocol header.
+func (c *PeekConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
 func newPeekConn(c net.Conn) *PeekConn {
-	return &PeekConn{c, bufio.NewReader(c)}
+	return &PeekConn{Conn: c, r: bufio.NewReader(c)}
 }
 
 // HybridListener inspects the first bytes of the connection to determine
 // whether to serve unencrypted HTTP or TLS. This allows using the same TCP port
 // for both, which is convenient for reducing the configuration burden on the user.
 // Source: https://github.com/foreverzmy/http-s-listen-same-port/
+//
+// Connections from trusted proxies may start with a PROXY protocol v1 or v2
+// header, in which case the client address it contains is used as the remote
+// address of the connection.
+//
+// Connections are inspected concurrently, so that slow clients don't delay
+// accepting other connections.
 type HybridListener struct {
 	net.Listener
-	tlsConfig *tls.Config
-	logger    *slog.Logger
+	tlsConfig      *tls.Config
+	trustedProxies []netip.Prefix
+	logger         *slog.Logger
+
+	accepted  chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// acceptResult is a connection that was accepted and inspected, or an error
+// returned by the underlying listener.
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// NewHybridListener returns a new HybridListener that accepts connections from
+// ln. TLS connections are served with tlsConfig, and connections from
+// trustedProxies may start with a PROXY protocol header.
+func NewHybridListener(
+	ln net.Listener, tlsConfig *tls.Config, trustedProxies []netip.Prefix, logger *slog.Logger,
+) *HybridListener {
+	hl := &HybridListener{
+		Listener:       ln,
+		tlsConfig:      tlsConfig,
+		trustedProxies: trustedProxies,
+		logger:         logger,
+		accepted:       make(chan acceptResult),
+		closed:         make(chan struct{}),
+	}
+	go hl.acceptLoop()
+
+	return hl
 }
 
 // Accept waits for and returns the next connection to the listener.
-// It inspects the first few bytes of the connection to determine if it's a TLS
-// handshake and returns either a TLS-wrapped connection or a plain HTTP
-// connection accordingly.
+// The first few bytes of the connection are inspected to determine if it's a
+// TLS handshake, and either a TLS-wrapped connection or a plain HTTP
+// connection is returned accordingly. Connections that fail to be inspected
+// are closed, and are never returned.
 func (ln *HybridListener) Accept() (net.Conn, error) {
-	conn, err := ln.Listener.Accept()
-	if err != nil {
-		return nil, err //nolint:wrapcheck // It doesn't matter, this is a low-level method.
+	select {
+	case res := <-ln.accepted:
+		return res.conn, res.err
+	case <-ln.closed:
+		return nil, net.ErrClosed
 	}
+}
 
-	peekConn := newPeekConn(conn)
+// Close closes the listener. Connections that are still being inspected are
+// closed once the inspection is done.
+func (ln *HybridListener) Close() error {
+	ln.closeOnce.Do(func() { close(ln.closed) })
+	return ln.Listener.Close() //nolint:wrapcheck // It doesn't matter, this is a low-level method.
+}
 
-	b, err := peekConn.Peek(3)
-	if err != nil {
-		if cerr := peekConn.Close(); cerr != nil {
-			return nil, cerr //nolint:wrapcheck // It doesn't matter, this is a low-level method.
+// acceptLoop accepts connections from the underlying listener, and inspects
+// each of them in a separate goroutine, until the listener is closed. Errors
+// are returned by Accept, which allows the HTTP server to retry on temporary
+// errors.
+func (ln *HybridListener) acceptLoop() {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			select {
+			case ln.accepted <- acceptResult{err: err}:
+			case <-ln.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
 		}
-		if !errors.Is(err, io.EOF) {
+
+		go func() {
+			hconn, err := ln.inspect(conn)
+			if err != nil {
+				ln.logger.Debug("closing connection", "remote_address", conn.RemoteAddr().String(), "error", err)
+				_ = conn.Close()
+				return
+			}
+
+			select {
+			case ln.accepted <- acceptResult{conn: hconn}:
+			case <-ln.closed:
+				_ = hconn.Close()
+			}
+		}()
+	}
+}
+
+// inspect reads the PROXY protocol header of connections from trusted proxies,
+// and peeks into the first bytes of the connection to determine whether it's
+// a TLS connection. This must be done within inspectTimeout.
+func (ln *HybridListener) inspect(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(inspectTimeout)); err != nil {
+		return nil, fmt.Errorf("failed setting read deadline: %w", err)
+	}
+
+	peekConn := newPeekConn(conn)
+
+	if isTrustedProxy(conn.RemoteAddr(), ln.trustedProxies) {
+		if err := ln.setProxyRemoteAddr(peekConn); err != nil {
 			return nil, err
 		}
 	}
 
+	b, err := peekConn.Peek(3)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, fmt.Errorf("failed resetting read deadline: %w", err)
+	}
+
 	if b[0] == 0x16 && b[1] == 0x03 && b[2] <= 0x03 {
 		ln.logger.Debug("accepting TLS connection")
 		return tls.Server(peekConn, ln.tlsConfig), nil
@@ -71,3 +189,21 @@ func (ln *HybridListener) Accept() (net.Conn, error) {
 	ln.logger.Debug("accepting HTTP connection")
 	return peekConn, nil
 }
+
+// setProxyRemoteAddr reads the PROXY protocol header from a connection made by
+// a trusted proxy, if it's sent, and sets the remote address of the connection
+// to the client address in the header.
+func (ln *HybridListener) setProxyRemoteAddr(conn *PeekConn) error {
+	src, ok, err := readProxyHeader(conn.r)
+	if err != nil {
+		return err
+	}
+
+	if ok && src.IsValid() {
+		conn.remoteAddr = net.TCPAddrFromAddrPort(src)
+		ln.logger.Debug("read PROXY protocol header",
+			"proxy_address", conn.Conn.RemoteAddr().String(), "client_address", src.String())
+	}
+
+	return nil
+}
@@ -0,0 +1,378 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go4.org/netipx"
+
+	actx "go.hackfix.me/sesame/app/context"
+	"go.hackfix.me/sesame/crypto"
+	"go.hackfix.me/sesame/db/models"
+	dbtypes "go.hackfix.me/sesame/db/types"
+	ftypes "go.hackfix.me/sesame/firewall/types"
+	"go.hackfix.me/sesame/web/server/handler"
+	"go.hackfix.me/sesame/web/server/types"
+)
+
+const (
+	joinRoute = "/api/v1/join"
+	// otherRoute is the route label of requests that didn't match any route, in
+	// order to avoid unbounded label values.
+	otherRoute = "other"
+)
+
+// Metrics are the Prometheus metrics of the server. HTTP request metrics are
+// recorded by the Middleware, firewall errors by the firewall returned by
+// WrapFirewall, and the rest are collected from the current state when the
+// metrics are scraped.
+type Metrics struct {
+	appCtx   *actx.Context
+	logger   *slog.Logger
+	registry *prometheus.Registry
+	// The firewall used by the API, which is set once while setting up the
+	// handlers.
+	firewall ftypes.Firewall
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	joins           *prometheus.CounterVec
+	firewallErrors  *prometheus.CounterVec
+}
+
+// NewMetrics returns a new Metrics instance.
+func NewMetrics(appCtx *actx.Context, logger *slog.Logger) *Metrics {
+	m := &Metrics{
+		appCtx:   appCtx,
+		logger:   logger,
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sesame_http_requests_total",
+			Help: "Total number of HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "sesame_http_request_duration_seconds",
+			Help:    "Duration of HTTP requests in seconds by route and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		joins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sesame_joins_total",
+			Help: "Total number of join requests by result, and the reason of failed requests.",
+		}, []string{"result", "reason"}),
+		firewallErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sesame_firewall_errors_total",
+			Help: "Total number of failed firewall operations by backend and operation.",
+		}, []string{"backend", "operation"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests, m.requestDuration, m.joins, m.firewallErrors,
+		newGaugeCollector("sesame_access_grants_active",
+			"Number of IP ranges currently allowed to access each service.",
+			[]string{"service"}, m.collectAccessGrants),
+		newGaugeCollector("sesame_tls_cert_expiry_seconds",
+			"Seconds until the server and CA TLS certificates expire.",
+			[]string{"cert"}, m.collectTLSCertExpiry),
+		newGaugeCollector("sesame_client_cert_expiry_seconds",
+			"Seconds until the unexpired and unrevoked client TLS certificates issued by this node expire.",
+			[]string{"user", "site_id", "serial_number"}, m.collectClientCertExpiry),
+	)
+
+	return m
+}
+
+// Handler returns an HTTP handler that serves the metrics in the Prometheus
+// exposition format. Metrics that fail to be collected are omitted.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{
+		ErrorLog:      slog.NewLogLogger(m.logger.Handler(), slog.LevelWarn),
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+}
+
+// Middleware records the count and duration of HTTP requests, and the result
+// of join requests. Requests that didn't match any route are recorded with the
+// "other" route and method.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		// The pattern is set by the ServeMux the handlers are registered on.
+		route, method := r.URL.Path, r.Method
+		if r.Pattern == "" || status == http.StatusNotFound || status == http.StatusMethodNotAllowed {
+			route, method = otherRoute, otherRoute
+		}
+
+		m.requests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+		m.requestDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+
+		if route == joinRoute {
+			if status < http.StatusBadRequest {
+				m.joins.WithLabelValues("success", "").Inc()
+			} else {
+				reason := strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+				m.joins.WithLabelValues("failure", reason).Inc()
+			}
+		}
+	})
+}
+
+// WrapFirewall returns a firewall that counts the errors of the operations of
+// fw, and uses it to collect the active access grants.
+//
+//nolint:ireturn // Intentional, this is a decorator of any firewall.
+func (m *Metrics) WrapFirewall(fw ftypes.Firewall) ftypes.Firewall {
+	backend := "unknown"
+	if m.appCtx.Config != nil && m.appCtx.Config.Firewall.Type.Valid {
+		backend = string(m.appCtx.Config.Firewall.Type.V)
+	}
+
+	ifw := &instrumentedFirewall{
+		Firewall: fw,
+		countError: func(op string) {
+			m.firewallErrors.WithLabelValues(backend, op).Inc()
+		},
+	}
+	m.firewall = ifw
+
+	return ifw
+}
+
+// collectAccessGrants sets the number of IP ranges allowed to access each
+// service, by matching the firewall elements to services with the same
+// protocol and ports.
+func (m *Metrics) collectAccessGrants(set func(float64, ...string)) error {
+	if m.firewall == nil {
+		return nil
+	}
+
+	elements, err := m.firewall.Elements()
+	if err != nil {
+		return fmt.Errorf("failed listing firewall elements: %w", err)
+	}
+
+	//nolint:contextcheck // This context is inherited from the global context.
+	services, err := models.Services(m.appCtx.DB.NewContext(), m.appCtx.DB, nil)
+	if err != nil {
+		return err
+	}
+
+	type svcKey struct {
+		proto ftypes.Protocol
+		ports ftypes.PortRange
+	}
+	svcNames := make(map[svcKey][]string)
+	grants := make(map[string]map[netipx.IPRange]struct{}, len(services))
+	for _, svc := range services {
+		grants[svc.Name] = make(map[netipx.IPRange]struct{})
+		for _, proto := range svc.Protocol.Expand() {
+			for _, pr := range svc.Ports {
+				key := svcKey{proto, pr}
+				svcNames[key] = append(svcNames[key], svc.Name)
+			}
+		}
+	}
+
+	// A range allowed to access a service on multiple ports or protocols is
+	// counted once.
+	for _, el := range elements {
+		for _, name := range svcNames[svcKey{el.Protocol, el.DestPorts}] {
+			grants[name][el.IPRange] = struct{}{}
+		}
+	}
+
+	for name, ranges := range grants {
+		set(float64(len(ranges)), name)
+	}
+
+	return nil
+}
+
+// collectTLSCertExpiry sets the seconds until the server and CA TLS
+// certificates expire.
+func (m *Metrics) collectTLSCertExpiry(set func(float64, ...string)) error {
+	timeNow := m.appCtx.TimeNow()
+
+	srvTLSCert, err := m.appCtx.ServerTLSCert()
+	if err != nil {
+		return err
+	}
+	srvCert, err := crypto.ExtractLeafCert(srvTLSCert)
+	if err != nil {
+		return fmt.Errorf("failed extracting server certificate: %w", err)
+	}
+	set(srvCert.NotAfter.Sub(timeNow).Seconds(), "server")
+
+	caTLSCert, err := m.appCtx.CATLSCert()
+	if err != nil {
+		return err
+	}
+	caCert, err := crypto.ExtractCACert(caTLSCert)
+	if err != nil {
+		return fmt.Errorf("failed extracting CA certificate: %w", err)
+	}
+	set(caCert.NotAfter.Sub(timeNow).Seconds(), "ca")
+
+	return nil
+}
+
+// collectClientCertExpiry sets the seconds until the client TLS certificates
+// issued by this node expire. Revoked and expired certificates are omitted,
+// since they can't be used anymore.
+func (m *Metrics) collectClientCertExpiry(set func(float64, ...string)) error {
+	timeNow := m.appCtx.TimeNow()
+	filter := dbtypes.NewFilter("cc.revoked_at IS NULL AND cc.expires_at > ?", []any{timeNow.UTC()})
+	//nolint:contextcheck // This context is inherited from the global context.
+	ccs, err := models.ClientCertificates(m.appCtx.DB.NewContext(), m.appCtx.DB, filter)
+	if err != nil {
+		return err
+	}
+
+	for _, cc := range ccs {
+		set(cc.ExpiresAt.Sub(timeNow).Seconds(), cc.User.Name, cc.SiteID, cc.SerialNumber)
+	}
+
+	return nil
+}
+
+// gaugeCollector is a collector of gauges whose values are collected from the
+// current state when the metrics are scraped. The collect function calls set
+// once for every combination of label values.
+type gaugeCollector struct {
+	desc    *prometheus.Desc
+	collect func(set func(v float64, labelValues ...string)) error
+}
+
+var _ prometheus.Collector = (*gaugeCollector)(nil)
+
+func newGaugeCollector(
+	name, help string, labels []string, collect func(set func(v float64, labelValues ...string)) error,
+) *gaugeCollector {
+	return &gaugeCollector{
+		desc:    prometheus.NewDesc(name, help, labels, nil),
+		collect: collect,
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *gaugeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements the prometheus.Collector interface. If the values fail to
+// be collected, an invalid metric is sent, which omits the gauge from the
+// scraped metrics.
+func (c *gaugeCollector) Collect(ch chan<- prometheus.Metric) {
+	var metrics []prometheus.Metric
+	err := c.collect(func(v float64, labelValues ...string) {
+		metrics = append(metrics, prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, v, labelValues...))
+	})
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+
+	for _, metric := range metrics {
+		ch <- metric
+	}
+}
+
+// requireTLSAuth returns a handler that only calls next for requests
+// authenticated with a client TLS certificate.
+func requireTLSAuth(appCtx *actx.Context, next http.Handler) http.Handler {
+	auth := handler.TLSAuth(appCtx)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := auth(r.Context(), &types.BaseRequest{Request: r}); err != nil {
+			status := http.StatusUnauthorized
+			var terr *types.Error
+			if errors.As(err, &terr) && terr.StatusCode > 0 {
+				status = terr.StatusCode
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// instrumentedFirewall is a firewall that counts the errors of its operations.
+type instrumentedFirewall struct {
+	ftypes.Firewall
+	countError func(op string)
+}
+
+func (f *instrumentedFirewall) Init() error {
+	return f.count("init", f.Firewall.Init())
+}
+
+func (f *instrumentedFirewall) Allow(
+	ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges, duration time.Duration,
+) error {
+	return f.count("allow", f.Firewall.Allow(ipSet, proto, destPorts, duration))
+}
+
+func (f *instrumentedFirewall) Deny(ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges) error {
+	return f.count("deny", f.Firewall.Deny(ipSet, proto, destPorts))
+}
+
+func (f *instrumentedFirewall) Elements() ([]ftypes.Element, error) {
+	elements, err := f.Firewall.Elements()
+	return elements, f.count("elements", err)
+}
+
+func (f *instrumentedFirewall) Check() error {
+	return f.count("check", f.Firewall.Check())
+}
+
+func (f *instrumentedFirewall) Ban(addr netip.Addr, duration time.Duration) error {
+	return f.count("ban", f.Firewall.Ban(addr, duration))
+}
+
+func (f *instrumentedFirewall) Unban(addr netip.Addr) error {
+	return f.count("unban", f.Firewall.Unban(addr))
+}
+
+func (f *instrumentedFirewall) Bans() ([]ftypes.Ban, error) {
+	bans, err := f.Firewall.Bans()
+	return bans, f.count("bans", err)
+}
+
+func (f *instrumentedFirewall) Block(
+	ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges, duration time.Duration,
+) error {
+	return f.count("block", f.Firewall.Block(ipSet, proto, destPorts, duration))
+}
+
+func (f *instrumentedFirewall) Unblock(ipSet *netipx.IPSet, proto ftypes.Protocol, destPorts ftypes.PortRanges) error {
+	return f.count("unblock", f.Firewall.Unblock(ipSet, proto, destPorts))
+}
+
+func (f *instrumentedFirewall) Blocks() ([]ftypes.Element, error) {
+	blocks, err := f.Firewall.Blocks()
+	return blocks, f.count("blocks", err)
+}
+
+func (f *instrumentedFirewall) count(op string, err error) error {
+	if err != nil {
+		f.countError(op)
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go4.org/netipx"
+
+	cfg "go.hackfix.me/sesame/app/config"
+	actx "go.hackfix.me/sesame/app/context"
+	"go.hackfix.me/sesame/firewall/mock"
+	ftypes "go.hackfix.me/sesame/firewall/types"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("POST /api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == joinRoute && r.URL.Query().Has("fail") {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+
+	m := NewMetrics(&actx.Context{}, slog.New(slog.DiscardHandler))
+	handler := m.Middleware(mux)
+
+	requests := []struct {
+		method, target string
+	}{
+		{http.MethodGet, "/metrics"},
+		{http.MethodGet, "/health"},
+		{http.MethodGet, "/health"},
+		{http.MethodPost, "/api/v1/join"},
+		{http.MethodPost, "/api/v1/join?fail"},
+		{http.MethodGet, "/unknown/1"},
+		{http.MethodGet, "/unknown/2"},
+		{http.MethodDelete, "/health"},
+	}
+	for _, req := range requests {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(req.method, req.target, nil))
+	}
+
+	tests := []struct {
+		route, method, status string
+		expCount              float64
+	}{
+		{"/metrics", "GET", "401", 1},
+		{"/health", "GET", "200", 2},
+		{"/api/v1/join", "POST", "200", 1},
+		{"/api/v1/join", "POST", "403", 1},
+		{otherRoute, otherRoute, "404", 2},
+		{otherRoute, otherRoute, "405", 1},
+	}
+	for _, tt := range tests {
+		assert.InDelta(t, tt.expCount,
+			testutil.ToFloat64(m.requests.WithLabelValues(tt.route, tt.method, tt.status)), 0,
+			"route=%s method=%s status=%s", tt.route, tt.method, tt.status)
+	}
+	assert.Equal(t, len(tests), testutil.CollectAndCount(m.requests))
+	assert.Equal(t, 4, testutil.CollectAndCount(m.requestDuration))
+
+	assert.InDelta(t, 1, testutil.ToFloat64(m.joins.WithLabelValues("success", "")), 0)
+	assert.InDelta(t, 1, testutil.ToFloat64(m.joins.WithLabelValues("failure", "forbidden")), 0)
+	assert.Equal(t, 2, testutil.CollectAndCount(m.joins))
+}
+
+func TestMetricsWrapFirewall(t *testing.T) {
+	t.Parallel()
+
+	appCtx := &actx.Context{Config: &cfg.Config{}}
+	appCtx.Config.Firewall.Type = sql.Null[ftypes.FirewallType]{V: ftypes.FirewallMock, Valid: true}
+	m := NewMetrics(appCtx, slog.New(slog.DiscardHandler))
+
+	mockFw := mock.New(time.Now)
+	fw := m.WrapFirewall(mockFw)
+
+	ipSet, err := (&netipx.IPSetBuilder{}).IPSet()
+	require.NoError(t, err)
+	ports := ftypes.PortRanges{{From: 22, To: 22}}
+
+	require.NoError(t, fw.Init())
+	require.NoError(t, fw.Allow(ipSet, ftypes.ProtocolTCP, ports, time.Minute))
+	_, err = fw.Elements()
+	require.NoError(t, err)
+	assert.Equal(t, 0, testutil.CollectAndCount(m.firewallErrors))
+
+	errFailed := errors.New("failed")
+	mockFw.SetFailError(errFailed)
+
+	require.ErrorIs(t, fw.Init(), errFailed)
+	require.ErrorIs(t, fw.Init(), errFailed)
+	_, err = fw.Elements()
+	require.ErrorIs(t, err, errFailed)
+
+	assert.InDelta(t, 2, testutil.ToFloat64(m.firewallErrors.WithLabelValues("mock", "init")), 0)
+	assert.InDelta(t, 1, testutil.ToFloat64(m.firewallErrors.WithLabelValues("mock", "elements")), 0)
+	assert.Equal(t, 2, testutil.CollectAndCount(m.firewallErrors))
+
+	// The wrapped firewall is used to collect the active access grants.
+	assert.Same(t, fw, m.firewall)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const (
+	// proxyV1MaxLen is the maximum length of a PROXY protocol v1 header,
+	// including the trailing CRLF.
+	proxyV1MaxLen = 107
+	// proxyV2HeaderLen is the length of the fixed part of a PROXY protocol v2
+	// header, which is followed by the address block.
+	proxyV2HeaderLen = 16
+)
+
+// proxyV2Signature is the signature that starts every PROXY protocol v2 header.
+//
+//nolint:gochecknoglobals // Effectively a constant.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from r, if the data
+// starts with one, and returns the original source address of the connection
+// it contains. If the data doesn't start with a PROXY protocol header, nothing
+// is read, and ok is false. The returned address is invalid if the header
+// doesn't contain an address, e.g. for health checks performed by the proxy
+// itself.
+// See https://www.haproxy.org/download/3.0/doc/proxy-protocol.txt
+func readProxyHeader(r *bufio.Reader) (src netip.AddrPort, ok bool, err error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return src, false, err //nolint:wrapcheck // It doesn't matter, this is a low-level function.
+	}
+
+	switch b[0] {
+	case 'P':
+		if b, err = r.Peek(6); err != nil || string(b) != "PROXY " {
+			return src, false, nil
+		}
+		src, err = readProxyHeaderV1(r)
+	case proxyV2Signature[0]:
+		if b, err = r.Peek(len(proxyV2Signature)); err != nil || !bytes.Equal(b, proxyV2Signature) {
+			return src, false, nil
+		}
+		src, err = readProxyHeaderV2(r)
+	default:
+		return src, false, nil
+	}
+
+	return src, true, err
+}
+
+// readProxyHeaderV1 reads a human-readable PROXY protocol v1 header, e.g.:
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readProxyHeaderV1(r *bufio.Reader) (netip.AddrPort, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("failed reading PROXY v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return netip.AddrPort{}, errors.New("PROXY v1 header is too long")
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return netip.AddrPort{}, errors.New("PROXY v1 header must end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return netip.AddrPort{}, nil
+	}
+	if len(fields) != 6 {
+		return netip.AddrPort{}, fmt.Errorf("invalid PROXY v1 header: %q", line)
+	}
+
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid PROXY v1 source address: %w", err)
+	}
+	switch {
+	case fields[1] == "TCP4" && addr.Is4():
+	case fields[1] == "TCP6" && addr.Is6():
+	default:
+		return netip.AddrPort{}, fmt.Errorf("invalid PROXY v1 protocol '%s' for address %s", fields[1], addr)
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid PROXY v1 source port: %w", err)
+	}
+
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
+
+// readProxyHeaderV2 reads a binary PROXY protocol v2 header. Type-length-value
+// vectors after the addresses are ignored.
+func readProxyHeaderV2(r *bufio.Reader) (netip.AddrPort, error) {
+	hdr := make([]byte, proxyV2HeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("failed reading PROXY v2 header: %w", err)
+	}
+
+	verCmd, fam := hdr[12], hdr[13]
+	addrLen := int(binary.BigEndian.Uint16(hdr[14:16]))
+
+	addrs := make([]byte, addrLen)
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return netip.AddrPort{}, fmt.Errorf("failed reading PROXY v2 addresses: %w", err)
+	}
+
+	if verCmd>>4 != 2 {
+		return netip.AddrPort{}, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+
+	switch verCmd & 0x0f {
+	case 0x0:
+		// LOCAL command, i.e. the connection was established by the proxy itself.
+		return netip.AddrPort{}, nil
+	case 0x1:
+		// PROXY command
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unsupported PROXY v2 command %d", verCmd&0x0f)
+	}
+
+	var ipLen int
+	switch fam >> 4 {
+	case 0x1: // AF_INET
+		ipLen = 4
+	case 0x2: // AF_INET6
+		ipLen = 16
+	default:
+		// AF_UNSPEC and AF_UNIX addresses aren't useful, so they're ignored.
+		return netip.AddrPort{}, nil
+	}
+
+	// Source and destination addresses, followed by source and destination ports.
+	if len(addrs) < 2*ipLen+4 {
+		return netip.AddrPort{}, fmt.Errorf("PROXY v2 address block is too short: %d bytes", len(addrs))
+	}
+	addr, _ := netip.AddrFromSlice(addrs[:ipLen])
+	port := binary.BigEndian.Uint16(addrs[2*ipLen : 2*ipLen+2])
+
+	return netip.AddrPortFrom(addr, port), nil
+}
+
+// isTrustedProxy returns true if the address of the connection is within any
+// of the trusted prefixes.
+func isTrustedProxy(addr net.Addr, trusted []netip.Prefix) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	t.Parallel()
+
+	v2 := func(verCmd, fam byte, addrs ...byte) string {
+		hdr := append([]byte{}, proxyV2Signature...)
+		hdr = append(hdr, verCmd, fam, 0, byte(len(addrs)))
+		return string(append(hdr, addrs...))
+	}
+	v2IPv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	v2IPv6 := make([]byte, 36)
+	copy(v2IPv6, netip.MustParseAddr("2001:db8::1").AsSlice())
+	v2IPv6[32], v2IPv6[33] = 0xdc, 0x04
+
+	testCases := []struct {
+		name    string
+		data    string
+		expSrc  netip.AddrPort
+		expOK   bool
+		expRest string
+		expErr  string
+	}{
+		{
+			name:    "no_header",
+			data:    "GET / HTTP/1.1\r\n",
+			expRest: "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:    "no_header_tls",
+			data:    "\x16\x03\x01",
+			expRest: "\x16\x03\x01",
+		},
+		{
+			name:    "v1_tcp4",
+			data:    "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\n",
+			expSrc:  netip.MustParseAddrPort("192.0.2.1:56324"),
+			expOK:   true,
+			expRest: "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:    "v1_tcp6",
+			data:    "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n\x16\x03\x01",
+			expSrc:  netip.MustParseAddrPort("[2001:db8::1]:56324"),
+			expOK:   true,
+			expRest: "\x16\x03\x01",
+		},
+		{
+			name:    "v1_unknown",
+			data:    "PROXY UNKNOWN\r\nGET / HTTP/1.1\r\n",
+			expOK:   true,
+			expRest: "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:   "v1_err_protocol_mismatch",
+			data:   "PROXY TCP6 192.0.2.1 198.51.100.1 56324 443\r\n",
+			expOK:  true,
+			expErr: "invalid PROXY v1 protocol 'TCP6' for address 192.0.2.1",
+		},
+		{
+			name:   "v1_err_fields",
+			data:   "PROXY TCP4 192.0.2.1\r\n",
+			expOK:  true,
+			expErr: `invalid PROXY v1 header: "PROXY TCP4 192.0.2.1\r\n"`,
+		},
+		{
+			name:   "v1_err_port",
+			data:   "PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n",
+			expOK:  true,
+			expErr: `invalid PROXY v1 source port: strconv.ParseUint: parsing "99999": value out of range`,
+		},
+		{
+			name:   "v1_err_too_long",
+			data:   "PROXY " + strings.Repeat("A", 200),
+			expOK:  true,
+			expErr: "PROXY v1 header is too long",
+		},
+		{
+			name:   "v1_err_eof",
+			data:   "PROXY TCP4 192.0.2.1",
+			expOK:  true,
+			expErr: "failed reading PROXY v1 header: EOF",
+		},
+		{
+			name:    "v2_ipv4",
+			data:    v2(0x21, 0x11, v2IPv4...) + "GET / HTTP/1.1\r\n",
+			expSrc:  netip.MustParseAddrPort("192.0.2.1:56324"),
+			expOK:   true,
+			expRest: "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:    "v2_ipv6_tlv",
+			data:    v2(0x21, 0x21, append(v2IPv6, 0x04, 0x00, 0x01, 0xff)...) + "\x16\x03\x01",
+			expSrc:  netip.MustParseAddrPort("[2001:db8::1]:56324"),
+			expOK:   true,
+			expRest: "\x16\x03\x01",
+		},
+		{
+			name:    "v2_local",
+			data:    v2(0x20, 0x00) + "GET / HTTP/1.1\r\n",
+			expOK:   true,
+			expRest: "GET / HTTP/1.1\r\n",
+		},
+		{
+			name:   "v2_err_version",
+			data:   v2(0x11, 0x11, v2IPv4...),
+			expOK:  true,
+			expErr: "unsupported PROXY protocol version 1",
+		},
+		{
+			name:   "v2_err_short",
+			data:   v2(0x21, 0x21, v2IPv4...),
+			expOK:  true,
+			expErr: "PROXY v2 address block is too short: 12 bytes",
+		},
+		{
+			name:   "v2_err_eof",
+			data:   v2(0x21, 0x11, v2IPv4...)[:20],
+			expOK:  true,
+			expErr: "failed reading PROXY v2 addresses: unexpected EOF",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := bufio.NewReader(strings.NewReader(tc.data))
+			src, ok, err := readProxyHeader(r)
+			assert.Equal(t, tc.expOK, ok)
+			if tc.expErr != "" {
+				assert.EqualError(t, err, tc.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expSrc, src)
+
+			rest, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expRest, string(rest))
+		})
+	}
+}
+
+func TestHybridListenerProxy(t *testing.T) {
+	t.Parallel()
+
+	newListener := func(t *testing.T, trusted ...netip.Prefix) *HybridListener {
+		t.Helper()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		hl := NewHybridListener(ln, nil, trusted, slog.New(slog.DiscardHandler))
+		t.Cleanup(func() { _ = hl.Close() })
+
+		return hl
+	}
+
+	// accept sends each of the payloads on a new connection, and returns the
+	// remote address and the data of the last connection accepted by ln.
+	accept := func(t *testing.T, ln *HybridListener, payloads ...string) (string, string) {
+		t.Helper()
+		for _, p := range payloads {
+			c, err := net.Dial("tcp", ln.Addr().String())
+			require.NoError(t, err)
+			_, err = c.Write([]byte(p))
+			require.NoError(t, err)
+			require.NoError(t, c.Close())
+		}
+
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		data, err := io.ReadAll(conn)
+		require.NoError(t, err)
+
+		return conn.RemoteAddr().String(), string(data)
+	}
+
+	header := "PROXY TCP4 192.0.2.1 127.0.0.1 56324 443\r\n"
+
+	t.Run("trusted", func(t *testing.T) {
+		t.Parallel()
+		ln := newListener(t, netip.MustParsePrefix("127.0.0.0/8"))
+		addr, data := accept(t, ln, header+"GET / HTTP/1.1\r\n")
+		assert.Equal(t, "192.0.2.1:56324", addr)
+		assert.Equal(t, "GET / HTTP/1.1\r\n", data)
+	})
+
+	t.Run("trusted_no_header", func(t *testing.T) {
+		t.Parallel()
+		ln := newListener(t, netip.MustParsePrefix("127.0.0.1/32"))
+		addr, data := accept(t, ln, "GET / HTTP/1.1\r\n")
+		assert.Contains(t, addr, "127.0.0.1:")
+		assert.Equal(t, "GET / HTTP/1.1\r\n", data)
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		t.Parallel()
+		ln := newListener(t, netip.MustParsePrefix("10.0.0.0/8"))
+		addr, data := accept(t, ln, header+"GET / HTTP/1.1\r\n")
+		assert.Contains(t, addr, "127.0.0.1:")
+		assert.Equal(t, header+"GET / HTTP/1.1\r\n", data)
+	})
+
+	t.Run("silent_client", func(t *testing.T) {
+		t.Parallel()
+		ln := newListener(t, netip.MustParsePrefix("127.0.0.0/8"))
+
+		// A connection that doesn't send anything doesn't block the others.
+		c, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+
+		addr, data := accept(t, ln, header+"GET / HTTP/1.1\r\n")
+		assert.Equal(t, "192.0.2.1:56324", addr)
+		assert.Equal(t, "GET / HTTP/1.1\r\n", data)
+	})
+
+	t.Run("invalid_header_skipped", func(t *testing.T) {
+		t.Parallel()
+		ln := newListener(t, netip.MustParsePrefix("127.0.0.0/8"))
+		addr, data := accept(t, ln, "PROXY TCP4 invalid\r\n", header+"GET / HTTP/1.1\r\n")
+		assert.Equal(t, "192.0.2.1:56324", addr)
+		assert.Equal(t, "GET / HTTP/1.1\r\n", data)
+	})
+}
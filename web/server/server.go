@@ -1,12 +1,16 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -14,6 +18,7 @@ import (
 
 	actx "go.hackfix.me/sesame/app/context"
 	"go.hackfix.me/sesame/crypto"
+	"go.hackfix.me/sesame/firewall"
 	"go.hackfix.me/sesame/web/server/api/v1"
 	"go.hackfix.me/sesame/web/server/types"
 )
@@ -21,38 +26,44 @@ import (
 // Server is a wrapper around http.Server with some custom behavior.
 type Server struct {
 	*http.Server
-	logger *slog.Logger
+	// MetricsAddr is the address of a separate listener that serves the metrics
+	// over HTTP without authentication. If empty, the metrics are only served
+	// by the main listener to clients authenticated with a TLS certificate.
+	MetricsAddr string
+	// TrustedProxies are the addresses of proxies whose connections may start
+	// with a PROXY protocol header. The client address in the header is used as
+	// the remote address of the request.
+	TrustedProxies []netip.Prefix
+
+	appCtx     *actx.Context
+	logger     *slog.Logger
+	metricsSrv *http.Server
+	// The TLS configuration used for new connections. It's replaced when the
+	// server TLS certificate is renewed.
+	tlsConfig atomic.Pointer[tls.Config]
 }
 
 // New returns a new web Server instance that will listen on addr for both TCP
-// and TLS connections. If tlsCert is provided, it configures TLS and requires
-// clients using TLS to authenticate with certificates signed by tlsCert.
+// and TLS connections. If tlsCert is provided, it configures TLS and verifies
+// client certificates issued by the trusted CA certificates. Client certificates are optional
+// during the handshake, so that clients with expired certificates can renew
+// them, but they're required by all authenticated endpoints except renewal.
+// The certificate can be replaced while the server is running with
+// SetTLSCert, without affecting established connections.
 func New(
 	appCtx *actx.Context, addr string, tlsCert *tls.Certificate, errLvl types.ErrorLevel,
 ) (*Server, error) {
-	var tlsCfg *tls.Config
-	if tlsCert != nil {
-		tlsCfg = crypto.DefaultTLSConfig()
-
-		tlsCfg.Certificates = []tls.Certificate{*tlsCert}
-		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
-
-		caCert, err := crypto.ExtractCACert(*tlsCert)
-		if err != nil {
-			return nil, fmt.Errorf("failed extracting CA certificate: %w", err)
-		}
-		caCertPool := x509.NewCertPool()
-		caCertPool.AddCert(caCert)
-		tlsCfg.ClientCAs = caCertPool
-	}
-
 	logger := appCtx.Logger.With("component", "web-server")
+	metrics := NewMetrics(appCtx, logger)
 
-	handlers, err := SetupHandlers(appCtx, errLvl, logger)
+	handlers, err := SetupHandlers(appCtx, errLvl, logger, metrics)
 	if err != nil {
 		return nil, err
 	}
 
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("GET /metrics", metrics.Handler())
+
 	srv := &Server{
 		Server: &http.Server{
 			Handler:           handlers,
@@ -60,17 +71,58 @@ func New(
 			ReadHeaderTimeout: 10 * time.Second,
 			ReadTimeout:       30 * time.Second,
 			WriteTimeout:      10 * time.Minute,
-			TLSConfig:         tlsCfg,
 		},
+		appCtx: appCtx,
 		logger: logger,
+		metricsSrv: &http.Server{
+			Handler:           metricsMux,
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      time.Minute,
+		},
+	}
+
+	if tlsCert != nil {
+		if err = srv.SetTLSCert(*tlsCert); err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS13,
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return srv.tlsConfig.Load(), nil
+			},
+		}
 	}
 
 	return srv, nil
 }
 
-// ListenAndServe starts either an HTTP or HTTPS server. It stores the actual
-// listen address, which is convenient when the address is dynamically
-// determined by the system (e.g. ':0').
+// SetTLSCert replaces the TLS certificate used for new connections, and the
+// CA certificates used to verify client certificates, which are loaded from
+// the database.
+func (s *Server) SetTLSCert(tlsCert tls.Certificate) error {
+	caCerts, err := s.appCtx.TrustedCACerts()
+	if err != nil {
+		return fmt.Errorf("failed loading trusted CA certificates: %w", err)
+	}
+	caCertPool := x509.NewCertPool()
+	for _, caCert := range caCerts {
+		caCertPool.AddCert(caCert)
+	}
+
+	tlsCfg := crypto.DefaultTLSConfig()
+	tlsCfg.Certificates = []tls.Certificate{tlsCert}
+	tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	tlsCfg.ClientCAs = caCertPool
+
+	s.tlsConfig.Store(tlsCfg)
+
+	return nil
+}
+
+// ListenAndServe starts either an HTTP or HTTPS server, and the metrics server
+// if MetricsAddr is set. It stores the actual listen addresses, which is
+// convenient when the address is dynamically determined by the system (e.g. ':0').
 func (s *Server) ListenAndServe() error {
 	ln, err := net.Listen("tcp", s.Addr)
 	if err != nil {
@@ -78,29 +130,56 @@ func (s *Server) ListenAndServe() error {
 		return err
 	}
 
+	if s.MetricsAddr != "" {
+		var metricsLn net.Listener
+		if metricsLn, err = net.Listen("tcp", s.MetricsAddr); err != nil {
+			_ = ln.Close()
+			return fmt.Errorf("failed starting metrics listener: %w", err)
+		}
+		s.MetricsAddr = metricsLn.Addr().String()
+		s.logger.Info("started metrics listener", "address", s.MetricsAddr)
+
+		go func() {
+			if srvErr := s.metricsSrv.Serve(metricsLn); !errors.Is(srvErr, http.ErrServerClosed) {
+				s.logger.Error("metrics server error", "error", srvErr)
+			}
+		}()
+	}
+
 	s.Addr = ln.Addr().String()
 	s.logger.Info("started listener", "address", s.Addr)
 
-	hl := &HybridListener{
-		Listener:  ln,
-		tlsConfig: s.TLSConfig,
-		logger:    s.logger,
-	}
+	hl := NewHybridListener(ln, s.TLSConfig, s.TrustedProxies, s.logger)
 
 	//nolint:wrapcheck // This is fine.
 	return s.Serve(hl)
 }
 
-// SetupHandlers configures the server HTTP handlers.
-func SetupHandlers(appCtx *actx.Context, errLvl types.ErrorLevel, logger *slog.Logger) (http.Handler, error) {
+// Shutdown gracefully shuts down the server and the metrics server.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return errors.Join(s.metricsSrv.Shutdown(ctx), s.Server.Shutdown(ctx))
+}
+
+// SetupHandlers configures the server HTTP handlers. Requests are recorded in
+// the metrics, which are served to clients authenticated with a TLS certificate.
+// The health and readiness endpoints don't require authentication.
+func SetupHandlers(
+	appCtx *actx.Context, errLvl types.ErrorLevel, logger *slog.Logger, metrics *Metrics,
+) (http.Handler, error) {
 	mux := http.NewServeMux()
+	health := NewHealth(appCtx, errLvl, logger)
 
-	apiHandlers, err := api.SetupHandlers(appCtx, errLvl, logger)
+	apiHandlers, err := api.SetupHandlers(appCtx, errLvl, logger,
+		firewall.WithFirewallWrapper(metrics.WrapFirewall),
+		firewall.WithFirewallWrapper(health.setFirewall))
 	if err != nil {
 		return nil, err
 	}
 
 	mux.Handle("/api/v1/", http.StripPrefix("/api/v1", apiHandlers))
+	mux.Handle("GET /metrics", requireTLSAuth(appCtx, metrics.Handler()))
+	mux.HandleFunc("GET /healthz", health.Live)
+	mux.HandleFunc("GET /readyz", health.Ready)
 
 	logBody := func(_ *http.Request) bool {
 		return appCtx.LogLevel == slog.LevelDebug
@@ -114,7 +193,7 @@ func SetupHandlers(appCtx *actx.Context, errLvl types.ErrorLevel, logger *slog.L
 		LogResponseBody:    logBody,
 	})
 
-	handler := chi.Chain(loggerMW).Handler(mux)
+	handler := chi.Chain(loggerMW, metrics.Middleware).Handler(mux)
 
 	return handler, nil
 }
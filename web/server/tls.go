@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"go.hackfix.me/sesame/crypto"
+	"go.hackfix.me/sesame/db/models"
+	"go.hackfix.me/sesame/db/queries"
+)
+
+// RotateTLSCert checks whether the server TLS certificate is due for renewal
+// right away, and then on every interval, until ctx is done. A certificate is
+// due for renewal once it's past the configured renewal threshold. It's renewed
+// with the same private key, signed by the CA, stored in the database, and used
+// for new connections without restarting the server. On every check the TLS
+// configuration is also reloaded from the database, so that a rotated CA, or
+// the end of a CA rollover, take effect.
+func (s *Server) RotateTLSCert(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.renewTLSCertIfDue(); err != nil {
+			s.logger.Error("failed renewing server TLS certificate", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// renewTLSCertIfDue renews the server TLS certificate if it's past the
+// configured renewal threshold, and reloads the TLS configuration.
+func (s *Server) renewTLSCertIfDue() error {
+	tlsCert, err := s.appCtx.ServerTLSCert()
+	if err != nil {
+		return err
+	}
+
+	cert, err := crypto.ExtractLeafCert(tlsCert)
+	if err != nil {
+		return fmt.Errorf("failed extracting server certificate: %w", err)
+	}
+
+	var (
+		cfg     = s.appCtx.Config.Server
+		timeNow = s.appCtx.TimeNow()
+		status  = models.CertStatusAt(cert.NotBefore, cert.NotAfter, false, timeNow,
+			cfg.TLSCertRenewalThreshold.V)
+	)
+	if status == models.CertStatusValid {
+		return s.SetTLSCert(tlsCert)
+	}
+
+	// Databases initialized before the CA was separated from the server
+	// certificate use a self-signed server certificate.
+	var parent *tls.Certificate
+	if !cert.IsCA {
+		var caTLSCert tls.Certificate
+		if caTLSCert, err = s.appCtx.CATLSCert(); err != nil {
+			return err
+		}
+		parent = &caTLSCert
+	}
+
+	newTLSCert, err := crypto.RenewTLSCert(tlsCert, timeNow, timeNow.Add(cfg.TLSCertExpiration.V), parent)
+	if err != nil {
+		return err
+	}
+
+	newTLSCertPEM, err := crypto.EncodeTLSCert(newTLSCert)
+	if err != nil {
+		return fmt.Errorf("failed encoding the server TLS certificate: %w", err)
+	}
+
+	if err = queries.SetServerTLSCert(s.appCtx.DB.NewContext(), s.appCtx.DB, newTLSCertPEM); err != nil {
+		return err
+	}
+
+	// Reload the certificate, which includes the cross-signed CA certificate
+	// during a CA rollover.
+	if tlsCert, err = s.appCtx.ServerTLSCert(); err != nil {
+		return err
+	}
+
+	if err = s.SetTLSCert(tlsCert); err != nil {
+		return err
+	}
+
+	s.logger.Info("renewed server TLS certificate",
+		"old_serial_number", cert.SerialNumber.Text(16),
+		"serial_number", newTLSCert.Leaf.SerialNumber.Text(16),
+		"expires_at", newTLSCert.Leaf.NotAfter)
+	s.appCtx.Audit(&models.AuditEvent{
+		Type: models.AuditEventServerCertRenew,
+		Payload: map[string]any{
+			"old_serial_number": cert.SerialNumber.Text(16),
+			"serial_number":     newTLSCert.Leaf.SerialNumber.Text(16),
+		},
+	})
+
+	return nil
+}
@@ -8,6 +8,9 @@ type CloseRequest struct {
 	BaseRequest `json:"-"`
 	Clients     []string `json:"clients"`
 	ServiceName string   `json:"service_name"`
+	// KillConnections terminates the established connections of the clients
+	// to the service.
+	KillConnections bool `json:"kill_connections,omitempty"`
 }
 
 // Validate checks that the request is valid and ready for processing.
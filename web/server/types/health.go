@@ -0,0 +1,26 @@
+package types
+
+// HealthStatus is the status of the server, or of one of its readiness checks.
+type HealthStatus string
+
+// Valid health statuses.
+const (
+	HealthStatusOK    HealthStatus = "ok"
+	HealthStatusError HealthStatus = "error"
+)
+
+// HealthResponse is the response to a health or readiness request.
+type HealthResponse struct {
+	Status HealthStatus `json:"status"`
+	// Checks are the results of the readiness checks, keyed by check name.
+	// They're only set in readiness responses.
+	Checks map[string]*HealthCheck `json:"checks,omitempty"`
+}
+
+// HealthCheck is the result of a readiness check.
+type HealthCheck struct {
+	Status HealthStatus `json:"status"`
+	// The reason the check failed. It's only set if the server is configured
+	// to return full error messages.
+	Error string `json:"error,omitempty"`
+}
@@ -3,15 +3,38 @@ package types
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"net/http"
+	"time"
 
 	"go.hackfix.me/sesame/crypto"
+	"go.hackfix.me/sesame/db/models"
+)
+
+// Versions of the join protocol.
+const (
+	// JoinProtocolV1 is the original join protocol, in which the server
+	// generates the client's private key, and sends it in the response along
+	// with the client certificate. Requests without a version use this protocol.
+	JoinProtocolV1 = 1
+	// JoinProtocolV2 is the join protocol in which the client generates its
+	// private key, and sends a CSR authenticated with a key derived from the
+	// ECDH shared key. The response only contains the signed client certificate.
+	JoinProtocolV2 = 2
 )
 
 // JoinRequest represents a request to join the Sesame service.
 type JoinRequest struct {
 	BaseRequest `json:"-"`
 	SiteID      string `json:"site_id"`
+	// Version is the join protocol version. If unset, JoinProtocolV1 is used.
+	Version int `json:"version,omitempty"`
+	// CSR is the PEM-encoded certificate signing request of the client. It's
+	// only used with JoinProtocolV2.
+	CSR []byte `json:"csr,omitempty"`
+	// CSRMAC is the HMAC of CSR, generated with a key derived from the ECDH
+	// shared key. It's only used with JoinProtocolV2.
+	CSRMAC []byte `json:"csr_mac,omitempty"`
 }
 
 // SetSiteID sets the ID of the remote Sesame site.
@@ -25,9 +48,28 @@ func (r *JoinRequest) Validate() error {
 	if r.User == nil {
 		return NewError(http.StatusUnauthorized, "user object not found in the request context")
 	}
+
+	switch r.ProtocolVersion() {
+	case JoinProtocolV1:
+	case JoinProtocolV2:
+		if len(r.CSR) == 0 || len(r.CSRMAC) == 0 {
+			return NewError(http.StatusBadRequest, "a CSR and its MAC must be provided")
+		}
+	default:
+		return NewError(http.StatusBadRequest, fmt.Sprintf("unsupported join protocol version: %d", r.Version))
+	}
+
 	return nil
 }
 
+// ProtocolVersion returns the join protocol version of the request.
+func (r *JoinRequest) ProtocolVersion() int {
+	if r.Version == 0 {
+		return JoinProtocolV1
+	}
+	return r.Version
+}
+
 // JoinResponse is the response returned on a join request.
 type JoinResponse struct {
 	BaseResponse
@@ -36,14 +78,29 @@ type JoinResponse struct {
 
 // JoinResponseData is the data sent in the JoinResponse.
 type JoinResponseData struct {
-	TLSCACert     []byte `json:"tls_ca_cert,omitempty"`
-	TLSClientCert []byte `json:"tls_client_cert,omitempty"`
+	TLSCACert []byte `json:"tls_ca_cert,omitempty"`
+	// TLSClientCert is the PEM-encoded client certificate. With JoinProtocolV1
+	// it also contains the private key.
+	TLSClientCert         []byte    `json:"tls_client_cert,omitempty"`
+	RenewalToken          []byte    `json:"renewal_token,omitempty"`
+	RenewalTokenExpiresAt time.Time `json:"renewal_token_expires_at"`
 }
 
-// NewJoinResponse creates a new JoinResponse with the provided certificates and
-// HTTP 200 status.
-func NewJoinResponse(caCert *x509.Certificate, clientCert tls.Certificate) (*JoinResponse, error) {
-	clientCertPEM, err := crypto.EncodeTLSCert(clientCert)
+// NewJoinResponse creates a new JoinResponse with the provided certificates,
+// the renewal token of the client certificate, and HTTP 200 status. The private
+// key of clientCert is only included if it's set.
+func NewJoinResponse(
+	caCert *x509.Certificate, clientCert tls.Certificate, cc *models.ClientCertificate,
+) (*JoinResponse, error) {
+	var (
+		clientCertPEM []byte
+		err           error
+	)
+	if clientCert.PrivateKey != nil {
+		clientCertPEM, err = crypto.EncodeTLSCert(clientCert)
+	} else {
+		clientCertPEM, err = crypto.EncodeCert(clientCert)
+	}
 	if err != nil {
 		return nil, NewError(http.StatusInternalServerError, err.Error())
 	}
@@ -51,8 +108,10 @@ func NewJoinResponse(caCert *x509.Certificate, clientCert tls.Certificate) (*Joi
 	resp := &JoinResponse{
 		BaseResponse: NewBaseResponse(http.StatusOK, nil),
 		Data: JoinResponseData{
-			TLSCACert:     caCert.Raw,
-			TLSClientCert: clientCertPEM,
+			TLSCACert:             caCert.Raw,
+			TLSClientCert:         clientCertPEM,
+			RenewalToken:          cc.RenewalToken,
+			RenewalTokenExpiresAt: cc.RenewalTokenExpiresAt,
 		},
 	}
 
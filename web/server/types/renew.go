@@ -0,0 +1,68 @@
+package types
+
+import (
+	"crypto/x509"
+	"net/http"
+	"time"
+
+	"go.hackfix.me/sesame/db/models"
+)
+
+// RenewRequest is the request data to renew a TLS client certificate.
+type RenewRequest struct {
+	BaseRequest `json:"-"`
+	// CSR is the PEM-encoded Certificate Signing Request for the new
+	// certificate. It must be signed with the private key of the certificate
+	// being renewed.
+	CSR []byte `json:"csr"`
+	// TLSClientCert is the DER-encoded certificate being renewed. It is only
+	// required when authenticating with a renewal token, since the certificate
+	// is otherwise provided in the TLS handshake.
+	TLSClientCert []byte `json:"tls_client_cert,omitempty"`
+}
+
+// Validate checks that the request is valid and ready for processing.
+// Returns an error if validation fails.
+func (r *RenewRequest) Validate() error {
+	if r.User == nil {
+		return NewError(http.StatusUnauthorized, "user object not found in the request context")
+	}
+
+	if len(r.CSR) == 0 {
+		return NewError(http.StatusBadRequest, "CSR must not be empty")
+	}
+
+	return nil
+}
+
+// RenewResponse is the response to a request to renew a TLS client certificate.
+type RenewResponse struct {
+	BaseResponse
+	Data RenewResponseData `json:"data"`
+}
+
+// RenewResponseData is the data sent in the RenewResponse.
+type RenewResponseData struct {
+	TLSCACert             []byte    `json:"tls_ca_cert,omitempty"`
+	TLSClientCert         []byte    `json:"tls_client_cert,omitempty"`
+	RenewalToken          []byte    `json:"renewal_token,omitempty"`
+	RenewalTokenExpiresAt time.Time `json:"renewal_token_expires_at"`
+}
+
+// NewRenewResponse creates a new RenewResponse with the provided CA
+// certificate, the renewed client certificate and its record, and HTTP 200
+// status. Only the client certificate is sent, since the client keeps its
+// private key.
+func NewRenewResponse(
+	caCert, clientCert *x509.Certificate, cc *models.ClientCertificate,
+) (*RenewResponse, error) {
+	return &RenewResponse{
+		BaseResponse: NewBaseResponse(http.StatusOK, nil),
+		Data: RenewResponseData{
+			TLSCACert:             caCert.Raw,
+			TLSClientCert:         clientCert.Raw,
+			RenewalToken:          cc.RenewalToken,
+			RenewalTokenExpiresAt: cc.RenewalTokenExpiresAt,
+		},
+	}, nil
+}
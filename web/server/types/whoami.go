@@ -0,0 +1,45 @@
+package types
+
+import (
+	"net/http"
+	"net/netip"
+)
+
+// WhoamiRequest is the request data to identify the client.
+type WhoamiRequest struct {
+	BaseRequest `json:"-"`
+}
+
+// Validate checks that the request is valid and ready for processing.
+// Returns an error if validation fails.
+func (r *WhoamiRequest) Validate() error {
+	if r.User == nil {
+		return NewError(http.StatusUnauthorized, "user object not found in the request context")
+	}
+
+	return nil
+}
+
+// WhoamiResponse is the response to a request to identify the client.
+type WhoamiResponse struct {
+	BaseResponse
+	Data WhoamiResponseData `json:"data"`
+}
+
+// WhoamiResponseData is the data sent in the WhoamiResponse.
+type WhoamiResponseData struct {
+	// The address the request was received from, as observed by the server.
+	SourceAddress netip.Addr `json:"source_address"`
+	// The name of the user the client certificate was issued for.
+	User string `json:"user"`
+	// The ID of the remote site the client certificate is used in.
+	SiteID string `json:"site_id"`
+}
+
+// NewWhoamiResponse creates a new WhoamiResponse with HTTP 200 status.
+func NewWhoamiResponse(data WhoamiResponseData) (*WhoamiResponse, error) {
+	return &WhoamiResponse{
+		BaseResponse: NewBaseResponse(http.StatusOK, nil),
+		Data:         data,
+	}, nil
+}